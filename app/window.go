@@ -187,6 +187,7 @@ func NewWindow(options ...Option) *Window {
 	w.imeState.compose = key.Range{Start: -1, End: -1}
 	w.semantic.ids = make(map[router.SemanticID]router.SemanticNode)
 	w.callbacks.w = w
+	w.queue.q.SetInvalidate(w.Invalidate)
 	go w.run(options)
 	return w
 }
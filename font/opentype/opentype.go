@@ -7,7 +7,9 @@ package opentype
 import (
 	"bytes"
 	"fmt"
+	"sync"
 
+	"github.com/benoitkugler/textlayout/fonts"
 	"github.com/benoitkugler/textlayout/fonts/truetype"
 	"github.com/go-text/typesetting/font"
 )
@@ -15,6 +17,32 @@ import (
 // Face is a shapeable representation of a font.
 type Face struct {
 	face font.Face
+	// tables provides the raw tables of the font.
+	tables *tables
+	meta   Metadata
+}
+
+// tables parses the table directory of a font the first time a raw table
+// is requested. Most faces never need their raw tables.
+type tables struct {
+	once sync.Once
+	src  []byte
+	// index is the index of the font in the collection of src.
+	index  int
+	parser *truetype.FontParser
+}
+
+// Metadata describes the font of a Face, as named by the font file.
+type Metadata struct {
+	// Family is the name of the font family, such as "Go".
+	Family string
+	// Style is the name of the face within its family, such as "Bold".
+	Style string
+	// Italic is set for italic and oblique faces.
+	Italic bool
+	// Weight is the OpenType weight class of the face, such as 400 for
+	// regular and 700 for bold faces.
+	Weight int
 }
 
 // Parse constructs a Face from source bytes.
@@ -23,9 +51,78 @@ func Parse(src []byte) (Face, error) {
 	if err != nil {
 		return Face{}, fmt.Errorf("failed parsing truetype font: %w", err)
 	}
-	return Face{face: face}, nil
+	return Face{face: face, tables: &tables{src: src}, meta: metadata(face)}, nil
+}
+
+// ParseCollection constructs the faces of a TrueType or OpenType collection
+// (.ttc or .otc) from source bytes, in the order of the collection. The
+// Metadata of each face is populated from its name and OS/2 tables. Single
+// font files are parsed as collections of one face.
+func ParseCollection(src []byte) ([]Face, error) {
+	loaded, err := truetype.Load(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing truetype collection: %w", err)
+	}
+	faces := make([]Face, len(loaded))
+	for i, l := range loaded {
+		face, ok := l.(*truetype.Font)
+		if !ok {
+			return nil, fmt.Errorf("failed parsing truetype collection: unsupported face %d", i)
+		}
+		faces[i] = Face{face: face, tables: &tables{src: src, index: i}, meta: metadata(face)}
+	}
+	return faces, nil
+}
+
+// metadata describes face from its name, OS/2 and head tables.
+func metadata(face *truetype.Font) Metadata {
+	// LoadSummary never fails for parsed fonts.
+	sum, _ := face.LoadSummary()
+	m := Metadata{
+		Family: sum.Familly,
+		Style:  sum.Style,
+		Italic: sum.IsItalic,
+	}
+	switch {
+	case face.OS2 != nil:
+		m.Weight = int(face.OS2.USWeightClass)
+	case sum.IsBold:
+		m.Weight = int(fonts.WeightBold)
+	}
+	return m
 }
 
 func (f Face) Face() font.Face {
 	return f.face
 }
+
+// Metadata returns the description of the font of the face.
+func (f Face) Metadata() Metadata {
+	return f.meta
+}
+
+// Table returns the raw content of the table of the font identified by tag,
+// such as the COLR and CPAL tables of color fonts, and whether the font
+// has the table.
+func (f Face) Table(tag truetype.Tag) ([]byte, bool) {
+	if f.tables == nil {
+		return nil, false
+	}
+	p := f.tables.load()
+	if p == nil {
+		return nil, false
+	}
+	data, err := p.GetRawTable(tag)
+	return data, err == nil
+}
+
+// load returns the parser of the tables, or nil if they can't be parsed.
+func (t *tables) load() *truetype.FontParser {
+	t.once.Do(func() {
+		parsers, err := truetype.NewFontParsers(bytes.NewReader(t.src))
+		if err == nil && t.index < len(parsers) {
+			t.parser = parsers[t.index]
+		}
+	})
+	return t.parser
+}
@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package opentype
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+func TestParseCollection(t *testing.T) {
+	for _, version := range []uint16{1, 2} {
+		src := collection(t, version, goregular.TTF, gobold.TTF)
+		faces, err := ParseCollection(src)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		if len(faces) != 2 {
+			t.Fatalf("version %d: got %d faces, expected 2", version, len(faces))
+		}
+		for i, style := range []string{"Regular", "Bold"} {
+			m := faces[i].Metadata()
+			if m.Family != "Go" {
+				t.Errorf("version %d: face %d has family %q, expected %q", version, i, m.Family, "Go")
+			}
+			if m.Style != style {
+				t.Errorf("version %d: face %d has style %q, expected %q", version, i, m.Style, style)
+			}
+			if faces[i].Face() == nil {
+				t.Errorf("version %d: face %d is not loaded", version, i)
+			}
+		}
+		if w0, w1 := faces[0].Metadata().Weight, faces[1].Metadata().Weight; w0 >= w1 {
+			t.Errorf("version %d: regular weight %d is not lighter than bold weight %d", version, w0, w1)
+		}
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	face, err := Parse(gobold.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Go Bold OS/2 table has weight class 600.
+	want := Metadata{Family: "Go", Style: "Bold", Weight: 600}
+	if got := face.Metadata(); got != want {
+		t.Errorf("got metadata %+v, expected %+v", got, want)
+	}
+}
+
+// collection returns a font collection with the given header major version
+// holding the fonts.
+func collection(t *testing.T, version uint16, fonts ...[]byte) []byte {
+	t.Helper()
+	headerLen := 12 + 4*len(fonts)
+	if version == 2 {
+		// Version 2 headers have an additional DSIG tag, length and offset.
+		headerLen += 12
+	}
+	out := make([]byte, headerLen)
+	copy(out, "ttcf")
+	binary.BigEndian.PutUint16(out[4:], version)
+	binary.BigEndian.PutUint32(out[8:], uint32(len(fonts)))
+	for i, f := range fonts {
+		for len(out)%4 != 0 {
+			out = append(out, 0)
+		}
+		base := len(out)
+		binary.BigEndian.PutUint32(out[12+4*i:], uint32(base))
+		out = append(out, f...)
+		// Table offsets are relative to the start of the collection.
+		numTables := int(binary.BigEndian.Uint16(f[4:]))
+		for k := 0; k < numTables; k++ {
+			off := base + 12 + 16*k + 8
+			if off+4 > len(out) {
+				t.Fatalf("font %d: truncated table directory", i)
+			}
+			binary.BigEndian.PutUint32(out[off:], binary.BigEndian.Uint32(out[off:])+uint32(base))
+		}
+	}
+	return out
+}
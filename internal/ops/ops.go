@@ -56,6 +56,7 @@ const (
 	TypeSource
 	TypeTarget
 	TypeOffer
+	TypeLocalOffer
 	TypeKeyInput
 	TypeKeyFocus
 	TypeKeySoftKeyboard
@@ -140,6 +141,7 @@ const (
 	TypeSourceLen           = 1
 	TypeTargetLen           = 1
 	TypeOfferLen            = 1
+	TypeLocalOfferLen       = 1
 	TypeKeyInputLen         = 1 + 1
 	TypeKeyFocusLen         = 1 + 1
 	TypeKeySoftKeyboardLen  = 1 + 1
@@ -397,6 +399,7 @@ var opProps = [0x100]opProp{
 	TypeSource:           {Size: TypeSourceLen, NumRefs: 2},
 	TypeTarget:           {Size: TypeTargetLen, NumRefs: 2},
 	TypeOffer:            {Size: TypeOfferLen, NumRefs: 3},
+	TypeLocalOffer:       {Size: TypeLocalOfferLen, NumRefs: 3},
 	TypeKeyInput:         {Size: TypeKeyInputLen, NumRefs: 2},
 	TypeKeyFocus:         {Size: TypeKeyFocusLen, NumRefs: 1},
 	TypeKeySoftKeyboard:  {Size: TypeKeySoftKeyboardLen, NumRefs: 0},
@@ -472,6 +475,8 @@ func (t OpType) String() string {
 		return "Target"
 	case TypeOffer:
 		return "Offer"
+	case TypeLocalOffer:
+		return "LocalOffer"
 	case TypeKeyInput:
 		return "KeyInput"
 	case TypeKeyFocus:
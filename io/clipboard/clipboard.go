@@ -3,6 +3,10 @@
 package clipboard
 
 import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
 	"gioui.org/internal/ops"
 	"gioui.org/io/event"
 	"gioui.org/op"
@@ -11,8 +15,23 @@ import (
 // Event is generated when the clipboard content is requested.
 type Event struct {
 	Text string
+	// Items holds the items of the clipboard, if the source placed
+	// several distinct items on it, such as files or table cells. Text
+	// is the data of the first text item, if any.
+	Items []Item
+}
+
+// Item is a clipboard item.
+type Item struct {
+	// Type is the MIME type of Data.
+	Type string
+	Data []byte
 }
 
+const textType = "text/plain"
+
+var errInvalidItems = errors.New("clipboard: invalid item list")
+
 // ReadOp requests the text of the clipboard, delivered to
 // the current handler through an Event.
 type ReadOp struct {
@@ -35,3 +54,70 @@ func (h WriteOp) Add(o *op.Ops) {
 }
 
 func (Event) ImplementsEvent() {}
+
+// MarshalBinary encodes the items of the event, for transporting the
+// clipboard content as a single blob. An event without items is encoded as a
+// single text item containing Text.
+func (e Event) MarshalBinary() ([]byte, error) {
+	items := e.Items
+	if len(items) == 0 {
+		items = []Item{{Type: textType, Data: []byte(e.Text)}}
+	}
+	var buf [binary.MaxVarintLen64]byte
+	appendUvarint := func(data []byte, v uint64) []byte {
+		n := binary.PutUvarint(buf[:], v)
+		return append(data, buf[:n]...)
+	}
+	data := appendUvarint(nil, uint64(len(items)))
+	for _, it := range items {
+		data = appendUvarint(data, uint64(len(it.Type)))
+		data = append(data, it.Type...)
+		data = appendUvarint(data, uint64(len(it.Data)))
+		data = append(data, it.Data...)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes items encoded by MarshalBinary into the event. Text
+// is set to the data of the first item whose type is text/plain.
+func (e *Event) UnmarshalBinary(data []byte) error {
+	next := func() ([]byte, error) {
+		n, w := binary.Uvarint(data)
+		if w <= 0 || n > uint64(len(data)-w) {
+			return nil, errInvalidItems
+		}
+		v := data[w : w+int(n)]
+		data = data[w+int(n):]
+		return v, nil
+	}
+	count, w := binary.Uvarint(data)
+	// Every item occupies at least two bytes.
+	if w <= 0 || count > uint64(len(data)-w)/2 {
+		return errInvalidItems
+	}
+	data = data[w:]
+	items := make([]Item, count)
+	text := ""
+	found := false
+	for i := range items {
+		typ, err := next()
+		if err != nil {
+			return err
+		}
+		content, err := next()
+		if err != nil {
+			return err
+		}
+		items[i] = Item{Type: string(typ), Data: append([]byte(nil), content...)}
+		if !found && strings.HasPrefix(items[i].Type, textType) {
+			text = string(content)
+			found = true
+		}
+	}
+	if len(data) > 0 {
+		return errInvalidItems
+	}
+	e.Text = text
+	e.Items = items
+	return nil
+}
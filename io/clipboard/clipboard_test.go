@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package clipboard
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventItemsRoundTrip(t *testing.T) {
+	e := Event{
+		Text: "cell 1",
+		Items: []Item{
+			{Type: "image/png", Data: []byte{0x89, 'P', 'N', 'G'}},
+			{Type: "text/plain;charset=utf-8", Data: []byte("cell 1")},
+			{Type: "text/plain", Data: []byte("cell 2")},
+			{Type: "application/octet-stream"},
+		},
+	}
+	data, err := e.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Event
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, e) {
+		t.Errorf("round trip of %+v resulted in %+v", e, got)
+	}
+	for n := 0; n < len(data); n++ {
+		if err := got.UnmarshalBinary(data[:n]); err == nil {
+			t.Errorf("decoding %d of %d bytes succeeded", n, len(data))
+		}
+	}
+}
+
+func TestEventTextRoundTrip(t *testing.T) {
+	data, err := Event{Text: "text"}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Event
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	want := Event{Text: "text", Items: []Item{{Type: "text/plain", Data: []byte("text")}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
@@ -3,8 +3,10 @@
 package router
 
 import (
+	"errors"
 	"image"
 	"io"
+	"sync"
 
 	"gioui.org/f32"
 	f32internal "gioui.org/internal/f32"
@@ -25,6 +27,10 @@ type pointerQueue struct {
 	pointers  []pointerInfo
 	transfers []io.ReadCloser // pending data transfers
 
+	// invalidateFunc requests a frame for events from other routers.
+	invalidateMu   sync.Mutex
+	invalidateFunc func()
+
 	scratch []event.Tag
 
 	semantic struct {
@@ -74,6 +80,9 @@ type pointerHandler struct {
 	targetMimes []string
 	offeredMime string
 	data        io.ReadCloser
+	// local is set if the offer is a Go value in value.
+	local bool
+	value interface{}
 }
 
 type areaOp struct {
@@ -336,6 +345,16 @@ func (c *pointerCollector) offerOp(op transfer.OfferOp, events *handlerEvents) {
 	h := c.newHandler(op.Tag, events)
 	h.offeredMime = op.Type
 	h.data = op.Data
+	h.local = false
+	h.value = nil
+}
+
+func (c *pointerCollector) localOfferOp(op transfer.LocalOfferOp, events *handlerEvents) {
+	h := c.newHandler(op.Tag, events)
+	h.offeredMime = op.Type
+	h.data = nil
+	h.local = true
+	h.value = op.Value
 }
 
 func (c *pointerCollector) reset() {
@@ -584,6 +603,7 @@ func (q *pointerQueue) Frame(events *handlerEvents) {
 		q.deliverEnterLeaveEvents(p, events, p.last)
 		q.deliverTransferDataEvent(p, events)
 	}
+	q.deliverWindowTransferEvents(events)
 }
 
 func (q *pointerQueue) dropHandler(events *handlerEvents, tag event.Tag) {
@@ -823,12 +843,14 @@ func (q *pointerQueue) deliverDragEvent(p *pointerInfo, events *handlerEvents) {
 		p.dataSource = k
 		// Notify all potential targets.
 		q.notifyPotentialTargets(src, events, transfer.InitiateEvent{})
+		q.beginWindowTransfer(k, src)
 		break
 	}
 }
 
 func (q *pointerQueue) deliverDropEvent(p *pointerInfo, events *handlerEvents) {
 	if p.dataSource == nil {
+		q.deliverWindowDropEvent(p)
 		return
 	}
 	// Request data from the source.
@@ -850,14 +872,26 @@ func (q *pointerQueue) deliverTransferDataEvent(p *pointerInfo, events *handlerE
 		return
 	}
 	src := q.handlers[p.dataSource]
-	if src.data == nil {
+	if src.data == nil && !src.local {
 		// Data not received yet.
 		return
 	}
 	if p.dataTarget == nil {
+		q.offerWindowTransfer(p.dataSource, src)
 		q.deliverTransferCancelEvent(p, events)
 		return
 	}
+	if src.local {
+		events.Add(p.dataTarget, transfer.DataEvent{
+			Type: src.offeredMime,
+			Open: func() (io.ReadCloser, error) {
+				return nil, errors.New("router: no data for a local transfer")
+			},
+			Value: src.value,
+		})
+		p.dataTarget = nil
+		return
+	}
 	// Send the offered data to the target.
 	transferIdx := len(q.transfers)
 	events.Add(p.dataTarget, transfer.DataEvent{
@@ -882,6 +916,9 @@ func (q *pointerQueue) deliverTransferCancelEvent(p *pointerInfo, events *handle
 	}
 	src.offeredMime = ""
 	src.data = nil
+	src.local = false
+	src.value = nil
+	q.endWindowTransfer(p.dataSource)
 	p.dataSource = nil
 	p.dataTarget = nil
 }
@@ -919,14 +956,7 @@ func addHandler(tags []event.Tag, tag event.Tag) []event.Tag {
 
 // firstMimeMatch returns the first type match between src and tgt.
 func firstMimeMatch(src, tgt *pointerHandler) (first string, matched bool) {
-	for _, m1 := range tgt.targetMimes {
-		for _, m2 := range src.sourceMimes {
-			if m1 == m2 {
-				return m1, true
-			}
-		}
-	}
-	return "", false
+	return mimeMatch(src.sourceMimes, tgt.targetMimes)
 }
 
 func (op *areaOp) Hit(pos f32.Point) bool {
@@ -944,8 +944,8 @@ func TestTransfer(t *testing.T) {
 		if got, want := dataEvent.Type, "file"; got != want {
 			t.Fatalf("got %s; want %s", got, want)
 		}
-		if got, want := dataEvent.Open(), ofr; got != want {
-			t.Fatalf("got %v; want %v", got, want)
+		if got, _ := dataEvent.Open(); got != ofr {
+			t.Fatalf("got %v; want %v", got, ofr)
 		}
 
 		// Drag and drop complete.
@@ -957,6 +957,130 @@ func TestTransfer(t *testing.T) {
 		assertEventSequence(t, r.Events(tgt), transfer.CancelEvent{})
 	})
 
+	t.Run("drop local value on valid target", func(t *testing.T) {
+		ops := new(op.Ops)
+		const mime = "application/x-gio-test"
+		src, tgt := setup(ops, mime, mime)
+		var r Router
+		r.Frame(ops)
+		r.Queue(
+			pointer.Event{
+				Position: f32.Pt(10, 10),
+				Type:     pointer.Press,
+			},
+			pointer.Event{
+				Position: f32.Pt(10, 10),
+				Type:     pointer.Move,
+			},
+			pointer.Event{
+				Position: f32.Pt(40, 10),
+				Type:     pointer.Release,
+			},
+		)
+		assertEventSequence(t, r.Events(src), cancel, transfer.RequestEvent{Type: mime})
+
+		// Offer a Go value.
+		type item struct{ name string }
+		value := &item{name: "hello"}
+		transfer.LocalOfferOp{
+			Tag:   src,
+			Type:  mime,
+			Value: value,
+		}.Add(ops)
+		r.Frame(ops)
+		evs := r.Events(tgt)
+		if len(evs) != 1 {
+			t.Fatalf("unexpected number of events: %d, want 1", len(evs))
+		}
+		dataEvent, ok := evs[0].(transfer.DataEvent)
+		if !ok {
+			t.Fatalf("unexpected event type: %T, want %T", evs[0], transfer.DataEvent{})
+		}
+		if got, want := dataEvent.Type, mime; got != want {
+			t.Fatalf("got %s; want %s", got, want)
+		}
+		if got := dataEvent.Value; got != value {
+			t.Fatalf("got %v; want %v", got, value)
+		}
+		if _, err := dataEvent.Open(); err == nil {
+			t.Error("Open succeeded for a local transfer")
+		}
+
+		// Drag and drop complete.
+		r.Frame(ops)
+		assertEventSequence(t, r.Events(src), transfer.CancelEvent{})
+		assertEventSequence(t, r.Events(tgt), transfer.CancelEvent{})
+	})
+
+	t.Run("drop local value on target in other window", func(t *testing.T) {
+		const mime = "application/x-gio-test"
+		srcOps, tgtOps := new(op.Ops), new(op.Ops)
+		src, _ := setup(srcOps, mime, mime)
+		_, tgt := setup(tgtOps, mime, mime)
+		var r1, r2 Router
+		var invalidated1, invalidated2 int
+		r1.SetInvalidate(func() { invalidated1++ })
+		r2.SetInvalidate(func() { invalidated2++ })
+		r1.Frame(srcOps)
+		r2.Frame(tgtOps)
+		// Drag in the first window.
+		r1.Queue(
+			pointer.Event{
+				Position: f32.Pt(10, 10),
+				Type:     pointer.Press,
+			},
+			pointer.Event{
+				Position: f32.Pt(10, 10),
+				Type:     pointer.Move,
+			},
+		)
+		assertEventSequence(t, r1.Events(src), cancel)
+		// Drop in the second window.
+		r2.Queue(
+			pointer.Event{
+				Position: f32.Pt(40, 10),
+				Type:     pointer.Release,
+			},
+		)
+		if invalidated1 != 1 {
+			t.Fatalf("source window invalidated %d times, want 1", invalidated1)
+		}
+		r1.Frame(srcOps)
+		assertEventSequence(t, r1.Events(src), transfer.RequestEvent{Type: mime})
+
+		// Offer a Go value.
+		value := new(int)
+		transfer.LocalOfferOp{
+			Tag:   src,
+			Type:  mime,
+			Value: value,
+		}.Add(srcOps)
+		r1.Frame(srcOps)
+		assertEventSequence(t, r1.Events(src), transfer.CancelEvent{})
+		if invalidated2 != 1 {
+			t.Fatalf("target window invalidated %d times, want 1", invalidated2)
+		}
+		r2.Frame(tgtOps)
+		evs := r2.Events(tgt)
+		if len(evs) != 1 {
+			t.Fatalf("unexpected number of events: %d, want 1", len(evs))
+		}
+		dataEvent, ok := evs[0].(transfer.DataEvent)
+		if !ok {
+			t.Fatalf("unexpected event type: %T, want %T", evs[0], transfer.DataEvent{})
+		}
+		if got, want := dataEvent.Type, mime; got != want {
+			t.Errorf("got %s; want %s", got, want)
+		}
+		if got := dataEvent.Value; got != value {
+			t.Errorf("got %v; want %v", got, value)
+		}
+
+		// The transfer is complete.
+		r2.Frame(tgtOps)
+		assertEventSequence(t, r2.Events(tgt))
+	})
+
 	t.Run("drop on valid target, DataEvent not used", func(t *testing.T) {
 		ops := new(op.Ops)
 		src, tgt := setup(ops, "file", "file")
@@ -1097,6 +1221,51 @@ func TestTransfer(t *testing.T) {
 	})
 }
 
+func TestTransferOps(t *testing.T) {
+	ops := new(op.Ops)
+	tag := new(int)
+	transfer.SourceOp{Tag: tag, Type: "text/plain"}.Add(ops)
+	transfer.TargetOp{Tag: tag, Type: "application/x-gio-test"}.Add(ops)
+	type item struct{ name string }
+	value := &item{name: "hello"}
+	transfer.LocalOfferOp{
+		Tag:   tag,
+		Type:  "application/x-gio-test",
+		Value: value,
+	}.Add(ops)
+
+	var r Router
+	r.Frame(ops)
+	h := r.pointer.queue.handlers[tag]
+	if h == nil {
+		t.Fatal("no handler for tag")
+	}
+	if got, want := h.sourceMimes, []string{"text/plain"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got source types %v, want %v", got, want)
+	}
+	if got, want := h.targetMimes, []string{"application/x-gio-test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got target types %v, want %v", got, want)
+	}
+	if got, want := h.offeredMime, "application/x-gio-test"; got != want {
+		t.Errorf("got offered type %q, want %q", got, want)
+	}
+	if !h.local || h.value != value || h.data != nil {
+		t.Errorf("got offer local=%v value=%v data=%v, want local value %v", h.local, h.value, h.data, value)
+	}
+
+	ops.Reset()
+	ofr := &offer{data: "hello"}
+	transfer.OfferOp{Tag: tag, Type: "text/plain", Data: ofr}.Add(ops)
+	r.Frame(ops)
+	h = r.pointer.queue.handlers[tag]
+	if got, want := h.offeredMime, "text/plain"; got != want {
+		t.Errorf("got offered type %q, want %q", got, want)
+	}
+	if h.local || h.value != nil || h.data != ofr {
+		t.Errorf("got offer local=%v value=%v data=%v, want data %v", h.local, h.value, h.data, ofr)
+	}
+}
+
 func TestDeferredInputOp(t *testing.T) {
 	var ops op.Ops
 
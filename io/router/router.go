@@ -134,6 +134,17 @@ func (q *Router) Frame(frame *op.Ops) {
 	}
 }
 
+// SetInvalidate sets the function for requesting a frame when
+// events arrive from the router of another window, such as a drop of
+// a transfer from one window to the other. The function may be called
+// from any goroutine.
+func (q *Router) SetInvalidate(f func()) {
+	pq := &q.pointer.queue
+	pq.invalidateMu.Lock()
+	defer pq.invalidateMu.Unlock()
+	pq.invalidateFunc = f
+}
+
 // Queue key events to the topmost handler.
 func (q *Router) QueueTopmost(events ...key.Event) bool {
 	var topmost event.Tag
@@ -481,6 +492,13 @@ func (q *Router) collect() {
 				Data: encOp.Refs[2].(io.ReadCloser),
 			}
 			pc.offerOp(op, &q.handlers)
+		case ops.TypeLocalOffer:
+			op := transfer.LocalOfferOp{
+				Tag:   encOp.Refs[0].(event.Tag),
+				Type:  encOp.Refs[1].(string),
+				Value: encOp.Refs[2],
+			}
+			pc.localOfferOp(op, &q.handlers)
 		case ops.TypeActionInput:
 			act := system.Action(encOp.Data[1])
 			pc.actionInputOp(act)
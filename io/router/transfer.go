@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package router
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"gioui.org/io/event"
+	"gioui.org/io/transfer"
+)
+
+// windowTransfer tracks the transfer in progress between the routers of
+// the program, such that a source in one window may be dropped on a
+// target in another window.
+var windowTransfer struct {
+	mu sync.Mutex
+	// source is the queue of the dragged source, or nil if no transfer
+	// is in progress.
+	source    *pointerQueue
+	sourceTag event.Tag
+	// mimes are the types supported by the source.
+	mimes []string
+	// target is the queue of a target in another window the source was
+	// dropped on, and mime the type requested from the source.
+	target    *pointerQueue
+	targetTag event.Tag
+	mime      string
+	// requested is set when the request has been delivered to the source.
+	requested bool
+	// offered is set when the source has responded to the request.
+	offered bool
+	data    io.ReadCloser
+	local   bool
+	value   interface{}
+}
+
+// beginWindowTransfer makes the transfer from src available to the targets
+// of other windows.
+func (q *pointerQueue) beginWindowTransfer(tag event.Tag, src *pointerHandler) {
+	t := &windowTransfer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.source = q
+	t.sourceTag = tag
+	t.mimes = append(t.mimes[:0], src.sourceMimes...)
+	t.target = nil
+	t.targetTag = nil
+	t.requested = false
+	t.offered = false
+	t.data = nil
+	t.local = false
+	t.value = nil
+}
+
+// endWindowTransfer ends the transfer of tag from q, unless it has been
+// dropped on a target in another window.
+func (q *pointerQueue) endWindowTransfer(tag event.Tag) {
+	t := &windowTransfer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.source == q && t.sourceTag == tag && t.target == nil {
+		t.source = nil
+		t.sourceTag = nil
+	}
+}
+
+// deliverWindowDropEvent drops the transfer of another window on the first
+// matching target entered by p.
+func (q *pointerQueue) deliverWindowDropEvent(p *pointerInfo) {
+	t := &windowTransfer
+	t.mu.Lock()
+	if t.source == nil || t.source == q || t.target != nil {
+		t.mu.Unlock()
+		return
+	}
+	for _, k := range p.entered {
+		m, ok := mimeMatch(t.mimes, q.handlers[k].targetMimes)
+		if !ok {
+			continue
+		}
+		t.target = q
+		t.targetTag = k
+		t.mime = m
+		src := t.source
+		t.mu.Unlock()
+		src.invalidate()
+		return
+	}
+	t.mu.Unlock()
+}
+
+// offerWindowTransfer hands the offer of src over to the target in another
+// window, if the transfer of tag was dropped there.
+func (q *pointerQueue) offerWindowTransfer(tag event.Tag, src *pointerHandler) {
+	t := &windowTransfer
+	t.mu.Lock()
+	if t.source != q || t.sourceTag != tag || t.target == nil {
+		t.mu.Unlock()
+		return
+	}
+	t.offered = true
+	t.data = src.data
+	t.local = src.local
+	t.value = src.value
+	// The target takes ownership of the data.
+	src.data = nil
+	tgt := t.target
+	t.mu.Unlock()
+	tgt.invalidate()
+}
+
+// deliverWindowTransferEvents delivers the events of a transfer between
+// windows that involve the handlers of q.
+func (q *pointerQueue) deliverWindowTransferEvents(events *handlerEvents) {
+	t := &windowTransfer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.source == q && t.target != nil && !t.requested:
+		if _, ok := q.handlers[t.sourceTag]; !ok {
+			// The source is gone.
+			t.source = nil
+			t.target = nil
+			return
+		}
+		events.Add(t.sourceTag, transfer.RequestEvent{Type: t.mime})
+		t.requested = true
+	case t.target == q && t.offered:
+		if _, ok := q.handlers[t.targetTag]; ok {
+			e := transfer.DataEvent{Type: t.mime}
+			if t.local {
+				e.Value = t.value
+				e.Open = func() (io.ReadCloser, error) {
+					return nil, errors.New("router: no data for a local transfer")
+				}
+			} else {
+				transferIdx := len(q.transfers)
+				data := t.data
+				e.Open = func() (io.ReadCloser, error) {
+					q.transfers[transferIdx] = nil
+					return data, nil
+				}
+				q.transfers = append(q.transfers, data)
+			}
+			events.Add(t.targetTag, e)
+		} else if t.data != nil {
+			t.data.Close()
+		}
+		t.source = nil
+		t.sourceTag = nil
+		t.target = nil
+		t.targetTag = nil
+		t.data = nil
+		t.value = nil
+	}
+}
+
+func (q *pointerQueue) invalidate() {
+	q.invalidateMu.Lock()
+	f := q.invalidateFunc
+	q.invalidateMu.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+// mimeMatch returns the first type of tgt supported by src.
+func mimeMatch(src, tgt []string) (string, bool) {
+	for _, m1 := range tgt {
+		for _, m2 := range src {
+			if m1 == m2 {
+				return m1, true
+			}
+		}
+	}
+	return "", false
+}
@@ -15,6 +15,12 @@
 // to the source and all potential targets.
 //
 // Note that the RequestEvent is sent to the source upon drop.
+//
+// Sources may respond with a LocalOfferOp instead of an OfferOp to
+// transfer an arbitrary Go value without serializing it. Local
+// transfers never leave the program, but may be dropped on targets in
+// other windows of the program. Their types should be application
+// defined, such as "application/x-myapp-item".
 package transfer
 
 import (
@@ -54,6 +60,19 @@ type OfferOp struct {
 	Data io.ReadCloser
 }
 
+// LocalOfferOp is like OfferOp, but offers a Go value that is delivered
+// as is in the Value field of the target's DataEvent. The value is
+// referenced by the operation and is delivered to targets in any window
+// of the program.
+type LocalOfferOp struct {
+	Tag event.Tag
+	// Type is the application defined type of Value.
+	// It must be the Type from the corresponding RequestEvent.
+	Type string
+	// Value is the offered value.
+	Value interface{}
+}
+
 func (op SourceOp) Add(o *op.Ops) {
 	data := ops.Write2(&o.Internal, ops.TypeSourceLen, op.Tag, op.Type)
 	data[0] = byte(ops.TypeSource)
@@ -74,6 +93,12 @@ func (op OfferOp) Add(o *op.Ops) {
 	data[0] = byte(ops.TypeOffer)
 }
 
+// Add the local offer to the list of operations.
+func (op LocalOfferOp) Add(o *op.Ops) {
+	data := ops.Write3(&o.Internal, ops.TypeLocalOfferLen, op.Tag, op.Type, op.Value)
+	data[0] = byte(ops.TypeLocalOffer)
+}
+
 // RequestEvent requests data from a data source. The source must
 // respond with an OfferOp.
 type RequestEvent struct {
@@ -103,7 +128,11 @@ type DataEvent struct {
 	Type string
 	// Open returns the transfer data. It is only valid to call Open in the frame
 	// the DataEvent is received. The caller must close the return value after use.
+	// Open returns an error for transfers offered by a LocalOfferOp.
 	Open func() (io.ReadCloser, error)
+	// Value is the value offered by a LocalOfferOp, or nil if the data
+	// was offered by an OfferOp.
+	Value interface{}
 }
 
 func (DataEvent) ImplementsEvent() {}
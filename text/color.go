@@ -0,0 +1,243 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"encoding/binary"
+	"image/color"
+	"sort"
+
+	"github.com/benoitkugler/textlayout/fonts"
+	"github.com/benoitkugler/textlayout/fonts/truetype"
+	"github.com/go-text/typesetting/font"
+)
+
+// ColorSource identifies how a glyph is displayed in color.
+type ColorSource uint8
+
+const (
+	// ColorNone is for glyphs drawn as outlines in the color of the text.
+	ColorNone ColorSource = iota
+	// ColorLayered is for glyphs drawn as a stack of outlines of their own
+	// colors, described by the COLR and CPAL tables of their face. The
+	// layers are returned by Shaper.ColorLayers.
+	ColorLayered
+	// ColorBitmap is for glyphs drawn as embedded images, from the CBDT or
+	// sbix tables of their face. The image is returned by Shaper.Bitmap.
+	ColorBitmap
+)
+
+// ColorLayer is a layer of a glyph drawn in color.
+type ColorLayer struct {
+	// Glyph is the glyph whose outline is the shape of the layer. It is
+	// placed like the color glyph it is part of.
+	Glyph Glyph
+	// Color is the color of the layer, unless Foreground is set.
+	Color color.NRGBA
+	// Foreground is set if the layer is drawn in the color of the text.
+	Foreground bool
+}
+
+// GlyphBitmap is the embedded image of a glyph.
+type GlyphBitmap = fonts.GlyphBitmap
+
+// tableFace is implemented by faces providing the raw content of their
+// font tables, such as the faces of package opentype.
+type tableFace interface {
+	Table(tag truetype.Tag) ([]byte, bool)
+}
+
+var (
+	tagCOLR = truetype.MustNewTag("COLR")
+	tagCPAL = truetype.MustNewTag("CPAL")
+	tagCBDT = truetype.MustNewTag("CBDT")
+	tagSbix = truetype.MustNewTag("sbix")
+)
+
+// colorFace holds the color tables of a face.
+type colorFace struct {
+	// bases are the COLR base glyph records, sorted by glyph.
+	bases []colorBase
+	// layers are the COLR layer records.
+	layers []colorLayer
+	// palette is the first CPAL palette.
+	palette []color.NRGBA
+	// bitmap is set if the face embeds bitmaps.
+	bitmap bool
+}
+
+// colorBase is a COLR base glyph record, the range of the layers of a glyph.
+type colorBase struct {
+	gid          font.GID
+	first, count int
+}
+
+// colorLayer is a COLR layer record.
+type colorLayer struct {
+	gid font.GID
+	// palette is the index of the color of the layer, or foregroundColor.
+	palette uint16
+}
+
+// foregroundColor is the palette index of the color of the text.
+const foregroundColor = 0xFFFF
+
+// loadColorFace returns the color tables of face, or nil if it has neither
+// valid COLR and CPAL tables nor embedded bitmaps.
+func loadColorFace(face tableFace) *colorFace {
+	c := new(colorFace)
+	_, cbdt := face.Table(tagCBDT)
+	_, sbix := face.Table(tagSbix)
+	c.bitmap = cbdt || sbix
+	colr, ok1 := face.Table(tagCOLR)
+	cpal, ok2 := face.Table(tagCPAL)
+	if ok1 && ok2 {
+		c.parseCOLR(colr)
+		c.parseCPAL(cpal)
+	}
+	if len(c.bases) == 0 && !c.bitmap {
+		return nil
+	}
+	return c
+}
+
+// parseCOLR parses the base glyph and layer records of a version 0 COLR
+// table. Records beyond the end of data are ignored.
+func (c *colorFace) parseCOLR(data []byte) {
+	if len(data) < 14 {
+		return
+	}
+	numBases := int(binary.BigEndian.Uint16(data[2:]))
+	basesOff := int(binary.BigEndian.Uint32(data[4:]))
+	layersOff := int(binary.BigEndian.Uint32(data[8:]))
+	numLayers := int(binary.BigEndian.Uint16(data[12:]))
+	for i := 0; i < numLayers; i++ {
+		off := layersOff + 4*i
+		if off < 0 || off+4 > len(data) {
+			break
+		}
+		c.layers = append(c.layers, colorLayer{
+			gid:     font.GID(binary.BigEndian.Uint16(data[off:])),
+			palette: binary.BigEndian.Uint16(data[off+2:]),
+		})
+	}
+	for i := 0; i < numBases; i++ {
+		off := basesOff + 6*i
+		if off < 0 || off+6 > len(data) {
+			break
+		}
+		b := colorBase{
+			gid:   font.GID(binary.BigEndian.Uint16(data[off:])),
+			first: int(binary.BigEndian.Uint16(data[off+2:])),
+			count: int(binary.BigEndian.Uint16(data[off+4:])),
+		}
+		if b.first+b.count > len(c.layers) {
+			continue
+		}
+		c.bases = append(c.bases, b)
+	}
+	sort.Slice(c.bases, func(i, j int) bool { return c.bases[i].gid < c.bases[j].gid })
+}
+
+// parseCPAL parses the first palette of a CPAL table.
+func (c *colorFace) parseCPAL(data []byte) {
+	if len(data) < 14 {
+		return
+	}
+	numEntries := int(binary.BigEndian.Uint16(data[2:]))
+	numPalettes := binary.BigEndian.Uint16(data[4:])
+	recordsOff := int(binary.BigEndian.Uint32(data[8:]))
+	if numPalettes == 0 {
+		return
+	}
+	first := int(binary.BigEndian.Uint16(data[12:]))
+	for i := 0; i < numEntries; i++ {
+		off := recordsOff + 4*(first+i)
+		if off < 0 || off+4 > len(data) {
+			break
+		}
+		// Color records are stored as BGRA.
+		c.palette = append(c.palette, color.NRGBA{B: data[off], G: data[off+1], R: data[off+2], A: data[off+3]})
+	}
+}
+
+// base returns the base glyph record of gid.
+func (c *colorFace) base(gid font.GID) (colorBase, bool) {
+	i := sort.Search(len(c.bases), func(i int) bool { return c.bases[i].gid >= gid })
+	if i < len(c.bases) && c.bases[i].gid == gid {
+		return c.bases[i], true
+	}
+	return colorBase{}, false
+}
+
+// source returns the color source of the glyph gid of face at size ppem.
+func (c *colorFace) source(face font.Face, gid font.GID, ppem uint16) ColorSource {
+	if _, ok := c.base(gid); ok {
+		return ColorLayered
+	}
+	if c.bitmap {
+		if _, ok := face.GlyphData(gid, ppem, ppem).(fonts.GlyphBitmap); ok {
+			return ColorBitmap
+		}
+	}
+	return ColorNone
+}
+
+// markColorGlyphs records the color sources of the glyphs of l whose faces
+// have color tables.
+func (s *shaperImpl) markColorGlyphs(l *line) {
+	for i := range l.runs {
+		run := &l.runs[i]
+		c := s.colors[run.face]
+		if c == nil {
+			continue
+		}
+		ppem := uint16(run.PPEM.Round())
+		for k := range run.Glyphs {
+			g := &run.Glyphs[k]
+			if _, _, gid := splitGlyphID(g.id); gid != placeholderGID {
+				g.color = c.source(run.face, gid, ppem)
+			}
+		}
+	}
+}
+
+// ColorLayers returns the layers of g, from bottom to top, if g is drawn
+// with ColorLayered.
+func (s *shaperImpl) ColorLayers(g Glyph) []ColorLayer {
+	ppem, faceIdx, gid := splitGlyphID(g.ID)
+	c := s.colors[s.orderer.faceFor(faceIdx)]
+	if c == nil {
+		return nil
+	}
+	base, ok := c.base(gid)
+	if !ok {
+		return nil
+	}
+	layers := make([]ColorLayer, 0, base.count)
+	for _, l := range c.layers[base.first : base.first+base.count] {
+		layer := ColorLayer{Glyph: g, Foreground: l.palette == foregroundColor}
+		layer.Glyph.ID = newGlyphID(ppem, faceIdx, l.gid)
+		layer.Glyph.Color = ColorNone
+		if !layer.Foreground {
+			if int(l.palette) >= len(c.palette) {
+				continue
+			}
+			layer.Color = c.palette[l.palette]
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+// Bitmap returns the embedded image of g, if g is drawn with ColorBitmap.
+func (s *shaperImpl) Bitmap(g Glyph) (GlyphBitmap, bool) {
+	ppem, faceIdx, gid := splitGlyphID(g.ID)
+	face := s.orderer.faceFor(faceIdx)
+	if s.colors[face] == nil {
+		return GlyphBitmap{}, false
+	}
+	ppem16 := uint16(ppem.Round())
+	bitmap, ok := face.GlyphData(gid, ppem16, ppem16).(fonts.GlyphBitmap)
+	return bitmap, ok
+}
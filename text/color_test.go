@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"encoding/binary"
+	"image/color"
+	"sort"
+	"testing"
+
+	"eliasnaur.com/font/roboto/robotoregular"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+
+	"gioui.org/font/opentype"
+)
+
+// withTables returns the font src with tables added to it.
+func withTables(src []byte, tables map[string][]byte) []byte {
+	type record struct {
+		tag          string
+		offset, size uint32
+		data         []byte
+	}
+	numTables := int(binary.BigEndian.Uint16(src[4:]))
+	shift := uint32(16 * len(tables))
+	var records []record
+	for i := 0; i < numTables; i++ {
+		rec := src[12+16*i:]
+		records = append(records, record{
+			tag:    string(rec[:4]),
+			offset: binary.BigEndian.Uint32(rec[8:]) + shift,
+			size:   binary.BigEndian.Uint32(rec[12:]),
+		})
+	}
+	body := append([]byte(nil), src[12+16*numTables:]...)
+	end := uint32(12+16*numTables) + shift + uint32(len(body))
+	for tag, data := range tables {
+		for end%4 != 0 {
+			body = append(body, 0)
+			end++
+		}
+		records = append(records, record{tag: tag, offset: end, size: uint32(len(data))})
+		body = append(body, data...)
+		end += uint32(len(data))
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].tag < records[j].tag })
+	out := append([]byte(nil), src[:12]...)
+	binary.BigEndian.PutUint16(out[4:], uint16(len(records)))
+	for _, r := range records {
+		rec := make([]byte, 16)
+		copy(rec, r.tag)
+		binary.BigEndian.PutUint32(rec[8:], r.offset)
+		binary.BigEndian.PutUint32(rec[12:], r.size)
+		out = append(out, rec...)
+	}
+	return append(out, body...)
+}
+
+// withColorGlyph returns the font src with COLR and CPAL tables that draw
+// the glyph base with three layers: the glyphs red and blue in a red and a
+// blue color, and the glyph fg in the text color.
+func withColorGlyph(src []byte, base, red, blue, fg uint16) []byte {
+	u16 := func(vs ...uint16) []byte {
+		var b []byte
+		for _, v := range vs {
+			b = append(b, byte(v>>8), byte(v))
+		}
+		return b
+	}
+	colr := u16(0, 1, 0, 14, 0, 20, 3)
+	colr = append(colr, u16(base, 0, 3)...)
+	colr = append(colr, u16(red, 0, blue, 1, fg, foregroundColor)...)
+	cpal := u16(0, 2, 1, 2, 0, 14, 0)
+	cpal = append(cpal, 0x00, 0x00, 0xff, 0xff, 0xff, 0x00, 0x00, 0xff)
+	return withTables(src, map[string][]byte{"COLR": colr, "CPAL": cpal})
+}
+
+// TestColorLayers checks that the glyphs of a COLR base glyph are reported
+// as color glyphs, with the layers and colors of their COLR and CPAL
+// records.
+func TestColorLayers(t *testing.T) {
+	// No COLR emoji font is available to the tests, so add color tables to
+	// Go Regular that draw "F" as a flag of a red pole and a blue banner
+	// under the outline of the letter in the text color.
+	plain, _ := opentype.Parse(goregular.TTF)
+	gid := func(r rune) uint16 {
+		g, _ := plain.Face().NominalGlyph(r)
+		return uint16(g)
+	}
+	face, err := opentype.Parse(withColorGlyph(goregular.TTF, gid('F'), gid('|'), gid('-'), gid('F')))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewShaper([]FontFace{{Face: face}})
+	cache.LayoutString(Parameters{PxPerEm: fixed.I(20)}, 0, 1000, english, "aF")
+	var glyphs []Glyph
+	for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+		glyphs = append(glyphs, g)
+	}
+	if len(glyphs) != 2 {
+		t.Fatalf("expected 2 glyphs, got %d", len(glyphs))
+	}
+	if glyphs[0].Color != ColorNone || cache.ColorLayers(glyphs[0]) != nil {
+		t.Errorf("expected a glyph without color layers, got source %v", glyphs[0].Color)
+	}
+	flag := glyphs[1]
+	if flag.Color != ColorLayered {
+		t.Fatalf("expected a layered color glyph, got source %v", flag.Color)
+	}
+	layers := cache.ColorLayers(flag)
+	want := []struct {
+		gid        uint16
+		color      color.NRGBA
+		foreground bool
+	}{
+		{gid: gid('|'), color: color.NRGBA{R: 0xff, A: 0xff}},
+		{gid: gid('-'), color: color.NRGBA{B: 0xff, A: 0xff}},
+		{gid: gid('F'), foreground: true},
+	}
+	if len(layers) != len(want) {
+		t.Fatalf("expected %d layers, got %d", len(want), len(layers))
+	}
+	ppem, faceIdx, _ := splitGlyphID(flag.ID)
+	for i, l := range layers {
+		lppem, lface, lgid := splitGlyphID(l.Glyph.ID)
+		if lppem != ppem || lface != faceIdx || uint16(lgid) != want[i].gid {
+			t.Errorf("layer %d: expected glyph %d of the face and size of the flag, got %d", i, want[i].gid, lgid)
+		}
+		if l.Color != want[i].color || l.Foreground != want[i].foreground {
+			t.Errorf("layer %d: expected color %v (foreground %v), got %v (%v)", i, want[i].color, want[i].foreground, l.Color, l.Foreground)
+		}
+		if l.Glyph.X != flag.X || l.Glyph.Y != flag.Y {
+			t.Errorf("layer %d: expected the position of the flag", i)
+		}
+	}
+	if _, ok := cache.Bitmap(flag); ok {
+		t.Errorf("expected no bitmap for an outline font")
+	}
+}
+
+// TestColorLigature checks that a ligature of several runes, like the
+// regional indicators of a flag emoji, is reported as a single color glyph
+// with its layers.
+func TestColorLigature(t *testing.T) {
+	// No COLR emoji font is available to the tests, so color the "fi"
+	// ligature of Roboto instead.
+	plain, _ := opentype.Parse(robotoregular.TTF)
+	gid := func(r rune) uint16 {
+		g, _ := plain.Face().NominalGlyph(r)
+		return uint16(g)
+	}
+	shaper := NewShaper([]FontFace{{Face: plain}})
+	params := Parameters{PxPerEm: fixed.I(20)}
+	shaper.LayoutString(params, 0, 1000, english, "fi")
+	lig, _ := shaper.NextGlyph()
+	if lig.Runes != 2 {
+		t.Fatalf("expected a ligature of 2 runes, got %d", lig.Runes)
+	}
+	_, _, ligID := splitGlyphID(lig.ID)
+	face, err := opentype.Parse(withColorGlyph(robotoregular.TTF, uint16(ligID), gid('f'), gid('i'), uint16(ligID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewShaper([]FontFace{{Face: face}})
+	cache.LayoutString(params, 0, 1000, english, "fi")
+	var glyphs []Glyph
+	for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+		glyphs = append(glyphs, g)
+	}
+	if len(glyphs) != 1 {
+		t.Fatalf("expected 1 glyph, got %d", len(glyphs))
+	}
+	g := glyphs[0]
+	if g.Runes != 2 || g.Flags&FlagClusterBreak == 0 {
+		t.Errorf("expected a cluster of 2 runes, got %d runes and flags %v", g.Runes, g.Flags)
+	}
+	if g.Color != ColorLayered {
+		t.Fatalf("expected a layered color glyph, got source %v", g.Color)
+	}
+	layers := cache.ColorLayers(g)
+	if len(layers) != 3 {
+		t.Fatalf("expected 3 layers, got %d", len(layers))
+	}
+	for i, want := range []uint16{gid('f'), gid('i'), uint16(ligID)} {
+		if _, _, lgid := splitGlyphID(layers[i].Glyph.ID); uint16(lgid) != want {
+			t.Errorf("layer %d: expected glyph %d, got %d", i, want, lgid)
+		}
+	}
+}
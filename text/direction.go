@@ -0,0 +1,245 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"golang.org/x/exp/slices"
+	"golang.org/x/text/unicode/bidi"
+
+	"gioui.org/io/system"
+)
+
+// ContainsRTL reports whether txt contains any strong right-to-left
+// character.
+func ContainsRTL(txt []rune) bool {
+	for _, r := range txt {
+		if isRTL(bidiClass(r)) {
+			return true
+		}
+	}
+	return false
+}
+
+// BaseDirection returns the paragraph direction of txt according to rules
+// P2 and P3 of the Unicode Bidirectional Algorithm: the direction of the
+// first strong character outside of isolates, or LTR if there is none.
+func BaseDirection(txt []rune) system.TextDirection {
+	dir, _ := strongDirection(txt)
+	return dir
+}
+
+// strongDirection is like BaseDirection, but also reports whether txt
+// contains a strong character that determines the direction.
+func strongDirection(txt []rune) (system.TextDirection, bool) {
+	isolates := 0
+	for _, r := range txt {
+		switch c := bidiClass(r); c {
+		case bidi.LRI, bidi.RLI, bidi.FSI:
+			isolates++
+		case bidi.PDI:
+			if isolates > 0 {
+				isolates--
+			}
+		case bidi.B:
+			// Paragraph separators end the paragraph.
+			return system.LTR, false
+		case bidi.L:
+			if isolates == 0 {
+				return system.LTR, true
+			}
+		default:
+			if isolates == 0 && isRTL(c) {
+				return system.RTL, true
+			}
+		}
+	}
+	return system.LTR, false
+}
+
+// bidiClass returns the bidirectional class of r.
+func bidiClass(r rune) bidi.Class {
+	p, _ := bidi.LookupRune(r)
+	return p.Class()
+}
+
+// isRTL reports whether c is a strong right-to-left class.
+func isRTL(c bidi.Class) bool {
+	return c == bidi.R || c == bidi.AL
+}
+
+// maxExplicitLevel is the deepest explicit embedding level of the Unicode
+// Bidirectional Algorithm.
+const maxExplicitLevel = 125
+
+// isExplicitControl reports whether r is an embedding, override or isolate
+// control, or the terminator of one.
+func isExplicitControl(r rune) bool {
+	switch r {
+	case '\u202A', '\u202B', '\u202C', '\u202D', '\u202E', '\u2066', '\u2067', '\u2068', '\u2069':
+		return true
+	}
+	return false
+}
+
+// isBidiControl reports whether r only directs the bidi algorithm, such as
+// explicit controls and the directional marks LRM, RLM and ALM.
+func isBidiControl(r rune) bool {
+	switch r {
+	case '\u061C', '\u200E', '\u200F':
+		return true
+	}
+	return isExplicitControl(r)
+}
+
+// paragraphLevel returns the embedding level of paragraphs of direction dir.
+func paragraphLevel(dir system.TextDirection) uint8 {
+	if dir.Progression() == system.TowardOrigin {
+		return 1
+	}
+	return 0
+}
+
+// explicitLevels returns the explicit embedding levels of the runes of txt in
+// a paragraph of level base, according to rules X1 to X8 of the Unicode
+// Bidirectional Algorithm. Controls have the level of the text around them,
+// and terminators without a matching initiator are ignored. It returns nil
+// if txt contains no explicit controls.
+func explicitLevels(txt []rune, base uint8) []uint8 {
+	if slices.IndexFunc(txt, isExplicitControl) == -1 {
+		return nil
+	}
+	type status struct {
+		level   uint8
+		isolate bool
+	}
+	stack := []status{{level: base}}
+	var overflowIsolates, overflowEmbeddings, validIsolates int
+	levels := make([]uint8, len(txt))
+	for i, r := range txt {
+		top := stack[len(stack)-1]
+		levels[i] = top.level
+		switch c := bidiClass(r); c {
+		case bidi.RLE, bidi.LRE, bidi.RLO, bidi.LRO, bidi.RLI, bidi.LRI, bidi.FSI:
+			isolate := c == bidi.RLI || c == bidi.LRI || c == bidi.FSI
+			rtl := c == bidi.RLE || c == bidi.RLO || c == bidi.RLI
+			if c == bidi.FSI {
+				rtl = isolateDirection(txt[i+1:]) == system.RTL
+			}
+			level := (top.level + 2) &^ 1
+			if rtl {
+				level = (top.level + 1) | 1
+			}
+			switch {
+			case level <= maxExplicitLevel && overflowIsolates == 0 && overflowEmbeddings == 0:
+				if isolate {
+					validIsolates++
+				}
+				stack = append(stack, status{level: level, isolate: isolate})
+			case isolate:
+				overflowIsolates++
+			case overflowIsolates == 0:
+				overflowEmbeddings++
+			}
+		case bidi.PDI:
+			switch {
+			case overflowIsolates > 0:
+				overflowIsolates--
+			case validIsolates == 0:
+				// Unmatched isolate terminators are ignored.
+			default:
+				overflowEmbeddings = 0
+				for !stack[len(stack)-1].isolate {
+					stack = stack[:len(stack)-1]
+				}
+				stack = stack[:len(stack)-1]
+				validIsolates--
+			}
+			levels[i] = stack[len(stack)-1].level
+		case bidi.PDF:
+			switch {
+			case overflowIsolates > 0:
+			case overflowEmbeddings > 0:
+				overflowEmbeddings--
+			case !top.isolate && len(stack) > 1:
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return levels
+}
+
+// isolateDirection returns the direction of the first strong character of
+// the isolate starting txt, up to its terminating PDI, as determined for an
+// FSI by rule P2 and P3.
+func isolateDirection(txt []rune) system.TextDirection {
+	isolates := 0
+	for _, r := range txt {
+		switch c := bidiClass(r); c {
+		case bidi.LRI, bidi.RLI, bidi.FSI:
+			isolates++
+		case bidi.PDI:
+			if isolates == 0 {
+				return system.LTR
+			}
+			isolates--
+		case bidi.L:
+			if isolates == 0 {
+				return system.LTR
+			}
+		default:
+			if isolates == 0 && isRTL(c) {
+				return system.RTL
+			}
+		}
+	}
+	return system.LTR
+}
+
+// resolvedLevel returns the level of a run of text of explicit level
+// explicit displayed in direction dir, according to rules I1 and I2 of the
+// Unicode Bidirectional Algorithm. Numbers are assigned the level of left to
+// right text.
+func resolvedLevel(explicit uint8, dir system.TextDirection) uint8 {
+	rtl := dir.Progression() == system.TowardOrigin
+	if rtl != (explicit%2 == 1) {
+		return explicit + 1
+	}
+	return explicit
+}
+
+// reorderLevels computes the visual order of the runs of l from their
+// levels, according to rule L2 of the Unicode Bidirectional Algorithm: from
+// the highest level down to the lowest odd level, every sequence of runs at
+// that level or higher is reversed.
+func reorderLevels(l *line) {
+	order := l.visualOrder
+	var lowest, highest uint8 = maxExplicitLevel + 1, 0
+	for i, run := range l.runs {
+		order[i] = i
+		if run.level < lowest {
+			lowest = run.level
+		}
+		if run.level > highest {
+			highest = run.level
+		}
+	}
+	for level := highest; level >= lowest|1 && level > 0; level-- {
+		for i := 0; i < len(order); {
+			if l.runs[order[i]].level < level {
+				i++
+				continue
+			}
+			j := i
+			for j < len(order) && l.runs[order[j]].level >= level {
+				j++
+			}
+			for a, b := i, j-1; a < b; a, b = a+1, b-1 {
+				order[a], order[b] = order[b], order[a]
+			}
+			i = j
+		}
+	}
+	for pos, runIdx := range order {
+		l.runs[runIdx].VisualPosition = pos
+	}
+}
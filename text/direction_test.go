@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"testing"
+
+	"golang.org/x/exp/slices"
+
+	"gioui.org/io/system"
+)
+
+func TestBaseDirection(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		txt         string
+		containsRTL bool
+		dir         system.TextDirection
+	}{
+		{name: "empty", txt: "", dir: system.LTR},
+		{name: "ltr", txt: "hello world", dir: system.LTR},
+		{name: "rtl", txt: "سلام عالم", containsRTL: true, dir: system.RTL},
+		{name: "hebrew", txt: "שלום", containsRTL: true, dir: system.RTL},
+		{name: "mixed ltr first", txt: "hello سلام", containsRTL: true, dir: system.LTR},
+		{name: "mixed rtl first", txt: "123 سلام hello", containsRTL: true, dir: system.RTL},
+		{name: "neutral", txt: "123 !?", dir: system.LTR},
+		{name: "isolated rtl", txt: "\u2067سلام\u2069 hello", containsRTL: true, dir: system.LTR},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			txt := []rune(tc.txt)
+			if got := ContainsRTL(txt); got != tc.containsRTL {
+				t.Errorf("ContainsRTL(%q) = %v, expected %v", tc.txt, got, tc.containsRTL)
+			}
+			if got := BaseDirection(txt); got != tc.dir {
+				t.Errorf("BaseDirection(%q) = %v, expected %v", tc.txt, got, tc.dir)
+			}
+		})
+	}
+}
+
+func TestExplicitLevels(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		txt    string
+		base   uint8
+		levels []uint8
+	}{
+		{name: "none", txt: "ab", levels: nil},
+		{name: "rli", txt: "a\u2067b\u2069c", levels: []uint8{0, 0, 1, 0, 0}},
+		{name: "nested", txt: "\u2067a\u2066b\u2069\u2069", levels: []uint8{0, 1, 1, 2, 1, 0}},
+		{name: "rtl paragraph", txt: "\u2066a\u2069", base: 1, levels: []uint8{1, 2, 1}},
+		{name: "embedding", txt: "\u202Ba\u202Cb", levels: []uint8{0, 1, 1, 0}},
+		{name: "unmatched pdi", txt: "a\u2069b", levels: []uint8{0, 0, 0}},
+		{name: "unmatched pdf", txt: "\u2067a\u202Cb\u2069", levels: []uint8{0, 1, 1, 1, 0}},
+		{name: "unterminated", txt: "a\u2067b", levels: []uint8{0, 0, 1}},
+		{name: "pdi closes embeddings", txt: "\u2067\u202Aa\u2069b", levels: []uint8{0, 1, 2, 0, 0}},
+		{name: "fsi", txt: "\u2068س\u2069", levels: []uint8{0, 1, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := explicitLevels([]rune(tc.txt), tc.base)
+			if !slices.Equal(got, tc.levels) {
+				t.Errorf("explicitLevels(%q) = %v, expected %v", tc.txt, got, tc.levels)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"encoding/binary"
+
+	"github.com/benoitkugler/textlayout/fonts/truetype"
+	"github.com/benoitkugler/textlayout/harfbuzz"
+)
+
+var (
+	tagMark         = truetype.MustNewTag("mark")
+	tagMarkToMark   = truetype.MustNewTag("mkmk")
+	tagTabular      = truetype.MustNewTag("tnum")
+	tagProportional = truetype.MustNewTag("pnum")
+	tagSmallCaps    = truetype.MustNewTag("smcp")
+)
+
+// features returns the OpenType features requested by p, or nil if the
+// default features of the shaper apply.
+func (p Parameters) features() []harfbuzz.Feature {
+	var feats []harfbuzz.Feature
+	set := func(tag Tag, value uint32) {
+		feats = append(feats, harfbuzz.Feature{Tag: tag, Value: value, Start: harfbuzz.FeatureGlobalStart, End: harfbuzz.FeatureGlobalEnd})
+	}
+	if p.DisableMark {
+		set(tagMark, 0)
+	}
+	if p.DisableMarkToMark {
+		set(tagMarkToMark, 0)
+	}
+	for _, f := range p.Features {
+		set(f.Tag, f.Value)
+	}
+	if p.SmallCaps {
+		set(tagSmallCaps, 1)
+	}
+	if p.TabularNumbers {
+		set(tagProportional, 0)
+		set(tagTabular, 1)
+	}
+	return feats
+}
+
+// featuresKey encodes feats for the layout cache key.
+func featuresKey(feats []FontFeature) string {
+	if len(feats) == 0 {
+		return ""
+	}
+	key := make([]byte, len(feats)*8)
+	for i, f := range feats {
+		binary.LittleEndian.PutUint32(key[i*8:], uint32(f.Tag))
+		binary.LittleEndian.PutUint32(key[i*8+4:], f.Value)
+	}
+	return string(key)
+}
+
+// shapingFeaturesKey encodes feats, whose features are global, for the run
+// cache key.
+func shapingFeaturesKey(feats []harfbuzz.Feature) string {
+	if len(feats) == 0 {
+		return ""
+	}
+	key := make([]byte, len(feats)*8)
+	for i, f := range feats {
+		binary.LittleEndian.PutUint32(key[i*8:], uint32(f.Tag))
+		binary.LittleEndian.PutUint32(key[i*8+4:], f.Value)
+	}
+	return string(key)
+}
@@ -3,24 +3,71 @@
 package text
 
 import (
+	"image"
 	"io"
+	"math"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/benoitkugler/textlayout/fonts"
+	"github.com/benoitkugler/textlayout/fonts/truetype"
+	"github.com/benoitkugler/textlayout/harfbuzz"
 	"github.com/benoitkugler/textlayout/language"
+	"github.com/benoitkugler/textlayout/unicodedata"
 	"github.com/go-text/typesetting/di"
 	"github.com/go-text/typesetting/font"
 	"github.com/go-text/typesetting/shaping"
 	"golang.org/x/exp/slices"
 	"golang.org/x/image/math/fixed"
 	"golang.org/x/text/unicode/bidi"
+	"golang.org/x/text/unicode/norm"
 
 	"gioui.org/f32"
+	f32internal "gioui.org/internal/f32"
 	"gioui.org/io/system"
 	"gioui.org/op"
 	"gioui.org/op/clip"
 )
 
+// LineEnding describes how a line ends.
+type LineEnding uint8
+
+const (
+	// SoftWrap ends a line wrapped within a paragraph, or truncated.
+	SoftWrap LineEnding = iota
+	// HardBreak ends a line with a newline, ending its paragraph.
+	HardBreak
+	// EndOfText ends the last line of text without a trailing newline.
+	EndOfText
+	// EmergencyWrap ends a line wrapped within a word too wide for a line,
+	// as allowed by WrapWordsOrGraphemes.
+	EmergencyWrap
+)
+
+func (e LineEnding) String() string {
+	switch e {
+	case SoftWrap:
+		return "SoftWrap"
+	case HardBreak:
+		return "HardBreak"
+	case EndOfText:
+		return "EndOfText"
+	case EmergencyWrap:
+		return "EmergencyWrap"
+	default:
+		panic("invalid LineEnding")
+	}
+}
+
+// wraps reports whether e ends a line wrapped within its paragraph.
+func (e LineEnding) wraps() bool {
+	return e == SoftWrap || e == EmergencyWrap
+}
+
 // document holds a collection of shaped lines and alignment information for
 // those lines.
 type document struct {
@@ -28,21 +75,232 @@ type document struct {
 	alignment Alignment
 	// alignWidth is the width used when aligning text.
 	alignWidth int
+	// minWidth is the minimum alignWidth requested by the layout.
+	minWidth int
+	// links holds the areas computed by the most recent call to LinkRects.
+	links [][]f32internal.Rectangle
+	// source is a copy of the shaped text, if Parameters.RetainSource
+	// was set.
+	source []rune
+	// paragraphs holds the direction of each paragraph of the document.
+	paragraphs []system.TextDirection
+	// Truncated is the number of runes at the end of the text that were
+	// omitted from the document because of Parameters.MaxLines.
+	Truncated int
+	// Overflowed is set if any line of the document is Overflowing.
+	Overflowed bool
+	// Start is the offset of the first rune of the document in the text
+	// passed to LayoutRunesRange. Adding it to the rune offsets of the
+	// document makes them absolute offsets into that text.
+	Start int
 }
 
 // append adds the lines of other to the end of l and ensures they
-// are aligned to the same width.
+// are aligned to the same width. The lines remain sorted by increasing
+// yOffset, as required by VisibleLines.
 func (l *document) append(other document) {
 	l.lines = append(l.lines, other.lines...)
 	l.alignWidth = max(l.alignWidth, other.alignWidth)
+	l.minWidth = max(l.minWidth, other.minWidth)
+	l.source = append(l.source, other.source...)
+	l.paragraphs = append(l.paragraphs, other.paragraphs...)
+	l.Truncated += other.Truncated
+	l.Overflowed = l.Overflowed || other.Overflowed
 	calculateYOffsets(l.lines)
 }
 
+// slice returns the lines [startLine, endLine) of l, belonging to the
+// paragraphs [startPara, endPara) whose source starts at sourceStart.
+func (l *document) slice(startLine, endLine, startPara, endPara, sourceStart int) document {
+	doc := document{
+		lines:      l.lines[startLine:endLine],
+		alignWidth: alignWidth(0, l.lines[startLine:endLine]),
+		paragraphs: l.paragraphs[startPara:endPara],
+	}
+	runes := 0
+	for _, ln := range doc.lines {
+		runes += ln.runeCount
+		doc.Overflowed = doc.Overflowed || ln.Overflowing
+	}
+	doc.source = l.source[sourceStart : sourceStart+runes]
+	return doc
+}
+
+// truncateHeight truncates the lines of l whose bottom is below maxHeight.
+// The break is moved up such that at least orphans lines of a split
+// paragraph are kept before it and widows lines are truncated after it. If
+// that would truncate every line, the break is left where the height ends.
+func (l *document) truncateHeight(maxHeight, orphans, widows int) {
+	n := sort.Search(len(l.lines), func(i int) bool {
+		ln := l.lines[i]
+		return ln.yOffset+ln.descent.Ceil() > maxHeight
+	})
+	if n == len(l.lines) {
+		return
+	}
+	// Find the paragraph of the first truncated line.
+	start, end := n, n
+	for start > 0 && l.lines[start-1].Ending.wraps() {
+		start--
+	}
+	for end < len(l.lines)-1 && l.lines[end].Ending.wraps() {
+		end++
+	}
+	brk := n
+	if brk > start && end+1-brk < widows {
+		brk = max(end+1-widows, start)
+	}
+	if brk > start && brk-start < orphans {
+		brk = start
+	}
+	if brk == 0 {
+		brk = n
+	}
+	// Truncate the paragraphs that start after the break.
+	paragraphs := 0
+	for i := brk; i < len(l.lines); i++ {
+		l.Truncated += l.lines[i].runeCount
+		if i == 0 || !l.lines[i-1].Ending.wraps() {
+			paragraphs++
+		}
+	}
+	l.lines = l.lines[:brk]
+	l.paragraphs = l.paragraphs[:len(l.paragraphs)-paragraphs]
+	l.Overflowed = false
+	for _, ln := range l.lines {
+		l.Overflowed = l.Overflowed || ln.Overflowing
+	}
+}
+
 // reset empties the document in preparation to reuse its memory.
 func (l *document) reset() {
 	l.lines = l.lines[:0]
 	l.alignment = Start
 	l.alignWidth = 0
+	l.minWidth = 0
+	l.links = l.links[:0]
+	l.source = l.source[:0]
+	l.paragraphs = l.paragraphs[:0]
+	l.Truncated = 0
+	l.Overflowed = false
+	l.Start = 0
+}
+
+// Source returns a copy of the text the document was shaped from. It is
+// empty unless the document was shaped with Parameters.RetainSource set.
+func (l *document) Source() []rune {
+	return append([]rune(nil), l.source...)
+}
+
+// VisibleLines returns the range [start, end) of the indices of the lines
+// whose line boxes intersect the vertical window [top, bottom) in document
+// coordinates. Lines are sorted by increasing yOffset and do not overlap, so
+// the range is found by binary search. The range is empty if no line
+// intersects the window.
+func (l *document) VisibleLines(top, bottom fixed.Int26_6) (start, end int) {
+	start = sort.Search(len(l.lines), func(i int) bool {
+		ln := l.lines[i]
+		return fixed.I(ln.yOffset)+ln.descent > top
+	})
+	end = start + sort.Search(len(l.lines)-start, func(i int) bool {
+		ln := l.lines[start+i]
+		return fixed.I(ln.yOffset)-ln.ascent >= bottom
+	})
+	return start, end
+}
+
+// ParagraphDirections returns the direction of each paragraph of the
+// document, in order. The direction is the one resolved from the text if
+// Parameters.DetectDirection was set, and that of the locale otherwise.
+// Callers can use it to place paragraph decorations, such as list markers,
+// on the side paragraphs start from.
+func (l *document) ParagraphDirections() []system.TextDirection {
+	return append([]system.TextDirection(nil), l.paragraphs...)
+}
+
+// UsedFace identifies a face and size glyphs of a document are shaped with.
+type UsedFace struct {
+	// FaceID is the index of the face in the shaper, as encoded in the
+	// GlyphID of its glyphs.
+	FaceID int
+	// PxPerEm is the effective size of the face, after adjustments such as
+	// Parameters.SizeAdjust.
+	PxPerEm fixed.Int26_6
+}
+
+// UsedFaces returns the distinct faces and sizes of the glyphs of the
+// document, including fallback faces, in order of first use. Renderers may
+// use it to allocate glyph caches before drawing.
+func (l *document) UsedFaces() []UsedFace {
+	var used []UsedFace
+	for _, ln := range l.lines {
+		for _, run := range ln.runs {
+			for _, g := range run.Glyphs {
+				// Skip the synthetic glyphs of newlines.
+				if g.glyphCount == 0 {
+					continue
+				}
+				_, faceIdx, _ := splitGlyphID(g.id)
+				u := UsedFace{FaceID: faceIdx, PxPerEm: run.PPEM}
+				if !slices.Contains(used, u) {
+					used = append(used, u)
+				}
+				break
+			}
+		}
+	}
+	return used
+}
+
+// Snapshot returns a copy of the document that does not share memory the
+// shaper reuses for subsequent layouts, and is thus safe to retain. The glyphs
+// of the snapshot are shared with the layout cache, where they are never
+// modified.
+func (l *document) Snapshot() document {
+	snap := document{
+		lines:      make([]line, len(l.lines)),
+		alignment:  l.alignment,
+		alignWidth: l.alignWidth,
+		minWidth:   l.minWidth,
+		source:     l.Source(),
+		paragraphs: l.ParagraphDirections(),
+		Truncated:  l.Truncated,
+		Overflowed: l.Overflowed,
+		Start:      l.Start,
+	}
+	for i, ln := range l.lines {
+		ln.runs = append([]runLayout(nil), ln.runs...)
+		ln.visualOrder = append([]int(nil), ln.visualOrder...)
+		snap.lines[i] = ln
+	}
+	for _, rects := range l.links {
+		snap.links = append(snap.links, append([]f32internal.Rectangle(nil), rects...))
+	}
+	return snap
+}
+
+// SynthesizedRuns returns the rune ranges of the runs whose requested style or
+// weight is missing from their face, as reported by runLayout.Oblique and
+// Embolden. Their glyphs are synthesized if Parameters.Synthesize is set.
+// Adjacent ranges are merged.
+func (l *document) SynthesizedRuns() []Range {
+	var ranges []Range
+	lineStart := 0
+	for _, ln := range l.lines {
+		for _, run := range ln.runs {
+			if run.Oblique == 0 && !run.Embolden {
+				continue
+			}
+			r := Range{Offset: lineStart + run.Runes.Offset, Count: run.Runes.Count}
+			if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Count == r.Offset {
+				ranges[n-1].Count += r.Count
+				continue
+			}
+			ranges = append(ranges, r)
+		}
+		lineStart += ln.runeCount
+	}
+	return ranges
 }
 
 func max(a, b int) int {
@@ -65,11 +323,17 @@ type line struct {
 	visualOrder []int
 	// width is the width of the line.
 	width fixed.Int26_6
-	// ascent is the height above the baseline.
+	// ascent is the height above the baseline, taken from the font metrics
+	// of the tallest run rather than the ink of its glyphs.
 	ascent fixed.Int26_6
 	// descent is the height below the baseline, including
-	// the line gap.
+	// the line gap. Like ascent, it is derived from font metrics.
 	descent fixed.Int26_6
+	// fontAscent, fontDescent and lineGap are the largest ascent, descent
+	// and line gap of the fonts of the runs of the line, for aligning inline
+	// content to the baseline. Unlike descent, fontDescent excludes the line
+	// gap, and none of them are adjusted for MinLineHeight or inline objects.
+	fontAscent, fontDescent, lineGap fixed.Int26_6
 	// bounds is the visible bounds of the line.
 	bounds fixed.Rectangle26_6
 	// direction is the dominant direction of the line. This direction will be
@@ -79,10 +343,135 @@ type line struct {
 	direction system.TextDirection
 	// runeCount is the number of text runes represented by this line's runs.
 	runeCount int
+	// Overflowing is set if the line is wider than the maximum width it was
+	// laid out for, such as when it contains a word too long to be broken.
+	// Renderers may use it to indicate that the line is clipped.
+	Overflowing bool
+	// Reordered is set if the visual order of the line differs from its
+	// logical order, that is if its runs are displayed out of logical order
+	// or any run flows right to left. Renderers may skip reordering for lines
+	// without it.
+	Reordered bool
+	// overflow is the amount by which the line exceeds the maximum width.
+	overflow fixed.Int26_6
+	// Ending describes how the line ends.
+	Ending LineEnding
+	// decorations are the decoration rectangles of the runs, in visual
+	// order. Their vertical positions are relative to the baseline.
+	decorations []DecorationRect
+	// ignorables are the markers of the default-ignorable characters of
+	// the line, in visual order, if requested by Parameters.ShowIgnorables.
+	// Their vertical positions are relative to the baseline.
+	ignorables []IgnorableMarker
 
 	yOffset int
 }
 
+// Baseline returns the distance from the top of the line box to the
+// alphabetic baseline shared by all runs of the line. Runs of different faces
+// and sizes are aligned to this baseline, so it sits below the tallest ascent
+// among them.
+func (l *line) Baseline() fixed.Int26_6 {
+	return l.ascent
+}
+
+// ContentWidth returns the width of the content of the line regardless of
+// alignment. Unlike the alignment width of the document, which is shared by
+// all of its lines, it excludes the padding that aligns the line, so it suits
+// drawing tight backgrounds.
+func (l *line) ContentWidth() fixed.Int26_6 {
+	return l.width
+}
+
+// LogicalRun describes the extent of a run of a line.
+type LogicalRun struct {
+	// Runes is the range of runes of the run, relative to the start of
+	// the line.
+	Runes Range
+	// Width is the width of the run, regardless of its direction.
+	Width fixed.Int26_6
+}
+
+// LogicalRuns returns the runs of the line in logical order, that is ordered
+// by rune offset.
+func (l *line) LogicalRuns() []LogicalRun {
+	runs := make([]LogicalRun, len(l.runs))
+	for i, run := range l.runs {
+		width := run.Advance
+		if width < 0 {
+			width = -width
+		}
+		runs[i] = LogicalRun{Runes: run.Runes, Width: width}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Runes.Offset < runs[j].Runes.Offset
+	})
+	return runs
+}
+
+// lineGlyph is a glyph positioned within its line.
+type lineGlyph struct {
+	glyph
+	// x is the position of the dot of the glyph relative to the start of
+	// the line.
+	x fixed.Int26_6
+}
+
+// GlyphsVisual returns the glyphs of the line in visual order, that is from
+// left to right.
+func (l *line) GlyphsVisual() []lineGlyph {
+	var glyphs []lineGlyph
+	for _, runIdx := range l.visualOrder {
+		run := l.runs[runIdx]
+		x := run.X
+		for _, g := range run.Glyphs {
+			glyphs = append(glyphs, lineGlyph{glyph: g, x: x})
+			x += g.xAdvance
+		}
+	}
+	return glyphs
+}
+
+// GlyphsLogical returns the glyphs of the line in logical order, that is
+// ordered by rune offset. Glyphs of the same cluster are in visual order.
+func (l *line) GlyphsLogical() []lineGlyph {
+	glyphs := l.GlyphsVisual()
+	sort.SliceStable(glyphs, func(i, j int) bool {
+		return glyphs[i].runeOffset < glyphs[j].runeOffset
+	})
+	return glyphs
+}
+
+// CaretOffsets returns the x position, relative to the start of the line, of
+// the caret before each rune of the line and after its last rune, in logical
+// order. At the boundary of runs of different directions, the caret follows
+// the logically preceding rune. The runes of clusters representing several
+// runes, such as ligatures, are spread evenly across the cluster advance.
+func (l *line) CaretOffsets() []fixed.Int26_6 {
+	offsets := make([]fixed.Int26_6, l.runeCount+1)
+	for _, run := range l.runs {
+		rtl := run.Direction.Progression() == system.TowardOrigin
+		forEachCluster(run, func(runes, _ Range, x, advance fixed.Int26_6) {
+			if runes.Count == 0 {
+				return
+			}
+			for k := 0; k <= runes.Count; k++ {
+				pos := runes.Offset + k
+				if k == 0 && pos > 0 {
+					// The position is owned by the preceding rune.
+					continue
+				}
+				visual := k
+				if rtl {
+					visual = runes.Count - k
+				}
+				offsets[pos] = run.X + x + advance*fixed.Int26_6(visual)/fixed.Int26_6(runes.Count)
+			}
+		})
+	}
+	return offsets
+}
+
 // Range describes the position and quantity of a range of text elements
 // within a larger slice. The unit is usually runes of unicode data or
 // glyphs of shaped font data.
@@ -106,6 +495,9 @@ type glyph struct {
 	// runeCount is the quantity of runes in the source text that this glyph
 	// corresponds to.
 	runeCount int
+	// runeOffset is the offset of the first rune of the cluster of this
+	// glyph, relative to the start of the line.
+	runeOffset int
 	// xAdvance and yAdvance describe the distance the dot moves when
 	// laying out the glyph on the X or Y axis.
 	xAdvance, yAdvance fixed.Int26_6
@@ -115,6 +507,10 @@ type glyph struct {
 	// bounds describes the visual bounding box of the glyph relative to
 	// its dot.
 	bounds fixed.Rectangle26_6
+	// fade is the opacity removed from the glyph by Parameters.Fade.
+	fade uint8
+	// color is the color source of the glyph.
+	color ColorSource
 }
 
 type runLayout struct {
@@ -134,12 +530,65 @@ type runLayout struct {
 	Runes Range
 	// Advance is the sum of the advances of all clusters in the Layout.
 	Advance fixed.Int26_6
-	// PPEM is the pixels-per-em scale used to shape this run.
+	// PPEM is the effective pixels-per-em scale used to shape this run. It
+	// differs from Parameters.PxPerEm if the size of the run was adjusted,
+	// such as by Parameters.SizeAdjust.
 	PPEM fixed.Int26_6
 	// Direction is the layout direction of the glyphs.
 	Direction system.TextDirection
+	// Oblique is the angle, in degrees, by which the glyphs should be slanted
+	// to synthesize an italic style missing from the face. It is zero if no
+	// synthesis is needed. The glyphs are only slanted if
+	// Parameters.Synthesize is set.
+	Oblique float32
+	// Embolden is set if a bold weight was requested but the face of the run
+	// is not bold. The glyphs are only emboldened if Parameters.Synthesize is
+	// set.
+	Embolden bool
+	// Kerning is set if Parameters.DebugKerning is set. It holds the kerning
+	// adjustment between each pair of adjacent glyphs, in visual order:
+	// Kerning[i] is the adjustment between Glyphs[i] and Glyphs[i+1], that is
+	// the difference between the positioned and the nominal advance of the
+	// logically first glyph of the pair.
+	Kerning []fixed.Int26_6
+	// Decoration is the decoration of the runes of the run, as assigned by
+	// FaceRange.Decoration.
+	Decoration Decoration
+	// Span is the index of the TextSpan of the runes of the run, for text
+	// laid out by LayoutSpans.
+	Span int
+	// SmallCapsScale is the scale of the capitals of the run relative to
+	// the size of the text, if they are synthesized for Parameters.SmallCaps.
+	// It is zero otherwise. The scale is accounted for by PPEM.
+	SmallCapsScale float32
+	// Font is the font the face of the run was registered with. It differs
+	// from the font of the text if the runes of the run are missing from the
+	// face chosen for the text and are displayed by a fallback face.
+	Font Font
+	// level is the bidi embedding level of the run, if its paragraph contains
+	// explicit directional controls. The visual order of runs with levels is
+	// computed from them, to account for nested embeddings and isolates.
+	level uint8
 	// face is the font face that the ID of each Glyph in the Layout refers to.
 	face font.Face
+	// synthesize is set if the Oblique and Embolden styles of the run are
+	// applied to its glyphs, as requested by Parameters.Synthesize.
+	synthesize bool
+}
+
+// ContentAdvance returns the sum of the advances of the glyphs of the run,
+// excluding synthetic glyphs such as the one representing a trailing
+// newline. Unlike Advance, it does not depend on how such glyphs are
+// represented.
+func (r *runLayout) ContentAdvance() fixed.Int26_6 {
+	var adv fixed.Int26_6
+	for _, g := range r.Glyphs {
+		if g.glyphCount == 0 {
+			continue
+		}
+		adv += g.xAdvance
+	}
+	return adv
 }
 
 // faceOrderer chooses the order in which faces should be applied to text.
@@ -151,6 +600,32 @@ type faceOrderer struct {
 	faces               map[Font]font.Face
 	faceToIndex         map[font.Face]int
 	fonts               []Font
+	// fallback, if set, provides faces for runes missing from every
+	// known face.
+	fallback func(Font, rune) (FontFace, bool)
+	// lazy holds the loaders of the fonts inserted by insertLazy whose
+	// faces are not yet loaded. The faces of such fonts are nil.
+	lazy map[Font]func() (Face, error)
+	// loaded, if set, is notified of the faces loaded from lazy.
+	loaded func(FontFace)
+	// fallbacks lists the fonts whose faces are preferred, in order, for
+	// runes missing from the primary face.
+	fallbacks []Font
+	// fallbackOrder holds the fonts resolved from fallbacks for the most
+	// recently sorted faces.
+	fallbackOrder []Font
+	// assigned holds the faces assigned to text by LayoutAssigned that are
+	// not registered with the orderer. They are never chosen for text and
+	// only index glyphs, from the largest face index downwards.
+	assigned        []FontFace
+	assignedToIndex map[font.Face]int
+	// coverage caches whether faces have glyphs for the runes looked up by
+	// resolveMissing and resolveFace.
+	coverage map[font.Face]map[rune]bool
+	// tries holds the number of faces tried by resolveFace for each rune,
+	// including the fallback faces tried by resolveMissing, recorded in
+	// fallbackTries.
+	tries, fallbackTries map[rune]int
 }
 
 func (f *faceOrderer) insert(fnt Font, face font.Face) {
@@ -169,7 +644,131 @@ func (f *faceOrderer) insert(fnt Font, face font.Face) {
 	f.faceScratch = append(f.faceScratch, face)
 	f.fonts = append(f.fonts, fnt)
 	f.faces[fnt] = face
-	f.faceToIndex[face] = f.fontDefaultOrder[fnt]
+	if face != nil {
+		f.faceToIndex[face] = f.fontDefaultOrder[fnt]
+	}
+}
+
+// insertLazy inserts fnt like insert, but defers calling load for its face
+// until the face is needed.
+func (f *faceOrderer) insertLazy(fnt Font, load func() (Face, error)) {
+	f.insert(fnt, nil)
+	if f.lazy == nil {
+		f.lazy = make(map[Font]func() (Face, error))
+	}
+	f.lazy[fnt] = load
+}
+
+// face returns the face of fnt, loading it if it was inserted by insertLazy.
+// Faces that fail to load are nil.
+func (f *faceOrderer) face(fnt Font) font.Face {
+	if load, ok := f.lazy[fnt]; ok {
+		delete(f.lazy, fnt)
+		if face, err := load(); err == nil {
+			ff := face.Face()
+			f.faces[fnt] = ff
+			f.faceToIndex[ff] = f.fontDefaultOrder[fnt]
+			if f.loaded != nil {
+				f.loaded(FontFace{Font: fnt, Face: face})
+			}
+		}
+	}
+	return f.faces[fnt]
+}
+
+// resolveMissing loads the faces provided by the fallback for the runes of txt
+// missing from every known face.
+func (f *faceOrderer) resolveMissing(fnt Font, txt []rune) {
+	for r := range f.fallbackTries {
+		delete(f.fallbackTries, r)
+	}
+	if f.fallback == nil {
+		return
+	}
+	for _, r := range txt {
+		if !unicode.IsGraphic(r) || f.covers(r) {
+			continue
+		}
+		if f.fallbackTries == nil {
+			f.fallbackTries = make(map[rune]int)
+		}
+		f.fallbackTries[r]++
+		if ff, ok := f.fallback(fnt, r); ok {
+			if _, known := f.faces[ff.Font]; !known {
+				f.insert(ff.Font, ff.Face.Face())
+			}
+		}
+	}
+}
+
+// covers reports whether any known face has a glyph for r.
+func (f *faceOrderer) covers(r rune) bool {
+	for _, face := range f.faces {
+		if face == nil {
+			continue
+		}
+		if f.faceCovers(face, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveFace returns the first of faces covering r, or the first face if none
+// does, and records the number of faces tried for r.
+func (f *faceOrderer) resolveFace(faces []font.Face, r rune) font.Face {
+	face, tried := faces[0], len(faces)
+	for i, ff := range faces {
+		if f.faceCovers(ff, r) {
+			face, tried = ff, i+1
+			break
+		}
+	}
+	if f.tries == nil {
+		f.tries = make(map[rune]int)
+	}
+	f.tries[r] = f.fallbackTries[r] + tried
+	return face
+}
+
+// facesTried returns the number of faces tried for the first rune of input,
+// which is 1 for runes whose face was not resolved, such as spaces.
+func (f *faceOrderer) facesTried(input shaping.Input) int {
+	if input.RunStart < input.RunEnd {
+		if n, ok := f.tries[input.Text[input.RunStart]]; ok {
+			return n
+		}
+	}
+	return 1
+}
+
+// faceMap is the shaping.Fontmap resolving runes to the first of faces
+// covering them with orderer.
+type faceMap struct {
+	orderer *faceOrderer
+	faces   []font.Face
+}
+
+func (m faceMap) ResolveFace(r rune) font.Face {
+	return m.orderer.resolveFace(m.faces, r)
+}
+
+// faceCovers reports whether face has a glyph for r, caching the result.
+func (f *faceOrderer) faceCovers(face font.Face, r rune) bool {
+	if f.coverage == nil {
+		f.coverage = make(map[font.Face]map[rune]bool)
+	}
+	runes := f.coverage[face]
+	if runes == nil {
+		runes = make(map[rune]bool)
+		f.coverage[face] = runes
+	}
+	covered, ok := runes[r]
+	if !ok {
+		_, covered = face.NominalGlyph(r)
+		runes[r] = covered
+	}
+	return covered
 }
 
 // resetFontOrder restores the fonts to a predictable order. It should be invoked
@@ -179,13 +778,51 @@ func (c *faceOrderer) resetFontOrder() {
 }
 
 func (c *faceOrderer) indexFor(face font.Face) int {
+	if idx, ok := c.assignedToIndex[face]; ok {
+		return idx
+	}
 	return c.faceToIndex[face]
 }
 
+// assign indexes the face f assigned to text by LayoutAssigned, if it is not
+// registered, without making it available for resolving the faces of text.
+// It reports whether f was newly indexed.
+func (c *faceOrderer) assign(f FontFace) bool {
+	face := f.Face.Face()
+	if _, ok := c.faceToIndex[face]; ok {
+		return false
+	}
+	if _, ok := c.assignedToIndex[face]; ok {
+		return false
+	}
+	if c.assignedToIndex == nil {
+		c.assignedToIndex = make(map[font.Face]int)
+	}
+	c.assignedToIndex[face] = maxFaceIndex - len(c.assigned)
+	c.assigned = append(c.assigned, f)
+	return true
+}
+
+// fontFor returns the Font a face was registered or assigned with, or the
+// zero Font if the face is unknown.
+func (c *faceOrderer) fontFor(face font.Face) Font {
+	idx := c.indexFor(face)
+	if i := maxFaceIndex - idx; i < len(c.assigned) {
+		return c.assigned[i].Font
+	}
+	if idx >= len(c.defaultOrderedFonts) {
+		return Font{}
+	}
+	return c.defaultOrderedFonts[idx]
+}
+
 func (c *faceOrderer) faceFor(idx int) font.Face {
 	if idx < len(c.defaultOrderedFonts) {
 		return c.faces[c.defaultOrderedFonts[idx]]
 	}
+	if i := maxFaceIndex - idx; i < len(c.assigned) {
+		return c.assigned[i].Face.Face()
+	}
 	panic("face index not found")
 }
 
@@ -202,6 +839,14 @@ func (c *faceOrderer) sortedFacesForStyle(font Font) []font.Face {
 			primary = c.def
 		}
 	}
+	c.face(primary)
+	c.fallbackOrder = c.fallbackOrder[:0]
+	for _, fb := range c.fallbacks {
+		if fnt, ok := c.fontForStyle(fb); ok && !slices.Contains(c.fallbackOrder, fnt) {
+			c.face(fnt)
+			c.fallbackOrder = append(c.fallbackOrder, fnt)
+		}
+	}
 	return c.sorted(primary)
 }
 
@@ -218,21 +863,29 @@ func (c *faceOrderer) fontForStyle(font Font) (Font, bool) {
 	return font, false
 }
 
-// faces returns a slice of faces with primary as the first element and
-// the remaining faces ordered by insertion order.
+// faces returns a slice of faces with primary as the first element,
+// followed by the faces of fallbackOrder and the remaining faces ordered
+// by insertion order. Faces not yet loaded are omitted.
 func (f *faceOrderer) sorted(primary Font) []font.Face {
-	sort.Slice(f.fonts, func(i, j int) bool {
-		if f.fonts[i] == primary {
-			return true
+	rank := func(fnt Font) int {
+		if fnt == primary {
+			return -1
 		}
-		a := f.fonts[i]
-		b := f.fonts[j]
-		return f.fontDefaultOrder[a] < f.fontDefaultOrder[b]
+		if i := slices.Index(f.fallbackOrder, fnt); i >= 0 {
+			return i
+		}
+		return len(f.fallbackOrder) + f.fontDefaultOrder[fnt]
+	}
+	sort.Slice(f.fonts, func(i, j int) bool {
+		return rank(f.fonts[i]) < rank(f.fonts[j])
 	})
-	for i, font := range f.fonts {
-		f.faceScratch[i] = f.faces[font]
+	faces := f.faceScratch[:0]
+	for _, font := range f.fonts {
+		if face := f.faces[font]; face != nil {
+			faces = append(faces, face)
+		}
 	}
-	return f.faceScratch
+	return faces
 }
 
 // shaperImpl implements the shaping and line-wrapping of opentype fonts.
@@ -241,15 +894,129 @@ type shaperImpl struct {
 	orderer faceOrderer
 
 	// Shaping and wrapping state.
-	shaper        shaping.HarfbuzzShaper
+	runShaper
 	wrapper       shaping.LineWrapper
 	bidiParagraph bidi.Paragraph
+	// workers is the number of goroutines shaping the runs of long text
+	// concurrently, each with its runShaper in workerShapers. Text is shaped
+	// serially if workers is below 2. pending holds the indices of the runs
+	// left to shape concurrently.
+	workers       int
+	workerShapers []runShaper
+	pending       []int
 
 	// Scratch buffers used to avoid re-allocating slices during routine internal
 	// shaping operations.
 	splitScratch1, splitScratch2 []shaping.Input
 	outScratchBuf                []shaping.Output
 	scratchRunes                 []rune
+	markScratch                  []rune
+	collapseScratch              []rune
+	collapseStarts               []int
+	normScratch                  []rune
+	normStarts                   []int
+	breaker                      breaker
+
+	// assigned holds the faces assigned to runes by LayoutAssigned. If nil,
+	// faces are resolved by glyph coverage.
+	assigned []faceRange
+	// spans holds the styles of the runes laid out by LayoutSpans. If
+	// non-nil, the faces and sizes of the text are resolved by it.
+	spans []spanRange
+	// overrides holds faces that replace the faces otherwise chosen for
+	// their runes.
+	overrides []faceRange
+	// letterSpacing holds the spacing added after each cluster by
+	// Parameters.LetterSpacing, indexed by the rune offset of the cluster.
+	letterSpacing []fixed.Int26_6
+	// runs caches shaped runs.
+	runs runCache
+	// colors holds the color tables of the loaded faces that have them.
+	colors map[font.Face]*colorFace
+	// maxRunGlyphs caps the number of glyphs of each run, bounding the
+	// memory of runs of very long text. If zero, defaultMaxRunGlyphs is used.
+	maxRunGlyphs int
+	// tofu, if set, provides the runes displayed with the face of tofuFont
+	// in place of runes missing from every face.
+	tofu     func(r rune) []rune
+	tofuFont Font
+	// observer, if set, is notified of the face resolution of each shaped
+	// run.
+	observer func(RunStats)
+	// missingGlyph, if set, is notified of the runes missing from every
+	// face. missingSeen holds the runes it was notified of since the last
+	// call to resetMissing.
+	missingGlyph func(r rune)
+	missingSeen  map[rune]bool
+	// segmentScratch holds the synthesized outlines of Shape.
+	segmentScratch []fonts.Segment
+}
+
+// shapeOptions holds the state of a call shaping and wrapping text, derived
+// from its Parameters.
+type shapeOptions struct {
+	// features holds the OpenType features requested by the parameters. If
+	// nil, the default features are applied. featuresKey encodes them for
+	// the run cache.
+	features    []harfbuzz.Feature
+	featuresKey string
+	// sizeAdjust and smallCaps are Parameters.SizeAdjust and
+	// Parameters.SmallCaps.
+	sizeAdjust, smallCaps bool
+	// smallCapsRuns holds the runs of the text with synthesized small
+	// capitals.
+	smallCapsRuns []smallCapsRun
+	// softHyphens maps the offsets of the soft hyphens of the text to the
+	// hyphen glyphs displayed if lines are broken at them.
+	softHyphens map[int]shaping.Glyph
+	// hyphenator is Parameters.Hyphenation, and hyphenLocale the locale of
+	// the wrapped text.
+	hyphenator   Hyphenator
+	hyphenLocale system.Locale
+	// hyphenBreaks holds the offsets of the line breaks within words found
+	// by hyphenator.
+	hyphenBreaks []int
+	// emergencyBreaks holds the offsets of the line breaks within words too
+	// wide for a line.
+	emergencyBreaks []int
+}
+
+// newShapeOptions returns the options for shaping text with params.
+func newShapeOptions(params Parameters) *shapeOptions {
+	feats := params.features()
+	return &shapeOptions{
+		features:    feats,
+		featuresKey: shapingFeaturesKey(feats),
+		sizeAdjust:  params.SizeAdjust,
+		smallCaps:   params.SmallCaps,
+		hyphenator:  params.Hyphenation,
+	}
+}
+
+// smallCapsRun is a run of lowercase runes shaped as capitals scaled by
+// scale.
+type smallCapsRun struct {
+	runes Range
+	scale float32
+}
+
+// defaultMaxRunGlyphs is the default cap on the number of glyphs of a run.
+const defaultMaxRunGlyphs = 4096
+
+// faceRange is a FaceRange resolved to the face used for shaping.
+type faceRange struct {
+	runes      Range
+	face       font.Face
+	decoration Decoration
+}
+
+// spanRange is a TextSpan resolved to the faces for shaping its runes.
+type spanRange struct {
+	runes  Range
+	font   Font
+	faces  []font.Face
+	size   fixed.Int26_6
+	object InlineObject
 }
 
 // Load registers the provided FontFace with the shaper, if it is compatible.
@@ -257,6 +1024,129 @@ type shaperImpl struct {
 // in the order in which they are loaded, with the first face being the default.
 func (s *shaperImpl) Load(f FontFace) {
 	s.orderer.insert(f.Font, f.Face.Face())
+	s.faceLoaded(f)
+}
+
+// LoadLazy registers fnt with the shaper like Load, but defers calling load
+// for its face until the face is chosen for shaping text. Faces that fail to
+// load are skipped.
+func (s *shaperImpl) LoadLazy(fnt Font, load func() (Face, error)) {
+	s.orderer.insertLazy(fnt, load)
+	s.orderer.loaded = s.faceLoaded
+	s.runs.Clear()
+}
+
+// faceLoaded prepares the shaper for shaping with the newly loaded face f.
+func (s *shaperImpl) faceLoaded(f FontFace) {
+	s.loadColors(f)
+	// Loaded faces may change the faces resolved for text.
+	s.runs.Clear()
+}
+
+// loadColors loads the color glyphs of f, if any.
+func (s *shaperImpl) loadColors(f FontFace) {
+	t, ok := f.Face.(tableFace)
+	if !ok {
+		return
+	}
+	if c := loadColorFace(t); c != nil {
+		if s.colors == nil {
+			s.colors = make(map[font.Face]*colorFace)
+		}
+		s.colors[f.Face.Face()] = c
+	}
+}
+
+// HasFeature reports whether the face chosen for fnt declares the OpenType
+// feature tag in its GSUB or GPOS tables.
+func (s *shaperImpl) HasFeature(fnt Font, tag Tag) bool {
+	faces := s.orderer.sortedFacesForStyle(fnt)
+	if len(faces) == 0 {
+		return false
+	}
+	return hasFeature(faces[0], tag)
+}
+
+// Metrics describes the vertical metrics of a face at a particular size.
+// Positions are measured upwards from the baseline, so the positions of
+// underlines are typically negative.
+type Metrics struct {
+	// XHeight is the height of lowercase letters such as 'x'.
+	XHeight fixed.Int26_6
+	// CapHeight is the height of capital letters such as 'H'.
+	CapHeight fixed.Int26_6
+	// UnderlinePosition is the position of the top of an underline.
+	UnderlinePosition fixed.Int26_6
+	// UnderlineThickness is the thickness of an underline.
+	UnderlineThickness fixed.Int26_6
+	// StrikethroughPosition is the position of the top of a strikethrough.
+	StrikethroughPosition fixed.Int26_6
+	// StrikethroughThickness is the thickness of a strikethrough.
+	StrikethroughThickness fixed.Int26_6
+}
+
+// Metrics returns the metrics of the face chosen for fnt, scaled to pxPerEm.
+// Metrics missing from the face are zero, except for the x-height and
+// cap-height which are measured from the glyphs of 'x' and 'H'.
+func (s *shaperImpl) Metrics(fnt Font, pxPerEm fixed.Int26_6) Metrics {
+	faces := s.orderer.sortedFacesForStyle(fnt)
+	if len(faces) == 0 {
+		return Metrics{}
+	}
+	return faceMetrics(faces[0], pxPerEm)
+}
+
+// faceMetrics returns the metrics of face scaled to pxPerEm.
+func faceMetrics(face font.Face, pxPerEm fixed.Int26_6) Metrics {
+	toFixed := func(em float32) fixed.Int26_6 {
+		return fixed.Int26_6(math.Round(float64(em * float32(pxPerEm))))
+	}
+	metric := func(m fonts.LineMetric) fixed.Int26_6 {
+		v, ok := face.LineMetric(m)
+		if !ok {
+			return 0
+		}
+		return toFixed(v / float32(face.Upem()))
+	}
+	var m Metrics
+	if h, ok := xHeight(face); ok {
+		m.XHeight = toFixed(h)
+	}
+	if h, ok := capHeight(face); ok {
+		m.CapHeight = toFixed(h)
+	}
+	m.UnderlinePosition = metric(fonts.UnderlinePosition)
+	m.UnderlineThickness = metric(fonts.UnderlineThickness)
+	m.StrikethroughPosition = metric(fonts.StrikethroughPosition)
+	m.StrikethroughThickness = metric(fonts.StrikethroughThickness)
+	return m
+}
+
+// hasFeature reports whether face implements the OpenType feature tag.
+func hasFeature(f font.Face, tag Tag) bool {
+	face, ok := f.(*truetype.Font)
+	if !ok {
+		return false
+	}
+	tables := face.LayoutTables()
+	for _, f := range tables.GSUB.Features {
+		if f.Tag == tag {
+			return true
+		}
+	}
+	for _, f := range tables.GPOS.Features {
+		if f.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// isCommonScript reports whether script is shared by text of any script, like
+// punctuation, or inherits the script of preceding text, like combining marks.
+// Such runes never start a run of their own.
+func isCommonScript(script language.Script) bool {
+	return script == language.Common || script == language.Inherited
 }
 
 // splitByScript divides the inputs into new, smaller inputs on script boundaries
@@ -276,7 +1166,7 @@ func splitByScript(inputs []shaping.Input, documentDir di.Direction, buf []shapi
 		}
 		firstNonCommonRune := input.RunStart
 		for i := firstNonCommonRune; i < input.RunEnd; i++ {
-			if language.LookupScript(input.Text[i]) != language.Common {
+			if !isCommonScript(language.LookupScript(input.Text[i])) {
 				firstNonCommonRune = i
 				break
 			}
@@ -286,7 +1176,7 @@ func splitByScript(inputs []shaping.Input, documentDir di.Direction, buf []shapi
 			r := input.Text[i]
 			runeScript := language.LookupScript(r)
 
-			if runeScript == language.Common || runeScript == currentInput.Script {
+			if isCommonScript(runeScript) || runeScript == currentInput.Script {
 				continue
 			}
 
@@ -334,60 +1224,1652 @@ func (s *shaperImpl) splitBidi(input shaping.Input) []shaping.Input {
 		} else {
 			currentInput.Direction = di.DirectionLTR
 		}
-		splitInputs = append(splitInputs, currentInput)
-		input.RunStart = currentInput.RunEnd
+		splitInputs = append(splitInputs, currentInput)
+		input.RunStart = currentInput.RunEnd
+	}
+	if levels := explicitLevels(input.Text, paragraphLevel(unmapDirection(input.Direction))); levels != nil {
+		splitInputs = splitByLevels(splitInputs, levels)
+	}
+	return splitInputs
+}
+
+// splitByLevels divides the inputs where the explicit embedding levels of
+// their runes change, such that text in different embeddings or isolates is
+// shaped and ordered separately.
+func splitByLevels(inputs []shaping.Input, levels []uint8) []shaping.Input {
+	var split []shaping.Input
+	for _, in := range inputs {
+		for start := in.RunStart; start < in.RunEnd; {
+			end := start + 1
+			for end < in.RunEnd && levels[end] == levels[start] {
+				end++
+			}
+			part := in
+			part.RunStart, part.RunEnd = start, end
+			split = append(split, part)
+			start = end
+		}
+	}
+	return split
+}
+
+// splitByFaces divides the inputs by font coverage in the provided faces. It will use the slice provided in buf
+// as the backing storage of the returned slice if buf is non-nil.
+func (s *shaperImpl) splitByFaces(inputs []shaping.Input, faces []font.Face, buf []shaping.Input) []shaping.Input {
+	var split []shaping.Input
+	if buf == nil {
+		split = make([]shaping.Input, 0, len(inputs))
+	} else {
+		split = buf
+	}
+	for _, input := range inputs {
+		start := len(split)
+		split = append(split, shaping.SplitByFace(input, faceMap{orderer: &s.orderer, faces: faces})...)
+		split = append(split[:start], mergeJoiners(split[start:])...)
+	}
+	return split
+}
+
+// mergeJoiners merges the inputs made only of joiner controls, such as a
+// zero width joiner preceding an Arabic letter, into the input that follows
+// them. Joiners select the joining forms of the letters next to them, so they
+// are shaped with the face of those letters rather than a face of their own.
+func mergeJoiners(inputs []shaping.Input) []shaping.Input {
+	merged := inputs[:0]
+	for i := 0; i < len(inputs); i++ {
+		in := inputs[i]
+		if i+1 < len(inputs) && isJoinerRun(in) {
+			inputs[i+1].RunStart = in.RunStart
+			continue
+		}
+		merged = append(merged, in)
+	}
+	return merged
+}
+
+// isJoinerRun reports whether the runes of input are all U+200C ZERO WIDTH
+// NON-JOINER or U+200D ZERO WIDTH JOINER.
+func isJoinerRun(input shaping.Input) bool {
+	for _, r := range input.Text[input.RunStart:input.RunEnd] {
+		if r != '\u200C' && r != '\u200D' {
+			return false
+		}
+	}
+	return input.RunStart < input.RunEnd
+}
+
+// splitByAssignment divides the inputs on the boundaries of the assigned
+// rune ranges, and sets the face of each resulting input to the face assigned
+// to its runes. Unassigned runes keep the face of their input. It will use the
+// slice provided in buf as the backing storage of the returned slice if buf is
+// non-nil.
+func splitByAssignment(inputs []shaping.Input, assigned []faceRange, buf []shaping.Input) []shaping.Input {
+	split := buf
+	for _, input := range inputs {
+		if input.RunStart == input.RunEnd {
+			split = append(split, input)
+			continue
+		}
+		for start := input.RunStart; start < input.RunEnd; {
+			in := input
+			in.RunStart = start
+			for _, a := range assigned {
+				end := a.runes.Offset + a.runes.Count
+				switch {
+				case a.runes.Offset <= start && start < end:
+					in.Face = a.face
+					if end < in.RunEnd {
+						in.RunEnd = end
+					}
+				case start < a.runes.Offset && a.runes.Offset < in.RunEnd:
+					in.RunEnd = a.runes.Offset
+				}
+			}
+			split = append(split, in)
+			start = in.RunEnd
+		}
+	}
+	return split
+}
+
+// splitBySpans divides the inputs on the boundaries of s.spans, and splits
+// the runes of each span by the glyph coverage of its faces. The resulting
+// inputs are shaped at the size of their span. It will use the slice provided
+// in buf as the backing storage of the returned slice if buf is non-nil.
+func (s *shaperImpl) splitBySpans(inputs []shaping.Input, buf []shaping.Input) []shaping.Input {
+	split := buf
+	for _, input := range inputs {
+		if input.RunStart == input.RunEnd {
+			split = append(split, input)
+			continue
+		}
+		for _, sp := range s.spans {
+			start, end := sp.runes.Offset, sp.runes.Offset+sp.runes.Count
+			if start < input.RunStart {
+				start = input.RunStart
+			}
+			if end > input.RunEnd {
+				end = input.RunEnd
+			}
+			if start >= end || len(sp.faces) == 0 {
+				continue
+			}
+			in := input
+			in.RunStart, in.RunEnd = start, end
+			in.Face = sp.faces[0]
+			in.Size = sp.size
+			n := len(split)
+			split = append(split, shaping.SplitByFace(in, faceMap{orderer: &s.orderer, faces: sp.faces})...)
+			split = append(split[:n], mergeJoiners(split[n:])...)
+		}
+	}
+	return split
+}
+
+// spanAt returns the index of the span of s.spans containing the rune at
+// offset.
+func (s *shaperImpl) spanAt(offset int) int {
+	for i, sp := range s.spans {
+		if sp.runes.Offset <= offset && offset < sp.runes.Offset+sp.runes.Count {
+			return i
+		}
+	}
+	return 0
+}
+
+// shapeText invokes the text shaper and returns the raw text data in the shaper's native
+// format. It does not wrap lines.
+func (s *shaperImpl) shapeText(opts *shapeOptions, faces []font.Face, ppem fixed.Int26_6, lc system.Locale, txt []rune) []shaping.Output {
+	if len(faces) < 1 {
+		return nil
+	}
+	if s.missingGlyph != nil {
+		s.reportMissing(txt)
+	}
+	lcfg := langConfig{
+		Language:  language.NewLanguage(lc.Language),
+		Direction: mapDirection(lc.Direction),
+	}
+	for r := range s.orderer.tries {
+		delete(s.orderer.tries, r)
+	}
+	// Create an initial input.
+	input := toInput(faces[0], ppem, lcfg, txt)
+	// Break input on font glyph coverage.
+	inputs := s.splitBidi(input)
+	switch {
+	case s.spans != nil:
+		inputs = s.splitBySpans(inputs, s.splitScratch1[:0])
+	case s.assigned != nil:
+		inputs = splitByAssignment(inputs, s.assigned, s.splitScratch1[:0])
+	default:
+		inputs = s.splitByFaces(inputs, faces, s.splitScratch1[:0])
+	}
+	if s.overrides != nil {
+		inputs = splitByAssignment(inputs, s.overrides, nil)
+	}
+	inputs = splitByScript(inputs, lcfg.Direction, s.splitScratch2[:0])
+	if s.tofu != nil {
+		inputs = splitTofu(inputs)
+	}
+	inputs = splitGraphemeJoiners(inputs)
+	if opts.sizeAdjust {
+		adjustSizes(inputs, faces[0])
+	}
+	if opts.smallCaps {
+		inputs = opts.synthesizeSmallCaps(inputs)
+	}
+	// Shape all inputs.
+	if needed := len(inputs) - len(s.outScratchBuf); needed > 0 {
+		s.outScratchBuf = slices.Grow(s.outScratchBuf, needed)
+	}
+	s.outScratchBuf = s.outScratchBuf[:len(inputs)]
+	if s.workers > 1 && len(inputs) > 1 && len(txt) >= minConcurrentRunes {
+		s.shapeConcurrently(opts, inputs)
+	} else {
+		for i := range inputs {
+			s.outScratchBuf[i] = s.shapeRun(opts, inputs[i])
+		}
+	}
+	if s.tofu != nil {
+		for i, in := range inputs {
+			if isTofu(in) {
+				s.outScratchBuf[i] = s.shapeTofu(opts, in)
+			}
+		}
+	}
+	if s.observer != nil {
+		for _, in := range inputs {
+			s.observer(RunStats{
+				Runes:      Range{Offset: in.RunStart, Count: in.RunEnd - in.RunStart},
+				FacesTried: s.orderer.facesTried(in),
+			})
+		}
+	}
+	return s.outScratchBuf
+}
+
+// reportMissing notifies s.missingGlyph of the graphic runes of txt missing
+// from every face, except for those it was already notified of. The object
+// replacement characters that hold the place of inline objects are not
+// reported.
+func (s *shaperImpl) reportMissing(txt []rune) {
+	for _, r := range txt {
+		if r == objectReplacement || !unicode.IsGraphic(r) || s.missingSeen[r] || s.orderer.covers(r) {
+			continue
+		}
+		if s.missingSeen == nil {
+			s.missingSeen = make(map[rune]bool)
+		}
+		s.missingSeen[r] = true
+		s.missingGlyph(r)
+	}
+}
+
+// resetMissing forgets the runes reported by reportMissing, so that they are
+// reported again.
+func (s *shaperImpl) resetMissing() {
+	for r := range s.missingSeen {
+		delete(s.missingSeen, r)
+	}
+}
+
+// minConcurrentRunes is the length of the shortest text whose runs are shaped
+// concurrently. Shorter text is shaped faster than goroutines are started.
+const minConcurrentRunes = 2048
+
+// runShaper shapes runs of text. Runs shaped concurrently each need their
+// own runShaper.
+type runShaper struct {
+	buf *harfbuzz.Buffer
+}
+
+// scaleShift matches the precision of shaping.HarfbuzzShaper.
+const scaleShift = 6
+
+// shape shapes input like shaping.HarfbuzzShaper, which doesn't support
+// features, with feats applied in addition to the default features of the
+// shaper.
+func (r *runShaper) shape(input shaping.Input, feats []harfbuzz.Feature) shaping.Output {
+	if r.buf == nil {
+		r.buf = harfbuzz.NewBuffer()
+	} else {
+		r.buf.Clear()
+	}
+	buf := r.buf
+	start, end := input.RunStart, input.RunEnd
+	buf.AddRunes(input.Text, start, end-start)
+	switch input.Direction {
+	case di.DirectionRTL:
+		buf.Props.Direction = harfbuzz.RightToLeft
+	case di.DirectionBTT:
+		buf.Props.Direction = harfbuzz.BottomToTop
+	case di.DirectionTTB:
+		buf.Props.Direction = harfbuzz.TopToBottom
+	default:
+		buf.Props.Direction = harfbuzz.LeftToRight
+	}
+	buf.Props.Language = input.Language
+	buf.Props.Script = input.Script
+	font := harfbuzz.NewFont(input.Face)
+	font.XScale = int32(input.Size.Ceil()) << scaleShift
+	font.YScale = font.XScale
+	buf.Shape(font, feats)
+	glyphs := make([]shaping.Glyph, len(buf.Info))
+	for i := range glyphs {
+		g := buf.Info[i].Glyph
+		glyphs[i] = shaping.Glyph{
+			ClusterIndex: buf.Info[i].Cluster,
+			GlyphID:      g,
+			Mask:         buf.Info[i].Mask,
+		}
+		extents, ok := font.GlyphExtents(g)
+		if !ok {
+			continue
+		}
+		glyphs[i].Width = fixed.I(int(extents.Width)) >> scaleShift
+		glyphs[i].Height = fixed.I(int(extents.Height)) >> scaleShift
+		glyphs[i].XBearing = fixed.I(int(extents.XBearing)) >> scaleShift
+		glyphs[i].YBearing = fixed.I(int(extents.YBearing)) >> scaleShift
+		glyphs[i].XAdvance = fixed.I(int(buf.Pos[i].XAdvance)) >> scaleShift
+		glyphs[i].YAdvance = fixed.I(int(buf.Pos[i].YAdvance)) >> scaleShift
+		glyphs[i].XOffset = fixed.I(int(buf.Pos[i].XOffset)) >> scaleShift
+		glyphs[i].YOffset = fixed.I(int(buf.Pos[i].YOffset)) >> scaleShift
+	}
+	countClusters(glyphs, end, input.Direction)
+	out := shaping.Output{
+		Glyphs:    glyphs,
+		Direction: input.Direction,
+		Face:      input.Face,
+		Size:      input.Size,
+	}
+	extents := font.ExtentsForDirection(buf.Props.Direction)
+	out.LineBounds = shaping.Bounds{
+		Ascent:  fixed.I(int(extents.Ascender)) >> scaleShift,
+		Descent: fixed.I(int(extents.Descender)) >> scaleShift,
+		Gap:     fixed.I(int(extents.LineGap)) >> scaleShift,
+	}
+	out.Runes.Offset = start
+	out.Runes.Count = end - start
+	out.RecalculateAll()
+	return out
+}
+
+// countClusters sets the number of runes and glyphs of the cluster of each
+// glyph, for text of textLen runes.
+func countClusters(glyphs []shaping.Glyph, textLen int, dir di.Direction) {
+	current := -1
+	runes, count := 0, 0
+	previous := textLen
+	for i := range glyphs {
+		c := glyphs[i].ClusterIndex
+		if c != current {
+			count = 1
+			current = c
+			next := textLen
+			for k := i + 1; k < len(glyphs); k++ {
+				if glyphs[k].ClusterIndex != c {
+					next = glyphs[k].ClusterIndex
+					break
+				}
+				count++
+			}
+			switch dir {
+			case di.DirectionLTR:
+				runes = next - current
+			case di.DirectionRTL:
+				runes = previous - current
+			}
+			previous = c
+		}
+		glyphs[i].GlyphCount = count
+		glyphs[i].RuneCount = runes
+	}
+}
+
+// shapeConcurrently shapes inputs into s.outScratchBuf like shapeRun, with
+// the runs missing from the run cache shaped by s.workers goroutines.
+func (s *shaperImpl) shapeConcurrently(opts *shapeOptions, inputs []shaping.Input) {
+	outs := s.outScratchBuf
+	s.pending = s.pending[:0]
+	for i, in := range inputs {
+		if s.runs.size > 0 {
+			if out, ok := s.runs.Get(s.runs.key(in, opts.featuresKey), in); ok {
+				outs[i] = out
+				continue
+			}
+		}
+		s.pending = append(s.pending, i)
+	}
+	n := s.workers
+	if n > len(s.pending) {
+		n = len(s.pending)
+	}
+	for len(s.workerShapers) < n {
+		s.workerShapers = append(s.workerShapers, runShaper{})
+	}
+	var next int32
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for w := 0; w < n; w++ {
+		go func(r *runShaper) {
+			defer wg.Done()
+			for {
+				k := int(atomic.AddInt32(&next, 1)) - 1
+				if k >= len(s.pending) {
+					return
+				}
+				i := s.pending[k]
+				outs[i] = r.shape(inputs[i], opts.features)
+			}
+		}(&s.workerShapers[w])
+	}
+	wg.Wait()
+	if s.runs.size > 0 {
+		for _, i := range s.pending {
+			in := inputs[i]
+			s.runs.Put(s.runs.key(in, opts.featuresKey), in, outs[i])
+		}
+	}
+}
+
+// shapeRun shapes input with the requested features, memoized by the run
+// cache if enabled.
+func (s *shaperImpl) shapeRun(opts *shapeOptions, input shaping.Input) shaping.Output {
+	var key runKey
+	if s.runs.size > 0 {
+		key = s.runs.key(input, opts.featuresKey)
+		if out, ok := s.runs.Get(key, input); ok {
+			return out
+		}
+	}
+	out := s.runShaper.shape(input, opts.features)
+	if s.runs.size > 0 {
+		s.runs.Put(key, input, out)
+	}
+	return out
+}
+
+// graphemeJoiner is U+034F COMBINING GRAPHEME JOINER.
+const graphemeJoiner = '\u034F'
+
+// splitGraphemeJoiners splits inputs after each combining grapheme joiner
+// such that no ligature forms across it. The joiner is invisible and has no
+// width, and stays in the run and cluster of the rune before it. Joiners
+// followed by a combining mark are not split at, to keep the mark with its
+// base. It returns inputs if they have no joiner to split at.
+func splitGraphemeJoiners(inputs []shaping.Input) []shaping.Input {
+	var split []shaping.Input
+	for i, in := range inputs {
+		start := in.RunStart
+		for k := in.RunStart; k < in.RunEnd-1; k++ {
+			if in.Text[k] != graphemeJoiner || unicode.In(in.Text[k+1], unicode.Mn, unicode.Mc, unicode.Me) {
+				continue
+			}
+			if split == nil {
+				split = append(split, inputs[:i]...)
+			}
+			before := in
+			before.RunStart, before.RunEnd = start, k+1
+			split = append(split, before)
+			start = k + 1
+		}
+		if split == nil {
+			continue
+		}
+		rest := in
+		rest.RunStart = start
+		split = append(split, rest)
+	}
+	if split == nil {
+		return inputs
+	}
+	return split
+}
+
+// missingRune reports whether r is displayed with the .notdef glyph of face.
+// Control and format characters, such as joiners and variation selectors,
+// are not displayed.
+func missingRune(face font.Face, r rune) bool {
+	if unicode.IsControl(r) || unicode.In(r, unicode.Cf, unicode.Variation_Selector) {
+		return false
+	}
+	_, ok := face.NominalGlyph(r)
+	return !ok
+}
+
+// isTofu reports whether input is a single rune missing from its face.
+func isTofu(input shaping.Input) bool {
+	return input.RunEnd-input.RunStart == 1 && missingRune(input.Face, input.Text[input.RunStart])
+}
+
+// splitTofu splits inputs such that each rune missing from its face is
+// shaped alone. It returns inputs if no rune is missing.
+func splitTofu(inputs []shaping.Input) []shaping.Input {
+	var split []shaping.Input
+	for i, in := range inputs {
+		start := in.RunStart
+		for k := in.RunStart; k < in.RunEnd; k++ {
+			if !missingRune(in.Face, in.Text[k]) {
+				continue
+			}
+			if split == nil {
+				split = append(split, inputs[:i]...)
+			}
+			if start < k {
+				before := in
+				before.RunStart, before.RunEnd = start, k
+				split = append(split, before)
+			}
+			missing := in
+			missing.RunStart, missing.RunEnd = k, k+1
+			split = append(split, missing)
+			start = k + 1
+		}
+		if split == nil {
+			continue
+		}
+		if start < in.RunEnd {
+			rest := in
+			rest.RunStart = start
+			split = append(split, rest)
+		}
+	}
+	if split == nil {
+		return inputs
+	}
+	return split
+}
+
+// shapeTofu shapes the replacement provided by s.tofu for the rune of input,
+// missing from its face, with the face of s.tofuFont. The glyphs of the
+// replacement form a single cluster representing the rune, and are shaped
+// left to right regardless of the direction of input.
+func (s *shaperImpl) shapeTofu(opts *shapeOptions, input shaping.Input) shaping.Output {
+	faces := s.orderer.sortedFacesForStyle(s.tofuFont)
+	replacement := s.tofu(input.Text[input.RunStart])
+	if len(faces) == 0 || len(replacement) == 0 {
+		return s.shapeRun(opts, input)
+	}
+	lcfg := langConfig{Language: input.Language, Script: language.Common, Direction: di.DirectionLTR}
+	out := s.shape(toInput(faces[0], input.Size, lcfg, replacement), nil)
+	for k := range out.Glyphs {
+		g := &out.Glyphs[k]
+		g.ClusterIndex = input.RunStart
+		g.RuneCount = 1
+		g.GlyphCount = len(out.Glyphs)
+	}
+	out.Runes = shaping.Range{Offset: input.RunStart, Count: 1}
+	return out
+}
+
+// adjustSizes scales the size of the inputs shaped with faces other than
+// primary such that their x-height matches the x-height of primary, after
+// the CSS font-size-adjust property.
+func adjustSizes(inputs []shaping.Input, primary font.Face) {
+	want, ok := xHeight(primary)
+	if !ok {
+		return
+	}
+	for i := range inputs {
+		in := &inputs[i]
+		if in.Face == primary {
+			continue
+		}
+		if got, ok := xHeight(in.Face); ok {
+			in.Size = fixed.Int26_6(float32(in.Size) * want / got)
+		}
+	}
+}
+
+// xHeight returns the x-height of face relative to its em size. It is taken
+// from the font metrics if available, and measured from the glyph for 'x'
+// otherwise.
+func xHeight(face font.Face) (float32, bool) {
+	return glyphHeight(face, fonts.XHeight, 'x')
+}
+
+// capHeight is like xHeight for the height of capital letters, measured from
+// the glyph for 'H'.
+func capHeight(face font.Face) (float32, bool) {
+	return glyphHeight(face, fonts.CapHeight, 'H')
+}
+
+// glyphHeight returns the line metric of face relative to its em size, or the
+// height of the glyph of r if face lacks the metric.
+func glyphHeight(face font.Face, metric fonts.LineMetric, r rune) (float32, bool) {
+	h, ok := face.LineMetric(metric)
+	if !ok || h <= 0 {
+		gid, found := face.NominalGlyph(r)
+		if !found {
+			return 0, false
+		}
+		ext, found := face.GlyphExtents(gid, 0, 0)
+		if !found || ext.YBearing <= 0 {
+			return 0, false
+		}
+		h = ext.YBearing
+	}
+	return h / float32(face.Upem()), true
+}
+
+// synthesizeSmallCaps splits the inputs whose face lacks small capitals into
+// runs of lowercase and other runes, and shapes the lowercase runs as
+// capitals scaled to the x-height of the face. The synthesized runs are
+// recorded in o.smallCapsRuns. Combining marks stay in the run of their base.
+func (o *shapeOptions) synthesizeSmallCaps(inputs []shaping.Input) []shaping.Input {
+	var split []shaping.Input
+	var capitals []rune
+	for _, in := range inputs {
+		if hasFeature(in.Face, tagSmallCaps) {
+			split = append(split, in)
+			continue
+		}
+		x, ok := xHeight(in.Face)
+		h, ok2 := capHeight(in.Face)
+		if !ok || !ok2 {
+			split = append(split, in)
+			continue
+		}
+		scale := x / h
+		if capitals == nil {
+			capitals = make([]rune, len(in.Text))
+			for i, r := range in.Text {
+				capitals[i] = unicode.ToUpper(r)
+			}
+		}
+		for start := in.RunStart; start < in.RunEnd; {
+			lower := unicode.IsLower(in.Text[start])
+			end := start + 1
+			for end < in.RunEnd && (unicode.IsLower(in.Text[end]) == lower || unicode.Is(unicode.Mn, in.Text[end])) {
+				end++
+			}
+			part := in
+			part.RunStart, part.RunEnd = start, end
+			if lower {
+				part.Text = capitals
+				part.Size = fixed.Int26_6(float32(in.Size) * scale)
+				o.smallCapsRuns = append(o.smallCapsRuns, smallCapsRun{
+					runes: Range{Offset: start, Count: end - start},
+					scale: scale,
+				})
+			}
+			split = append(split, part)
+			start = end
+		}
+	}
+	return split
+}
+
+// smallCapsScale returns the scale of the synthesized small capitals of the
+// runes in [start, end), or zero if they are not synthesized.
+func (o *shapeOptions) smallCapsScale(start, end int) float32 {
+	for _, r := range o.smallCapsRuns {
+		if r.runes.Offset < end && start < r.runes.Offset+r.runes.Count {
+			return r.scale
+		}
+	}
+	return 0
+}
+
+// dottedCircle is the placeholder base for combining marks lacking one.
+const dottedCircle = '\u25CC'
+
+// shapeWithDottedCircle shapes txt, which must start with a combining mark,
+// with a dotted circle inserted before the mark. The returned outputs
+// describe txt itself: the inserted base is merged into the cluster of the
+// mark and accounts for no runes. If circleFace is not nil, the dotted circle
+// and the leading marks are shaped with it.
+func (s *shaperImpl) shapeWithDottedCircle(opts *shapeOptions, faces []font.Face, circleFace font.Face, ppem fixed.Int26_6, lc system.Locale, txt []rune) []shaping.Output {
+	s.markScratch = append(s.markScratch[:0], dottedCircle)
+	s.markScratch = append(s.markScratch, txt...)
+	if circleFace != nil {
+		n := 1
+		for n < len(s.markScratch) && unicode.Is(unicode.M, s.markScratch[n]) {
+			n++
+		}
+		s.overrides = []faceRange{{runes: Range{Count: n}, face: circleFace}}
+	}
+	outs := s.shapeText(opts, faces, ppem, lc, s.markScratch)
+	s.overrides = nil
+	for i := range outs {
+		out := &outs[i]
+		out.Runes.Offset--
+		if out.Runes.Offset < 0 {
+			out.Runes.Offset = 0
+			out.Runes.Count--
+		}
+		for k := range out.Glyphs {
+			g := &out.Glyphs[k]
+			if g.ClusterIndex == 0 {
+				g.RuneCount--
+			} else {
+				g.ClusterIndex--
+			}
+		}
+	}
+	return outs
+}
+
+// startsWithMark reports whether txt begins with a combining mark.
+func startsWithMark(txt []rune) bool {
+	return len(txt) > 0 && unicode.Is(unicode.M, txt[0])
+}
+
+// punctuationSubstitutes maps punctuation to similar looking runes that are
+// supported by more fonts.
+var punctuationSubstitutes = map[rune]rune{
+	'\u2010': '-',  // Hyphen.
+	'\u2011': '-',  // Non-breaking hyphen.
+	'\u2012': '-',  // Figure dash.
+	'\u2013': '-',  // En dash.
+	'\u2014': '-',  // Em dash.
+	'\u2015': '-',  // Horizontal bar.
+	'\u2212': '-',  // Minus sign.
+	'\u2018': '\'', // Left single quotation mark.
+	'\u2019': '\'', // Right single quotation mark.
+	'\u201C': '"',  // Left double quotation mark.
+	'\u201D': '"',  // Right double quotation mark.
+	'\u2032': '\'', // Prime.
+	'\u2033': '"',  // Double prime.
+}
+
+// substitutePunctuation replaces the runes of txt that are missing from
+// primary with their entry in punctuationSubstitutes, if primary supports it.
+func substitutePunctuation(primary font.Face, txt []rune) {
+	for i, r := range txt {
+		sub, ok := punctuationSubstitutes[r]
+		if !ok {
+			continue
+		}
+		if _, ok := primary.NominalGlyph(r); ok {
+			continue
+		}
+		if _, ok := primary.NominalGlyph(sub); ok {
+			txt[i] = sub
+		}
+	}
+}
+
+// quotationMarks lists the opening and closing primary (double) and
+// secondary (single) quotation marks of languages.
+type quotationMarks struct {
+	open, close, openSingle, closeSingle rune
+}
+
+// localeQuotes maps base language tags to their quotation marks. Other
+// languages use the English marks.
+var localeQuotes = map[string]quotationMarks{
+	"en": {'“', '”', '‘', '’'},
+	"de": {'„', '“', '‚', '‘'},
+	"fr": {'«', '»', '‹', '›'},
+	"it": {'«', '»', '“', '”'},
+	"es": {'«', '»', '“', '”'},
+	"ru": {'«', '»', '„', '“'},
+	"pl": {'„', '”', '«', '»'},
+	"nl": {'“', '”', '‘', '’'},
+	"sv": {'”', '”', '’', '’'},
+	"da": {'»', '«', '›', '‹'},
+	"ja": {'「', '」', '『', '』'},
+	"zh": {'“', '”', '‘', '’'},
+}
+
+// substituteQuotes replaces the ASCII quotation marks and apostrophes of txt
+// with the quotation marks of the language of lc. A mark is opening if it
+// starts the text or follows whitespace or opening punctuation, and closing
+// otherwise, so apostrophes within words become closing marks. Runes are
+// replaced one for one, so rune offsets are unchanged.
+func substituteQuotes(lc system.Locale, txt []rune) {
+	lang := strings.ToLower(lc.Language)
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+	marks, ok := localeQuotes[lang]
+	if !ok {
+		marks = localeQuotes["en"]
+	}
+	for i, r := range txt {
+		if r != '"' && r != '\'' {
+			continue
+		}
+		opening := i == 0 || unicode.IsSpace(txt[i-1]) ||
+			unicode.In(txt[i-1], unicode.Ps, unicode.Pi) || txt[i-1] == marks.open || txt[i-1] == marks.openSingle
+		switch {
+		case r == '"' && opening:
+			txt[i] = marks.open
+		case r == '"':
+			txt[i] = marks.close
+		case opening:
+			txt[i] = marks.openSingle
+		default:
+			txt[i] = marks.closeSingle
+		}
+	}
+}
+
+// tabulateSeparators gives the glyphs of the runes of txt listed in seps the
+// advance of the digit zero of their face. The glyphs are centered in their
+// new advance.
+func tabulateSeparators(outs []shaping.Output, txt []rune, seps string) {
+	for i := range outs {
+		out := &outs[i]
+		zero, ok := out.Face.NominalGlyph('0')
+		if !ok {
+			continue
+		}
+		figure := fixed.Int26_6(out.Face.HorizontalAdvance(zero) * float32(out.Size) / float32(out.Face.Upem()))
+		for k := range out.Glyphs {
+			g := &out.Glyphs[k]
+			if g.RuneCount != 1 || g.GlyphCount != 1 || !strings.ContainsRune(seps, txt[g.ClusterIndex]) {
+				continue
+			}
+			delta := figure - g.XAdvance
+			g.XAdvance = figure
+			g.XOffset += delta / 2
+			out.Advance += delta
+		}
+	}
+}
+
+// objectReplacement is the rune reserving space for an inline object.
+const objectReplacement = '\uFFFC'
+
+// spaceLetters adds spacing to the advance of every cluster of outs, for
+// paragraphs of n runes. Negative spacing reduces the advance of clusters to
+// at most zero. The spacing added to each cluster is recorded in
+// s.letterSpacing.
+func (s *shaperImpl) spaceLetters(outs []shaping.Output, n int, spacing fixed.Int26_6) {
+	s.letterSpacing = append(s.letterSpacing[:0], make([]fixed.Int26_6, n)...)
+	for i := range outs {
+		out := &outs[i]
+		for start := 0; start < len(out.Glyphs); {
+			cluster := out.Glyphs[start].ClusterIndex
+			end := start
+			var advance fixed.Int26_6
+			for ; end < len(out.Glyphs) && out.Glyphs[end].ClusterIndex == cluster; end++ {
+				advance += out.Glyphs[end].XAdvance
+			}
+			d := spacing
+			if advance+d < 0 {
+				d = -advance
+			}
+			// Add the spacing to the rightmost glyph of the cluster, so that
+			// it separates the cluster from its right neighbour in both
+			// directions.
+			out.Glyphs[end-1].XAdvance += d
+			if cluster < n {
+				s.letterSpacing[cluster] = d
+			}
+			start = end
+		}
+		out.RecomputeAdvance()
+	}
+}
+
+// spaceWords adds spacing to the advance of the clusters of outs that
+// represent breaking spaces of txt. Like letter spacing, negative spacing
+// reduces the advance of spaces to at most zero.
+func spaceWords(outs []shaping.Output, txt []rune, spacing fixed.Int26_6) {
+	for i := range outs {
+		out := &outs[i]
+		for start := 0; start < len(out.Glyphs); {
+			cluster := out.Glyphs[start].ClusterIndex
+			end := start
+			var advance fixed.Int26_6
+			for ; end < len(out.Glyphs) && out.Glyphs[end].ClusterIndex == cluster; end++ {
+				advance += out.Glyphs[end].XAdvance
+			}
+			if cluster < len(txt) && isBreakingSpace(txt[cluster]) {
+				d := spacing
+				if advance+d < 0 {
+					d = -advance
+				}
+				out.Glyphs[end-1].XAdvance += d
+			}
+			start = end
+		}
+		out.RecomputeAdvance()
+	}
+}
+
+// isBreakingSpace reports whether r is a space separator at which lines may
+// be broken, unlike no-break spaces such as U+00A0.
+func isBreakingSpace(r rune) bool {
+	switch r {
+	case '\u00A0', '\u2007', '\u202F':
+		return false
+	}
+	return unicode.Is(unicode.Zs, r)
+}
+
+// trimLetterSpacing removes the letter spacing after the visually final
+// cluster of l, so that spacing is only present between clusters.
+func (s *shaperImpl) trimLetterSpacing(l *line) {
+	if len(l.visualOrder) == 0 {
+		return
+	}
+	run := &l.runs[l.visualOrder[len(l.visualOrder)-1]]
+	if len(run.Glyphs) == 0 {
+		return
+	}
+	g := &run.Glyphs[len(run.Glyphs)-1]
+	// The glyphs of a truncator account for no runes and are not spaced.
+	if g.clusterIndex >= len(s.letterSpacing) || g.runeCount == 0 {
+		return
+	}
+	d := s.letterSpacing[g.clusterIndex]
+	g.xAdvance -= d
+	run.Advance -= d
+	l.width -= d
+	l.bounds.Max.X -= d
+}
+
+// justifyLine widens the breaking spaces of l such that its width is
+// maxWidth. Trailing spaces are given zero advance so that the visible text
+// reaches the end of the line. The hyphen ending a line broken at a soft
+// hyphen is content like any other glyph, so it ends at the edge of the line
+// and the spaces fill the width before it. Lines without inner spaces are
+// left as is.
+func justifyLine(l *line, txt []rune, maxWidth int) {
+	isSpace := func(g glyph) bool {
+		return g.clusterIndex < len(txt) && isBreakingSpace(txt[g.clusterIndex])
+	}
+	// The end of the visible text in logical order.
+	contentEnd := -1
+	for _, run := range l.runs {
+		for _, g := range run.Glyphs {
+			if g.clusterIndex < len(txt) && !isSpace(g) && g.clusterIndex > contentEnd {
+				contentEnd = g.clusterIndex
+			}
+		}
+	}
+	var spaces []*glyph
+	delta := fixed.Int26_6(0)
+	for r := range l.runs {
+		run := &l.runs[r]
+		for k := range run.Glyphs {
+			g := &run.Glyphs[k]
+			if !isSpace(*g) {
+				continue
+			}
+			if g.clusterIndex > contentEnd {
+				run.Advance -= g.xAdvance
+				delta -= g.xAdvance
+				g.xAdvance = 0
+				continue
+			}
+			if k > 0 && run.Glyphs[k-1].clusterIndex == g.clusterIndex {
+				continue
+			}
+			spaces = append(spaces, g)
+		}
+	}
+	if extra := fixed.I(maxWidth) - (l.width + delta); extra > 0 && len(spaces) > 0 {
+		n := fixed.Int26_6(len(spaces))
+		per, rem := extra/n, extra%n
+		for i, g := range spaces {
+			g.xAdvance += per
+			if fixed.Int26_6(i) < rem {
+				g.xAdvance++
+			}
+		}
+		delta += extra
+		for r := range l.runs {
+			run := &l.runs[r]
+			run.Advance = 0
+			for _, g := range run.Glyphs {
+				run.Advance += g.xAdvance
+			}
+		}
+	}
+	if delta == 0 {
+		return
+	}
+	l.width += delta
+	l.bounds.Max.X += delta
+	x := fixed.Int26_6(0)
+	for _, runIdx := range l.visualOrder {
+		l.runs[runIdx].X = x
+		x += l.runs[runIdx].Advance
+	}
+}
+
+// tatweel is U+0640 ARABIC TATWEEL, which elongates the connection between
+// joined letters.
+const tatweel = '\u0640'
+
+// elongate inserts tatweel glyphs at the connections between the joined
+// letters of l, such that its content is as close to maxWidth as whole
+// tatweels allow. The tatweels are spread evenly across the connections and
+// join the cluster of the letter before the connection. Runs whose face
+// lacks a tatweel are not elongated.
+func (s *shaperImpl) elongate(l shaping.Line, txt []rune, maxWidth int, lc system.Locale) shaping.Line {
+	type connection struct {
+		run, cluster int
+		tatweel      shaping.Glyph
+		count        int
+	}
+	isSpace := func(g shaping.Glyph) bool {
+		return g.ClusterIndex < len(txt) && isBreakingSpace(txt[g.ClusterIndex])
+	}
+	// The end of the visible text in logical order. Trailing spaces are
+	// given zero advance by justifyLine.
+	contentEnd := -1
+	for _, run := range l {
+		for _, g := range run.Glyphs {
+			if !isSpace(g) && g.ClusterIndex > contentEnd {
+				contentEnd = g.ClusterIndex
+			}
+		}
+	}
+	var conns []connection
+	var width fixed.Int26_6
+	for r, run := range l {
+		for _, g := range run.Glyphs {
+			if g.ClusterIndex <= contentEnd || !isSpace(g) {
+				width += g.XAdvance
+			}
+		}
+		end := run.Runes.Offset + run.Runes.Count
+		var tatweelGlyph shaping.Glyph
+		shaped := false
+		prev := -1
+		for _, g := range run.Glyphs {
+			// The glyphs of a cluster are adjacent.
+			if g.ClusterIndex == prev {
+				continue
+			}
+			prev = g.ClusterIndex
+			next := g.ClusterIndex + g.RuneCount
+			if next >= end || !joinsConnection(txt, g.ClusterIndex, next) {
+				continue
+			}
+			if !shaped {
+				if _, ok := run.Face.NominalGlyph(tatweel); !ok {
+					break
+				}
+				var ok bool
+				if tatweelGlyph, ok = s.shapeRune(run, lc, tatweel); !ok || tatweelGlyph.XAdvance <= 0 {
+					break
+				}
+				shaped = true
+			}
+			conns = append(conns, connection{run: r, cluster: g.ClusterIndex, tatweel: tatweelGlyph})
+		}
+	}
+	// Connections are visited in logical order.
+	sort.Slice(conns, func(i, j int) bool { return conns[i].cluster < conns[j].cluster })
+	slack := fixed.I(maxWidth) - width
+	for added := true; added; {
+		added = false
+		for i := range conns {
+			c := &conns[i]
+			if c.tatweel.XAdvance > slack {
+				continue
+			}
+			slack -= c.tatweel.XAdvance
+			c.count++
+			added = true
+		}
+	}
+	for _, c := range conns {
+		if c.count == 0 {
+			continue
+		}
+		run := &l[c.run]
+		// The next letter is visually after the cluster in left-to-right
+		// runs and before it in right-to-left runs.
+		first, last := -1, -1
+		var base shaping.Glyph
+		for k, g := range run.Glyphs {
+			if g.ClusterIndex == c.cluster {
+				if first == -1 {
+					first = k
+				}
+				last, base = k, g
+			}
+		}
+		at := last + 1
+		if run.Direction.Progression() == di.TowardTopLeft {
+			at = first
+		}
+		t := c.tatweel
+		t.ClusterIndex, t.RuneCount, t.GlyphCount = c.cluster, base.RuneCount, base.GlyphCount+c.count
+		glyphs := make([]shaping.Glyph, 0, len(run.Glyphs)+c.count)
+		glyphs = append(glyphs, run.Glyphs[:at]...)
+		for k := 0; k < c.count; k++ {
+			glyphs = append(glyphs, t)
+		}
+		glyphs = append(glyphs, run.Glyphs[at:]...)
+		for k := range glyphs {
+			if glyphs[k].ClusterIndex == c.cluster {
+				glyphs[k].GlyphCount = t.GlyphCount
+			}
+		}
+		run.Glyphs = glyphs
+		run.Advance += fixed.Int26_6(c.count) * t.XAdvance
+	}
+	return l
+}
+
+// joinsConnection reports whether the letters of the cluster of txt in
+// [start, end) and the letter at end are joined, such that the connection
+// between them may be elongated by a tatweel.
+func joinsConnection(txt []rune, start, end int) bool {
+	if end >= len(txt) {
+		return false
+	}
+	// Transparent runes, such as vowel marks, don't affect joining.
+	before := unicodedata.T
+	for i := end - 1; i >= start && before == unicodedata.T; i-- {
+		before = unicodedata.ArabicJoinings[txt[i]]
+	}
+	switch before {
+	case unicodedata.D, unicodedata.L:
+	default:
+		return false
+	}
+	switch unicodedata.ArabicJoinings[txt[end]] {
+	case unicodedata.D, unicodedata.R, unicodedata.Alaph, unicodedata.DalathRish:
+		return true
+	}
+	return false
+}
+
+// round rounds v to a whole pixel according to mode.
+func (mode RoundMode) round(v fixed.Int26_6) fixed.Int26_6 {
+	switch mode {
+	case RoundFloor:
+		return v &^ 63
+	case RoundNearest:
+		return (v + 32) &^ 63
+	case RoundCeil:
+		return (v + 63) &^ 63
+	default:
+		return v
+	}
+}
+
+// snapAdvances snaps the glyph advances of l to whole pixels. Each glyph
+// ends at its unsnapped position rounded by mode, which bounds the error of
+// every position to a pixel.
+func snapAdvances(l *line, mode RoundMode) {
+	var exact, snapped fixed.Int26_6
+	for _, runIdx := range l.visualOrder {
+		run := &l.runs[runIdx]
+		run.X = snapped
+		run.Advance = 0
+		for k := range run.Glyphs {
+			g := &run.Glyphs[k]
+			exact += g.xAdvance
+			end := mode.round(exact)
+			g.xAdvance = end - snapped
+			run.Advance += g.xAdvance
+			snapped = end
+		}
+	}
+	l.bounds.Max.X += snapped - l.width
+	l.width = snapped
+}
+
+// SnapClusters moves the glyph clusters of each line to the positions of
+// grid, which are relative to the start of the line and sorted in increasing
+// order. The first cluster of a line stays at its start, and every following
+// cluster moves to the grid position nearest to its natural position that
+// is after the position of the visually preceding cluster. The difference
+// is added to the advance of the preceding cluster. Clusters past the last
+// usable grid position keep their natural advances, as do clusters without
+// advance, such as synthetic newlines. SnapClusters returns the resulting
+// advances of the clusters of all lines, in visual order.
+func (l *document) SnapClusters(grid []fixed.Int26_6) []fixed.Int26_6 {
+	var advances []fixed.Int26_6
+	for i := range l.lines {
+		advances = snapLineClusters(&l.lines[i], grid, advances)
+	}
+	// Snapping changes the widths of the lines.
+	l.alignWidth = alignWidth(l.minWidth, l.lines)
+	return advances
+}
+
+// snapLineClusters snaps the clusters of ln to grid, as described by
+// SnapClusters, and appends their advances to advances. The runs and glyphs
+// of ln are copied before they are modified, because they may be shared
+// with the layout cache.
+func snapLineClusters(ln *line, grid []fixed.Int26_6, advances []fixed.Int26_6) []fixed.Int26_6 {
+	type cluster struct {
+		run, last  int
+		x, advance fixed.Int26_6
+	}
+	var clusters []cluster
+	for _, runIdx := range ln.visualOrder {
+		run := ln.runs[runIdx]
+		forEachCluster(run, func(_, glyphs Range, x, advance fixed.Int26_6) {
+			if advance == 0 || glyphs.Count == 0 {
+				return
+			}
+			clusters = append(clusters, cluster{run: runIdx, last: glyphs.Offset + glyphs.Count - 1, x: run.X + x, advance: advance})
+		})
+	}
+	if len(clusters) == 0 {
+		return advances
+	}
+	ln.runs = append([]runLayout(nil), ln.runs...)
+	for i := range ln.runs {
+		ln.runs[i].Glyphs = append([]glyph(nil), ln.runs[i].Glyphs...)
+	}
+	pos := clusters[0].x
+	next := sort.Search(len(grid), func(i int) bool { return grid[i] > pos })
+	for i := 1; i <= len(clusters); i++ {
+		prev := clusters[i-1]
+		end := pos + prev.advance
+		if i < len(clusters) && next < len(grid) {
+			want := clusters[i].x
+			k := next + sort.Search(len(grid)-next, func(j int) bool { return grid[next+j] >= want })
+			if k == len(grid) || (k > next && want-grid[k-1] <= grid[k]-want) {
+				k--
+			}
+			end = grid[k]
+			next = k + 1
+		}
+		adv := end - pos
+		ln.runs[prev.run].Glyphs[prev.last].xAdvance += adv - prev.advance
+		advances = append(advances, adv)
+		pos = end
+	}
+	var x fixed.Int26_6
+	for _, runIdx := range ln.visualOrder {
+		run := &ln.runs[runIdx]
+		run.X = x
+		run.Advance = 0
+		for _, g := range run.Glyphs {
+			run.Advance += g.xAdvance
+		}
+		x += run.Advance
+	}
+	ln.bounds.Max.X += x - ln.width
+	ln.width = x
+	return advances
+}
+
+// fadeLine fades out the glyphs of l within distance of its end, the right
+// edge of left-to-right lines and the left edge of right-to-left lines. The
+// fade of each glyph increases linearly with the position of its center,
+// from opaque at distance to transparent at the end of the line.
+func fadeLine(l *line, distance fixed.Int26_6) {
+	rtl := l.direction.Progression() == system.TowardOrigin
+	for _, runIdx := range l.visualOrder {
+		run := &l.runs[runIdx]
+		x := run.X
+		for k := range run.Glyphs {
+			g := &run.Glyphs[k]
+			center := x + g.xAdvance/2
+			x += g.xAdvance
+			d := l.width - center
+			if rtl {
+				d = center
+			}
+			if d >= distance {
+				continue
+			}
+			if d < 0 {
+				d = 0
+			}
+			g.fade = uint8(255 - int64(d)*255/int64(distance))
+		}
+	}
+}
+
+// placeholderGID is the glyph id of placeholders for inline objects. It
+// matches no glyph of any face.
+const placeholderGID = font.GID(1<<gidbits - 1)
+
+// controlGID is the glyph id of the markers of bidi controls. Like
+// placeholderGID, it matches no glyph of any face.
+const controlGID = placeholderGID - 1
+
+// markBidiControls replaces the glyphs of the bidi controls of txt, which
+// only direct the bidi algorithm, with markers of no width and no outline,
+// regardless of how faces display the controls.
+func markBidiControls(outs []shaping.Output, txt []rune) {
+	for i := range outs {
+		out := &outs[i]
+		marked := false
+		for k := range out.Glyphs {
+			g := &out.Glyphs[k]
+			if g.RuneCount != 1 || g.ClusterIndex >= len(txt) || !isBidiControl(txt[g.ClusterIndex]) {
+				continue
+			}
+			*g = shaping.Glyph{
+				GlyphID:      controlGID,
+				ClusterIndex: g.ClusterIndex,
+				RuneCount:    1,
+				GlyphCount:   1,
+			}
+			marked = true
+		}
+		if marked {
+			out.RecomputeAdvance()
+		}
+	}
+}
+
+// reserveObjects replaces the glyphs of the inline objects of the text
+// with placeholders covering the objects. objectAt returns the object at a
+// rune offset, if any.
+func reserveObjects(outs []shaping.Output, objectAt func(offset int) (InlineObject, bool)) {
+	for i := range outs {
+		out := &outs[i]
+		for k := range out.Glyphs {
+			g := &out.Glyphs[k]
+			if g.RuneCount != 1 {
+				continue
+			}
+			obj, ok := objectAt(g.ClusterIndex)
+			if !ok {
+				continue
+			}
+			out.Advance += obj.Width - g.XAdvance
+			*g = shaping.Glyph{
+				GlyphID:      placeholderGID,
+				ClusterIndex: g.ClusterIndex,
+				RuneCount:    1,
+				GlyphCount:   1,
+				XAdvance:     obj.Width,
+				Width:        obj.Width,
+				YBearing:     obj.Ascent,
+				Height:       -(obj.Ascent + obj.Descent),
+			}
+		}
+	}
+}
+
+// reserveObjectHeight raises the ascent and descent of l to fit the objects
+// placed in it. objectAt returns the object at a rune offset, if any.
+func reserveObjectHeight(l *line, objectAt func(offset int) (InlineObject, bool)) {
+	for _, run := range l.runs {
+		for _, g := range run.Glyphs {
+			if _, _, gid := splitGlyphID(g.id); gid != placeholderGID || g.glyphCount == 0 {
+				continue
+			}
+			obj, ok := objectAt(g.clusterIndex)
+			if !ok {
+				continue
+			}
+			if l.ascent < obj.Ascent {
+				l.ascent = obj.Ascent
+			}
+			if l.descent < obj.Descent {
+				l.descent = obj.Descent
+			}
+			if l.bounds.Min.Y > -obj.Ascent {
+				l.bounds.Min.Y = -obj.Ascent
+			}
+			if l.bounds.Max.Y < obj.Descent {
+				l.bounds.Max.Y = obj.Descent
+			}
+		}
+	}
+}
+
+// spanObject returns the inline object of the span at offset, if any.
+func (s *shaperImpl) spanObject(offset int) (InlineObject, bool) {
+	obj := s.spans[s.spanAt(offset)].object
+	return obj, obj != (InlineObject{})
+}
+
+// shapeAndWrapText invokes the text shaper and returns wrapped lines in the shaper's native format.
+func (s *shaperImpl) shapeAndWrapText(opts *shapeOptions, faces []font.Face, params Parameters, maxWidth int, lc system.Locale, txt []rune) []shaping.Line {
+	if params.SubstitutePunctuation && len(faces) > 0 {
+		substitutePunctuation(faces[0], txt)
+	}
+	var outs []shaping.Output
+	if params.DottedCircle && startsWithMark(txt) {
+		var circleFace font.Face
+		if params.DottedCircleFont != (Font{}) {
+			if fnt, ok := s.orderer.fontForStyle(params.DottedCircleFont); ok {
+				circleFace = s.orderer.face(fnt)
+			}
+		}
+		outs = s.shapeWithDottedCircle(opts, faces, circleFace, params.PxPerEm, lc, txt)
+	} else {
+		outs = s.shapeText(opts, faces, params.PxPerEm, lc, txt)
+	}
+	if params.Synthesize && params.Font.Weight >= SemiBold {
+		s.emboldenAdvances(outs)
+	}
+	if params.StemDarkening > 0 {
+		darkenAdvances(outs, params.StemDarkening)
+	}
+	if params.GridCell > 0 {
+		snapToGrid(outs, txt, params.GridCell, params.AmbiguousWidth.wide(lc))
+	}
+	if params.TabularSeparators != "" {
+		tabulateSeparators(outs, txt, params.TabularSeparators)
+	}
+	tabs := tabWidth(params, faces)
+	if tabs > 0 {
+		reserveTabs(outs, txt, tabs)
+	}
+	markBidiControls(outs, txt)
+	if params.ObjectSize != (fixed.Point26_6{}) {
+		obj := InlineObject{Width: params.ObjectSize.X, Ascent: params.ObjectSize.Y}
+		reserveObjects(outs, func(offset int) (InlineObject, bool) {
+			return obj, txt[offset] == objectReplacement
+		})
+	}
+	if s.spans != nil {
+		reserveObjects(outs, s.spanObject)
+	}
+	if params.LetterSpacing != 0 {
+		s.spaceLetters(outs, len(txt), params.LetterSpacing)
+	}
+	if params.WordSpacing != 0 {
+		spaceWords(outs, txt, params.WordSpacing)
+	}
+	opts.softHyphens = s.shapeSoftHyphens(outs, txt, lc)
+	opts.hyphenLocale = lc
+	// Wrap outputs into lines.
+	var lines []shaping.Line
+	if policy := params.WrapPolicy; policy != WrapWords || opts.softHyphens != nil || opts.hyphenator != nil {
+		// Only wrapLines accounts for the hyphens of soft hyphen breaks and
+		// hyphenates words.
+		lines = s.wrapLines(opts, maxWidth, params.MaxLines, txt, policy, outs)
+		showSoftHyphens(lines, opts.softHyphens)
+		s.insertHyphens(opts, lines)
+	} else {
+		lines = s.wrapper.WrapParagraph(shaping.WrapConfig{
+			TruncateAfterLines: params.MaxLines,
+		}, maxWidth, txt, outs...)
+	}
+	if tabs > 0 {
+		for _, l := range lines {
+			expandTabs(l, txt, tabs, params.TabOrigin)
+		}
+	}
+	maxGlyphs := s.maxRunGlyphs
+	if maxGlyphs == 0 {
+		maxGlyphs = defaultMaxRunGlyphs
+	}
+	for i, l := range lines {
+		lines[i] = splitLongRuns(l, maxGlyphs)
+	}
+	return lines
+}
+
+// defaultTabSpaces is the number of spaces between tab stops if neither
+// TabWidth nor TabSpaces is set.
+const defaultTabSpaces = 8
+
+// tabWidth returns the distance between the tab stops of params. Unless
+// TabWidth is set, it is the advance of TabSpaces spaces of the primary face.
+// It returns zero if tabs should keep the advance of their glyph.
+func tabWidth(params Parameters, faces []font.Face) fixed.Int26_6 {
+	if params.TabWidth > 0 {
+		return params.TabWidth
+	}
+	spaces := params.TabSpaces
+	if spaces == 0 {
+		spaces = defaultTabSpaces
+	}
+	if spaces < 0 || len(faces) == 0 {
+		return 0
+	}
+	face := faces[0]
+	gid, ok := face.NominalGlyph(' ')
+	if !ok {
+		return 0
+	}
+	// Match the scale of the shaper.
+	scale := float32(params.PxPerEm.Ceil()<<6) / float32(face.Upem())
+	space := fixed.Int26_6(math.Round(float64(face.HorizontalAdvance(gid) * scale)))
+	return fixed.Int26_6(spaces) * space
+}
+
+// softHyphen marks a line break opportunity within a word. It is invisible
+// unless a line is broken at it, in which case a hyphen is displayed.
+const softHyphen = '\u00AD'
+
+// shapeSoftHyphens returns the hyphen glyphs displayed for the soft hyphens
+// of txt if lines are broken at them, keyed by rune offset. The hyphens are
+// shaped with the face and size of the runs of the soft hyphens. It returns
+// nil if txt has no soft hyphens.
+func (s *shaperImpl) shapeSoftHyphens(outs []shaping.Output, txt []rune, lc system.Locale) map[int]shaping.Glyph {
+	var hyphens map[int]shaping.Glyph
+	for _, out := range outs {
+		var hyphen shaping.Glyph
+		shaped := false
+		for _, g := range out.Glyphs {
+			if txt[g.ClusterIndex] != softHyphen || g.RuneCount != 1 {
+				continue
+			}
+			if !shaped {
+				var ok bool
+				if hyphen, ok = s.shapeHyphen(out, lc); !ok {
+					break
+				}
+				shaped = true
+			}
+			if hyphens == nil {
+				hyphens = make(map[int]shaping.Glyph)
+			}
+			hyphens[g.ClusterIndex] = hyphen
+		}
+	}
+	return hyphens
+}
+
+// shapeHyphen shapes the hyphen displayed at a line break within a word of
+// out, with the face and size of out. The hyphen is U+2010 HYPHEN, or
+// U+002D HYPHEN-MINUS if the face lacks it.
+func (s *shaperImpl) shapeHyphen(out shaping.Output, lc system.Locale) (shaping.Glyph, bool) {
+	r := '\u2010' // Hyphen.
+	if _, ok := out.Face.NominalGlyph(r); !ok {
+		r = '-'
+	}
+	return s.shapeRune(out, lc, r)
+}
+
+// shapeRune shapes r with the face, size and direction of out. It reports
+// false if r doesn't shape to a single glyph.
+func (s *shaperImpl) shapeRune(out shaping.Output, lc system.Locale, r rune) (shaping.Glyph, bool) {
+	lcfg := langConfig{Language: language.NewLanguage(lc.Language), Direction: out.Direction}
+	shaped := s.shape(toInput(out.Face, out.Size, lcfg, []rune{r}), nil)
+	if len(shaped.Glyphs) != 1 {
+		return shaping.Glyph{}, false
+	}
+	return shaped.Glyphs[0], true
+}
+
+// softHyphenWidth returns the advance of the hyphen displayed if a line of
+// paragraph is broken before the rune at end.
+func (o *shapeOptions) softHyphenWidth(paragraph []rune, end int) fixed.Int26_6 {
+	if end == 0 || end == len(paragraph) || paragraph[end-1] != softHyphen {
+		return 0
+	}
+	return o.softHyphens[end-1].XAdvance
+}
+
+// showSoftHyphens replaces the glyphs of the soft hyphens ending all but the
+// last of lines with the hyphen glyphs of hyphens.
+func showSoftHyphens(lines []shaping.Line, hyphens map[int]shaping.Glyph) {
+	for _, l := range lines[:max(len(lines)-1, 0)] {
+		if len(l) == 0 {
+			continue
+		}
+		last := l[len(l)-1]
+		end := last.Runes.Offset + last.Runes.Count
+		hyphen, ok := hyphens[end-1]
+		if !ok {
+			continue
+		}
+		for i := range l {
+			run := &l[i]
+			for k := range run.Glyphs {
+				g := &run.Glyphs[k]
+				if g.ClusterIndex != end-1 {
+					continue
+				}
+				h := hyphen
+				h.ClusterIndex, h.RuneCount, h.GlyphCount = g.ClusterIndex, g.RuneCount, g.GlyphCount
+				run.Advance += h.XAdvance - g.XAdvance
+				*g = h
+				break
+			}
+		}
 	}
-	return splitInputs
 }
 
-// splitByFaces divides the inputs by font coverage in the provided faces. It will use the slice provided in buf
-// as the backing storage of the returned slice if buf is non-nil.
-func (s *shaperImpl) splitByFaces(inputs []shaping.Input, faces []font.Face, buf []shaping.Input) []shaping.Input {
-	var split []shaping.Input
-	if buf == nil {
-		split = make([]shaping.Input, 0, len(inputs))
-	} else {
-		split = buf
-	}
-	for _, input := range inputs {
-		split = append(split, shaping.SplitByFontGlyphs(input, faces)...)
+// insertHyphens appends a hyphen to the lines of lines that end at a break
+// of opts.hyphenBreaks. The hyphen joins the logically last cluster of the
+// line, so it represents no runes of its own.
+func (s *shaperImpl) insertHyphens(opts *shapeOptions, lines []shaping.Line) {
+	for _, l := range lines {
+		if len(l) == 0 {
+			continue
+		}
+		run := &l[len(l)-1]
+		end := run.Runes.Offset + run.Runes.Count
+		if len(run.Glyphs) == 0 || !slices.Contains(opts.hyphenBreaks, end) {
+			continue
+		}
+		hyphen, ok := s.shapeHyphen(*run, opts.hyphenLocale)
+		if !ok {
+			continue
+		}
+		last := run.Glyphs[0]
+		for _, g := range run.Glyphs {
+			if g.ClusterIndex > last.ClusterIndex {
+				last = g
+			}
+		}
+		hyphen.ClusterIndex, hyphen.RuneCount, hyphen.GlyphCount = last.ClusterIndex, last.RuneCount, last.GlyphCount+1
+		glyphs := make([]shaping.Glyph, 0, len(run.Glyphs)+1)
+		// The logical end of right-to-left runs is on the left.
+		rtl := run.Direction.Progression() == di.TowardTopLeft
+		if rtl {
+			glyphs = append(glyphs, hyphen)
+		}
+		for _, g := range run.Glyphs {
+			if g.ClusterIndex == last.ClusterIndex {
+				g.GlyphCount++
+			}
+			glyphs = append(glyphs, g)
+		}
+		if !rtl {
+			glyphs = append(glyphs, hyphen)
+		}
+		run.Glyphs = glyphs
+		run.Advance += hyphen.XAdvance
 	}
-	return split
 }
 
-// shapeText invokes the text shaper and returns the raw text data in the shaper's native
-// format. It does not wrap lines.
-func (s *shaperImpl) shapeText(faces []font.Face, ppem fixed.Int26_6, lc system.Locale, txt []rune) []shaping.Output {
-	if len(faces) < 1 {
-		return nil
-	}
-	lcfg := langConfig{
-		Language:  language.NewLanguage(lc.Language),
-		Direction: mapDirection(lc.Direction),
-	}
-	// Create an initial input.
-	input := toInput(faces[0], ppem, lcfg, txt)
-	// Break input on font glyph coverage.
-	inputs := s.splitBidi(input)
-	inputs = s.splitByFaces(inputs, faces, s.splitScratch1[:0])
-	inputs = splitByScript(inputs, lcfg.Direction, s.splitScratch2[:0])
-	// Shape all inputs.
-	if needed := len(inputs) - len(s.outScratchBuf); needed > 0 {
-		s.outScratchBuf = slices.Grow(s.outScratchBuf, needed)
-	}
-	s.outScratchBuf = s.outScratchBuf[:len(inputs)]
-	for i := range inputs {
-		s.outScratchBuf[i] = s.shaper.Shape(inputs[i])
+// reserveTabs widens the tab glyphs of outs to width, the widest advance
+// expandTabs may assign them, such that lines wrap before their tabs are
+// expanded.
+func reserveTabs(outs []shaping.Output, txt []rune, width fixed.Int26_6) {
+	for i := range outs {
+		out := &outs[i]
+		for k := range out.Glyphs {
+			g := &out.Glyphs[k]
+			if txt[g.ClusterIndex] == '\t' && g.GlyphCount == 1 {
+				out.Advance += width - g.XAdvance
+				g.XAdvance = width
+			}
+		}
 	}
-	return s.outScratchBuf
 }
 
-// shapeAndWrapText invokes the text shaper and returns wrapped lines in the shaper's native format.
-func (s *shaperImpl) shapeAndWrapText(faces []font.Face, params Parameters, maxWidth int, lc system.Locale, txt []rune) []shaping.Line {
-	// Wrap outputs into lines.
-	return s.wrapper.WrapParagraph(shaping.WrapConfig{
-		TruncateAfterLines: params.MaxLines,
-	}, maxWidth, txt, s.shapeText(faces, params.PxPerEm, lc, txt)...)
+// expandTabs adjusts the advances of the tab glyphs of l such that the
+// glyphs following each tab start at the next tab stop. Stops are width
+// apart and measured according to origin, in the reading direction of the
+// text, so the stops of right-to-left text are measured from the right.
+// Tabs only shrink from the advance given them by reserveTabs, so lines
+// never grow wider.
+func expandTabs(l shaping.Line, txt []rune, width fixed.Int26_6, origin TabOrigin) {
+	var x, start fixed.Int26_6
+	indent := origin == TabLineStart
+	for i := range l {
+		run := &l[i]
+		rtl := run.Direction.Progression() == di.TowardTopLeft
+		for k := range run.Glyphs {
+			// Visit glyphs in logical order.
+			if rtl {
+				k = len(run.Glyphs) - 1 - k
+			}
+			g := &run.Glyphs[k]
+			r := txt[g.ClusterIndex]
+			if indent && r != ' ' && r != '\t' {
+				indent = false
+				start = x
+			}
+			if r == '\t' && g.GlyphCount == 1 {
+				stop := start + ((x-start)/width+1)*width
+				run.Advance += stop - x - g.XAdvance
+				g.XAdvance = stop - x
+			}
+			x += g.XAdvance
+		}
+	}
 }
 
 // replaceControlCharacters replaces problematic unicode
@@ -403,6 +2885,8 @@ func replaceControlCharacters(in []rune) []rune {
 		case '\u001E':
 		case '\r':
 		case '\n':
+		// Vertical tab and form feed.
+		case '\v', '\f':
 		// Unicode "next line" character.
 		case '\u0085':
 		// Unicode "paragraph separator".
@@ -415,6 +2899,151 @@ func replaceControlCharacters(in []rune) []rune {
 	return in
 }
 
+// replaceNoncharacters replaces the noncharacters, surrogates and invalid
+// code points of in, which have no glyphs in any face, as specified by
+// mode. Every rune is replaced by a single rune to preserve rune accounting.
+func replaceNoncharacters(in []rune, mode NoncharacterMode) []rune {
+	replacement := '\uFFFD'
+	if mode == NoncharacterHide {
+		// U+2060 WORD JOINER is invisible and prevents breaks like the
+		// absent rune.
+		replacement = '\u2060'
+	}
+	for i, r := range in {
+		if isNoncharacter(r) {
+			in[i] = replacement
+		}
+	}
+	return in
+}
+
+// isNoncharacter reports whether r is a noncharacter, a surrogate or not a
+// Unicode code point.
+func isNoncharacter(r rune) bool {
+	switch {
+	case !utf8.ValidRune(r):
+		// Surrogates are not valid runes.
+		return true
+	case r >= 0xFDD0 && r <= 0xFDEF:
+		return true
+	}
+	return r&0xFFFE == 0xFFFE
+}
+
+// isParagraphSeparator reports whether r ends a paragraph. Besides newlines,
+// vertical tabs and form feeds are mandatory breaks, of class BK in UAX #14.
+func isParagraphSeparator(r rune) bool {
+	switch r {
+	case '\n', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+// controlPicture returns the symbol displaying the C0 control character r.
+func controlPicture(r rune) rune {
+	return 0x2400 + r
+}
+
+// isCollapsible reports whether r is whitespace collapsed by
+// WhitespaceNormal.
+func isCollapsible(r rune) bool {
+	switch r {
+	case ' ', '\t', '\n', '\v', '\r', '\f':
+		return true
+	}
+	return false
+}
+
+// collapseWhitespace collapses each sequence of whitespace in txt into a single
+// space and trims leading and trailing whitespace. It returns the collapsed
+// text along with, for each collapsed rune, the index of the first rune of txt
+// it represents and a final entry of len(txt). Trimmed whitespace is
+// attributed to the first and last runes. The results are appended to buf and
+// starts.
+func collapseWhitespace(txt, buf []rune, starts []int) ([]rune, []int) {
+	spaceStart := -1
+	for i, r := range txt {
+		if isCollapsible(r) {
+			if spaceStart < 0 {
+				spaceStart = i
+			}
+			continue
+		}
+		if spaceStart >= 0 && len(buf) > 0 {
+			buf = append(buf, ' ')
+			starts = append(starts, spaceStart)
+		}
+		spaceStart = -1
+		start := i
+		if len(starts) == 0 {
+			start = 0
+		}
+		buf = append(buf, r)
+		starts = append(starts, start)
+	}
+	if len(buf) == 0 && len(txt) > 0 {
+		buf = append(buf, ' ')
+		starts = append(starts, 0)
+	}
+	starts = append(starts, len(txt))
+	return buf, starts
+}
+
+// normalizeRunes converts txt to the normalization form n. It returns the
+// normalized text along with, for each normalized rune, the index of the
+// first rune of the normalized sequence of txt it belongs to and a final
+// entry of len(txt), like collapseWhitespace. The results are appended to
+// buf and starts.
+func normalizeRunes(n Normalization, txt, buf []rune, starts []int) ([]rune, []int) {
+	form := norm.NFC
+	if n == NormalizeNFD {
+		form = norm.NFD
+	}
+	str := string(txt)
+	start := 0
+	for len(str) > 0 {
+		end := form.NextBoundaryInString(str, true)
+		if end <= 0 {
+			end = len(str)
+		}
+		seq := str[:end]
+		for _, r := range form.String(seq) {
+			buf = append(buf, r)
+			starts = append(starts, start)
+		}
+		start += utf8.RuneCountInString(seq)
+		str = str[end:]
+	}
+	starts = append(starts, len(txt))
+	return buf, starts
+}
+
+// normalizes reports whether text laid out with params is normalized.
+func (s *shaperImpl) normalizes(params Parameters) bool {
+	return params.Normalize != NormalizeNone && s.assigned == nil && s.spans == nil
+}
+
+// restoreRuneCounts rewrites the rune ranges and cluster indices of lines
+// shaped from collapsed text to refer to the original text, using the starts
+// computed by collapseWhitespace.
+func restoreRuneCounts(lines []shaping.Line, starts []int) {
+	for _, l := range lines {
+		for i := range l {
+			run := &l[i]
+			end := run.Runes.Offset + run.Runes.Count
+			run.Runes.Offset = starts[run.Runes.Offset]
+			run.Runes.Count = starts[end] - run.Runes.Offset
+			for k := range run.Glyphs {
+				g := &run.Glyphs[k]
+				end := g.ClusterIndex + g.RuneCount
+				g.ClusterIndex = starts[g.ClusterIndex]
+				g.RuneCount = starts[end] - g.ClusterIndex
+			}
+		}
+	}
+}
+
 // Layout shapes and wraps the text, and returns the result in Gio's shaped text format.
 func (s *shaperImpl) LayoutString(params Parameters, minWidth, maxWidth int, lc system.Locale, txt string) document {
 	return s.LayoutRunes(params, minWidth, maxWidth, lc, []rune(txt))
@@ -429,6 +3058,19 @@ func (s *shaperImpl) Layout(params Parameters, minWidth, maxWidth int, lc system
 	return s.LayoutRunes(params, minWidth, maxWidth, lc, s.scratchRunes)
 }
 
+// LayoutRunesRange is like LayoutRunes applied to txt[start:end], without
+// allocating a copy of the range. The runes of txt are not modified. Rune
+// offsets of the document are relative to start, which is recorded in the
+// Start field of the document for converting them to offsets into txt.
+func (s *shaperImpl) LayoutRunesRange(params Parameters, minWidth, maxWidth int, lc system.Locale, txt []rune, start, end int) document {
+	// LayoutRunes replaces control characters in place, so shape a copy in
+	// reused memory.
+	s.scratchRunes = append(s.scratchRunes[:0], txt[start:end]...)
+	doc := s.LayoutRunes(params, minWidth, maxWidth, lc, s.scratchRunes)
+	doc.Start = start
+	return doc
+}
+
 func calculateYOffsets(lines []line) {
 	currentY := 0
 	prevDesc := fixed.I(0)
@@ -440,17 +3082,241 @@ func calculateYOffsets(lines []line) {
 	}
 }
 
+// trimSeparator removes the paragraph separator ending txt, if any, and
+// reports whether it did. Separators displayed by params.ShowInvisibles are
+// instead replaced by their symbol, and reported by visible.
+func trimSeparator(params Parameters, txt []rune) (_ []rune, trimmed, visible bool) {
+	n := len(txt)
+	if n == 0 || !isParagraphSeparator(txt[n-1]) {
+		return txt, false, false
+	}
+	if params.ShowInvisibles && txt[n-1] != '\n' {
+		txt[n-1] = controlPicture(txt[n-1])
+		return txt, false, true
+	}
+	return txt[:n-1], true, false
+}
+
+// wrapParagraph shapes and wraps the paragraph txt, without its separator,
+// into lines of at most maxWidth, recording the details of the wrapping in
+// opts. It returns the lines along with the locale and width they were
+// wrapped with, as adjusted by params.
+func (s *shaperImpl) wrapParagraph(opts *shapeOptions, params Parameters, maxWidth int, lc system.Locale, txt []rune) ([]shaping.Line, system.Locale, int) {
+	if params.DetectDirection {
+		if dir, ok := strongDirection(txt); ok {
+			lc.Direction = dir
+		}
+	}
+	wrapWidth := maxWidth
+	if !params.Whitespace.wraps() {
+		wrapWidth = Unbounded
+	}
+	if params.SmartQuotes {
+		substituteQuotes(lc, txt)
+	}
+	s.orderer.resolveMissing(params.Font, txt)
+	txt = replaceNoncharacters(replaceControlCharacters(txt), params.Noncharacters)
+	ls := s.shapeAndWrapText(opts, s.orderer.sortedFacesForStyle(params.Font), params, wrapWidth, lc, txt)
+	return ls, lc, wrapWidth
+}
+
+// Measure returns the size of txt laid out like a Shaper would, without
+// converting the wrapped lines to the document format. Parameters that
+// adjust lines after wrapping, such as justification or MaxLines, are
+// measured with a full layout. The runes of txt are not modified.
+func (s *shaperImpl) Measure(params Parameters, maxWidth int, lc system.Locale, txt []rune) image.Point {
+	s.scratchRunes = append(s.scratchRunes[:0], txt...)
+	txt = s.scratchRunes
+	// Collapsed whitespace includes newlines, so the text is a single paragraph.
+	collapse := params.Whitespace.collapses()
+	adjusts := params.adjustsLines()
+	if collapse && !adjusts {
+		s.collapseScratch, s.collapseStarts = collapseWhitespace(txt, s.collapseScratch[:0], s.collapseStarts[:0])
+		txt = s.collapseScratch
+	}
+	if s.normalizes(params) && !adjusts {
+		s.normScratch, s.normStarts = normalizeRunes(params.Normalize, txt, s.normScratch[:0], s.normStarts[:0])
+		txt = s.normScratch
+	}
+	var doc document
+	maxLines := params.MaxLines
+	// Lay out the lines like calculateYOffsets, from the metrics of their
+	// runs.
+	var size image.Point
+	var prevDesc fixed.Int26_6
+	for {
+		end := len(txt)
+		if !collapse {
+			if i := slices.IndexFunc(txt, isParagraphSeparator); i >= 0 {
+				end = i + 1
+			}
+		}
+		if adjusts {
+			doc.append(s.LayoutRunes(params, 0, maxWidth, lc, txt[:end]))
+			if maxLines > 0 {
+				params.MaxLines = maxLines - len(doc.lines)
+				if params.MaxLines == 0 {
+					break
+				}
+			}
+		} else {
+			paragraph, _, _ := trimSeparator(params, txt[:end])
+			ls, _, _ := s.wrapParagraph(newShapeOptions(params), params, maxWidth, lc, paragraph)
+			for _, l := range ls {
+				var width, ascent, descent fixed.Int26_6
+				for _, run := range l {
+					width += run.Advance
+					if ascent < run.LineBounds.Ascent {
+						ascent = run.LineBounds.Ascent
+					}
+					if d := -run.LineBounds.Descent + run.LineBounds.Gap; descent < d {
+						descent = d
+					}
+				}
+				size.X = max(size.X, width.Ceil())
+				size.Y += (prevDesc + ascent).Ceil()
+				prevDesc = descent
+			}
+		}
+		txt = txt[end:]
+		if len(txt) == 0 {
+			break
+		}
+	}
+	if !adjusts {
+		size.Y += prevDesc.Ceil()
+		return size
+	}
+	if params.MaxHeight > 0 {
+		doc.truncateHeight(params.MaxHeight, params.Orphans, params.Widows)
+	}
+	if len(doc.lines) == 0 {
+		return image.Point{}
+	}
+	last := doc.lines[len(doc.lines)-1]
+	return image.Pt(alignWidth(0, doc.lines), last.yOffset+last.descent.Ceil())
+}
+
+// adjustsLines reports whether p changes the size of lines after they are
+// wrapped.
+func (p Parameters) adjustsLines() bool {
+	return p.Alignment == Justify || p.LetterSpacing != 0 || p.RoundMode != RoundNone ||
+		p.MinLineHeight > 0 || p.ObjectSize.Y > 0 || p.MaxLines > 0 || p.MaxHeight > 0
+}
+
 // LayoutRunes shapes and wraps the text, and returns the result in Gio's shaped text format.
 func (s *shaperImpl) LayoutRunes(params Parameters, minWidth, maxWidth int, lc system.Locale, txt []rune) document {
-	hasNewline := len(txt) > 0 && txt[len(txt)-1] == '\n'
-	if hasNewline {
-		txt = txt[:len(txt)-1]
+	var source []rune
+	if params.RetainSource {
+		source = append(source, txt...)
+	}
+	runeCount := len(txt)
+	orig := txt
+	// starts maps the runes of the shaped text to the runes of txt, if they
+	// differ.
+	var starts []int
+	collapse := params.Whitespace.collapses()
+	if collapse {
+		s.collapseScratch, s.collapseStarts = collapseWhitespace(txt, s.collapseScratch[:0], s.collapseStarts[:0])
+		txt = s.collapseScratch
+		starts = s.collapseStarts
+	}
+	normalize := s.normalizes(params)
+	if normalize {
+		s.normScratch, s.normStarts = normalizeRunes(params.Normalize, txt, s.normScratch[:0], s.normStarts[:0])
+		txt = s.normScratch
+		if collapse {
+			for i, st := range s.normStarts {
+				s.normStarts[i] = s.collapseStarts[st]
+			}
+		}
+		starts = s.normStarts
+	}
+	txt, hasNewline, visibleBreak := trimSeparator(params, txt)
+	opts := newShapeOptions(params)
+	ls, lc, wrapWidth := s.wrapParagraph(opts, params, maxWidth, lc, txt)
+	truncating := params.MaxLines > 0 && len(ls) == params.MaxLines && lineRunes(ls) < len(txt)
+	if truncating {
+		// The trailing newline is truncated with the text before it.
+		hasNewline = false
+		if params.Truncator != "" {
+			last := len(ls) - 1
+			ls[last] = s.appendTruncator(ls[last], txt, []rune(params.Truncator), maxWidth, lc)
+		}
 	}
-	ls := s.shapeAndWrapText(s.orderer.sortedFacesForStyle(params.Font), params, maxWidth, lc, replaceControlCharacters(txt))
+	if starts != nil {
+		restoreRuneCounts(ls, starts)
+	}
+	if normalize {
+		// The clusters of the lines refer to the text before normalization.
+		txt = orig[:starts[len(txt)]]
+	}
+	truncated := 0
+	if truncating {
+		truncated = runeCount - lineRunes(ls)
+	}
+	levelText := txt
+	if starts != nil {
+		levelText = orig
+	}
+	levels := explicitLevels(levelText, paragraphLevel(lc.Direction))
 	// Convert to Lines.
 	textLines := make([]line, len(ls))
+	overflowed := false
 	for i := range ls {
+		ending := EndOfText
+		switch {
+		case i < len(ls)-1 && opts.emergency(ls[i]):
+			ending = EmergencyWrap
+		case i < len(ls)-1 || truncating:
+			ending = SoftWrap
+		case hasNewline || visibleBreak:
+			ending = HardBreak
+		}
+		// Only wrapped lines are justified, unless JustifyLastLine is set.
+		justify := params.Alignment == Justify && wrapWidth != Unbounded && (ending.wraps() || params.JustifyLastLine)
+		if justify && params.Kashida {
+			ls[i] = s.elongate(ls[i], txt, wrapWidth, lc)
+		}
 		otLine := toLine(&s.orderer, ls[i], lc.Direction)
+		if levels != nil {
+			for k, run := range ls[i] {
+				explicit := paragraphLevel(lc.Direction)
+				if run.Runes.Offset < len(levels) {
+					explicit = levels[run.Runes.Offset]
+				}
+				otLine.runs[k].level = resolvedLevel(explicit, otLine.runs[k].Direction)
+			}
+			computeVisualOrder(&otLine)
+		}
+		otLine.Ending = ending
+		if len(opts.smallCapsRuns) > 0 {
+			for k, run := range ls[i] {
+				otLine.runs[k].SmallCapsScale = opts.smallCapsScale(run.Runes.Offset, run.Runes.Offset+run.Runes.Count)
+			}
+		}
+		if s.assigned != nil {
+			for k, run := range ls[i] {
+				otLine.runs[k].Decoration = decorationAt(s.assigned, run.Runes.Offset)
+			}
+		}
+		if s.spans != nil {
+			for k, run := range ls[i] {
+				otLine.runs[k].Span = s.spanAt(run.Runes.Offset)
+			}
+		}
+		if params.LetterSpacing != 0 {
+			s.trimLetterSpacing(&otLine)
+		}
+		if justify {
+			justifyLine(&otLine, txt, wrapWidth)
+		}
+		if params.RoundMode != RoundNone {
+			snapAdvances(&otLine, params.RoundMode)
+		}
+		if truncating && i == len(ls)-1 && params.Fade > 0 {
+			fadeLine(&otLine, params.Fade)
+		}
 		if i == len(ls)-1 && hasNewline {
 			// If there was a trailing newline update the rune counts to include
 			// it on the last line of the paragraph.
@@ -463,6 +3329,7 @@ func (s *shaperImpl) LayoutRunes(params Parameters, minWidth, maxWidth int, lc s
 				clusterIndex: len(txt),
 				glyphCount:   0,
 				runeCount:    1,
+				runeOffset:   otLine.runeCount - 1,
 				xAdvance:     0,
 				yAdvance:     0,
 				xOffset:      0,
@@ -478,6 +3345,35 @@ func (s *shaperImpl) LayoutRunes(params Parameters, minWidth, maxWidth int, lc s
 				otLine.runs[finalRunIdx].Glyphs[0] = syntheticGlyph
 			}
 		}
+		s.synthesizeStyle(params, &otLine)
+		if s.colors != nil {
+			s.markColorGlyphs(&otLine)
+		}
+		if params.DebugKerning {
+			recordKerning(&otLine)
+		}
+		if params.ObjectSize.Y > 0 {
+			// Every placeholder is an object of ObjectSize.
+			obj := InlineObject{Width: params.ObjectSize.X, Ascent: params.ObjectSize.Y}
+			reserveObjectHeight(&otLine, func(int) (InlineObject, bool) {
+				return obj, true
+			})
+		}
+		if s.spans != nil {
+			reserveObjectHeight(&otLine, s.spanObject)
+		}
+		if params.MinLineHeight > 0 {
+			ensureLineHeight(&otLine, params.MinLineHeight)
+		}
+		decorateLine(&otLine)
+		if params.ShowIgnorables {
+			markIgnorables(&otLine, txt)
+		}
+		if otLine.width.Ceil() > maxWidth {
+			otLine.Overflowing = true
+			otLine.overflow = otLine.width - fixed.I(maxWidth)
+			overflowed = true
+		}
 		textLines[i] = otLine
 	}
 	calculateYOffsets(textLines)
@@ -485,7 +3381,237 @@ func (s *shaperImpl) LayoutRunes(params Parameters, minWidth, maxWidth int, lc s
 		lines:      textLines,
 		alignment:  params.Alignment,
 		alignWidth: alignWidth(minWidth, textLines),
+		minWidth:   minWidth,
+		source:     source,
+		paragraphs: []system.TextDirection{lc.Direction},
+		Truncated:  truncated,
+		Overflowed: overflowed,
+	}
+}
+
+// appendTruncator returns l, the final line of truncated text, with the
+// truncator shaped and appended at its logical end. The truncator is shaped
+// with the face of the logically last run of l, and as many trailing clusters
+// and spaces are removed as needed for the line to fit maxWidth. The glyphs
+// of the truncator form a cluster of no runes at the offset of the first
+// omitted rune, so that hit testing the truncator maps to the truncation
+// point. Ellipses missing from the face are replaced by three periods.
+func (s *shaperImpl) appendTruncator(l shaping.Line, txt, truncator []rune, maxWidth int, lc system.Locale) shaping.Line {
+	if len(l) == 0 {
+		return l
+	}
+	last := l[len(l)-1]
+	lcfg := langConfig{
+		Language:  language.NewLanguage(lc.Language),
+		Direction: mapDirection(lc.Direction),
+	}
+	trunc := s.shape(toInput(last.Face, last.Size, lcfg, adaptEllipses(last.Face, truncator)), nil)
+	start, end := l[0].Runes.Offset, last.Runes.Offset+last.Runes.Count
+	line := cutLine(l, start, end)
+	for end > start {
+		var width fixed.Int26_6
+		for _, run := range line {
+			width += run.Advance
+		}
+		if (width+trunc.Advance).Ceil() <= maxWidth && !isBreakingSpace(txt[end-1]) {
+			break
+		}
+		// Remove the logically last cluster.
+		prev := start
+		for _, run := range l {
+			for _, g := range run.Glyphs {
+				if g.ClusterIndex < end && g.ClusterIndex > prev {
+					prev = g.ClusterIndex
+				}
+			}
+		}
+		end = prev
+		line = cutLine(l, start, end)
+	}
+	for i := range trunc.Glyphs {
+		trunc.Glyphs[i].ClusterIndex = end
+		trunc.Glyphs[i].RuneCount = 0
+	}
+	trunc.Runes = shaping.Range{Offset: end}
+	return append(line, trunc)
+}
+
+// ellipsis is U+2026 HORIZONTAL ELLIPSIS, the usual truncator.
+const ellipsis = '\u2026'
+
+// adaptEllipses returns truncator with its ellipses replaced by three
+// periods if face lacks a glyph for the ellipsis. The periods are shaped
+// with the spacing of the face.
+func adaptEllipses(face font.Face, truncator []rune) []rune {
+	if _, ok := face.NominalGlyph(ellipsis); ok || !slices.Contains(truncator, ellipsis) {
+		return truncator
+	}
+	adapted := make([]rune, 0, len(truncator)+2)
+	for _, r := range truncator {
+		if r == ellipsis {
+			adapted = append(adapted, '.', '.', '.')
+			continue
+		}
+		adapted = append(adapted, r)
+	}
+	return adapted
+}
+
+// emergency reports whether l, a line of the wrapped text, ends within a word
+// too wide for a line.
+func (o *shapeOptions) emergency(l shaping.Line) bool {
+	if len(l) == 0 {
+		return false
+	}
+	last := l[len(l)-1]
+	return slices.Contains(o.emergencyBreaks, last.Runes.Offset+last.Runes.Count)
+}
+
+// lineRunes returns the number of runes of lines.
+func lineRunes(lines []shaping.Line) int {
+	n := 0
+	for _, l := range lines {
+		for _, run := range l {
+			n += run.Runes.Count
+		}
+	}
+	return n
+}
+
+// LayoutAssigned is like LayoutRunes, but shapes the runes in each of faces
+// with its face instead of resolving faces by glyph coverage. The offsets of
+// faces are relative to start, the offset of txt in the text it is part of.
+func (s *shaperImpl) LayoutAssigned(params Parameters, minWidth, maxWidth int, lc system.Locale, txt []rune, faces []FaceRange, start int) document {
+	assigned := make([]faceRange, 0, len(faces))
+	for _, f := range faces {
+		face := f.Face.Face.Face()
+		if s.orderer.assign(f.Face) {
+			s.loadColors(f.Face)
+		}
+		r := f.Runes
+		r.Offset -= start
+		assigned = append(assigned, faceRange{runes: r, face: face, decoration: f.Decoration})
+	}
+	s.assigned = assigned
+	doc := s.LayoutRunes(params, minWidth, maxWidth, lc, txt)
+	s.assigned = nil
+	return doc
+}
+
+// LayoutSpans is like LayoutRunes, but shapes the runes of each span with
+// the faces and size of its font. The spans are the pieces of the text that
+// txt is part of, and start is the offset of txt in that text.
+func (s *shaperImpl) LayoutSpans(params Parameters, minWidth, maxWidth int, lc system.Locale, txt []rune, spans []TextSpan, start int) document {
+	ranges := make([]spanRange, 0, len(spans))
+	offset := -start
+	for _, sp := range spans {
+		n := utf8.RuneCountInString(sp.Text)
+		if sp.Object != (InlineObject{}) {
+			n = 1
+		}
+		ranges = append(ranges, spanRange{
+			runes:  Range{Offset: offset, Count: n},
+			font:   sp.Font,
+			faces:  slices.Clone(s.orderer.sortedFacesForStyle(sp.Font)),
+			size:   sp.PxPerEm,
+			object: sp.Object,
+		})
+		offset += n
+	}
+	s.spans = ranges
+	doc := s.LayoutRunes(params, minWidth, maxWidth, lc, txt)
+	s.spans = nil
+	return doc
+}
+
+// FirstLine shapes and wraps only the first line of txt, returning it along
+// with whether any text remains after it. The line is laid out like the
+// first line of LayoutRunes, but only the first paragraph of txt is shaped
+// and wrapping stops after the first line. It is cheaper than LayoutRunes
+// when only the dimensions of the first line are needed.
+func (s *shaperImpl) FirstLine(params Parameters, maxWidth int, lc system.Locale, txt []rune) (line, bool) {
+	paragraph := txt
+	if i := slices.IndexFunc(txt, isParagraphSeparator); i >= 0 && !params.Whitespace.collapses() {
+		paragraph = txt[:i+1]
+	}
+	// The first line of the paragraph is laid out as if the paragraph was
+	// truncated after it, without the effects of truncation.
+	params.MaxLines = 1
+	params.Truncator = ""
+	params.Fade = 0
+	doc := s.LayoutRunes(params, 0, maxWidth, lc, paragraph)
+	return doc.lines[0], doc.Truncated > 0 || len(paragraph) < len(txt)
+}
+
+// defaultObliqueAngle is the slant used to synthesize italics when
+// Parameters.ObliqueAngle is zero.
+const defaultObliqueAngle = 12
+
+// recordKerning fills in the Kerning of the runs of l. Glyphs without
+// advance, such as marks, are not considered kerned.
+func recordKerning(l *line) {
+	for i := range l.runs {
+		run := &l.runs[i]
+		if run.face == nil || len(run.Glyphs) < 2 {
+			continue
+		}
+		// Match the scale used by the shaper, so that unkerned glyphs report
+		// no adjustment.
+		scale := float32(run.PPEM.Ceil()<<6) / float32(run.face.Upem())
+		deltas := make([]fixed.Int26_6, len(run.Glyphs))
+		for k, g := range run.Glyphs {
+			_, _, gid := splitGlyphID(g.id)
+			if g.xAdvance == 0 || g.glyphCount == 0 || gid == placeholderGID {
+				continue
+			}
+			nominal := fixed.Int26_6(math.Round(float64(run.face.HorizontalAdvance(gid) * scale)))
+			deltas[k] = g.xAdvance - nominal
+		}
+		if run.Direction.Progression() == system.TowardOrigin {
+			// The logically first glyph of each pair is on the right.
+			deltas = deltas[1:]
+		} else {
+			deltas = deltas[:len(deltas)-1]
+		}
+		run.Kerning = deltas
+	}
+}
+
+// synthesizeStyle marks the runs of l that were shaped with faces lacking the
+// style or weight requested by params.
+func (s *shaperImpl) synthesizeStyle(params Parameters, l *line) {
+	angle := params.ObliqueAngle
+	if angle == 0 {
+		angle = defaultObliqueAngle
+	}
+	for i := range l.runs {
+		fnt := l.runs[i].Font
+		want := params.Font
+		if s.spans != nil {
+			want = s.spans[l.runs[i].Span].font
+		}
+		if want.Style == Italic && fnt.Style != Italic {
+			l.runs[i].Oblique = angle
+		}
+		if want.Weight >= SemiBold && fnt.Weight < SemiBold {
+			l.runs[i].Embolden = true
+		}
+		l.runs[i].synthesize = params.Synthesize
+	}
+}
+
+// ensureLineHeight extends the ascent and descent of l evenly such that
+// they add up to at least height.
+func ensureLineHeight(l *line, height fixed.Int26_6) {
+	extra := height - (l.ascent + l.descent)
+	if extra <= 0 {
+		return
 	}
+	above := extra / 2
+	l.ascent += above
+	l.descent += extra - above
+	l.bounds.Min.Y -= above
+	l.bounds.Max.Y += extra - above
 }
 
 func alignWidth(minWidth int, lines []line) int {
@@ -506,6 +3632,9 @@ func (s *shaperImpl) Shape(ops *op.Ops, gs []Glyph) clip.PathSpec {
 			x = g.X
 		}
 		ppem, faceIdx, gid := splitGlyphID(g.ID)
+		if gid == placeholderGID || gid == controlGID {
+			continue
+		}
 		face := s.orderer.faceFor(faceIdx)
 		ppemInt := ppem.Round()
 		ppem16 := uint16(ppemInt)
@@ -514,6 +3643,11 @@ func (s *shaperImpl) Shape(ops *op.Ops, gs []Glyph) clip.PathSpec {
 		if !ok {
 			continue
 		}
+		segments := outline.Segments
+		if g.Flags&syntheticFlags != 0 {
+			s.segmentScratch = synthesizeOutline(append(s.segmentScratch[:0], segments...), g.Flags, g.Oblique, float32(face.Upem()))
+			segments = s.segmentScratch
+		}
 		// Move to glyph position.
 		pos := f32.Point{
 			X: float32(g.X-x)/64 - float32(g.Offset.X)/64,
@@ -524,7 +3658,7 @@ func (s *shaperImpl) Shape(ops *op.Ops, gs []Glyph) clip.PathSpec {
 		var lastArg f32.Point
 
 		// Convert fonts.Segments to relative segments.
-		for _, fseg := range outline.Segments {
+		for _, fseg := range segments {
 			nargs := 1
 			switch fseg.Op {
 			case fonts.SegmentOpQuadTo:
@@ -649,10 +3783,16 @@ func toLine(orderer *faceOrderer, o shaping.Line, dir system.TextDirection) line
 				Offset: line.runeCount,
 			},
 			Direction: unmapDirection(run.Direction),
+			Font:      orderer.fontFor(run.Face),
 			face:      run.Face,
 			Advance:   run.Advance,
 			PPEM:      run.Size,
 		}
+		forEachCluster(line.runs[i], func(runes, glyphs Range, _, _ fixed.Int26_6) {
+			for k := glyphs.Offset; k < glyphs.Offset+glyphs.Count; k++ {
+				line.runs[i].Glyphs[k].runeOffset = runes.Offset
+			}
+		})
 		line.runeCount += run.Runes.Count
 		if line.bounds.Min.Y > -run.LineBounds.Ascent {
 			line.bounds.Min.Y = -run.LineBounds.Ascent
@@ -668,6 +3808,15 @@ func toLine(orderer *faceOrderer, o shaping.Line, dir system.TextDirection) line
 		if line.descent < -run.LineBounds.Descent+run.LineBounds.Gap {
 			line.descent = -run.LineBounds.Descent + run.LineBounds.Gap
 		}
+		if line.fontAscent < run.LineBounds.Ascent {
+			line.fontAscent = run.LineBounds.Ascent
+		}
+		if line.fontDescent < -run.LineBounds.Descent {
+			line.fontDescent = -run.LineBounds.Descent
+		}
+		if line.lineGap < run.LineBounds.Gap {
+			line.lineGap = run.LineBounds.Gap
+		}
 	}
 	computeVisualOrder(&line)
 	// Account for glyphs hanging off of either side in the bounds.
@@ -687,10 +3836,68 @@ func toLine(orderer *faceOrderer, o shaping.Line, dir system.TextDirection) line
 	return line
 }
 
+// decorationAt returns the decoration assigned to the rune at offset.
+func decorationAt(assigned []faceRange, offset int) Decoration {
+	for _, a := range assigned {
+		if a.runes.Offset <= offset && offset < a.runes.Offset+a.runes.Count {
+			return a.decoration
+		}
+	}
+	return 0
+}
+
+// decorateLine computes the decoration rectangles of the runs of l from
+// the metrics of their faces. The rectangle of a run extends the rectangle
+// of the visually previous run if they draw the same decoration at the same
+// position and thickness.
+func decorateLine(l *line) {
+	l.decorations = nil
+	for _, runIdx := range l.visualOrder {
+		run := &l.runs[runIdx]
+		if run.Decoration == 0 || run.face == nil {
+			continue
+		}
+		m := faceMetrics(run.face, run.PPEM)
+		for _, d := range [...]DecorationRect{
+			{Decoration: Underline, Y: -m.UnderlinePosition, Thickness: m.UnderlineThickness},
+			{Decoration: Strikethrough, Y: -m.StrikethroughPosition, Thickness: m.StrikethroughThickness},
+		} {
+			if run.Decoration&d.Decoration == 0 {
+				continue
+			}
+			d.Start, d.End = run.X, run.X+run.Advance
+			if i := lastDecoration(l.decorations, d.Decoration); i >= 0 {
+				prev := &l.decorations[i]
+				if prev.End >= d.Start && prev.Y == d.Y && prev.Thickness == d.Thickness {
+					prev.End = d.End
+					continue
+				}
+			}
+			l.decorations = append(l.decorations, d)
+		}
+	}
+}
+
+// lastDecoration returns the index of the last rectangle of rects drawing d,
+// or -1 if there is none.
+func lastDecoration(rects []DecorationRect, d Decoration) int {
+	for i := len(rects) - 1; i >= 0; i-- {
+		if rects[i].Decoration == d {
+			return i
+		}
+	}
+	return -1
+}
+
 // computeVisualOrder will populate the Line's VisualOrder field and the
 // VisualPosition field of each element in Runs.
 func computeVisualOrder(l *line) {
 	l.visualOrder = make([]int, len(l.runs))
+	if slices.IndexFunc(l.runs, func(r runLayout) bool { return r.level > 0 }) >= 0 {
+		reorderLevels(l)
+		positionRuns(l)
+		return
+	}
 	const none = -1
 	bidiRangeStart := none
 
@@ -737,11 +3944,19 @@ func computeVisualOrder(l *line) {
 		// We ended iteration within a bidi segment, resolve it.
 		resolveBidi(bidiRangeStart, len(l.runs))
 	}
-	// Iterate and resolve the X of each run.
+	positionRuns(l)
+}
+
+// positionRuns resolves the X of each run of l from its visual order.
+func positionRuns(l *line) {
 	x := fixed.Int26_6(0)
-	for _, runIdx := range l.visualOrder {
+	l.Reordered = false
+	for pos, runIdx := range l.visualOrder {
 		l.runs[runIdx].X = x
 		x += l.runs[runIdx].Advance
+		if pos != runIdx || l.runs[runIdx].Direction.Progression() == system.TowardOrigin {
+			l.Reordered = true
+		}
 	}
 }
 
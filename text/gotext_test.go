@@ -1,12 +1,23 @@
 package text
 
 import (
+	"fmt"
 	"math"
 	"reflect"
+	"strings"
 	"testing"
+	"unicode"
 
 	nsareg "eliasnaur.com/font/noto/sans/arabic/regular"
+	"eliasnaur.com/font/roboto/robotoregular"
+	"github.com/benoitkugler/textlayout/fonts"
+	"github.com/benoitkugler/textlayout/fonts/truetype"
+	"github.com/benoitkugler/textlayout/language"
+	"github.com/go-text/typesetting/di"
 	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/exp/slices"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goitalic"
 	"golang.org/x/image/font/gofont/goregular"
 	"golang.org/x/image/math/fixed"
 
@@ -256,8 +267,8 @@ func makeTestText(shaper *shaperImpl, primaryDir system.TextDirection, fontSize,
 			rtlSource = string(complexRunes[:runeLimit])
 		}
 	}
-	simpleText := shaper.shapeAndWrapText(shaper.orderer.sortedFacesForStyle(Font{}), Parameters{PxPerEm: fixed.I(fontSize)}, lineWidth, locale, []rune(simpleSource))
-	complexText := shaper.shapeAndWrapText(shaper.orderer.sortedFacesForStyle(Font{}), Parameters{PxPerEm: fixed.I(fontSize)}, lineWidth, locale, []rune(complexSource))
+	simpleText := shaper.shapeAndWrapText(newShapeOptions(Parameters{}), shaper.orderer.sortedFacesForStyle(Font{}), Parameters{PxPerEm: fixed.I(fontSize)}, lineWidth, locale, []rune(simpleSource))
+	complexText := shaper.shapeAndWrapText(newShapeOptions(Parameters{}), shaper.orderer.sortedFacesForStyle(Font{}), Parameters{PxPerEm: fixed.I(fontSize)}, lineWidth, locale, []rune(complexSource))
 	shaper = testShaper(rtlFace, ltrFace)
 	return simpleText, complexText
 }
@@ -524,6 +535,7 @@ func FuzzLayout(f *testing.F) {
 	ltrFace, _ := opentype.Parse(goregular.TTF)
 	rtlFace, _ := opentype.Parse(nsareg.TTF)
 	f.Add("د عرمثال dstي met لم aqل جدmوpمg lرe dرd  لو عل ميrةsdiduntut lab renنيتذدagلaaiua.ئPocttأior رادرsاي mيrbلmnonaيdتد ماةعcلخ.", true, uint8(10), uint16(200))
+	f.Add("a\uFDD0b\uFFFEc\U0010FFFF d\uFDEF", false, uint8(10), uint16(20))
 
 	shaper := testShaper(ltrFace, rtlFace)
 	f.Fuzz(func(t *testing.T, txt string, rtl bool, fontSize uint8, width uint16) {
@@ -586,6 +598,44 @@ func validateLines(t *testing.T, lines []line, expectedRuneCount int) {
 	}
 }
 
+// TestNoncharacters checks that noncharacters, surrogates and invalid code
+// points are displayed as replacement characters or hidden, each as a
+// cluster of a single rune.
+func TestNoncharacters(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	replacement, _ := ltrFace.Face().NominalGlyph('\uFFFD')
+	txt := []rune{'a', 0xFDD0, 'b', 0xFFFF, 0xD800, 'c', 0x10FFFE, 0x110000, -1}
+	bad := map[int]bool{1: true, 3: true, 4: true, 6: true, 7: true, 8: true}
+	for _, mode := range []NoncharacterMode{NoncharacterReplace, NoncharacterHide} {
+		params := Parameters{PxPerEm: fixed.I(10), Noncharacters: mode}
+		doc := shaper.LayoutRunes(params, 0, 1000, english, append([]rune(nil), txt...))
+		validateLines(t, doc.lines, len(txt))
+		for _, run := range doc.lines[0].runs {
+			forEachCluster(run, func(runes, glyphs Range, _, advance fixed.Int26_6) {
+				if runes.Count != 1 {
+					t.Errorf("mode %d: expected clusters of a single rune, got %v", mode, runes)
+					return
+				}
+				if !bad[runes.Offset] {
+					return
+				}
+				_, _, gid := splitGlyphID(run.Glyphs[glyphs.Offset].id)
+				switch mode {
+				case NoncharacterReplace:
+					if gid != replacement {
+						t.Errorf("rune %d: expected the replacement character glyph, got %d", runes.Offset, gid)
+					}
+				case NoncharacterHide:
+					if advance != 0 {
+						t.Errorf("rune %d: expected a hidden cluster, got advance %v", runes.Offset, advance)
+					}
+				}
+			})
+		}
+	}
+}
+
 // TestTextAppend ensures that appending two texts together correctly updates the new lines'
 // y offsets.
 func TestTextAppend(t *testing.T) {
@@ -711,3 +761,1974 @@ func TestClosestFontByWeight(t *testing.T) {
 		}
 	}
 }
+
+// TestRetainSource ensures that documents can retain a private copy of their
+// source text.
+func TestRetainSource(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	txt := []rune("hello\n")
+	doc := shaper.LayoutRunes(Parameters{PxPerEm: fixed.I(10)}, 0, 200, english, txt)
+	if src := doc.Source(); len(src) != 0 {
+		t.Errorf("expected no source without RetainSource, got %q", string(src))
+	}
+	txt = []rune("hello\n")
+	doc = shaper.LayoutRunes(Parameters{PxPerEm: fixed.I(10), RetainSource: true}, 0, 200, english, txt)
+	for i := range txt {
+		txt[i] = 'x'
+	}
+	if got := string(doc.Source()); got != "hello\n" {
+		t.Errorf("expected source %q, got %q", "hello\n", got)
+	}
+}
+
+// TestLayoutRunesRange ensures that laying out a range of a buffer matches
+// laying out a slice of it, and leaves the buffer intact.
+func TestLayoutRunesRange(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	params := Parameters{PxPerEm: fixed.I(10)}
+	const txt = "first line\nthe second line is wrapped\nthird"
+	buf := []rune(txt)
+	start := strings.IndexRune(txt, '\n') + 1
+	end := start + strings.IndexRune(txt[start:], '\n') + 1
+	got := shaper.LayoutRunesRange(params, 0, 100, english, buf, start, end)
+	if string(buf) != txt {
+		t.Errorf("expected the buffer to be unmodified, got %q", string(buf))
+	}
+	if got.Start != start {
+		t.Errorf("expected document start %d, got %d", start, got.Start)
+	}
+	want := shaper.LayoutRunes(params, 0, 100, english, []rune(txt[start:end]))
+	if len(got.lines) < 2 {
+		t.Errorf("expected the range to wrap, got %d lines", len(got.lines))
+	}
+	if !reflect.DeepEqual(got.lines, want.lines) {
+		t.Errorf("range layout differs from sliced layout:\n%+v\n%+v", got.lines, want.lines)
+	}
+}
+
+// TestFirstLine ensures that wrapping only the first line of text matches the
+// first line of a full layout.
+func TestFirstLine(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	type testcase struct {
+		name   string
+		txt    string
+		more   bool
+		params Parameters
+	}
+	for _, tc := range []testcase{
+		{name: "wrapped", txt: "The quick brown fox jumps over the lazy dog.", more: true},
+		{name: "single line", txt: "The quick", more: false},
+		{name: "paragraphs", txt: "The quick\nbrown fox", more: true},
+		{name: "trailing newline", txt: "The quick\n", more: false},
+		{name: "bidi", txt: "The quick سماء שלום لا fox تمط שלום غير the lazy dog.", more: true},
+		{name: "spacing", txt: "The quick brown fox jumps over the lazy dog.", more: true, params: Parameters{LetterSpacing: fixed.I(1), WordSpacing: fixed.I(2)}},
+		{name: "tabs", txt: "The\tquick\tbrown fox jumps", more: true, params: Parameters{TabWidth: fixed.I(30)}},
+		{name: "features", txt: "The quick brown fox 0123456789", more: true, params: Parameters{TabularNumbers: true, Alignment: Justify}},
+		{name: "truncated", txt: "The quick brown fox jumps over the lazy dog.", more: true, params: Parameters{MaxLines: 3, Truncator: "…", Fade: 100}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := tc.params
+			params.PxPerEm = fixed.I(10)
+			// Paragraphs are split before reaching the shaper, so compare against
+			// the layout of the first paragraph.
+			doc := shaper.LayoutString(params, 0, 100, english, strings.SplitAfter(tc.txt, "\n")[0])
+			first, more := shaper.FirstLine(params, 100, english, []rune(tc.txt))
+			if more != tc.more {
+				t.Errorf("expected more=%v, got %v", tc.more, more)
+			}
+			full := doc.lines[0]
+			if !reflect.DeepEqual(first.runs, full.runs) {
+				t.Errorf("expected the runs of the first line of the full layout")
+			}
+			if first.width != full.width || first.runeCount != full.runeCount {
+				t.Errorf("expected first line width %v runes %d, got width %v runes %d", full.width, full.runeCount, first.width, first.runeCount)
+			}
+			if first.yOffset != full.yOffset {
+				t.Errorf("expected first line y offset %d, got %d", full.yOffset, first.yOffset)
+			}
+		})
+	}
+}
+
+// TestSyntheticOblique ensures that runs lacking a requested italic face
+// report the configured slant.
+func TestSyntheticOblique(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	italicFace, _ := opentype.Parse(goitalic.TTF)
+	shaper := testShaper(ltrFace)
+	params := Parameters{PxPerEm: fixed.I(10), Font: Font{Style: Italic}, ObliqueAngle: 20}
+	doc := shaper.LayoutString(params, 0, 200, english, "hello")
+	if got := doc.lines[0].runs[0].Oblique; got != 20 {
+		t.Errorf("expected synthesized oblique angle 20, got %v", got)
+	}
+	params.ObliqueAngle = 0
+	doc = shaper.LayoutString(params, 0, 200, english, "hello")
+	if got := doc.lines[0].runs[0].Oblique; got != defaultObliqueAngle {
+		t.Errorf("expected default oblique angle %v, got %v", defaultObliqueAngle, got)
+	}
+	shaper.Load(FontFace{Font: Font{Style: Italic}, Face: italicFace})
+	doc = shaper.LayoutString(params, 0, 200, english, "hello")
+	if got := doc.lines[0].runs[0].Oblique; got != 0 {
+		t.Errorf("expected no synthesized oblique with an italic face, got %v", got)
+	}
+}
+
+// TestSyntheticObliqueOutline checks that synthesized oblique outlines are
+// slanted by the angle of their glyphs.
+func TestSyntheticObliqueOutline(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	face := ltrFace.Face()
+	gid, _ := face.NominalGlyph('l')
+	outline := face.GlyphData(gid, 0, 0).(fonts.GlyphOutline)
+	for _, angle := range []float32{defaultObliqueAngle, 20} {
+		segments := append([]fonts.Segment(nil), outline.Segments...)
+		synthesizeOutline(segments, FlagSyntheticOblique, angle, float32(face.Upem()))
+		slant := math.Tan(float64(angle) * math.Pi / 180)
+		for i, seg := range segments {
+			for k, pt := range seg.ArgsSlice() {
+				orig := outline.Segments[i].Args[k]
+				if want := float64(orig.X) + float64(orig.Y)*slant; math.Abs(float64(pt.X)-want) > 1e-3 {
+					t.Fatalf("angle %v: expected point at x %v, got %v", angle, want, pt.X)
+				}
+			}
+		}
+	}
+}
+
+// TestDottedCircle ensures that a leading combining mark can be given a
+// dotted circle base without disturbing rune accounting.
+func TestDottedCircle(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	const txt = "\u0301abc"
+	countGlyphs := func(doc document) int {
+		n := 0
+		for _, run := range doc.lines[0].runs {
+			n += len(run.Glyphs)
+		}
+		return n
+	}
+	params := Parameters{PxPerEm: fixed.I(10)}
+	plain := shaper.LayoutString(params, 0, 200, english, txt)
+	validateLines(t, plain.lines, 4)
+	params.DottedCircle = true
+	doc := shaper.LayoutString(params, 0, 200, english, txt)
+	validateLines(t, doc.lines, 4)
+	if got, want := countGlyphs(doc), countGlyphs(plain)+1; got != want {
+		t.Errorf("expected %d glyphs with dotted circle, got %d", want, got)
+	}
+	first := doc.lines[0].runs[0]
+	gid, _ := first.face.NominalGlyph(dottedCircle)
+	if _, _, id := splitGlyphID(first.Glyphs[0].id); id != gid {
+		t.Errorf("expected first glyph to be a dotted circle (%d), got %d", gid, id)
+	}
+	if doc.lines[0].width <= plain.lines[0].width {
+		t.Errorf("expected dotted circle to widen the line")
+	}
+}
+
+// TestDottedCircleFont checks that the dotted circle is shaped with the
+// configured face.
+func TestDottedCircleFont(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	robotoFace, _ := opentype.Parse(robotoregular.TTF)
+	shaper := testShaper()
+	shaper.Load(FontFace{Font: Font{Typeface: "Go"}, Face: ltrFace})
+	shaper.Load(FontFace{Font: Font{Typeface: "Noto"}, Face: rtlFace})
+	shaper.Load(FontFace{Font: Font{Typeface: "Roboto"}, Face: robotoFace})
+	const txt = "\u0301abc"
+	params := Parameters{PxPerEm: fixed.I(10), DottedCircle: true, Font: Font{Typeface: "Go"}}
+	circleFont := func() Font {
+		doc := shaper.LayoutString(params, 0, 200, english, txt)
+		validateLines(t, doc.lines, 4)
+		return shaper.orderer.fontFor(doc.lines[0].runs[0].face)
+	}
+	for _, typeface := range []Typeface{"Noto", "Go", "Roboto"} {
+		params.DottedCircleFont = Font{Typeface: typeface}
+		if got, want := circleFont(), params.DottedCircleFont; got != want {
+			t.Errorf("expected dotted circle from %v, got %v", want, got)
+		}
+	}
+}
+
+// TestLineBaseline ensures that the baseline lies within the line box for both
+// text directions.
+func TestLineBaseline(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	for _, locale := range []system.Locale{english, arabic} {
+		doc := shaper.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 100, locale, "The quick سماء שלום لا fox تمط שלום غير the lazy dog.")
+		for i, line := range doc.lines {
+			baseline := line.Baseline()
+			if baseline <= 0 || baseline >= line.ascent+line.descent {
+				t.Errorf("%s line %d: baseline %v outside of line box of height %v", locale.Direction, i, baseline, line.ascent+line.descent)
+			}
+			if top := -line.bounds.Min.Y; baseline != top {
+				t.Errorf("%s line %d: baseline %v does not match line top %v", locale.Direction, i, baseline, top)
+			}
+		}
+	}
+}
+
+// TestSubstitutePunctuation ensures that punctuation missing from the primary
+// face can be replaced instead of falling back to another face.
+func TestSubstitutePunctuation(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	// The Arabic face lacks an em dash, but the Go face has one.
+	shaper := &shaperImpl{}
+	shaper.Load(FontFace{Font: Font{Typeface: "Noto"}, Face: rtlFace})
+	shaper.Load(FontFace{Font: Font{Typeface: "Go"}, Face: ltrFace})
+	const txt = "سماء—سماء"
+	params := Parameters{PxPerEm: fixed.I(10)}
+	doc := shaper.LayoutString(params, 0, 200, arabic, txt)
+	if runs := len(doc.lines[0].runs); runs != 3 {
+		t.Errorf("expected em dash to fall back to another face, got %d runs", runs)
+	}
+	params.SubstitutePunctuation = true
+	doc = shaper.LayoutString(params, 0, 200, arabic, txt)
+	validateLines(t, doc.lines, len([]rune(txt)))
+	for i, run := range doc.lines[0].runs {
+		if run.face != rtlFace.Face() {
+			t.Errorf("run %d: expected primary face to be used", i)
+		}
+	}
+}
+
+// TestSmartQuotes checks that quotation marks are substituted according to
+// the locale without changing rune offsets.
+func TestSmartQuotes(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	const txt = `"Hi," he said. 'It's fine.'`
+	german := system.Locale{Language: "de-DE", Direction: system.LTR}
+	for _, tc := range []struct {
+		name   string
+		locale system.Locale
+		want   string
+	}{
+		{"english", english, "“Hi,” he said. ‘It’s fine.’"},
+		{"german", german, "„Hi,“ he said. ‚It‘s fine.‘"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runes := []rune(txt)
+			substituteQuotes(tc.locale, runes)
+			if got := string(runes); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+	params := Parameters{PxPerEm: fixed.I(10), SmartQuotes: true, RetainSource: true}
+	en := shaper.LayoutString(params, 0, 1000, english, txt)
+	de := shaper.LayoutString(params, 0, 1000, german, txt)
+	validateLines(t, en.lines, len([]rune(txt)))
+	validateLines(t, de.lines, len([]rune(txt)))
+	if string(en.Source()) != txt {
+		t.Errorf("expected source to retain the original quotes, got %q", string(en.Source()))
+	}
+	enGlyphs, deGlyphs := en.lines[0].GlyphsLogical(), de.lines[0].GlyphsLogical()
+	if len(enGlyphs) != len(deGlyphs) {
+		t.Fatalf("expected the same number of glyphs, got %d and %d", len(enGlyphs), len(deGlyphs))
+	}
+	for i := range enGlyphs {
+		eg, dg := enGlyphs[i], deGlyphs[i]
+		if eg.runeOffset != dg.runeOffset || eg.runeCount != dg.runeCount {
+			t.Errorf("glyph %d: expected the same runes, got %d+%d and %d+%d", i, eg.runeOffset, eg.runeCount, dg.runeOffset, dg.runeCount)
+		}
+	}
+	if enGlyphs[0].id == deGlyphs[0].id {
+		t.Errorf("expected different opening quotes for English and German")
+	}
+	plain := shaper.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 1000, english, txt)
+	if plain.lines[0].GlyphsLogical()[0].id == enGlyphs[0].id {
+		t.Errorf("expected curly quotes to replace the straight quotes")
+	}
+}
+
+// TestLineMetrics ensures that line ascent and descent are taken from the
+// font metrics and agree with the line bounds.
+func TestLineMetrics(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	ppem := fixed.I(100)
+	doc := shaper.LayoutString(Parameters{PxPerEm: ppem}, 0, 2000, english, "xxx")
+	line := doc.lines[0]
+	face := ltrFace.Face()
+	extents, _ := face.FontHExtents()
+	scale := float32(ppem.Round()) / float32(face.Upem())
+	const tolerance = 2
+	near := func(a fixed.Int26_6, b float32) bool {
+		return fixedAbs(a-fixed.Int26_6(b*64)) <= tolerance
+	}
+	if !near(line.ascent, extents.Ascender*scale) {
+		t.Errorf("expected ascent %v, got %v", extents.Ascender*scale, line.ascent)
+	}
+	if !near(line.descent, (extents.LineGap-extents.Descender)*scale) {
+		t.Errorf("expected descent %v, got %v", (extents.LineGap-extents.Descender)*scale, line.descent)
+	}
+	if height := line.bounds.Max.Y - line.bounds.Min.Y; height != line.ascent+line.descent {
+		t.Errorf("expected bounds height %v to match ascent+descent %v", height, line.ascent+line.descent)
+	}
+}
+
+// TestTabularSeparators checks that times of equal digit count have equal
+// widths when their separators are tabular.
+func TestTabularSeparators(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	width := func(params Parameters, txt string) fixed.Int26_6 {
+		return shaper.LayoutString(params, 0, 2000, english, txt).lines[0].width
+	}
+	params := Parameters{PxPerEm: fixed.I(16)}
+	if a, b := width(params, "12:34"), width(params, "12.34"); a == b {
+		t.Fatalf("expected separators of distinct widths, got %v for both", a)
+	}
+	params.TabularSeparators = ":."
+	times := []string{"12:34", "09:05", "12.34"}
+	want := width(params, times[0])
+	for _, txt := range times[1:] {
+		if got := width(params, txt); got != want {
+			t.Errorf("width of %q is %v, expected %v", txt, got, want)
+		}
+	}
+	// Allow for rounding of the advances by the shaper.
+	if got, want := width(params, "0:0"), 3*width(params, "0"); fixedAbs(got-want) > 1 {
+		t.Errorf("expected tabular separator width %v, got %v", want, got)
+	}
+}
+
+// TestTabOrigin checks that tab stops are measured from the configured origin
+// of an indented line.
+func TestTabOrigin(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	const txt = "  a\tb"
+	tabWidth := fixed.I(40)
+	// glyphX returns the position of the glyph at index i of the single run.
+	glyphX := func(origin TabOrigin, i int) fixed.Int26_6 {
+		doc := shaper.LayoutString(Parameters{
+			PxPerEm:   fixed.I(10),
+			TabWidth:  tabWidth,
+			TabOrigin: origin,
+		}, 0, 1000, english, txt)
+		var x fixed.Int26_6
+		for _, g := range doc.lines[0].runs[0].Glyphs[:i] {
+			x += g.xAdvance
+		}
+		return x
+	}
+	indent := glyphX(TabParagraphStart, 2)
+	if indent == 0 {
+		t.Fatalf("expected indentation")
+	}
+	if got := glyphX(TabParagraphStart, 4); got != tabWidth {
+		t.Errorf("expected tab stop at %v from paragraph start, got %v", tabWidth, got)
+	}
+	if got := glyphX(TabLineStart, 4); got != indent+tabWidth {
+		t.Errorf("expected tab stop at %v from line start, got %v", indent+tabWidth, got)
+	}
+}
+
+// TestTabWrap checks that lines containing expanded tabs fit the maximum
+// width.
+func TestTabWrap(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	const maxWidth = 100
+	for _, tc := range []struct {
+		name     string
+		tabWidth fixed.Int26_6
+	}{
+		{"tab width", fixed.I(30)},
+		// Tabs are expanded to TabSpaces spaces by default.
+		{"default", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := shaper.LayoutString(Parameters{
+				PxPerEm:  fixed.I(10),
+				TabWidth: tc.tabWidth,
+			}, 0, maxWidth, english, "aaaa\tb\tc\td\te\tf\tg")
+			if len(doc.lines) < 2 {
+				t.Fatalf("expected the text to wrap, got %d lines", len(doc.lines))
+			}
+			for i, l := range doc.lines {
+				if l.width > fixed.I(maxWidth) {
+					t.Errorf("line %d is %v wide, exceeding %v", i, l.width, fixed.I(maxWidth))
+				}
+			}
+		})
+	}
+}
+
+// TestContentAdvance checks that the content advance of runs excludes the
+// synthetic glyph of a trailing newline.
+func TestContentAdvance(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	params := Parameters{PxPerEm: fixed.I(10)}
+	for _, tc := range []struct {
+		name    string
+		locale  system.Locale
+		txt     string
+		newline bool
+		// content, dir and script describe the shaping of the content
+		// of the run, without synthetic glyphs.
+		content string
+		dir     di.Direction
+		script  language.Script
+	}{
+		{"ltr", english, "abc def", false, "abc def", di.DirectionLTR, language.Latin},
+		{"ltr newline", english, "abc def\n", true, "abc def", di.DirectionLTR, language.Latin},
+		{"rtl newline", arabic, "سماء\n", true, "سماء", di.DirectionRTL, language.Arabic},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := shaper.LayoutString(params, 0, 1000, tc.locale, tc.txt)
+			ln := doc.lines[len(doc.lines)-1]
+			run := &ln.runs[len(ln.runs)-1]
+			synthetic := false
+			for _, g := range run.Glyphs {
+				if g.glyphCount == 0 {
+					synthetic = true
+				}
+			}
+			if synthetic != tc.newline {
+				t.Fatalf("expected synthetic newline glyph %v, got %v", tc.newline, synthetic)
+			}
+			// Measure the content separately, with the face of the run.
+			content := []rune(tc.content)
+			out := new(shaping.HarfbuzzShaper).Shape(shaping.Input{
+				Text:      content,
+				RunEnd:    len(content),
+				Direction: tc.dir,
+				Face:      run.face,
+				Size:      params.PxPerEm,
+				Script:    tc.script,
+			})
+			var want fixed.Int26_6
+			for _, g := range out.Glyphs {
+				want += g.XAdvance
+			}
+			if got := run.ContentAdvance(); got != want {
+				t.Errorf("expected content advance %v, got %v", want, got)
+			}
+			if got := run.ContentAdvance(); !tc.newline && got != run.Advance {
+				t.Errorf("expected content advance %v to equal advance %v", got, run.Advance)
+			}
+		})
+	}
+}
+
+// TestZeroWidthJoiner checks that a zero width joiner selects the joining
+// form of an adjacent Arabic letter while contributing no width.
+func TestZeroWidthJoiner(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper()
+	shaper.Load(FontFace{Font: Font{Typeface: "Go"}, Face: ltrFace})
+	shaper.Load(FontFace{Font: Font{Typeface: "Noto"}, Face: rtlFace})
+	// Go is the primary face, and lacks Arabic.
+	params := Parameters{PxPerEm: fixed.I(20), Font: Font{Typeface: "Go"}}
+	// letter returns the glyph of the letter beh in the layout of txt, and
+	// the advance of the other glyphs.
+	letter := func(txt string) (glyph, fixed.Int26_6) {
+		doc := shaper.LayoutString(params, 0, 1000, arabic, txt)
+		if n := len(doc.lines[0].runs); n != 1 {
+			t.Fatalf("%q: expected a single run, got %d", txt, n)
+		}
+		var beh glyph
+		var rest fixed.Int26_6
+		for _, g := range doc.lines[0].runs[0].Glyphs {
+			if g.xAdvance > beh.xAdvance {
+				rest += beh.xAdvance
+				beh = g
+			} else {
+				rest += g.xAdvance
+			}
+		}
+		return beh, rest
+	}
+	isolated, _ := letter("ب")
+	for _, txt := range []string{"ب\u200D", "\u200Dب", "\u200Dب\u200D"} {
+		g, rest := letter(txt)
+		if g.id == isolated.id {
+			t.Errorf("%q: expected a joining form", txt)
+		}
+		if rest != 0 {
+			t.Errorf("%q: expected zero width joiners, got advance %v", txt, rest)
+		}
+	}
+}
+
+// TestDefaultTabWidth checks that tab stops are a multiple of the space
+// width when TabWidth is not set.
+func TestDefaultTabWidth(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	params := Parameters{PxPerEm: fixed.I(10)}
+	space := shaper.LayoutString(params, 0, 1000, english, " ").lines[0].width
+	// tabAdvance returns the advance of the leading tab of "\ta".
+	tabAdvance := func(params Parameters) fixed.Int26_6 {
+		doc := shaper.LayoutString(params, 0, 1000, english, "\ta")
+		return doc.lines[0].runs[0].Glyphs[0].xAdvance
+	}
+	if got, want := tabAdvance(params), space*defaultTabSpaces; got != want {
+		t.Errorf("expected default tab advance %v, got %v", want, got)
+	}
+	params.TabSpaces = 4
+	if got, want := tabAdvance(params), space*4; got != want {
+		t.Errorf("expected tab advance of 4 spaces %v, got %v", want, got)
+	}
+	params.TabSpaces = -1
+	if got := tabAdvance(params); got == space*defaultTabSpaces || got == space*4 {
+		t.Errorf("expected tab glyph advance, got tab stops of %v", got)
+	}
+}
+
+// TestSynthesizedRuns checks that runs shaped with a face lacking the requested
+// weight are reported.
+func TestSynthesizedRuns(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	boldFace, _ := opentype.Parse(gobold.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper()
+	shaper.Load(FontFace{Font: Font{Typeface: "Go"}, Face: ltrFace})
+	shaper.Load(FontFace{Font: Font{Typeface: "Go", Weight: Bold}, Face: boldFace})
+	shaper.Load(FontFace{Font: Font{Typeface: "Noto"}, Face: rtlFace})
+	const txt = "hello سلام"
+	params := Parameters{PxPerEm: fixed.I(10), Font: Font{Typeface: "Go"}}
+	doc := shaper.LayoutString(params, 0, 1000, english, txt)
+	if got := doc.SynthesizedRuns(); len(got) != 0 {
+		t.Errorf("expected no synthesized runs, got %v", got)
+	}
+	params.Font.Weight = Bold
+	doc = shaper.LayoutString(params, 0, 1000, english, txt)
+	expected := []Range{{Offset: 6, Count: 4}}
+	if got := doc.SynthesizedRuns(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected synthesized runs %v, got %v", expected, got)
+	}
+}
+
+// TestUsedFaces checks that documents report the primary and fallback faces
+// of their glyphs at their effective sizes.
+func TestUsedFaces(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper()
+	shaper.Load(FontFace{Font: Font{Typeface: "Go"}, Face: ltrFace})
+	shaper.Load(FontFace{Font: Font{Typeface: "Noto"}, Face: rtlFace})
+	ltrID := shaper.orderer.indexFor(ltrFace.Face())
+	rtlID := shaper.orderer.indexFor(rtlFace.Face())
+	const txt = "hello سلام world\nسلام"
+	params := Parameters{PxPerEm: fixed.I(10), Font: Font{Typeface: "Go"}}
+	doc := shaper.LayoutString(params, 0, 1000, english, txt)
+	want := []UsedFace{{FaceID: ltrID, PxPerEm: fixed.I(10)}, {FaceID: rtlID, PxPerEm: fixed.I(10)}}
+	if got := doc.UsedFaces(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected used faces %v, got %v", want, got)
+	}
+	// The fallback face is scaled to the x-height of the primary face.
+	params.SizeAdjust = true
+	doc = shaper.LayoutString(params, 0, 1000, english, txt)
+	got := doc.UsedFaces()
+	if len(got) != 2 || got[0] != want[0] || got[1].FaceID != rtlID || got[1].PxPerEm == fixed.I(10) {
+		t.Errorf("expected an adjusted fallback size, got %v", got)
+	}
+	for _, ln := range doc.lines {
+		for _, run := range ln.runs {
+			if run.face == rtlFace.Face() && run.PPEM != got[1].PxPerEm {
+				t.Errorf("expected fallback size %v, got %v", run.PPEM, got[1].PxPerEm)
+			}
+		}
+	}
+}
+
+// TestTofu checks that runes missing from every face are displayed with the
+// runes of their replacement, as a single cluster.
+func TestTofu(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	params := Parameters{PxPerEm: fixed.I(10)}
+	ids := func(l line) []GlyphID {
+		var ids []GlyphID
+		for _, run := range l.runs {
+			for _, g := range run.Glyphs {
+				ids = append(ids, g.id)
+			}
+		}
+		return ids
+	}
+	want := shaper.LayoutString(params, 0, 1000, english, "aU+1F4A9b").lines[0]
+	shaper.tofu = func(r rune) []rune {
+		return []rune(fmt.Sprintf("U+%X", r))
+	}
+	got := shaper.LayoutString(params, 0, 1000, english, "a\U0001F4A9b").lines[0]
+	if !slices.Equal(ids(got), ids(want)) {
+		t.Errorf("expected the glyphs of the placeholder %v, got %v", ids(want), ids(got))
+	}
+	if got.runeCount != 3 {
+		t.Errorf("expected 3 runes, got %d", got.runeCount)
+	}
+	if got.width != want.width {
+		t.Errorf("expected width %v, got %v", want.width, got.width)
+	}
+	var clusters []Range
+	for _, run := range got.runs {
+		forEachCluster(run, func(runes, glyphs Range, _, _ fixed.Int26_6) {
+			clusters = append(clusters, runes)
+		})
+	}
+	if len(clusters) != 3 || clusters[1] != (Range{Offset: 1, Count: 1}) {
+		t.Errorf("expected the placeholder to be the cluster of the missing rune, got %v", clusters)
+	}
+}
+
+// TestSynthesizeBold checks that runs synthesized in bold are wider than
+// the regular runs, and that their outlines are widened.
+func TestSynthesizeBold(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper()
+	shaper.Load(FontFace{Font: Font{Typeface: "Go"}, Face: ltrFace})
+	const txt = "hello world"
+	params := Parameters{PxPerEm: fixed.I(10), Font: Font{Typeface: "Go", Weight: Bold}}
+	regular := shaper.LayoutString(params, 0, 1000, english, txt).lines[0]
+	params.Synthesize = true
+	bold := shaper.LayoutString(params, 0, 1000, english, txt).lines[0]
+	if bold.width <= regular.width {
+		t.Errorf("expected synthesized bold width %v to exceed regular width %v", bold.width, regular.width)
+	}
+	// Wrapping must account for the synthesized advances.
+	doc := shaper.LayoutString(params, 0, regular.width.Ceil(), english, txt)
+	if len(doc.lines) < 2 {
+		t.Errorf("expected synthesized bold text to wrap within the regular width")
+	}
+
+	face := ltrFace.Face()
+	gid, _ := face.NominalGlyph('o')
+	outline := face.GlyphData(gid, 0, 0).(fonts.GlyphOutline)
+	segments := append([]fonts.Segment(nil), outline.Segments...)
+	synthesizeOutline(segments, FlagSyntheticBold, 0, float32(face.Upem()))
+	width := func(segs []fonts.Segment) float32 {
+		minX, maxX := float32(math.Inf(1)), float32(math.Inf(-1))
+		for _, seg := range segs {
+			for _, pt := range seg.ArgsSlice() {
+				minX = float32(math.Min(float64(minX), float64(pt.X)))
+				maxX = float32(math.Max(float64(maxX), float64(pt.X)))
+			}
+		}
+		return maxX - minX
+	}
+	if before, after := width(outline.Segments), width(segments); after <= before {
+		t.Errorf("expected emboldened outline width %v to exceed %v", after, before)
+	}
+}
+
+// TestStemDarkening checks that the advances of small glyphs include the
+// width added by stem darkening, decreasing to none at larger sizes.
+func TestStemDarkening(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	const txt = "hello"
+	const darkening = 16 // A quarter pixel.
+	for _, tc := range []struct {
+		ppem  fixed.Int26_6
+		extra fixed.Int26_6
+	}{
+		{ppem: fixed.I(6), extra: darkening},
+		{ppem: fixed.I(8), extra: darkening},
+		{ppem: fixed.I(16), extra: darkening / 2},
+		{ppem: fixed.I(24), extra: 0},
+	} {
+		params := Parameters{PxPerEm: tc.ppem}
+		plain := shaper.LayoutString(params, 0, 1000, english, txt).lines[0]
+		params.StemDarkening = darkening
+		dark := shaper.LayoutString(params, 0, 1000, english, txt).lines[0]
+		if len(plain.runs) != 1 || len(dark.runs) != 1 {
+			t.Fatalf("%v: expected single runs", tc.ppem)
+		}
+		for i, g := range dark.runs[0].Glyphs {
+			if got, want := g.xAdvance, plain.runs[0].Glyphs[i].xAdvance+tc.extra; got != want {
+				t.Errorf("%v: glyph %d: expected advance %v, got %v", tc.ppem, i, want, got)
+			}
+		}
+		if got, want := dark.width, plain.width+fixed.Int26_6(len(txt))*tc.extra; got != want {
+			t.Errorf("%v: expected width %v, got %v", tc.ppem, want, got)
+		}
+	}
+}
+
+// TestObjectReplacement checks that object replacement runes reserve the
+// configured space.
+func TestObjectReplacement(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	params := Parameters{PxPerEm: fixed.I(10)}
+	plain := shaper.LayoutString(params, 0, 1000, english, "ab").lines[0]
+	params.ObjectSize = fixed.Point26_6{X: fixed.I(30), Y: fixed.I(40)}
+	doc := shaper.LayoutString(params, 0, 1000, english, "a\uFFFCb")
+	line := doc.lines[0]
+	if got, want := line.width, plain.width+params.ObjectSize.X; got != want {
+		t.Errorf("expected line width %v, got %v", want, got)
+	}
+	if line.ascent != params.ObjectSize.Y {
+		t.Errorf("expected line ascent %v, got %v", params.ObjectSize.Y, line.ascent)
+	}
+	runes, glyphs, ok := doc.ClusterAt(1)
+	if !ok || runes != (Range{Offset: 1, Count: 1}) || glyphs != 1 {
+		t.Errorf("expected the object to be a single cluster, got %+v with %d glyphs", runes, glyphs)
+	}
+	for _, run := range line.runs {
+		for _, g := range run.Glyphs {
+			if _, _, gid := splitGlyphID(g.id); gid == placeholderGID {
+				return
+			}
+		}
+	}
+	t.Errorf("no placeholder glyph found")
+}
+
+// TestReordered checks that only lines whose runs are displayed out of
+// logical order are reported as reordered.
+func TestReordered(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	params := Parameters{PxPerEm: fixed.I(10)}
+	ltr := shaper.LayoutString(params, 0, 1000, english, "hello world").lines[0]
+	if ltr.Reordered {
+		t.Errorf("expected a left-to-right line not to be reordered")
+	}
+	bidi := shaper.LayoutString(params, 0, 1000, english, "hello سلام دنیا world").lines[0]
+	if !bidi.Reordered {
+		t.Errorf("expected a bidi line to be reordered, got visual order %v", bidi.visualOrder)
+	}
+}
+
+// TestContentWidth checks that the content width of a centered line spans
+// its glyphs and excludes the alignment padding.
+func TestContentWidth(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10), Alignment: Middle}
+	shaper.LayoutString(params, 200, 200, english, "hello world")
+	// Measure the extent of the glyphs as positioned by the shaper.
+	start, end := fixed.I(200), fixed.Int26_6(0)
+	for g, ok := shaper.NextGlyph(); ok; g, ok = shaper.NextGlyph() {
+		if g.X < start {
+			start = g.X
+		}
+		if e := g.X + g.Advance; e > end {
+			end = e
+		}
+	}
+	doc := shaper.txt
+	if len(doc.lines) != 1 {
+		t.Fatalf("expected 1 line, got %d", len(doc.lines))
+	}
+	for i, ln := range doc.lines {
+		if got, want := ln.ContentWidth(), end-start; got != want {
+			t.Errorf("line %d: expected content width %v, got %v", i, want, got)
+		}
+		if got := ln.ContentWidth(); got >= fixed.I(doc.alignWidth) {
+			t.Errorf("line %d: expected content width %v below the alignment width %d", i, got, doc.alignWidth)
+		}
+		if align := doc.alignment.Align(ln.direction, ln.width, doc.alignWidth); align <= 0 {
+			t.Errorf("line %d: expected the line to be padded, got offset %v", i, align)
+		}
+	}
+}
+
+// TestBidiIsolates checks that isolates direct the bidi algorithm, and that
+// bidi controls are displayed as markers of no width.
+func TestBidiIsolates(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	params := Parameters{PxPerEm: fixed.I(10)}
+	// clusterX returns the position of the cluster of the rune at offset.
+	clusterX := func(l line, offset int) (fixed.Int26_6, glyph) {
+		for _, run := range l.runs {
+			x := run.X
+			for _, g := range run.Glyphs {
+				if g.clusterIndex == offset {
+					return x, g
+				}
+				x += g.xAdvance
+			}
+		}
+		t.Fatalf("no cluster at %d", offset)
+		return 0, glyph{}
+	}
+	// runAt returns the run of the rune at offset.
+	runAt := func(l line, offset int) runLayout {
+		for _, run := range l.runs {
+			if run.Runes.Offset <= offset && offset < run.Runes.Offset+run.Runes.Count {
+				return run
+			}
+		}
+		t.Fatalf("no run at %d", offset)
+		return runLayout{}
+	}
+
+	// The neutral runes of a right-to-left isolate are displayed right to
+	// left.
+	doc := shaper.LayoutString(params, 0, 1000, english, "ab \u2067!?\u2069 cd")
+	l := doc.lines[0]
+	if dir := runAt(l, 4).Direction; dir != system.RTL {
+		t.Errorf("isolate: expected RTL run, got %v", dir)
+	}
+	if dir := runAt(l, 0).Direction; dir != system.LTR {
+		t.Errorf("isolate: expected LTR run before the isolate, got %v", dir)
+	}
+	for _, offset := range []int{3, 6} {
+		_, g := clusterX(l, offset)
+		if _, _, gid := splitGlyphID(g.id); gid != controlGID || g.xAdvance != 0 {
+			t.Errorf("isolate: expected a control marker at %d, got glyph %d of advance %v", offset, gid, g.xAdvance)
+		}
+	}
+	x4, _ := clusterX(l, 4)
+	x5, _ := clusterX(l, 5)
+	if x4 <= x5 {
+		t.Errorf("isolate: expected '!' right of '?', got %v and %v", x4, x5)
+	}
+
+	// Nested isolates: the left-to-right text of a right-to-left isolate
+	// is ordered right to left, including a nested left-to-right isolate.
+	doc = shaper.LayoutString(params, 0, 1000, english, "x \u2067a \u2066b \u0633\u2069\u2069 y")
+	l = doc.lines[0]
+	xa, _ := clusterX(l, 3)
+	xb, _ := clusterX(l, 6)
+	xs, _ := clusterX(l, 8)
+	if xb >= xa {
+		t.Errorf("nested: expected 'b' left of 'a', got %v and %v", xb, xa)
+	}
+	if xs <= xb || xs >= xa {
+		t.Errorf("nested: expected the Arabic letter between 'b' and 'a', got %v", xs)
+	}
+
+	// An unmatched terminator is ignored.
+	doc = shaper.LayoutString(params, 0, 1000, english, "ab \u2069 cd")
+	l = doc.lines[0]
+	for _, run := range l.runs {
+		if run.Direction != system.LTR {
+			t.Errorf("unmatched: expected LTR runs, got %v", run.Direction)
+		}
+	}
+	if l.Reordered {
+		t.Error("unmatched: expected the line in logical order")
+	}
+}
+
+// TestRunFont checks that runs report the fonts of the faces that shaped
+// them.
+func TestRunFont(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	goFont := Font{Typeface: "Go"}
+	arabicFont := Font{Typeface: "Noto Sans Arabic"}
+	shaper := shaperImpl{}
+	shaper.Load(FontFace{Font: goFont, Face: ltrFace})
+	shaper.Load(FontFace{Font: arabicFont, Face: rtlFace})
+	params := Parameters{PxPerEm: fixed.I(10), Font: goFont}
+	doc := shaper.LayoutString(params, 0, 1000, english, "hello \u0633\u0644\u0627\u0645")
+	if len(doc.lines) != 1 {
+		t.Fatalf("expected 1 line, got %d", len(doc.lines))
+	}
+	runs := doc.lines[0].runs
+	if len(runs) != 2 {
+		t.Fatalf("expected 2 runs, got %d", len(runs))
+	}
+	for i, want := range []Font{goFont, arabicFont} {
+		if got := runs[i].Font; got != want {
+			t.Errorf("run %d: expected font %v, got %v", i, want, got)
+		}
+	}
+}
+
+// TestShowIgnorables checks that default-ignorable characters are marked by
+// ShowIgnorables without changing the layout.
+func TestShowIgnorables(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	const txt = "go\u200Bgo\u200Ego"
+	params := Parameters{PxPerEm: fixed.I(10)}
+	plain := shaper.LayoutString(params, 0, 1000, english, txt)
+	params.ShowIgnorables = true
+	doc := shaper.LayoutString(params, 0, 1000, english, txt)
+	if len(plain.lines) != 1 || len(doc.lines) != 1 {
+		t.Fatalf("expected 1 line, got %d and %d", len(plain.lines), len(doc.lines))
+	}
+	if len(plain.lines[0].ignorables) != 0 {
+		t.Errorf("expected no markers without ShowIgnorables, got %v", plain.lines[0].ignorables)
+	}
+	ln := doc.lines[0]
+	if got, want := ln.width, plain.lines[0].width; got != want {
+		t.Errorf("expected width %v, got %v", want, got)
+	}
+	goWidth := shaper.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 1000, english, "go").lines[0].width
+	want := []IgnorableMarker{
+		{Rune: '\u200B', Label: "ZWSP", X: goWidth},
+		{Rune: '\u200E', Label: "LRM", X: 2 * goWidth},
+	}
+	if !reflect.DeepEqual(ln.ignorables, want) {
+		t.Errorf("expected markers %v, got %v", want, ln.ignorables)
+	}
+}
+
+// TestLogicalRuns checks that the runs of a bidi line are returned ordered by
+// rune offset.
+func TestLogicalRuns(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	doc := shaper.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 1000, arabic, "hello سلام world")
+	line := doc.lines[0]
+	runs := line.LogicalRuns()
+	if len(runs) != len(line.runs) || len(runs) < 2 {
+		t.Fatalf("expected %d logical runs, got %d", len(line.runs), len(runs))
+	}
+	offset := 0
+	var width fixed.Int26_6
+	for i, run := range runs {
+		if run.Runes.Offset != offset {
+			t.Errorf("run %d: expected offset %d, got %d", i, offset, run.Runes.Offset)
+		}
+		if run.Width <= 0 {
+			t.Errorf("run %d: expected positive width, got %v", i, run.Width)
+		}
+		offset += run.Runes.Count
+		width += run.Width
+	}
+	if offset != line.runeCount {
+		t.Errorf("expected runs to cover %d runes, got %d", line.runeCount, offset)
+	}
+	if width != line.width {
+		t.Errorf("expected run widths to sum to %v, got %v", line.width, width)
+	}
+}
+
+// TestGlyphRuneOffsets checks that the rune offsets of glyphs are consistent
+// with the rune ranges of their runs and with cluster boundaries.
+func TestGlyphRuneOffsets(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper()
+	shaper.Load(FontFace{Font: Font{Typeface: "LTR"}, Face: ltrFace})
+	shaper.Load(FontFace{Font: Font{Typeface: "RTL"}, Face: rtlFace})
+	doc := shaper.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 60, arabic, "hello لا سلام world\n")
+	for i, line := range doc.lines {
+		for j, run := range line.runs {
+			// Map each cluster's rune offset to its rune count.
+			clusters := make(map[int]int)
+			for _, g := range run.Glyphs {
+				if g.runeOffset < run.Runes.Offset || g.runeOffset >= run.Runes.Offset+run.Runes.Count {
+					t.Errorf("line %d run %d: glyph rune offset %d outside run runes %+v", i, j, g.runeOffset, run.Runes)
+				}
+				if n, ok := clusters[g.runeOffset]; ok && n != g.runeCount {
+					t.Errorf("line %d run %d: glyphs at rune offset %d disagree on cluster size", i, j, g.runeOffset)
+				}
+				clusters[g.runeOffset] = g.runeCount
+			}
+			// The clusters must tile the runes of the run.
+			for offset := run.Runes.Offset; offset < run.Runes.Offset+run.Runes.Count; {
+				n, ok := clusters[offset]
+				if !ok || n == 0 {
+					t.Errorf("line %d run %d: no cluster starts at rune %d", i, j, offset)
+					break
+				}
+				offset += n
+			}
+		}
+	}
+}
+
+// TestGlyphOrders checks the visual and logical glyph orders of a bidi line.
+func TestGlyphOrders(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper()
+	shaper.Load(FontFace{Font: Font{Typeface: "LTR"}, Face: ltrFace})
+	shaper.Load(FontFace{Font: Font{Typeface: "RTL"}, Face: rtlFace})
+	doc := shaper.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 1000, english, "hello سلام world")
+	line := doc.lines[0]
+	visual, logical := line.GlyphsVisual(), line.GlyphsLogical()
+	if len(visual) != len(logical) {
+		t.Fatalf("visual order has %d glyphs, logical order %d", len(visual), len(logical))
+	}
+	var x fixed.Int26_6
+	for i, g := range visual {
+		if g.x != x {
+			t.Errorf("visual glyph %d: expected x %v, got %v", i, x, g.x)
+		}
+		x += g.xAdvance
+	}
+	if x != line.width {
+		t.Errorf("expected visual glyphs to span %v, got %v", line.width, x)
+	}
+	differ := false
+	for i, g := range logical {
+		if i > 0 && g.runeOffset < logical[i-1].runeOffset {
+			t.Errorf("logical glyph %d: rune offset %d precedes %d", i, g.runeOffset, logical[i-1].runeOffset)
+		}
+		differ = differ || g != visual[i]
+	}
+	if !differ {
+		t.Errorf("expected visual and logical orders to differ")
+	}
+}
+
+// TestTabRTL checks that the tab stops of right-to-left text are measured
+// from the right edge.
+func TestTabRTL(t *testing.T) {
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(rtlFace)
+	tabWidth := fixed.I(40)
+	params := Parameters{PxPerEm: fixed.I(10), TabWidth: tabWidth}
+	const before, after = "سلام", "عالم"
+	doc := shaper.LayoutString(params, 0, 1000, arabic, before+"\t"+after)
+	line := doc.lines[0]
+	// Find the right edge of the text following the tab.
+	var right fixed.Int26_6
+	for _, g := range line.GlyphsVisual() {
+		if g.runeOffset > len([]rune(before)) && g.x+g.xAdvance > right {
+			right = g.x + g.xAdvance
+		}
+	}
+	if got := line.width - right; got != tabWidth {
+		t.Errorf("expected text after the tab at %v from the right edge, got %v", tabWidth, got)
+	}
+}
+
+// TestDebugKerning checks that the kerning of glyph pairs is recorded only
+// when requested, and that it matches the kerning of the font.
+func TestDebugKerning(t *testing.T) {
+	robotoFace, _ := opentype.Parse(robotoregular.TTF)
+	shaper := testShaper(robotoFace)
+	// At 32px, Roboto's 2048 units per em are 1/64 pixel each, so the
+	// recorded adjustments equal the kerning in font units.
+	params := Parameters{PxPerEm: fixed.I(32)}
+	doc := shaper.LayoutString(params, 0, 1000, english, "AV o")
+	if k := doc.lines[0].runs[0].Kerning; k != nil {
+		t.Errorf("recorded kerning %v without DebugKerning", k)
+	}
+	params.DebugKerning = true
+	doc = shaper.LayoutString(params, 0, 1000, english, "AV o")
+	run := doc.lines[0].runs[0]
+	if got, want := len(run.Kerning), len(run.Glyphs)-1; got != want {
+		t.Fatalf("expected %d adjustments, got %d", want, got)
+	}
+	// Roboto kerns the pair "AV" by -87 units, and the other pairs not at all.
+	want := []fixed.Int26_6{-87, 0, 0}
+	for i, k := range run.Kerning {
+		if k != want[i] {
+			t.Errorf("pair %d: expected kerning %d, got %d", i, want[i], k)
+		}
+	}
+}
+
+// TestSplitLongRuns checks that runs are split at cluster boundaries into runs
+// of a bounded number of glyphs that together match the unsplit run.
+func TestSplitLongRuns(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	for _, tc := range []struct {
+		name   string
+		locale system.Locale
+		txt    string
+	}{
+		{"ltr", english, strings.Repeat("abcdefg", 20)},
+		{"rtl", arabic, strings.Repeat("سماء", 30)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			shaper := testShaper(ltrFace, rtlFace)
+			params := Parameters{PxPerEm: fixed.I(10)}
+			whole := shaper.LayoutString(params, 0, math.MaxInt, tc.locale, tc.txt)
+			validateLines(t, whole.lines, len([]rune(tc.txt)))
+			if n := len(whole.lines[0].runs); n != 1 {
+				t.Fatalf("expected a single run, got %d", n)
+			}
+			const max = 16
+			shaper.maxRunGlyphs = max
+			split := shaper.LayoutString(params, 0, math.MaxInt, tc.locale, tc.txt)
+			validateLines(t, split.lines, len([]rune(tc.txt)))
+			ln := split.lines[0]
+			if len(ln.runs) < 2 {
+				t.Fatalf("expected the run to be split, got %d runs", len(ln.runs))
+			}
+			glyphs, runes := 0, 0
+			var width fixed.Int26_6
+			for i, run := range ln.runs {
+				if len(run.Glyphs) > max {
+					t.Errorf("run %d: %d glyphs exceed %d", i, len(run.Glyphs), max)
+				}
+				if run.Runes.Offset != runes {
+					t.Errorf("run %d: expected rune offset %d, got %d", i, runes, run.Runes.Offset)
+				}
+				glyphs += len(run.Glyphs)
+				runes += run.Runes.Count
+				width += run.Advance
+			}
+			if want := len(whole.lines[0].runs[0].Glyphs); glyphs != want {
+				t.Errorf("expected %d glyphs, got %d", want, glyphs)
+			}
+			if want := whole.lines[0].width; width != want || ln.width != want {
+				t.Errorf("expected width %v, got runs %v and line %v", want, width, ln.width)
+			}
+		})
+	}
+}
+
+// TestSizeAdjust checks that runs of fallback faces are scaled to the x-height
+// of the primary face, and that their effective size is reported.
+func TestSizeAdjust(t *testing.T) {
+	robotoFace, _ := opentype.Parse(robotoregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper()
+	shaper.Load(FontFace{Font: Font{Typeface: "Roboto"}, Face: robotoFace})
+	shaper.Load(FontFace{Font: Font{Typeface: "Noto"}, Face: rtlFace})
+	const txt = "abc سماء"
+	params := Parameters{PxPerEm: fixed.I(20), Font: Font{Typeface: "Roboto"}}
+	for _, adjust := range []bool{false, true} {
+		params.SizeAdjust = adjust
+		doc := shaper.LayoutString(params, 0, 1000, english, txt)
+		runs := doc.lines[0].runs
+		if len(runs) < 2 {
+			t.Fatalf("adjust %v: expected a fallback run, got %d runs", adjust, len(runs))
+		}
+		primary, fallback := runs[0], runs[len(runs)-1]
+		if primary.face != robotoFace.Face() || fallback.face != rtlFace.Face() {
+			t.Fatalf("adjust %v: unexpected faces of runs", adjust)
+		}
+		if primary.PPEM != params.PxPerEm {
+			t.Errorf("adjust %v: expected primary size %v, got %v", adjust, params.PxPerEm, primary.PPEM)
+		}
+		if !adjust {
+			if fallback.PPEM != params.PxPerEm {
+				t.Errorf("expected unadjusted fallback size %v, got %v", params.PxPerEm, fallback.PPEM)
+			}
+			continue
+		}
+		// Roboto's x-height is 1082/2048 em, Noto Sans Arabic's 374/1000 em.
+		want := fixed.Int26_6(float32(params.PxPerEm) * (1082. / 2048) / (374. / 1000))
+		if d := fallback.PPEM - want; d < -1 || d > 1 {
+			t.Errorf("expected adjusted fallback size %v, got %v", want, fallback.PPEM)
+		}
+	}
+}
+
+// TestLetterSpacing checks that letter spacing is added between clusters, but
+// not after the final cluster of lines.
+func TestLetterSpacing(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	clusters := func(l line) int {
+		n := 0
+		for _, run := range l.runs {
+			forEachCluster(run, func(_, _ Range, _, _ fixed.Int26_6) { n++ })
+		}
+		return n
+	}
+	for _, tc := range []struct {
+		name    string
+		locale  system.Locale
+		txt     string
+		spacing fixed.Int26_6
+	}{
+		{"ltr", english, "spacing", fixed.I(2)},
+		{"negative", english, "spacing", -fixed.I(1)},
+		{"rtl", arabic, "سماء", fixed.I(3)},
+		{"bidi", english, "abc سماء def", fixed.I(2)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := Parameters{PxPerEm: fixed.I(10)}
+			plain := shaper.LayoutString(params, 0, 1000, tc.locale, tc.txt)
+			params.LetterSpacing = tc.spacing
+			spaced := shaper.LayoutString(params, 0, 1000, tc.locale, tc.txt)
+			if len(plain.lines) != 1 || len(spaced.lines) != 1 {
+				t.Fatalf("expected single lines, got %d and %d", len(plain.lines), len(spaced.lines))
+			}
+			n := clusters(plain.lines[0])
+			want := plain.lines[0].width + fixed.Int26_6(n-1)*tc.spacing
+			if got := spaced.lines[0].width; got != want {
+				t.Errorf("expected width %v for %d clusters, got %v", want, n, got)
+			}
+			var x fixed.Int26_6
+			for _, idx := range spaced.lines[0].visualOrder {
+				run := spaced.lines[0].runs[idx]
+				if run.X != x {
+					t.Errorf("run %d: expected x %v, got %v", idx, x, run.X)
+				}
+				if run.Advance < 0 {
+					t.Errorf("run %d: negative advance %v", idx, run.Advance)
+				}
+				x += run.Advance
+			}
+		})
+	}
+	// Spacing never reduces the advance of clusters below zero.
+	params := Parameters{PxPerEm: fixed.I(10), LetterSpacing: -fixed.I(100)}
+	doc := shaper.LayoutString(params, 0, 1000, english, "spacing")
+	for _, run := range doc.lines[0].runs {
+		forEachCluster(run, func(_, _ Range, _, advance fixed.Int26_6) {
+			if advance < 0 {
+				t.Errorf("negative cluster advance %v", advance)
+			}
+		})
+		if run.Advance < 0 {
+			t.Errorf("negative run advance %v", run.Advance)
+		}
+	}
+	if w := doc.lines[0].width; w < 0 {
+		t.Errorf("negative line width %v", w)
+	}
+}
+
+// TestWordSpacing checks that word spacing widens breaking spaces only, and
+// that lines are wrapped with the widened spaces.
+func TestWordSpacing(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	const spacing = 5 << 6
+	for _, tc := range []struct {
+		name   string
+		locale system.Locale
+		txt    string
+		spaces int
+	}{
+		{"ltr", english, "a b c d", 3},
+		{"nbsp", english, "a b c", 1},
+		{"rtl", arabic, "سماء جميل سماء", 2},
+		{"bidi", english, "abc سماء جميل def", 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := Parameters{PxPerEm: fixed.I(10)}
+			plain := shaper.LayoutString(params, 0, 1000, tc.locale, tc.txt)
+			params.WordSpacing = spacing
+			spaced := shaper.LayoutString(params, 0, 1000, tc.locale, tc.txt)
+			if len(plain.lines) != 1 || len(spaced.lines) != 1 {
+				t.Fatalf("expected single lines, got %d and %d", len(plain.lines), len(spaced.lines))
+			}
+			want := plain.lines[0].width + fixed.Int26_6(tc.spaces)*spacing
+			if got := spaced.lines[0].width; got != want {
+				t.Errorf("expected width %v for %d spaces, got %v", want, tc.spaces, got)
+			}
+		})
+	}
+	// Wrapping accounts for the widened spaces.
+	params := Parameters{PxPerEm: fixed.I(10)}
+	const txt = "go go go go"
+	plain := shaper.LayoutString(params, 0, 1000, english, txt)
+	maxWidth := plain.lines[0].width.Ceil() + 1
+	if doc := shaper.LayoutString(params, 0, maxWidth, english, txt); len(doc.lines) != 1 {
+		t.Errorf("expected a single line without word spacing, got %d", len(doc.lines))
+	}
+	params.WordSpacing = spacing
+	if doc := shaper.LayoutString(params, 0, maxWidth, english, txt); len(doc.lines) < 2 {
+		t.Errorf("expected widened spaces to wrap, got %d lines", len(doc.lines))
+	}
+}
+
+// TestSoftHyphen checks that a hyphen is displayed only where a line is
+// broken at a soft hyphen.
+func TestSoftHyphen(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	params := Parameters{PxPerEm: fixed.I(20)}
+	const txt = "hyphen\u00ADation"
+	plain := shaper.LayoutString(params, 0, 1000, english, "hyphenation")
+	unbroken := shaper.LayoutString(params, 0, 1000, english, txt)
+	if len(unbroken.lines) != 1 {
+		t.Fatalf("expected a single line, got %d", len(unbroken.lines))
+	}
+	if got, want := unbroken.lines[0].width, plain.lines[0].width; got != want {
+		t.Errorf("expected invisible soft hyphen, got width %v instead of %v", got, want)
+	}
+	hyphen := shaper.LayoutString(params, 0, 1000, english, "-").lines[0].width
+	prefix := shaper.LayoutString(params, 0, 1000, english, "hyphen").lines[0].width
+	maxWidth := (prefix + hyphen).Ceil()
+	broken := shaper.LayoutString(params, 0, maxWidth, english, txt)
+	validateLines(t, broken.lines, len([]rune(txt)))
+	if len(broken.lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(broken.lines))
+	}
+	first := broken.lines[0]
+	if first.runeCount != 7 {
+		t.Errorf("expected break after the soft hyphen, got %d runes", first.runeCount)
+	}
+	if got, want := first.width, prefix+hyphen; got != want {
+		t.Errorf("expected line width %v including the hyphen, got %v", want, got)
+	}
+	glyphs := first.GlyphsLogical()
+	if last := glyphs[len(glyphs)-1]; last.xAdvance != hyphen || last.runeCount != 1 {
+		t.Errorf("expected hyphen glyph of advance %v for the soft hyphen, got %v for %d runes", hyphen, last.xAdvance, last.runeCount)
+	}
+	// The line must fit the hyphen for the break to be taken.
+	withoutHyphen := shaper.LayoutString(params, 0, 1000, english, "a hyphen").lines[0].width
+	narrow := shaper.LayoutString(params, 0, withoutHyphen.Ceil(), english, "a "+txt)
+	if n := narrow.lines[0].runeCount; n != 2 {
+		t.Errorf("expected break before the word, got %d runes on the first line", n)
+	}
+}
+
+// TestTruncator checks that the truncator replaces the end of the last line
+// of truncated text and maps to the truncation point.
+func TestTruncator(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	const maxWidth = 60
+	for _, tc := range []struct {
+		name   string
+		locale system.Locale
+		txt    string
+	}{
+		{"ltr", english, "mmmm mmmm mmmm mmmm mmmm"},
+		{"rtl", arabic, "سماء سماء سماء سماء سماء سماء سماء"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := Parameters{PxPerEm: fixed.I(10), MaxLines: 1, Truncator: "…"}
+			doc := shaper.LayoutString(params, 0, maxWidth, tc.locale, tc.txt)
+			if len(doc.lines) != 1 {
+				t.Fatalf("expected 1 line, got %d", len(doc.lines))
+			}
+			ln := doc.lines[0]
+			if ln.width.Ceil() > maxWidth {
+				t.Errorf("expected line to fit %d, got width %v", maxWidth, ln.width)
+			}
+			if got, want := doc.Truncated, len([]rune(tc.txt))-ln.runeCount; got != want {
+				t.Errorf("expected %d truncated runes, got %d", want, got)
+			}
+			// The truncator is the logically last run and at the visual end
+			// of the line.
+			trunc := ln.runs[len(ln.runs)-1]
+			if trunc.Runes.Count != 0 || trunc.Runes.Offset != ln.runeCount || len(trunc.Glyphs) == 0 {
+				t.Fatalf("expected truncator run of no runes at %d, got %+v", ln.runeCount, trunc.Runes)
+			}
+			visualEnd := ln.visualOrder[len(ln.visualOrder)-1]
+			if tc.locale.Direction == system.RTL {
+				visualEnd = ln.visualOrder[0]
+			}
+			if visualEnd != len(ln.runs)-1 {
+				t.Errorf("expected truncator at the visual end of the line, got position %d", trunc.VisualPosition)
+			}
+			for _, g := range trunc.Glyphs {
+				if g.runeCount != 0 || g.runeOffset != ln.runeCount {
+					t.Errorf("expected truncator glyph of no runes at %d, got %d runes at %d", ln.runeCount, g.runeCount, g.runeOffset)
+				}
+			}
+			x := float32(trunc.X+trunc.Advance/2) / 64
+			if off, ok := doc.runeAt(x, float32(ln.yOffset)); !ok || off != ln.runeCount {
+				t.Errorf("expected hit test of truncator at %d, got %d, %v", ln.runeCount, off, ok)
+			}
+		})
+	}
+	// Text that fits is not given a truncator.
+	params := Parameters{PxPerEm: fixed.I(10), MaxLines: 1, Truncator: "…"}
+	doc := shaper.LayoutString(params, 0, 1000, english, "mmmm")
+	if n := len(doc.lines[0].runs); n != 1 {
+		t.Errorf("expected a single run without truncation, got %d", n)
+	}
+}
+
+// TestTruncatorEllipsis checks that an ellipsis truncator is displayed as
+// three periods by faces lacking the ellipsis glyph.
+func TestTruncatorEllipsis(t *testing.T) {
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	if _, ok := rtlFace.Face().NominalGlyph('…'); ok {
+		t.Fatal("expected a face without an ellipsis glyph")
+	}
+	shaper := testShaper(rtlFace)
+	params := Parameters{PxPerEm: fixed.I(10)}
+	periods := shaper.LayoutString(params, 0, 1000, arabic, "...").lines[0]
+	params.MaxLines, params.Truncator = 1, "…"
+	doc := shaper.LayoutString(params, 0, 60, arabic, "سماء سماء سماء سماء سماء سماء سماء")
+	ln := doc.lines[0]
+	trunc := ln.runs[len(ln.runs)-1]
+	if n := len(trunc.Glyphs); n != 3 {
+		t.Fatalf("expected 3 period glyphs, got %d", n)
+	}
+	want := periods.runs[0].Glyphs[0].id
+	for i, g := range trunc.Glyphs {
+		if g.id != want {
+			t.Errorf("glyph %d: expected period glyph %v, got %v", i, want, g.id)
+		}
+	}
+	if got, want := trunc.Advance, periods.width; got != want {
+		t.Errorf("expected truncator width %v, got %v", want, got)
+	}
+}
+
+// TestJustify checks that justified lines fill the maximum width, except for
+// the last line of a paragraph unless JustifyLastLine is set.
+func TestJustify(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	const maxWidth = 100
+	params := Parameters{PxPerEm: fixed.I(10), Alignment: Justify}
+	checkRuns := func(t *testing.T, l line) {
+		var x fixed.Int26_6
+		for _, idx := range l.visualOrder {
+			run := l.runs[idx]
+			if run.X != x {
+				t.Errorf("run %d: expected x %v, got %v", idx, x, run.X)
+			}
+			x += run.Advance
+		}
+		if x != l.width {
+			t.Errorf("expected runs to cover width %v, got %v", l.width, x)
+		}
+	}
+	doc := shaper.LayoutString(params, 0, maxWidth, english, "go go go go go go go go go go go go go")
+	if len(doc.lines) < 2 {
+		t.Fatalf("expected wrapped lines, got %d", len(doc.lines))
+	}
+	for i, l := range doc.lines[:len(doc.lines)-1] {
+		if l.width != fixed.I(maxWidth) {
+			t.Errorf("line %d: expected width %v, got %v", i, fixed.I(maxWidth), l.width)
+		}
+		checkRuns(t, l)
+	}
+	last := doc.lines[len(doc.lines)-1]
+	if last.width >= fixed.I(maxWidth) {
+		t.Errorf("expected last line to not be stretched, got width %v", last.width)
+	}
+
+	// A single line is the last line of its paragraph.
+	const txt = "one line"
+	plain := shaper.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, maxWidth, english, txt)
+	single := shaper.LayoutString(params, 0, maxWidth, english, txt)
+	if got, want := single.lines[0].width, plain.lines[0].width; got != want {
+		t.Errorf("expected unstretched single line of width %v, got %v", want, got)
+	}
+	params.JustifyLastLine = true
+	single = shaper.LayoutString(params, 0, maxWidth, english, txt)
+	if got := single.lines[0].width; got != fixed.I(maxWidth) {
+		t.Errorf("expected JustifyLastLine to stretch the line to %v, got %v", fixed.I(maxWidth), got)
+	}
+	checkRuns(t, single.lines[0])
+}
+
+// TestJustifySoftHyphen checks that the hyphen of a justified line broken at a
+// soft hyphen ends at the edge of the line, with the spaces justified before
+// it.
+func TestJustifySoftHyphen(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	params := Parameters{PxPerEm: fixed.I(20)}
+	const txt = "a b hyphen\u00ADation"
+	space := shaper.LayoutString(params, 0, 1000, english, " ").lines[0].width
+	// Leave some room for justification after "a b hyphen-".
+	maxWidth := shaper.LayoutString(params, 0, 1000, english, "a b hyphen-").lines[0].width.Ceil() + 10
+	params.Alignment = Justify
+	doc := shaper.LayoutString(params, 0, maxWidth, english, txt)
+	if len(doc.lines) != 2 || doc.lines[0].runeCount != 11 {
+		t.Fatalf("expected a break at the soft hyphen, got %d lines", len(doc.lines))
+	}
+	ln := doc.lines[0]
+	if ln.width != fixed.I(maxWidth) {
+		t.Errorf("expected justified width %v, got %v", fixed.I(maxWidth), ln.width)
+	}
+	glyphs := ln.GlyphsVisual()
+	last := glyphs[len(glyphs)-1]
+	if last.runeOffset != 10 || last.xAdvance == 0 {
+		t.Fatalf("expected the hyphen to be the visually last glyph, got rune %d", last.runeOffset)
+	}
+	if end := last.x + last.xAdvance; end != fixed.I(maxWidth) {
+		t.Errorf("expected the hyphen to end at the edge %v, got %v", fixed.I(maxWidth), end)
+	}
+	for _, g := range glyphs {
+		if (g.runeOffset == 1 || g.runeOffset == 3) && g.xAdvance <= space {
+			t.Errorf("expected space at %d to be widened, got advance %v", g.runeOffset, g.xAdvance)
+		}
+	}
+}
+
+// TestKashida checks that justified Arabic lines are stretched by tatweels
+// elongating the connections between letters, and spaces absorb only the
+// remaining width.
+func TestKashida(t *testing.T) {
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(rtlFace)
+	const maxWidth = 100
+	const txt = "سماء سماء سماء سماء سماء سماء سماء سماء"
+	params := Parameters{PxPerEm: fixed.I(10), Alignment: Justify}
+	tatweelID := shaper.LayoutString(params, 0, 1000, arabic, "\u0640").lines[0].runs[0].Glyphs[0].id
+	// spaces returns the total advance of the spaces of l, and the number of
+	// tatweels.
+	spaces := func(l line) (fixed.Int26_6, int) {
+		var adv fixed.Int26_6
+		tatweels := 0
+		for _, run := range l.runs {
+			for _, g := range run.Glyphs {
+				if g.id == tatweelID {
+					tatweels++
+				} else if []rune(txt)[g.clusterIndex] == ' ' {
+					adv += g.xAdvance
+				}
+			}
+		}
+		return adv, tatweels
+	}
+	plain := shaper.LayoutString(params, 0, maxWidth, arabic, txt)
+	params.Kashida = true
+	doc := shaper.LayoutString(params, 0, maxWidth, arabic, txt)
+	validateLines(t, doc.lines, len([]rune(txt)))
+	if len(doc.lines) != len(plain.lines) || len(doc.lines) < 2 {
+		t.Fatalf("expected %d wrapped lines, got %d", len(plain.lines), len(doc.lines))
+	}
+	for i, l := range doc.lines[:len(doc.lines)-1] {
+		if l.width != fixed.I(maxWidth) {
+			t.Errorf("line %d: expected width %v, got %v", i, fixed.I(maxWidth), l.width)
+		}
+		space, tatweels := spaces(l)
+		plainSpace, _ := spaces(plain.lines[i])
+		if tatweels == 0 {
+			t.Errorf("line %d: expected elongation by tatweels", i)
+		}
+		if space >= plainSpace {
+			t.Errorf("line %d: expected spaces narrower than %v, got %v", i, plainSpace, space)
+		}
+	}
+	if _, tatweels := spaces(doc.lines[len(doc.lines)-1]); tatweels != 0 {
+		t.Errorf("expected no tatweels in the last line, got %d", tatweels)
+	}
+}
+
+// TestRoundMode checks that glyph advances are snapped to whole pixels with
+// positions rounded by the mode, so the width stays close to the unsnapped
+// width.
+func TestRoundMode(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	const txt = "Illicit minimum; quill."
+	params := Parameters{PxPerEm: fixed.I(11)}
+	exact := shaper.LayoutString(params, 0, 1000, english, txt).lines[0]
+	var positions []fixed.Int26_6
+	var x fixed.Int26_6
+	for _, g := range exact.runs[0].Glyphs {
+		x += g.xAdvance
+		positions = append(positions, x)
+	}
+	if x%64 == 0 {
+		t.Fatalf("expected a fractional width, got %v", x)
+	}
+	for _, tc := range []struct {
+		mode  RoundMode
+		round func(fixed.Int26_6) fixed.Int26_6
+	}{
+		{RoundFloor, func(v fixed.Int26_6) fixed.Int26_6 { return fixed.I(v.Floor()) }},
+		{RoundNearest, func(v fixed.Int26_6) fixed.Int26_6 { return fixed.I(v.Round()) }},
+		{RoundCeil, func(v fixed.Int26_6) fixed.Int26_6 { return fixed.I(v.Ceil()) }},
+	} {
+		params.RoundMode = tc.mode
+		ln := shaper.LayoutString(params, 0, 1000, english, txt).lines[0]
+		var x fixed.Int26_6
+		for i, g := range ln.runs[0].Glyphs {
+			if g.xAdvance%64 != 0 {
+				t.Errorf("mode %d, glyph %d: expected integral advance, got %v", tc.mode, i, g.xAdvance)
+			}
+			x += g.xAdvance
+			if want := tc.round(positions[i]); x != want {
+				t.Errorf("mode %d, glyph %d: expected position %v, got %v", tc.mode, i, want, x)
+			}
+		}
+		if ln.width != x || ln.runs[0].Advance != x {
+			t.Errorf("mode %d: expected line and run width %v, got %v and %v", tc.mode, x, ln.width, ln.runs[0].Advance)
+		}
+		if d := ln.width - exact.width; d <= -fixed.I(1) || d >= fixed.I(1) {
+			t.Errorf("mode %d: width %v too far from unsnapped width %v", tc.mode, ln.width, exact.width)
+		}
+	}
+}
+
+// stubHyphenator breaks "hyphenation" after "hy".
+type stubHyphenator struct {
+	calls int
+	lang  string
+}
+
+func (h *stubHyphenator) BreakPoints(word []rune, lang string) []int {
+	h.calls++
+	h.lang = lang
+	if string(word) == "hyphenation" {
+		return []int{2}
+	}
+	return nil
+}
+
+// TestHyphenation checks that words that would overflow their line are
+// broken at the points of the hyphenator, ending the line with a hyphen.
+func TestHyphenation(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	h := new(stubHyphenator)
+	params := Parameters{PxPerEm: fixed.I(20), Hyphenation: h}
+	const txt = "a hyphenation"
+	measure := func(s string) fixed.Int26_6 {
+		return shaper.LayoutString(Parameters{PxPerEm: params.PxPerEm}, 0, 1000, english, s).lines[0].width
+	}
+	hyphen, prefix := measure("-"), measure("a hy")
+
+	wide := shaper.LayoutString(params, 0, 1000, english, txt)
+	if len(wide.lines) != 1 {
+		t.Errorf("expected a single line, got %d", len(wide.lines))
+	}
+	if h.calls != 0 {
+		t.Errorf("expected no hyphenation of fitting words, got %d calls", h.calls)
+	}
+
+	broken := shaper.LayoutString(params, 0, (prefix + hyphen).Ceil(), english, txt)
+	validateLines(t, broken.lines, len([]rune(txt)))
+	if len(broken.lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(broken.lines))
+	}
+	first := broken.lines[0]
+	if first.runeCount != 4 {
+		t.Errorf("expected break after \"hy\", got %d runes", first.runeCount)
+	}
+	if got, want := first.width, prefix+hyphen; got != want {
+		t.Errorf("expected line width %v including the hyphen, got %v", want, got)
+	}
+	glyphs := first.GlyphsLogical()
+	if last := glyphs[len(glyphs)-1]; last.xAdvance != hyphen || last.runeOffset != 3 {
+		t.Errorf("expected hyphen of advance %v in the cluster of rune 3, got %v in rune %d", hyphen, last.xAdvance, last.runeOffset)
+	}
+	if h.lang != english.Language {
+		t.Errorf("expected hyphenation language %q, got %q", english.Language, h.lang)
+	}
+
+	// Without room for "hy" and the hyphen, the word moves to the next line
+	// unbroken.
+	narrow := shaper.LayoutString(params, 0, (measure("a ") + hyphen).Ceil(), english, txt)
+	if len(narrow.lines) != 2 || narrow.lines[0].runeCount != 2 {
+		t.Errorf("expected break before the word, got %d lines", len(narrow.lines))
+	}
+	for _, l := range narrow.lines {
+		if l.width > measure("hyphenation") {
+			t.Errorf("expected no hyphen, got line width %v", l.width)
+		}
+	}
+}
+
+// TestDisableMarkPositioning checks that turning off the mark and mkmk
+// features changes the placement of stacked combining marks.
+func TestDisableMarkPositioning(t *testing.T) {
+	robotoFace, _ := opentype.Parse(robotoregular.TTF)
+	shaper := testShaper(robotoFace)
+	// x followed by two combining acute accents.
+	const txt = "x́́"
+	offsets := func(params Parameters) []fixed.Point26_6 {
+		params.PxPerEm = fixed.I(32)
+		doc := shaper.LayoutString(params, 0, 1000, english, txt)
+		runs := doc.lines[0].runs
+		// Marks must be shaped in the run of their base to be positioned.
+		if len(runs) != 1 || len(runs[0].Glyphs) != 3 {
+			t.Fatalf("expected a single run of 3 glyphs, got %d runs", len(runs))
+		}
+		var offs []fixed.Point26_6
+		for _, g := range runs[0].Glyphs[1:] {
+			offs = append(offs, fixed.Point26_6{X: g.xOffset, Y: g.yOffset})
+		}
+		return offs
+	}
+	def := offsets(Parameters{})
+	noMark := offsets(Parameters{DisableMark: true})
+	noMarkToMark := offsets(Parameters{DisableMarkToMark: true})
+	if def[0] == noMark[0] {
+		t.Errorf("first mark at %v regardless of mark positioning", def[0])
+	}
+	if def[0] != noMarkToMark[0] {
+		t.Errorf("first mark moved from %v to %v without mark to mark positioning", def[0], noMarkToMark[0])
+	}
+	if def[1] == noMarkToMark[1] {
+		t.Errorf("stacked mark at %v regardless of mark to mark positioning", def[1])
+	}
+	// Without mkmk, the stacked mark is attached to the base like the first.
+	if noMarkToMark[1] != noMarkToMark[0] {
+		t.Errorf("expected both marks at %v without mark to mark positioning, got %v", noMarkToMark[0], noMarkToMark[1])
+	}
+}
+
+// TestFeatures checks that Parameters.Features is applied while shaping.
+func TestFeatures(t *testing.T) {
+	robotoFace, _ := opentype.Parse(robotoregular.TTF)
+	shaper := testShaper(robotoFace)
+	params := Parameters{PxPerEm: fixed.I(20)}
+	glyphs := func(params Parameters) int {
+		return len(shaper.LayoutString(params, 0, 1000, english, "fi").lines[0].runs[0].Glyphs)
+	}
+	if n := glyphs(params); n != 1 {
+		t.Fatalf("expected the fi ligature by default, got %d glyphs", n)
+	}
+	params.Features = []FontFeature{{Tag: truetype.MustNewTag("liga"), Value: 0}}
+	if n := glyphs(params); n != 2 {
+		t.Errorf("expected 2 glyphs without ligatures, got %d", n)
+	}
+}
+
+// TestTabularNumbers checks that TabularNumbers gives figures equal
+// advances, and leaves faces without the tnum feature unchanged.
+func TestTabularNumbers(t *testing.T) {
+	robotoFace, _ := opentype.Parse(robotoregular.TTF)
+	shaper := testShaper(robotoFace)
+	// Roboto figures are tabular by default, so start from proportional
+	// figures.
+	params := Parameters{PxPerEm: fixed.I(20), Features: []FontFeature{{Tag: truetype.MustNewTag("pnum"), Value: 1}}}
+	width := func(shaper *shaperImpl, params Parameters, txt string) fixed.Int26_6 {
+		return shaper.LayoutString(params, 0, 1000, english, txt).lines[0].width
+	}
+	if ones, zeros := width(shaper, params, "111"), width(shaper, params, "000"); ones == zeros {
+		t.Fatalf("expected proportional figures of different widths, got %v", ones)
+	}
+	params.TabularNumbers = true
+	if ones, zeros := width(shaper, params, "111"), width(shaper, params, "000"); ones != zeros {
+		t.Errorf("expected tabular figures of equal widths, got %v and %v", ones, zeros)
+	}
+
+	arabicFace, _ := opentype.Parse(nsareg.TTF)
+	shaper = testShaper(arabicFace)
+	const digits = "١٢٣٠"
+	if got, want := width(shaper, Parameters{PxPerEm: fixed.I(20), TabularNumbers: true}, digits), width(shaper, Parameters{PxPerEm: fixed.I(20)}, digits); got != want {
+		t.Errorf("expected width %v for a face without tnum, got %v", want, got)
+	}
+}
+
+// TestSyntheticSmallCaps checks that small capitals are synthesized for
+// faces without the smcp feature, and that the scale is reported.
+func TestSyntheticSmallCaps(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	params := Parameters{PxPerEm: fixed.I(20), SmallCaps: true}
+	ln := shaper.LayoutString(params, 0, 1000, english, "Mm").lines[0]
+	if len(ln.runs) != 2 {
+		t.Fatalf("expected runs for the capital and the small capital, got %d", len(ln.runs))
+	}
+	capital, small := ln.runs[0], ln.runs[1]
+	if capital.SmallCapsScale != 0 || capital.PPEM != params.PxPerEm {
+		t.Errorf("expected unscaled capital, got scale %v at %v", capital.SmallCapsScale, capital.PPEM)
+	}
+	scale := small.SmallCapsScale
+	if scale < 0.7 || scale > 0.8 {
+		t.Errorf("expected small caps scale in [0.7, 0.8], got %v", scale)
+	}
+	if want := fixed.Int26_6(float32(params.PxPerEm) * scale); small.PPEM != want {
+		t.Errorf("expected small capital size %v, got %v", want, small.PPEM)
+	}
+	// The small capital is the glyph of the capital, at the smaller size.
+	if got, want := small.Glyphs[0].id&(1<<gidbits-1), capital.Glyphs[0].id&(1<<gidbits-1); got != want {
+		t.Errorf("expected glyph %d of the capital, got %d", want, got)
+	}
+	if small.Advance >= capital.Advance {
+		t.Errorf("expected small capital narrower than %v, got %v", capital.Advance, small.Advance)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	// The post and OS/2 tables of Go Regular, in units of its 2048 unit em.
+	const (
+		underlinePosition      = -275
+		underlineThickness     = 50
+		strikethroughPosition  = 512
+		strikethroughThickness = 102
+	)
+	m := shaper.Metrics(Font{}, fixed.I(2048))
+	if got, want := m.UnderlinePosition, fixed.I(underlinePosition); got != want {
+		t.Errorf("underline position: got %v, want %v", got, want)
+	}
+	if got, want := m.UnderlineThickness, fixed.I(underlineThickness); got != want {
+		t.Errorf("underline thickness: got %v, want %v", got, want)
+	}
+	if got, want := m.StrikethroughPosition, fixed.I(strikethroughPosition); got != want {
+		t.Errorf("strikethrough position: got %v, want %v", got, want)
+	}
+	if got, want := m.StrikethroughThickness, fixed.I(strikethroughThickness); got != want {
+		t.Errorf("strikethrough thickness: got %v, want %v", got, want)
+	}
+	if m.XHeight <= 0 || m.CapHeight <= m.XHeight {
+		t.Errorf("expected 0 < x-height < cap-height, got %v and %v", m.XHeight, m.CapHeight)
+	}
+	// Metrics scale with the size.
+	small := shaper.Metrics(Font{}, fixed.I(16))
+	if got, want := small.UnderlinePosition, fixed.Int26_6(-138); got != want {
+		t.Errorf("underline position at 16px: got %v, want %v", got, want)
+	}
+	if got, want := small.CapHeight, (m.CapHeight*16+1024)/2048; got < want-1 || got > want+1 {
+		t.Errorf("cap-height at 16px: got %v, want %v", got, want)
+	}
+}
+
+// TestGraphemeJoiner checks that a combining grapheme joiner prevents the
+// ligature of the runes around it, and adds no width of its own.
+func TestGraphemeJoiner(t *testing.T) {
+	robotoFace, _ := opentype.Parse(robotoregular.TTF)
+	shaper := testShaper(robotoFace)
+	params := Parameters{PxPerEm: fixed.I(32)}
+	glyphs := func(txt string) (n, runes int, width fixed.Int26_6) {
+		doc := shaper.LayoutString(params, 0, 1000, english, txt)
+		for _, run := range doc.lines[0].runs {
+			n += len(run.Glyphs)
+			runes += run.Runes.Count
+			width += run.Advance
+		}
+		return n, runes, width
+	}
+	// Roboto has an "fi" ligature.
+	if n, _, _ := glyphs("fi"); n != 1 {
+		t.Fatalf("expected a ligature for \"fi\", got %d glyphs", n)
+	}
+	_, _, fWidth := glyphs("f")
+	_, _, iWidth := glyphs("i")
+	n, runes, width := glyphs("f\u034Fi")
+	if n != 3 {
+		t.Errorf("expected 3 glyphs for \"f\\u034Fi\", got %d", n)
+	}
+	if runes != 3 {
+		t.Errorf("expected 3 runes, got %d", runes)
+	}
+	if want := fWidth + iWidth; width != want {
+		t.Errorf("expected width %v, got %v", want, width)
+	}
+	// A joiner before a combining mark keeps the mark with its base.
+	doc := shaper.LayoutString(params, 0, 1000, english, "a\u034F\u0302")
+	if runs := len(doc.lines[0].runs); runs != 1 {
+		t.Errorf("expected 1 run for \"a\\u034F\\u0302\", got %d", runs)
+	}
+	for _, g := range doc.lines[0].runs[0].Glyphs {
+		if g.clusterIndex != 0 {
+			t.Errorf("expected the mark in the cluster of its base, got cluster %d", g.clusterIndex)
+		}
+	}
+}
+
+// TestDecorations checks that the decoration rectangles of a line follow its
+// runs in visual order, and that adjacent runs share rectangles.
+func TestDecorations(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	ltr := FontFace{Font: Font{Typeface: "Go"}, Face: ltrFace}
+	rtl := FontFace{Font: Font{Typeface: "Noto"}, Face: rtlFace}
+	shaper := testShaper()
+	shaper.Load(ltr)
+	shaper.Load(rtl)
+	const txt = "ab سلام cd"
+	faces := []FaceRange{
+		{Runes: Range{Offset: 0, Count: 1}, Face: ltr, Decoration: Underline},
+		{Runes: Range{Offset: 1, Count: 2}, Face: ltr, Decoration: Underline},
+		{Runes: Range{Offset: 3, Count: 2}, Face: rtl, Decoration: Underline | Strikethrough},
+		{Runes: Range{Offset: 5, Count: 2}, Face: rtl},
+		{Runes: Range{Offset: 7, Count: 3}, Face: ltr, Decoration: Underline},
+	}
+	params := Parameters{PxPerEm: fixed.I(16)}
+	doc := shaper.LayoutAssigned(params, 0, 1000, english, []rune(txt), faces, 0)
+	if len(doc.lines) != 1 {
+		t.Fatalf("expected 1 line, got %d", len(doc.lines))
+	}
+	ln := doc.lines[0]
+	// The runs in logical order are "a", "b ", "سل", "ام" and " cd", and
+	// the Arabic runs are displayed right to left.
+	if len(ln.runs) != 5 {
+		t.Fatalf("expected 5 runs, got %d", len(ln.runs))
+	}
+	runs := ln.runs
+	if runs[3].X >= runs[2].X {
+		t.Fatalf("expected the second Arabic run left of the first")
+	}
+	ltrMetrics := faceMetrics(ltrFace.Face(), params.PxPerEm)
+	rtlMetrics := faceMetrics(rtlFace.Face(), params.PxPerEm)
+	want := []DecorationRect{
+		{Decoration: Underline, Start: 0, End: runs[0].Advance + runs[1].Advance, Y: -ltrMetrics.UnderlinePosition, Thickness: ltrMetrics.UnderlineThickness},
+		{Decoration: Underline, Start: runs[2].X, End: runs[2].X + runs[2].Advance, Y: -rtlMetrics.UnderlinePosition, Thickness: rtlMetrics.UnderlineThickness},
+		{Decoration: Strikethrough, Start: runs[2].X, End: runs[2].X + runs[2].Advance, Y: -rtlMetrics.StrikethroughPosition, Thickness: rtlMetrics.StrikethroughThickness},
+		{Decoration: Underline, Start: runs[4].X, End: runs[4].X + runs[4].Advance, Y: -ltrMetrics.UnderlinePosition, Thickness: ltrMetrics.UnderlineThickness},
+	}
+	if !reflect.DeepEqual(ln.decorations, want) {
+		t.Errorf("expected decorations\n%v\ngot\n%v", want, ln.decorations)
+	}
+	for _, d := range want {
+		if d.Thickness <= 0 {
+			t.Errorf("expected a positive thickness for %v", d)
+		}
+	}
+}
+
+// TestSnapClusters checks that clusters are moved to the positions of a
+// coarse grid, with the advances and alignment adjusted to match.
+func TestSnapClusters(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	doc := shaper.LayoutString(Parameters{PxPerEm: fixed.I(10), Alignment: End}, 0, 1000, english, "hello")
+	var grid []fixed.Int26_6
+	for x := 0; x <= 100; x += 10 {
+		grid = append(grid, fixed.I(x))
+	}
+	advances := doc.SnapClusters(grid)
+	want := []fixed.Int26_6{fixed.I(10), fixed.I(10), fixed.I(10), fixed.I(10)}
+	if len(advances) != 5 || !slices.Equal(advances[:4], want) {
+		t.Fatalf("expected advances %v followed by a natural advance, got %v", want, advances)
+	}
+	ln := doc.lines[0]
+	var x fixed.Int26_6
+	for _, runIdx := range ln.visualOrder {
+		run := ln.runs[runIdx]
+		forEachCluster(run, func(_, _ Range, off, advance fixed.Int26_6) {
+			if pos := run.X + off; !slices.Contains(grid, pos) {
+				t.Errorf("cluster at %v is not on the grid", pos)
+			}
+			x += advance
+		})
+	}
+	if got, want := ln.width, fixed.I(40)+advances[4]; got != want || x != want {
+		t.Errorf("expected line width %v, got %v", want, got)
+	}
+	// The line still ends at the end of the alignment width.
+	if align := doc.alignment.Align(ln.direction, ln.width, doc.alignWidth); align != 0 {
+		t.Errorf("expected the end-aligned line at 0, got %d", align)
+	}
+}
+
+// TestSplitByScriptInherited checks that runes of the Inherited script, such
+// as combining marks, take the script of the preceding text for text of every
+// script.
+func TestSplitByScriptInherited(t *testing.T) {
+	const mark = '́' // COMBINING ACUTE ACCENT, of the Inherited script.
+	if got := language.LookupScript(mark); got != language.Inherited {
+		t.Fatalf("expected script Inherited for U+0301, got %v", got)
+	}
+	for name, table := range unicode.Scripts {
+		if name == "Common" || name == "Inherited" {
+			continue
+		}
+		var base rune
+		if len(table.R16) > 0 {
+			base = rune(table.R16[0].Lo)
+		} else {
+			base = rune(table.R32[0].Lo)
+		}
+		script := language.LookupScript(base)
+		if script == language.Unknown {
+			continue
+		}
+		txt := []rune{base, mark, base, mark}
+		inputs := splitByScript([]shaping.Input{{Text: txt, RunEnd: len(txt)}}, di.DirectionLTR, nil)
+		if len(inputs) != 1 || inputs[0].Script != script {
+			t.Errorf("%s: expected a single run of script %v, got %+v", name, script, inputs)
+		}
+	}
+	// A mark between two scripts belongs to the run of the text before it.
+	txt := []rune{'a', mark, 'α'}
+	inputs := splitByScript([]shaping.Input{{Text: txt, RunEnd: len(txt)}}, di.DirectionLTR, nil)
+	if len(inputs) != 2 || inputs[0].RunEnd != 2 || inputs[0].Script != language.Latin || inputs[1].Script != language.Greek {
+		t.Errorf("expected a Latin run with the mark followed by a Greek run, got %+v", inputs)
+	}
+}
@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import "github.com/go-text/typesetting/segmenter"
+
+// NextGrapheme returns the offset of the start of the grapheme cluster
+// following the one containing the rune at from, or len(runes) if it is
+// the last. Grapheme clusters, such as a base letter and its combining
+// marks, an emoji sequence joined by zero width joiners or a flag made of
+// two regional indicators, are displayed as a unit and should be stepped
+// over as a unit. They never split the glyph clusters of the shaper.
+func NextGrapheme(runes []rune, from int) int {
+	if from >= len(runes) {
+		return len(runes)
+	}
+	if from < 0 {
+		from = 0
+	}
+	start, end := paragraphAround(runes, from)
+	var seg segmenter.Segmenter
+	seg.Init(runes[start:end])
+	for it := seg.GraphemeIterator(); it.Next(); {
+		g := it.Grapheme()
+		if next := start + g.Offset + len(g.Text); next > from {
+			return next
+		}
+	}
+	return end
+}
+
+// PrevGrapheme returns the offset of the start of the grapheme cluster
+// preceding the position from, or 0 if there is none. See NextGrapheme.
+func PrevGrapheme(runes []rune, from int) int {
+	if from <= 0 {
+		return 0
+	}
+	if from > len(runes) {
+		from = len(runes)
+	}
+	start, end := paragraphAround(runes, from-1)
+	var seg segmenter.Segmenter
+	seg.Init(runes[start:end])
+	prev := start
+	for it := seg.GraphemeIterator(); it.Next(); {
+		g := it.Grapheme()
+		if start+g.Offset >= from {
+			break
+		}
+		prev = start + g.Offset
+	}
+	return prev
+}
+
+// paragraphAround returns the range of the paragraph of runes containing the
+// rune at idx, including its terminating separator. Grapheme clusters always
+// break after a newline, so the paragraph can be segmented on its own.
+func paragraphAround(runes []rune, idx int) (start, end int) {
+	start, end = idx, idx
+	for ; start > 0 && !isParagraphSeparator(runes[start-1]); start-- {
+	}
+	for ; end < len(runes) && !isParagraphSeparator(runes[end]); end++ {
+	}
+	if end < len(runes) {
+		end++
+	}
+	return start, end
+}
@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"testing"
+
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+
+	"gioui.org/font/opentype"
+)
+
+func TestGraphemeMovement(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	for _, tc := range []struct {
+		name string
+		txt  string
+		// starts are the offsets of the grapheme clusters, followed by the
+		// length of the text.
+		starts []int
+	}{
+		{name: "combining acute", txt: "ae\u0301b", starts: []int{0, 1, 3, 4}},
+		{name: "flags", txt: "\U0001F1EB\U0001F1F7\U0001F1E9\U0001F1EA", starts: []int{0, 2, 4}},
+		{name: "zwj emoji", txt: "a\U0001F469\u200D\U0001F469\u200D\U0001F467b", starts: []int{0, 1, 6, 7}},
+		{name: "crlf", txt: "a\r\nb", starts: []int{0, 1, 3, 4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runes := []rune(tc.txt)
+			for i := 0; i < len(tc.starts)-1; i++ {
+				start, next := tc.starts[i], tc.starts[i+1]
+				if got := NextGrapheme(runes, start); got != next {
+					t.Errorf("NextGrapheme(%d) = %d, expected %d", start, got, next)
+				}
+				// Moving from inside a grapheme cluster goes to its end.
+				if got := NextGrapheme(runes, next-1); got != next {
+					t.Errorf("NextGrapheme(%d) = %d, expected %d", next-1, got, next)
+				}
+				if got := PrevGrapheme(runes, next); got != start {
+					t.Errorf("PrevGrapheme(%d) = %d, expected %d", next, got, start)
+				}
+			}
+			if got := NextGrapheme(runes, len(runes)); got != len(runes) {
+				t.Errorf("NextGrapheme at the end = %d, expected %d", got, len(runes))
+			}
+			if got := PrevGrapheme(runes, 0); got != 0 {
+				t.Errorf("PrevGrapheme at the start = %d, expected 0", got)
+			}
+			// Grapheme boundaries must not split the clusters of the shaper.
+			doc := shaper.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 1000, english, tc.txt)
+			for _, start := range tc.starts[:len(tc.starts)-1] {
+				cluster, _, ok := doc.ClusterAt(start)
+				if ok && cluster.Offset != start {
+					t.Errorf("grapheme at %d splits cluster %+v", start, cluster)
+				}
+			}
+		})
+	}
+}
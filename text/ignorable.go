@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"fmt"
+	"unicode"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// IgnorableMarker marks the position of a default-ignorable character, such
+// as a zero width space or a directional mark, displayed by
+// Parameters.ShowIgnorables. Markers are meant to be drawn as faint overlays
+// for debugging, and take no space in the layout.
+type IgnorableMarker struct {
+	// Rune is the marked character.
+	Rune rune
+	// Label is the abbreviated name of the character, such as "ZWSP" or
+	// "LRM", or its code point for characters without a common abbreviation.
+	Label string
+	// X is the horizontal position of the cluster of the character.
+	X fixed.Int26_6
+	// Y is the baseline of the line of the character.
+	Y fixed.Int26_6
+}
+
+// ignorableLabels are the abbreviations of common default-ignorable
+// characters.
+var ignorableLabels = map[rune]string{
+	'\u00AD': "SHY",
+	'\u034F': "CGJ",
+	'\u061C': "ALM",
+	'\u180E': "MVS",
+	'\u200B': "ZWSP",
+	'\u200C': "ZWNJ",
+	'\u200D': "ZWJ",
+	'\u200E': "LRM",
+	'\u200F': "RLM",
+	'\u202A': "LRE",
+	'\u202B': "RLE",
+	'\u202C': "PDF",
+	'\u202D': "LRO",
+	'\u202E': "RLO",
+	'\u2060': "WJ",
+	'\u2066': "LRI",
+	'\u2067': "RLI",
+	'\u2068': "FSI",
+	'\u2069': "PDI",
+	'\uFEFF': "ZWNBSP",
+}
+
+// isDefaultIgnorable reports whether r has the Default_Ignorable_Code_Point
+// property, derived as in DerivedCoreProperties.txt.
+func isDefaultIgnorable(r rune) bool {
+	switch {
+	case unicode.In(r, unicode.Other_Default_Ignorable_Code_Point, unicode.Variation_Selector):
+		return true
+	case unicode.In(r, unicode.White_Space, unicode.Prepended_Concatenation_Mark),
+		'\uFFF9' <= r && r <= '\uFFFB', 0x13430 <= r && r <= 0x1343F:
+		return false
+	}
+	return unicode.Is(unicode.Cf, r)
+}
+
+// ignorableLabel returns the label of the marker of r.
+func ignorableLabel(r rune) string {
+	if l, ok := ignorableLabels[r]; ok {
+		return l
+	}
+	if unicode.Is(unicode.Variation_Selector, r) {
+		switch {
+		case 0xFE00 <= r && r <= 0xFE0F:
+			return fmt.Sprintf("VS%d", r-0xFE00+1)
+		case 0xE0100 <= r && r <= 0xE01EF:
+			return fmt.Sprintf("VS%d", r-0xE0100+17)
+		}
+	}
+	return fmt.Sprintf("U+%04X", r)
+}
+
+// markIgnorables records a marker for each default-ignorable rune of txt
+// shaped in l, at the position of its cluster.
+func markIgnorables(l *line, txt []rune) {
+	l.ignorables = nil
+	for _, runIdx := range l.visualOrder {
+		run := l.runs[runIdx]
+		forEachCluster(run, func(runes, glyphs Range, x, _ fixed.Int26_6) {
+			start := run.Glyphs[glyphs.Offset].clusterIndex
+			for i := start; i < start+runes.Count && i < len(txt); i++ {
+				if r := txt[i]; isDefaultIgnorable(r) {
+					l.ignorables = append(l.ignorables, IgnorableMarker{Rune: r, Label: ignorableLabel(r), X: run.X + x})
+				}
+			}
+		})
+	}
+}
@@ -5,10 +5,17 @@ package text
 import (
 	"encoding/binary"
 	"hash/maphash"
+	"math"
+
+	"github.com/benoitkugler/textlayout/language"
+	"github.com/go-text/typesetting/di"
+	"github.com/go-text/typesetting/font"
+	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/exp/slices"
+	"golang.org/x/image/math/fixed"
 
 	"gioui.org/io/system"
 	"gioui.org/op/clip"
-	"golang.org/x/image/math/fixed"
 )
 
 type layoutCache struct {
@@ -16,6 +23,39 @@ type layoutCache struct {
 	head, tail *layoutElem
 }
 
+// runCache memoizes the shaping of runs of text. Its outputs are copied in
+// and out, because wrapping modifies the glyphs of shaped runs.
+type runCache struct {
+	// size is the maximum number of cached runs. Zero disables the cache.
+	size       int
+	seed       maphash.Seed
+	m          map[runKey]*runElem
+	head, tail *runElem
+}
+
+type runElem struct {
+	next, prev *runElem
+	key        runKey
+	// text is the text of the run and its context, for detecting collisions
+	// of text hashes.
+	text []rune
+	out  shaping.Output
+}
+
+// runKey identifies the shaping of a run. Runs are shaped in the context of
+// the runes around them, so the key covers the window of text returned by
+// runWindow, and start and end are relative to it.
+type runKey struct {
+	face       font.Face
+	textHash   uint64
+	start, end int
+	size       fixed.Int26_6
+	direction  di.Direction
+	script     language.Script
+	language   language.Language
+	features   string
+}
+
 type pathCache struct {
 	seed       maphash.Seed
 	m          map[uint64]*path
@@ -36,17 +76,57 @@ type path struct {
 }
 
 type glyphInfo struct {
-	ID GlyphID
-	X  fixed.Int26_6
+	ID      GlyphID
+	X       fixed.Int26_6
+	Flags   Flags
+	Oblique float32
 }
 
 type layoutKey struct {
 	ppem               fixed.Int26_6
 	maxWidth, minWidth int
 	maxLines           int
+	truncator          string
+	fade               fixed.Int26_6
 	str                string
 	locale             system.Locale
 	font               Font
+	retainSource       bool
+	oblique            float32
+	synthesize         bool
+	stemDarkening      fixed.Int26_6
+	noncharacters      NoncharacterMode
+	normalize          Normalization
+	showInvisibles     bool
+	showIgnorables     bool
+	dottedCircle       bool
+	circleFont         Font
+	punctuation        bool
+	smartQuotes        bool
+	whitespace         WhitespaceMode
+	separators         string
+	gridCell           fixed.Int26_6
+	ambiguous          AmbiguousWidth
+	tabWidth           fixed.Int26_6
+	tabSpaces          int
+	tabOrigin          TabOrigin
+	wrapPolicy         WrapPolicy
+	roundMode          RoundMode
+	objectSize         fixed.Point26_6
+	minHeight          fixed.Int26_6
+	debugKerning       bool
+	detectDir          bool
+	sizeAdjust         bool
+	spacing            fixed.Int26_6
+	wordSpacing        fixed.Int26_6
+	noMark             bool
+	noMarkToMark       bool
+	features           string
+	tabularNums        bool
+	smallCaps          bool
+	justify            bool
+	justifyLast        bool
+	kashida            bool
 }
 
 type pathKey struct {
@@ -94,6 +174,116 @@ func (l *layoutCache) insert(lt *layoutElem) {
 	lt.next.prev = lt
 }
 
+// runContext is the number of runes on either side of a run that shaping
+// reads, the context length of HarfBuzz buffers.
+const runContext = 5
+
+// runWindow returns the runes of input read by shaping its run, and the
+// offset of the first of them in input.Text.
+func runWindow(input shaping.Input) ([]rune, int) {
+	start, end := input.RunStart-runContext, input.RunEnd+runContext
+	if start < 0 {
+		start = 0
+	}
+	if end > len(input.Text) {
+		end = len(input.Text)
+	}
+	return input.Text[start:end], start
+}
+
+// key returns the key of input shaped with the features encoded by features.
+func (c *runCache) key(input shaping.Input, features string) runKey {
+	if c.seed == (maphash.Seed{}) {
+		c.seed = maphash.MakeSeed()
+	}
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	var b [4]byte
+	text, offset := runWindow(input)
+	for _, r := range text {
+		binary.LittleEndian.PutUint32(b[:], uint32(r))
+		h.Write(b[:])
+	}
+	return runKey{
+		face:      input.Face,
+		textHash:  h.Sum64(),
+		start:     input.RunStart - offset,
+		end:       input.RunEnd - offset,
+		size:      input.Size,
+		direction: input.Direction,
+		script:    input.Script,
+		language:  input.Language,
+		features:  features,
+	}
+}
+
+// Get returns a copy of the output cached for k, shaped from input.
+func (c *runCache) Get(k runKey, input shaping.Input) (shaping.Output, bool) {
+	text, offset := runWindow(input)
+	e, ok := c.m[k]
+	if !ok || !slices.Equal(e.text, text) {
+		return shaping.Output{}, false
+	}
+	c.remove(e)
+	c.insert(e)
+	out := e.out
+	out.Glyphs = append([]shaping.Glyph(nil), out.Glyphs...)
+	offsetClusters(&out, offset)
+	return out, true
+}
+
+// Put caches a copy of out, shaped from input, for k.
+func (c *runCache) Put(k runKey, input shaping.Input, out shaping.Output) {
+	text, offset := runWindow(input)
+	if c.m == nil {
+		c.m = make(map[runKey]*runElem)
+		c.head = new(runElem)
+		c.tail = new(runElem)
+		c.head.prev = c.tail
+		c.tail.next = c.head
+	}
+	if e, ok := c.m[k]; ok {
+		c.remove(e)
+	}
+	out.Glyphs = append([]shaping.Glyph(nil), out.Glyphs...)
+	// Cache the clusters relative to the window of the run.
+	offsetClusters(&out, -offset)
+	e := &runElem{key: k, text: append([]rune(nil), text...), out: out}
+	c.m[k] = e
+	c.insert(e)
+	for len(c.m) > c.size {
+		oldest := c.tail.next
+		c.remove(oldest)
+		delete(c.m, oldest.key)
+	}
+}
+
+// offsetClusters moves the runes and clusters of out by offset.
+func offsetClusters(out *shaping.Output, offset int) {
+	out.Runes.Offset += offset
+	for i := range out.Glyphs {
+		out.Glyphs[i].ClusterIndex += offset
+	}
+}
+
+// Clear empties the cache.
+func (c *runCache) Clear() {
+	c.m = nil
+	c.head, c.tail = nil, nil
+}
+
+func (c *runCache) remove(e *runElem) {
+	e.next.prev = e.prev
+	e.prev.next = e.next
+}
+
+func (c *runCache) insert(e *runElem) {
+	e.next = c.head
+	e.prev = c.head.prev
+	e.prev.next = e
+	e.next.prev = e
+}
+
 // hashGlyphs computes a hash key based on the ID and X offset of
 // every glyph in the slice.
 func (c *pathCache) hashGlyphs(gs []Glyph) uint64 {
@@ -113,6 +303,10 @@ func (c *pathCache) hashGlyphs(gs []Glyph) uint64 {
 		h.Write(b[:4])
 		binary.LittleEndian.PutUint64(b[:], uint64(g.ID))
 		h.Write(b[:])
+		binary.LittleEndian.PutUint16(b[:2], uint16(g.Flags&syntheticFlags))
+		h.Write(b[:2])
+		binary.LittleEndian.PutUint32(b[:4], math.Float32bits(g.Oblique))
+		h.Write(b[:4])
 	}
 	sum := h.Sum64()
 	return sum
@@ -128,7 +322,7 @@ func gidsEqual(a []glyphInfo, glyphs []Glyph) bool {
 			firstX = glyphs[i].X
 		}
 		// Cache glyph X offsets relative to the first glyph.
-		if a[i].ID != glyphs[i].ID || a[i].X != (glyphs[i].X-firstX) {
+		if a[i].ID != glyphs[i].ID || a[i].X != (glyphs[i].X-firstX) || a[i].Flags != glyphs[i].Flags&syntheticFlags || a[i].Oblique != glyphs[i].Oblique {
 			return false
 		}
 	}
@@ -159,7 +353,7 @@ func (c *pathCache) Put(key uint64, glyphs []Glyph, v clip.PathSpec) {
 			firstX = glyph.X
 		}
 		// Cache glyph X offsets relative to the first glyph.
-		gids[i] = glyphInfo{ID: glyph.ID, X: glyph.X - firstX}
+		gids[i] = glyphInfo{ID: glyph.ID, X: glyph.X - firstX, Flags: glyph.Flags & syntheticFlags, Oblique: glyph.Oblique}
 	}
 	val := &path{key: key, val: v, glyphs: gids}
 	c.m[key] = val
@@ -0,0 +1,426 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"unicode"
+
+	"github.com/go-text/typesetting/segmenter"
+	"golang.org/x/image/math/fixed"
+
+	"gioui.org/internal/f32"
+	"gioui.org/io/system"
+)
+
+// forEachCluster invokes fn for each glyph cluster of run in visual order
+// (left to right). The runes of each cluster are relative to the start of
+// the line containing run, glyphs indexes run.Glyphs, and x is the offset of
+// the cluster relative to the start of run.
+func forEachCluster(run runLayout, fn func(runes, glyphs Range, x, advance fixed.Int26_6)) {
+	rtl := run.Direction.Progression() == system.TowardOrigin
+	runeOff := run.Runes.Offset
+	if rtl {
+		runeOff += run.Runes.Count
+	}
+	var x fixed.Int26_6
+	for i := 0; i < len(run.Glyphs); {
+		g := run.Glyphs[i]
+		advance := fixed.Int26_6(0)
+		end := i
+		for ; end < len(run.Glyphs) && run.Glyphs[end].clusterIndex == g.clusterIndex; end++ {
+			advance += run.Glyphs[end].xAdvance
+		}
+		runes := Range{Count: g.runeCount, Offset: runeOff}
+		if rtl {
+			runes.Offset -= g.runeCount
+			runeOff -= g.runeCount
+		} else {
+			runeOff += g.runeCount
+		}
+		fn(runes, Range{Count: end - i, Offset: i}, x, advance)
+		x += advance
+		i = end
+	}
+}
+
+// Region is the area of a line covered by glyph clusters of a range of
+// runes, in document coordinates.
+type Region struct {
+	// Top and Bottom are the vertical extent of the line.
+	Top, Bottom fixed.Int26_6
+	// Min and Max are the visual horizontal extent of the clusters.
+	Min, Max fixed.Int26_6
+}
+
+// SelectionRegions returns the regions covering the glyph clusters of the
+// runes in [start, end), for drawing selections. Clusters that are visually
+// adjacent on the same line are merged into a single region, so a range
+// crossing a bidi boundary may produce several disjoint regions per line.
+func (l *document) SelectionRegions(start, end int) []Region {
+	var regions []Region
+	lineStart := 0
+	for _, ln := range l.lines {
+		if lineStart >= end {
+			break
+		}
+		if lineStart+ln.runeCount <= start {
+			lineStart += ln.runeCount
+			continue
+		}
+		align := l.alignment.Align(ln.direction, ln.width, l.alignWidth)
+		top := fixed.I(ln.yOffset) - ln.ascent
+		bottom := fixed.I(ln.yOffset) + ln.descent
+		firstRegion := len(regions)
+		for _, runIdx := range ln.visualOrder {
+			run := ln.runs[runIdx]
+			forEachCluster(run, func(runes, _ Range, x, advance fixed.Int26_6) {
+				off := lineStart + runes.Offset
+				if off+runes.Count <= start || off >= end {
+					return
+				}
+				x0 := align + run.X + x
+				x1 := x0 + advance
+				if n := len(regions); n > firstRegion && regions[n-1].Max == x0 {
+					regions[n-1].Max = x1
+					return
+				}
+				regions = append(regions, Region{Top: top, Bottom: bottom, Min: x0, Max: x1})
+			})
+		}
+		lineStart += ln.runeCount
+	}
+	return regions
+}
+
+// SelectionOutline returns the vertices of the polygon enclosing the
+// selection of the runes in [start, end), in document coordinates. Each line
+// contributes the horizontal extent of its selected clusters, including any
+// gaps between them at bidi boundaries, and the extents of consecutive lines
+// are joined at the bottom of the upper line. The vertices go clockwise from
+// the top left of the first line, skip collinear points, and end with the
+// first vertex to close the polygon. The outline is empty if no cluster is
+// selected.
+func (l *document) SelectionOutline(start, end int) []f32.Point {
+	type span struct {
+		top, bottom, min, max fixed.Int26_6
+	}
+	var spans []span
+	for _, reg := range l.SelectionRegions(start, end) {
+		if n := len(spans); n > 0 && spans[n-1].top == reg.Top {
+			sp := &spans[n-1]
+			if reg.Min < sp.min {
+				sp.min = reg.Min
+			}
+			if reg.Max > sp.max {
+				sp.max = reg.Max
+			}
+			continue
+		}
+		spans = append(spans, span{top: reg.Top, bottom: reg.Bottom, min: reg.Min, max: reg.Max})
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	var outline []f32.Point
+	add := func(x, y fixed.Int26_6) {
+		p := f32.Pt(float32(x)/64, float32(y)/64)
+		if n := len(outline); n >= 2 {
+			// Replace the previous vertex if it lies on the segment to p.
+			a, b := outline[n-2], outline[n-1]
+			if (a.X == b.X && b.X == p.X) || (a.Y == b.Y && b.Y == p.Y) {
+				outline[n-1] = p
+				return
+			}
+		}
+		outline = append(outline, p)
+	}
+	first := spans[0]
+	add(first.min, first.top)
+	add(first.max, first.top)
+	for i, sp := range spans {
+		if i > 0 {
+			add(sp.max, spans[i-1].bottom)
+		}
+		add(sp.max, sp.bottom)
+	}
+	for i := len(spans) - 1; i >= 0; i-- {
+		sp := spans[i]
+		add(sp.min, sp.bottom)
+		if i > 0 {
+			add(sp.min, spans[i-1].bottom)
+		}
+	}
+	add(first.min, first.bottom)
+	add(first.min, first.top)
+	return outline
+}
+
+// rangeRects returns the rectangles, in document coordinates, covering the
+// glyph clusters of the runes in r, as described by SelectionRegions.
+func (l *document) rangeRects(r Range) []f32.Rectangle {
+	var rects []f32.Rectangle
+	for _, reg := range l.SelectionRegions(r.Offset, r.Offset+r.Count) {
+		rects = append(rects, f32.Rect(float32(reg.Min)/64, float32(reg.Top)/64, float32(reg.Max)/64, float32(reg.Bottom)/64))
+	}
+	return rects
+}
+
+// LinkRects returns the clickable areas of each rune range in links, keyed by
+// the index of the link within links. The areas are retained for use by LinkAt
+// until the next call to LinkRects.
+func (l *document) LinkRects(links []Range) map[int][]f32.Rectangle {
+	l.links = l.links[:0]
+	rects := make(map[int][]f32.Rectangle, len(links))
+	for i, link := range links {
+		r := l.rangeRects(link)
+		l.links = append(l.links, r)
+		rects[i] = r
+	}
+	return rects
+}
+
+// LinkAt returns the index of the link whose area contains the point (x, y)
+// in document coordinates, using the links provided to the most recent call
+// to LinkRects.
+func (l *document) LinkAt(x, y float32) (int, bool) {
+	for i, rects := range l.links {
+		for _, r := range rects {
+			if r.Min.X <= x && x < r.Max.X && r.Min.Y <= y && y < r.Max.Y {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// ClusterAt returns the range of runes in the glyph cluster containing the
+// rune at runeOffset, along with the number of glyphs in the cluster. It is
+// useful for deleting or stepping over clusters as a unit.
+func (l *document) ClusterAt(runeOffset int) (runes Range, glyphs int, ok bool) {
+	lineStart := 0
+	for _, ln := range l.lines {
+		if runeOffset >= lineStart+ln.runeCount {
+			lineStart += ln.runeCount
+			continue
+		}
+		for _, run := range ln.runs {
+			if runeOffset-lineStart >= run.Runes.Offset+run.Runes.Count {
+				continue
+			}
+			forEachCluster(run, func(cluster, g Range, _, _ fixed.Int26_6) {
+				start := lineStart + cluster.Offset
+				if start <= runeOffset && runeOffset < start+cluster.Count {
+					runes = Range{Count: cluster.Count, Offset: start}
+					glyphs = g.Count
+					ok = true
+				}
+			})
+			return runes, glyphs, ok
+		}
+		break
+	}
+	return Range{}, 0, false
+}
+
+// Locate returns the rune offset of the caret position closest to pt in
+// document coordinates. The line is chosen by the y coordinate of pt, and the
+// position by the glyph cluster under its x coordinate, in visual order, so
+// that bidi text is handled. The runes of clusters representing several
+// runes, such as ligatures, are spread evenly across the cluster advance.
+// Points beyond either end of a line map to the position at that end.
+func (l *document) Locate(pt fixed.Point26_6) int {
+	if len(l.lines) == 0 {
+		return 0
+	}
+	lineIdx, lineStart := len(l.lines)-1, 0
+	for i, ln := range l.lines {
+		if pt.Y < fixed.I(ln.yOffset)+ln.descent || i == len(l.lines)-1 {
+			lineIdx = i
+			break
+		}
+		lineStart += ln.runeCount
+	}
+	ln := l.lines[lineIdx]
+	x := pt.X - l.alignment.Align(ln.direction, ln.width, l.alignWidth)
+	pos, found, first := 0, false, true
+	for _, runIdx := range ln.visualOrder {
+		run := ln.runs[runIdx]
+		rtl := run.Direction.Progression() == system.TowardOrigin
+		forEachCluster(run, func(runes, glyphs Range, cx, advance fixed.Int26_6) {
+			if found || run.Glyphs[glyphs.Offset].glyphCount == 0 {
+				// Skip synthetic glyphs such as trailing newlines.
+				return
+			}
+			x0 := run.X + cx
+			switch {
+			case first && x < x0:
+				pos, found = clusterPosition(runes, rtl, 0, advance), true
+			case x < x0+advance:
+				pos, found = clusterPosition(runes, rtl, x-x0, advance), true
+			default:
+				// Beyond the end of the line unless a later cluster is found.
+				pos = clusterPosition(runes, rtl, advance, advance)
+			}
+			first = false
+		})
+	}
+	return lineStart + pos
+}
+
+// CaretPos returns the position of the caret before the rune at runeIndex:
+// its x coordinate and the top and bottom of its line, in document
+// coordinates. A position at the boundary of runs of different directions
+// has two visual locations; the caret is placed after the logically
+// preceding rune, in the direction of its run, as described by
+// line.CaretOffsets.
+func (l *document) CaretPos(runeIndex int) (x, top, bottom fixed.Int26_6) {
+	if len(l.lines) == 0 {
+		return 0, 0, 0
+	}
+	lineIdx, lineStart := len(l.lines)-1, 0
+	for i, ln := range l.lines {
+		if runeIndex < lineStart+ln.runeCount || i == len(l.lines)-1 {
+			lineIdx = i
+			break
+		}
+		lineStart += ln.runeCount
+	}
+	ln := l.lines[lineIdx]
+	align := l.alignment.Align(ln.direction, ln.width, l.alignWidth)
+	top = fixed.I(ln.yOffset) - ln.ascent
+	bottom = fixed.I(ln.yOffset) + ln.descent
+	local := runeIndex - lineStart
+	if local < 0 {
+		local = 0
+	} else if local > ln.runeCount {
+		local = ln.runeCount
+	}
+	x = align + ln.CaretOffsets()[local]
+	return x, top, bottom
+}
+
+// clusterPosition returns the rune offset of the caret position within the
+// cluster of runes nearest to dx, the distance from the visual left of the
+// cluster.
+func clusterPosition(runes Range, rtl bool, dx, advance fixed.Int26_6) int {
+	k := 0
+	if advance > 0 {
+		k = int((dx*fixed.Int26_6(runes.Count) + advance/2) / advance)
+	}
+	if k < 0 {
+		k = 0
+	} else if k > runes.Count {
+		k = runes.Count
+	}
+	if rtl {
+		return runes.Offset + runes.Count - k
+	}
+	return runes.Offset + k
+}
+
+// glyphRef identifies a glyph of a document by the indices of its line, its
+// run within the line and the glyph within the run.
+type glyphRef struct {
+	line, run, glyph int
+}
+
+// WordGlyphsAt returns the glyphs of the word under the point (x, y) in
+// document coordinates, in visual order, for example to highlight the word
+// under the pointer. Words are delimited by the line break opportunities of
+// the text, excluding trailing whitespace, so a word may span several runs
+// of different directions. WordGlyphsAt returns nil if the point is not over
+// a word. Words are found in the source of the document, so WordGlyphsAt
+// panics if the document was not shaped with Parameters.RetainSource.
+func (l *document) WordGlyphsAt(x, y float32) []glyphRef {
+	offset, ok := l.runeAt(x, y)
+	if !ok {
+		return nil
+	}
+	if offset >= len(l.source) {
+		panic("text: WordGlyphsAt requires Parameters.RetainSource")
+	}
+	word, ok := wordAt(l.source, offset)
+	if !ok {
+		return nil
+	}
+	var refs []glyphRef
+	end := word.Offset + word.Count
+	lineStart := 0
+	for i, ln := range l.lines {
+		if lineStart >= end {
+			break
+		}
+		if lineStart+ln.runeCount <= word.Offset {
+			lineStart += ln.runeCount
+			continue
+		}
+		for _, runIdx := range ln.visualOrder {
+			forEachCluster(ln.runs[runIdx], func(runes, glyphs Range, _, _ fixed.Int26_6) {
+				start := lineStart + runes.Offset
+				if start+runes.Count <= word.Offset || start >= end {
+					return
+				}
+				for g := glyphs.Offset; g < glyphs.Offset+glyphs.Count; g++ {
+					refs = append(refs, glyphRef{line: i, run: runIdx, glyph: g})
+				}
+			})
+		}
+		lineStart += ln.runeCount
+	}
+	return refs
+}
+
+// runeAt returns the offset of the first rune of the cluster under the point
+// (x, y) in document coordinates.
+func (l *document) runeAt(x, y float32) (offset int, ok bool) {
+	lineStart := 0
+	for _, ln := range l.lines {
+		top := float32(ln.yOffset) - float32(ln.ascent)/64
+		bottom := float32(ln.yOffset) + float32(ln.descent)/64
+		if y < top || y >= bottom {
+			lineStart += ln.runeCount
+			continue
+		}
+		align := l.alignment.Align(ln.direction, ln.width, l.alignWidth)
+		for _, runIdx := range ln.visualOrder {
+			run := ln.runs[runIdx]
+			forEachCluster(run, func(runes, _ Range, cx, advance fixed.Int26_6) {
+				x0 := float32(align+run.X+cx) / 64
+				x1 := float32(align+run.X+cx+advance) / 64
+				if !ok && x0 <= x && x < x1 {
+					offset, ok = lineStart+runes.Offset, true
+				}
+			})
+		}
+		break
+	}
+	return offset, ok
+}
+
+// wordAt returns the range of the word of txt containing the rune at offset.
+// Only the paragraph containing offset is segmented.
+func wordAt(txt []rune, offset int) (Range, bool) {
+	if offset < 0 || offset >= len(txt) || unicode.IsSpace(txt[offset]) {
+		return Range{}, false
+	}
+	start, end := offset, offset
+	for ; start > 0 && !isParagraphSeparator(txt[start-1]); start-- {
+	}
+	for ; end < len(txt) && !isParagraphSeparator(txt[end]); end++ {
+	}
+	var seg segmenter.Segmenter
+	seg.Init(txt[start:end])
+	for it := seg.LineIterator(); it.Next(); {
+		line := it.Line()
+		wordStart := start + line.Offset
+		wordEnd := wordStart + len(line.Text)
+		if offset >= wordEnd {
+			continue
+		}
+		for wordEnd > wordStart && unicode.IsSpace(txt[wordEnd-1]) {
+			wordEnd--
+		}
+		return Range{Offset: wordStart, Count: wordEnd - wordStart}, true
+	}
+	return Range{}, false
+}
@@ -0,0 +1,379 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"math"
+	"testing"
+
+	nsareg "eliasnaur.com/font/noto/sans/arabic/regular"
+
+	"github.com/go-text/typesetting/di"
+	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/exp/slices"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+
+	"gioui.org/f32"
+	"gioui.org/font/opentype"
+	"gioui.org/io/system"
+)
+
+// TestLinkRects checks that link areas are hit-tested correctly and that
+// distinct links do not overlap.
+func TestLinkRects(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	const txt = "visit golang.org or gioui.org today"
+	doc := shaper.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 1000, english, txt)
+	links := []Range{
+		{Offset: 6, Count: 10},
+		{Offset: 20, Count: 9},
+	}
+	rects := doc.LinkRects(links)
+	if len(rects) != len(links) {
+		t.Fatalf("expected %d links, got %d", len(links), len(rects))
+	}
+	for id := range links {
+		if len(rects[id]) != 1 {
+			t.Fatalf("link %d: expected a single rectangle, got %v", id, rects[id])
+		}
+		r := rects[id][0]
+		mid := r.Min.Add(r.Max).Mul(.5)
+		got, ok := doc.LinkAt(mid.X, mid.Y)
+		if !ok || got != id {
+			t.Errorf("link %d: LinkAt(%v) = %d, %v", id, mid, got, ok)
+		}
+	}
+	a, b := rects[0][0], rects[1][0]
+	if !a.Intersect(b).Empty() {
+		t.Errorf("link areas %v and %v overlap", a, b)
+	}
+	if _, ok := doc.LinkAt(a.Min.X-1, (a.Min.Y+a.Max.Y)/2); ok {
+		t.Errorf("found link outside of link areas")
+	}
+}
+
+// TestClusterAt checks the cluster boundaries reported for ligatures and
+// expansions.
+func TestClusterAt(t *testing.T) {
+	type testcase struct {
+		name       string
+		glyphs     []shaping.Glyph
+		runes      int
+		runeOffset int
+		expected   Range
+		glyphCount int
+	}
+	for _, tc := range []testcase{
+		{
+			name:       "ligature",
+			glyphs:     []shaping.Glyph{simpleGlyph(0), ligatureGlyph(1, 2), simpleGlyph(3)},
+			runes:      4,
+			runeOffset: 2,
+			expected:   Range{Offset: 1, Count: 2},
+			glyphCount: 1,
+		},
+		{
+			name:       "expansion",
+			glyphs:     []shaping.Glyph{simpleGlyph(0), expansionGlyph(1, 2), expansionGlyph(1, 2), simpleGlyph(2)},
+			runes:      3,
+			runeOffset: 1,
+			expected:   Range{Offset: 1, Count: 1},
+			glyphCount: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			shaper := testShaper()
+			ln := toLine(&shaper.orderer, shaping.Line{{
+				Glyphs:    tc.glyphs,
+				Runes:     shaping.Range{Count: tc.runes},
+				Direction: di.DirectionLTR,
+			}}, system.LTR)
+			doc := document{lines: []line{ln}}
+			runes, glyphs, ok := doc.ClusterAt(tc.runeOffset)
+			if !ok {
+				t.Fatalf("no cluster found at %d", tc.runeOffset)
+			}
+			if runes != tc.expected || glyphs != tc.glyphCount {
+				t.Errorf("expected cluster %+v with %d glyphs, got %+v with %d", tc.expected, tc.glyphCount, runes, glyphs)
+			}
+		})
+	}
+	if _, _, ok := (&document{}).ClusterAt(0); ok {
+		t.Errorf("found cluster in empty document")
+	}
+}
+
+// TestWordGlyphsAt checks that all the glyphs of a word spanning runs of
+// different directions are found from a point in its middle.
+func TestWordGlyphsAt(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	// The word "abcسماء" has a left-to-right and a right-to-left run.
+	const txt = "xx abcسماء yy"
+	word := Range{Offset: 3, Count: 7}
+	params := Parameters{PxPerEm: fixed.I(10), RetainSource: true}
+	doc := shaper.LayoutString(params, 0, 1000, english, txt)
+	ln := doc.lines[0]
+	var want []glyphRef
+	var hover f32.Point
+	for _, runIdx := range ln.visualOrder {
+		run := ln.runs[runIdx]
+		forEachCluster(run, func(runes, glyphs Range, x, advance fixed.Int26_6) {
+			if runes.Offset < word.Offset || runes.Offset >= word.Offset+word.Count {
+				return
+			}
+			if runes.Offset == word.Offset+1 {
+				hover = f32.Pt(float32(run.X+x+advance/2)/64, float32(ln.yOffset))
+			}
+			for g := glyphs.Offset; g < glyphs.Offset+glyphs.Count; g++ {
+				want = append(want, glyphRef{run: runIdx, glyph: g})
+			}
+		})
+	}
+	got := doc.WordGlyphsAt(hover.X, hover.Y)
+	if !slices.Equal(got, want) {
+		t.Errorf("expected glyphs %v, got %v", want, got)
+	}
+	runs := map[int]bool{}
+	for _, ref := range got {
+		runs[ref.run] = true
+	}
+	if len(runs) < 2 {
+		t.Errorf("expected the word to span several runs, got %d", len(runs))
+	}
+	if refs := doc.WordGlyphsAt(-1, hover.Y); refs != nil {
+		t.Errorf("expected no glyphs outside of the text, got %v", refs)
+	}
+	params.RetainSource = false
+	doc = shaper.LayoutString(params, 0, 1000, english, txt)
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for a document without source")
+		}
+	}()
+	doc.WordGlyphsAt(hover.X, hover.Y)
+}
+
+// TestLocate checks that points at the visual start and end of each run of
+// bidi text map to the logical ends of the run.
+func TestLocate(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	for _, dir := range []system.TextDirection{system.LTR, system.RTL} {
+		t.Run(dir.String(), func(t *testing.T) {
+			_, lines := makeTestText(shaper, dir, 16, 100, 0)
+			doc := document{}
+			for _, l := range lines {
+				doc.lines = append(doc.lines, toLine(&shaper.orderer, l, dir))
+			}
+			calculateYOffsets(doc.lines)
+			doc.alignWidth = alignWidth(100, doc.lines)
+			lineStart := 0
+			for i, ln := range doc.lines {
+				align := doc.alignment.Align(ln.direction, ln.width, doc.alignWidth)
+				y := fixed.I(ln.yOffset)
+				for _, run := range ln.runs {
+					start := lineStart + run.Runes.Offset
+					end := start + run.Runes.Count
+					if run.Direction.Progression() == system.TowardOrigin {
+						start, end = end, start
+					}
+					left := fixed.Point26_6{X: align + run.X + 1, Y: y}
+					if got := doc.Locate(left); got != start {
+						t.Errorf("line %d: expected visual start of run %+v at %d, got %d", i, run.Runes, start, got)
+					}
+					right := fixed.Point26_6{X: align + run.X + run.Advance - 1, Y: y}
+					if got := doc.Locate(right); got != end {
+						t.Errorf("line %d: expected visual end of run %+v at %d, got %d", i, run.Runes, end, got)
+					}
+				}
+				lineStart += ln.runeCount
+			}
+		})
+	}
+}
+
+// TestCaretPos checks that carets advance monotonically across left-to-right
+// text, and follow the preceding run at bidi boundaries.
+func TestCaretPos(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	params := Parameters{PxPerEm: fixed.I(10)}
+
+	const ltr = "hello world"
+	doc := shaper.LayoutString(params, 0, 1000, english, ltr)
+	prev := -fixed.I(1)
+	for i := 0; i <= len(ltr); i++ {
+		x, top, bottom := doc.CaretPos(i)
+		if x <= prev {
+			t.Errorf("caret %d: expected x after %v, got %v", i, prev, x)
+		}
+		if top >= bottom {
+			t.Errorf("caret %d: expected positive height, got %v to %v", i, top, bottom)
+		}
+		prev = x
+	}
+	if x, _, _ := doc.CaretPos(len(ltr)); x != doc.lines[0].width {
+		t.Errorf("expected caret at the end of the line %v, got %v", doc.lines[0].width, x)
+	}
+
+	// The Arabic word occupies runes [4, 8) between left-to-right runs.
+	doc = shaper.LayoutString(params, 0, 1000, english, "abc سماء def")
+	ln := doc.lines[0]
+	var arabic runLayout
+	for _, run := range ln.runs {
+		if run.Direction == system.RTL {
+			arabic = run
+		}
+	}
+	if arabic.Runes != (Range{Offset: 4, Count: 4}) {
+		t.Fatalf("expected right-to-left run of runes [4, 8), got %+v", arabic.Runes)
+	}
+	left, right := arabic.X, arabic.X+arabic.Advance
+	// After the left-to-right run, the caret is at the visual left of the
+	// Arabic run.
+	if x, _, _ := doc.CaretPos(4); x != left {
+		t.Errorf("expected caret at %v after the left-to-right run, got %v", left, x)
+	}
+	// Within the Arabic run, the caret moves from right to left.
+	prev = right
+	for i := 5; i <= 8; i++ {
+		x, _, _ := doc.CaretPos(i)
+		if x >= prev || x < left {
+			t.Errorf("caret %d: expected x in [%v, %v), got %v", i, left, prev, x)
+		}
+		prev = x
+	}
+	// After the Arabic run, the caret is at its visual end, the left.
+	if x, _, _ := doc.CaretPos(8); x != left {
+		t.Errorf("expected caret at %v after the right-to-left run, got %v", left, x)
+	}
+}
+
+// TestCaretOffsets checks that the caret offsets of bidi lines match the
+// positions reported by CaretPos.
+func TestCaretOffsets(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	params := Parameters{PxPerEm: fixed.I(16)}
+	for _, tc := range []struct {
+		locale system.Locale
+		txt    string
+	}{
+		{english, "The quick سماء שלום لا fox تمط שלום غير the lazy dog."},
+		{arabic, "الحب سماء brown привет fox تمط jumps привет over غير الأحلام"},
+	} {
+		t.Run(tc.locale.Direction.String(), func(t *testing.T) {
+			doc := shaper.LayoutString(params, 0, 200, tc.locale, tc.txt)
+			lineStart := 0
+			for i, ln := range doc.lines {
+				offsets := ln.CaretOffsets()
+				if len(offsets) != ln.runeCount+1 {
+					t.Errorf("line %d: expected %d offsets, got %d", i, ln.runeCount+1, len(offsets))
+					continue
+				}
+				align := doc.alignment.Align(ln.direction, ln.width, doc.alignWidth)
+				for k := 0; k <= ln.runeCount; k += 3 {
+					// The position after the last rune of a line is the first
+					// of the next line.
+					if k == ln.runeCount && i < len(doc.lines)-1 {
+						break
+					}
+					x, _, _ := doc.CaretPos(lineStart + k)
+					if got := align + offsets[k]; got != x {
+						t.Errorf("line %d: rune %d: expected offset %v, got %v", i, k, x, got)
+					}
+				}
+				lineStart += ln.runeCount
+			}
+		})
+	}
+}
+
+// TestSelectionRegions checks that a selection crossing from left-to-right
+// into right-to-left text produces disjoint regions.
+func TestSelectionRegions(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := testShaper(ltrFace, rtlFace)
+	const txt = "The quick سماء שלום لا fox تمط שלום غير the lazy dog."
+	doc := shaper.LayoutString(Parameters{PxPerEm: fixed.I(16)}, 0, 1000, english, txt)
+	if len(doc.lines) != 1 {
+		t.Fatalf("expected a single line, got %d", len(doc.lines))
+	}
+	// "quick سم" ends within the first right-to-left run, so the selected
+	// part of the run is at its visual right, apart from "quick ".
+	regions := doc.SelectionRegions(4, 12)
+	if len(regions) != 2 {
+		t.Fatalf("expected 2 regions, got %v", regions)
+	}
+	a, b := regions[0], regions[1]
+	if a.Top != b.Top || a.Bottom != b.Bottom || a.Top >= a.Bottom {
+		t.Errorf("expected regions of the same line, got %v and %v", a, b)
+	}
+	if a.Max >= b.Min {
+		t.Errorf("expected disjoint regions, got %v and %v", a, b)
+	}
+	// A left-to-right range is a single region.
+	if regions := doc.SelectionRegions(0, 9); len(regions) != 1 {
+		t.Errorf("expected a single region, got %v", regions)
+	}
+}
+
+// TestSelectionOutline checks that a selection of three lines with ragged
+// right edges is enclosed by a single closed polygon.
+func TestSelectionOutline(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	const txt = "The quick brown fox jumps over the lazy dog and keeps running."
+	doc := shaper.LayoutString(Parameters{PxPerEm: fixed.I(16)}, 0, 150, english, txt)
+	if len(doc.lines) < 3 {
+		t.Fatalf("expected at least 3 lines, got %d", len(doc.lines))
+	}
+	l0, l1 := doc.lines[0], doc.lines[1]
+	if l0.width == l1.width {
+		t.Fatalf("expected ragged lines, got equal widths %v", l0.width)
+	}
+	// Select from the second rune of the first line to the second rune of
+	// the third line.
+	start := 1
+	end := l0.runeCount + l1.runeCount + 1
+	outline := doc.SelectionOutline(start, end)
+	// The outline steps in at the start of the first line, along the right
+	// edges of the first two lines and at the end of the third line.
+	if len(outline) != 11 {
+		t.Fatalf("expected 10 vertices and a closing vertex, got %v", outline)
+	}
+	if outline[0] != outline[len(outline)-1] {
+		t.Errorf("expected a closed polygon, got %v", outline)
+	}
+	// Adjacent vertices share either coordinate.
+	for i := 1; i < len(outline); i++ {
+		a, b := outline[i-1], outline[i]
+		if a.X != b.X && a.Y != b.Y {
+			t.Errorf("vertices %d and %d are not axis aligned: %v and %v", i-1, i, a, b)
+		}
+	}
+	// The outline encloses the selected regions.
+	lo, hi := outline[0], outline[0]
+	for _, p := range outline {
+		lo = f32.Pt(float32(math.Min(float64(lo.X), float64(p.X))), float32(math.Min(float64(lo.Y), float64(p.Y))))
+		hi = f32.Pt(float32(math.Max(float64(hi.X), float64(p.X))), float32(math.Max(float64(hi.Y), float64(p.Y))))
+	}
+	for _, reg := range doc.SelectionRegions(start, end) {
+		r0 := f32.Pt(float32(reg.Min)/64, float32(reg.Top)/64)
+		r1 := f32.Pt(float32(reg.Max)/64, float32(reg.Bottom)/64)
+		if r0.X < lo.X || r0.Y < lo.Y || r1.X > hi.X || r1.Y > hi.Y {
+			t.Errorf("region %v outside of the outline bounds %v-%v", reg, lo, hi)
+		}
+	}
+	if outline := doc.SelectionOutline(3, 3); outline != nil {
+		t.Errorf("expected no outline for an empty selection, got %v", outline)
+	}
+}
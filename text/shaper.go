@@ -5,14 +5,23 @@ package text
 import (
 	"bufio"
 	"fmt"
+	"image"
 	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"unicode/utf8"
 
+	"gioui.org/f32"
+	"gioui.org/font/opentype"
 	"gioui.org/io/system"
 	"gioui.org/op"
 	"gioui.org/op/clip"
 	"github.com/go-text/typesetting/font"
+	"golang.org/x/exp/slices"
 	"golang.org/x/image/math/fixed"
 )
 
@@ -22,11 +31,370 @@ type Parameters struct {
 	Font Font
 	// Alignment characterizes the positioning of text within the line. It does not directly
 	// impact shaping, but is provided in order to allow efficient offset computation.
+	// Justify is the exception, as it widens the spaces of lines.
 	Alignment Alignment
+	// JustifyLastLine stretches the last line of each paragraph under the
+	// Justify alignment, including paragraphs of a single line, like
+	// in some Arabic typesetting. By default the last line is not stretched.
+	JustifyLastLine bool
+	// Kashida justifies joined scripts such as Arabic under the Justify
+	// alignment by elongating the connections between letters with
+	// U+0640 ARABIC TATWEEL glyphs of faces that have them. Spaces are
+	// widened only by the remaining width.
+	Kashida bool
 	// PxPerEm is the pixels-per-em to shape the text with.
 	PxPerEm fixed.Int26_6
 	// MaxLines limits the quantity of shaped lines. Zero means no limit.
+	// Text beyond the limit is truncated at a line break, and the number of
+	// truncated runes is reported by the layout.
 	MaxLines int
+	// Truncator, if set, is shaped and appended to the last line of a
+	// paragraph truncated because of MaxLines, for example "…". Trailing clusters of
+	// the line are removed as needed for the truncator to fit. The
+	// truncator glyphs represent no runes and are positioned at the offset
+	// of the first truncated rune. Ellipses (U+2026) are displayed as three
+	// periods by faces without an ellipsis glyph.
+	Truncator string
+	// Fade, if positive, fades out the end of the last line of a paragraph
+	// truncated because of MaxLines over that distance, hinting that the
+	// text continues. The fade of each glyph is reported in Glyph.Fade for
+	// renderers to apply.
+	Fade fixed.Int26_6
+	// MaxHeight, if positive, limits the shaped lines to those whose bottom
+	// is within MaxHeight pixels of the top of the text, such as when text
+	// is laid out into a column. Text beyond the limit is truncated at a line
+	// break, and the number of truncated runes is reported by the layout.
+	MaxHeight int
+	// Orphans is the minimum number of lines of a paragraph kept before a
+	// break caused by MaxHeight. A paragraph split with fewer lines before
+	// the break is truncated entirely.
+	Orphans int
+	// Widows is the minimum number of lines of a paragraph kept after a
+	// break caused by MaxHeight. More lines are truncated as needed, unless
+	// fewer than Orphans lines would remain before the break.
+	Widows int
+	// ObliqueAngle is the angle, in degrees, by which glyphs are slanted when an
+	// italic style is requested but only an upright face is available. If zero,
+	// a default of 12 degrees is used.
+	ObliqueAngle float32
+	// Synthesize emboldens and slants the glyphs of faces lacking the
+	// requested weight or style, instead of only reporting the synthesized
+	// runs. The advances of emboldened glyphs are widened before lines are
+	// wrapped, and the glyphs are marked with FlagSyntheticBold and
+	// FlagSyntheticOblique for Shape to transform their outlines.
+	Synthesize bool
+	// StemDarkening is the width by which a renderer darkening the stems of
+	// small text widens each glyph, like FreeType's stem darkening. The
+	// advances of glyphs are widened to match, by the full amount for text
+	// of at most 8 pixels per em and by a linearly decreasing amount up to
+	// 24 pixels per em, above which text is not darkened.
+	StemDarkening fixed.Int26_6
+	// Noncharacters selects how noncharacters such as U+FFFF, surrogates
+	// and other invalid code points are displayed. They are never shaped
+	// as they are.
+	Noncharacters NoncharacterMode
+	// Normalize selects a Unicode normalization form the text is converted
+	// to before it is shaped, such as NFC for composing decomposed accented
+	// letters that shape poorly in faces without mark positioning. Rune
+	// offsets of the layout refer to the text before normalization, and the
+	// runes of a normalized sequence belong to the clusters of its first
+	// rune. Text laid out by LayoutFaces and LayoutSpans is not normalized.
+	Normalize Normalization
+	// ShowInvisibles displays vertical tabs and form feeds as the U+240B and
+	// U+240C symbols of the Control Pictures block instead of hiding them.
+	// They end their paragraphs regardless.
+	ShowInvisibles bool
+	// ShowIgnorables records a marker for each default-ignorable character,
+	// such as zero width spaces, joiners and directional marks, for
+	// debugging bidi and segmentation issues. The characters keep their
+	// zero advance, and the markers returned by Shaper.IgnorableMarkers are
+	// drawn as overlays that don't affect the layout.
+	ShowIgnorables bool
+	// DottedCircle inserts a U+25CC DOTTED CIRCLE base before a combining
+	// mark at the start of a paragraph, so that the mark is displayed attached
+	// to a placeholder. The inserted base does not correspond to any rune of
+	// the text.
+	DottedCircle bool
+	// DottedCircleFont selects the face that provides the dotted circle
+	// inserted by DottedCircle, so that it can match the surrounding text.
+	// The marks following the dotted circle are shaped with the same face.
+	// If zero, the face is chosen like for any other rune.
+	DottedCircleFont Font
+	// SubstitutePunctuation replaces dashes, quotes and similar punctuation
+	// missing from the primary face with plain ASCII equivalents from the
+	// same face, rather than displaying them in a fallback face.
+	SubstitutePunctuation bool
+	// SmartQuotes replaces ASCII quotation marks and apostrophes with the
+	// curly quotation marks of the language of the locale, such as “ and ”
+	// for English and „ and “ for German. Marks are chosen as opening or
+	// closing from the preceding rune. Each mark replaces a single rune, so
+	// rune offsets refer to the original text.
+	SmartQuotes bool
+	// GridCell, if positive, is the width of the cells of a monospace grid
+	// the text is snapped to, such as in a terminal. Every cluster is given
+	// the advance of the cells its runes occupy according to DisplayWidth.
+	GridCell fixed.Int26_6
+	// AmbiguousWidth selects the width of characters of ambiguous East Asian
+	// width in grid cells, for GridCell.
+	AmbiguousWidth AmbiguousWidth
+	// TabularSeparators lists separator runes, such as ':' in times or '/' in
+	// dates, that are given the advance of the face's figures, as if shaped with
+	// the tnum feature. Combined with tabular digits, it aligns strings such as
+	// "12:34" and "09:05" in columns.
+	TabularSeparators string
+	// LetterSpacing is added between adjacent glyph clusters, like the CSS
+	// letter-spacing property. It is not added after the visually final
+	// cluster of each line, so it does not affect alignment. Negative
+	// spacing draws clusters closer, but never reduces the advance of a
+	// cluster below zero.
+	LetterSpacing fixed.Int26_6
+	// WordSpacing is added to the advance of breaking spaces, such as
+	// U+0020 SPACE, like the CSS word-spacing property. No-break spaces such
+	// as U+00A0 are not widened. Lines are wrapped with the widened spaces.
+	WordSpacing fixed.Int26_6
+	// Whitespace controls how whitespace and line wrapping are handled.
+	Whitespace WhitespaceMode
+	// MinLineHeight is the minimum distance between the top and bottom of
+	// each line. Lines shorter than it, such as empty lines or lines of
+	// small glyphs, are extended evenly above and below their content.
+	MinLineHeight fixed.Int26_6
+	// ObjectSize is the space reserved for each U+FFFC OBJECT REPLACEMENT
+	// CHARACTER, for placing inline objects. X is the advance of the object
+	// and Y its height above the baseline. The rune is displayed by a
+	// placeholder glyph without outline whose bounds cover the object.
+	// If zero, the rune is shaped like any other.
+	ObjectSize fixed.Point26_6
+	// RoundMode snaps the advances of glyphs to whole pixels, for crisp
+	// rendering. Glyphs are placed at their unsnapped positions rounded by
+	// the mode, so rounding errors don't accumulate along lines. The zero
+	// value leaves advances unsnapped.
+	RoundMode RoundMode
+	// WrapPolicy controls where lines may be broken, and whether words too
+	// wide for a line are broken.
+	WrapPolicy WrapPolicy
+	// Hyphenation, if set, provides the points at which words that would
+	// overflow their line may be broken, in the language of the locale.
+	// Lines broken within a word end with a hyphen, like lines broken at
+	// soft hyphens. Layouts using a hyphenator are not cached.
+	Hyphenation Hyphenator
+	// TabWidth is the distance between tab stops. Text following a tab starts
+	// at the next stop. If zero, stops are TabSpaces spaces of the primary
+	// face apart.
+	TabWidth fixed.Int26_6
+	// TabSpaces is the number of spaces between tab stops when TabWidth is
+	// zero. If zero, a default of 8 is used. If negative, tabs have the
+	// advance of the tab glyph of the font, which varies between fonts.
+	TabSpaces int
+	// TabOrigin is the position tab stops are measured from.
+	TabOrigin TabOrigin
+	// DisableMark turns off the OpenType mark feature, which positions
+	// combining marks relative to their base glyphs. It is useful for
+	// inspecting the raw placement of marks.
+	DisableMark bool
+	// DisableMarkToMark turns off the OpenType mkmk feature, which stacks
+	// combining marks on top of each other.
+	DisableMarkToMark bool
+	// SmallCaps displays lowercase letters as small capitals, with the
+	// OpenType smcp feature of faces that implement it. Small capitals are
+	// synthesized for other faces by scaling capitals to the x-height.
+	SmallCaps bool
+	// TabularNumbers gives figures equal advances, so that numbers align in
+	// columns, like the CSS font-variant-numeric: tabular-nums property. It
+	// enables the OpenType tnum feature and disables pnum, overriding their
+	// values in Features. Faces without the features are unaffected.
+	TabularNumbers bool
+	// Features sets OpenType features, such as "liga" to 0 to disable
+	// standard ligatures, or "smcp" or "onum" to 1 for small capitals or
+	// oldstyle figures. Later features override earlier features of the
+	// same tag, and all override DisableMark and DisableMarkToMark.
+	Features []FontFeature
+	// SizeAdjust scales the text shown in fallback faces such that its
+	// x-height matches the x-height of the primary face, like the CSS
+	// font-size-adjust property. The scaled size of each run is reported
+	// by its PPEM.
+	SizeAdjust bool
+	// DetectDirection sets the direction of each paragraph from its text,
+	// as described by BaseDirection, instead of from the locale. Paragraphs
+	// without strong characters keep the direction of the locale.
+	DetectDirection bool
+	// DebugKerning records the kerning adjustment between each pair of
+	// adjacent glyphs in the runs of the layout, for inspecting the kerning
+	// of fonts. It is off by default, as it costs an allocation per run.
+	DebugKerning bool
+	// RetainSource keeps a copy of the shaped runes alongside the layout,
+	// for use by operations that need to compare old and new text.
+	RetainSource bool
+}
+
+// Hyphenator finds the points at which words may be hyphenated.
+type Hyphenator interface {
+	// BreakPoints returns the offsets of the runes of word before which it
+	// may be broken with a hyphen, according to the rules of the BCP 47
+	// language lang.
+	BreakPoints(word []rune, lang string) []int
+}
+
+// WhitespaceMode controls the handling of whitespace and line wrapping, after
+// the CSS white-space property.
+type WhitespaceMode uint8
+
+const (
+	// WhitespacePreWrap preserves whitespace and wraps lines to the maximum width.
+	WhitespacePreWrap WhitespaceMode = iota
+	// WhitespacePre preserves whitespace and only breaks lines at newlines.
+	WhitespacePre
+	// WhitespaceNormal collapses each sequence of whitespace, including newlines,
+	// into a single space, trims leading and trailing whitespace and wraps lines
+	// to the maximum width. Collapsed whitespace is attributed to the remaining
+	// space, so rune counts still describe the original text.
+	WhitespaceNormal
+	// WhitespaceNoWrap collapses whitespace like WhitespaceNormal, but never
+	// breaks lines.
+	WhitespaceNoWrap
+)
+
+// collapses reports whether the mode collapses whitespace.
+func (w WhitespaceMode) collapses() bool {
+	return w == WhitespaceNormal || w == WhitespaceNoWrap
+}
+
+// wraps reports whether the mode wraps lines to the maximum width.
+func (w WhitespaceMode) wraps() bool {
+	return w == WhitespacePreWrap || w == WhitespaceNormal
+}
+
+// RoundMode controls the snapping of glyph advances to whole pixels.
+type RoundMode uint8
+
+const (
+	// RoundNone leaves advances unsnapped.
+	RoundNone RoundMode = iota
+	// RoundFloor rounds glyph positions down.
+	RoundFloor
+	// RoundNearest rounds glyph positions to the nearest pixel.
+	RoundNearest
+	// RoundCeil rounds glyph positions up.
+	RoundCeil
+)
+
+// WrapPolicy controls the break opportunities of lines, after the CSS
+// word-break and overflow-wrap properties.
+type WrapPolicy uint8
+
+const (
+	// WrapWords breaks lines only between words. Words too wide for a line
+	// overflow it.
+	WrapWords WrapPolicy = iota
+	// WrapGraphemes breaks lines between any graphemes, like the CSS
+	// break-all value. Whitespace is kept at the end of lines.
+	WrapGraphemes
+	// WrapWordsOrGraphemes breaks lines between words, and words too wide
+	// for a line of their own between graphemes, like the CSS overflow-wrap
+	// anywhere value.
+	WrapWordsOrGraphemes
+	// WrapKeepAll is like WrapWords, except that lines are not broken
+	// between letters or numbers, like the CSS keep-all value. Text of
+	// scripts without spaces between words, such as Chinese, is broken only
+	// at spaces and punctuation.
+	WrapKeepAll
+)
+
+// TabOrigin is the position tab stops are measured from.
+type TabOrigin uint8
+
+const (
+	// TabParagraphStart measures tab stops from the start edge of the
+	// paragraph.
+	TabParagraphStart TabOrigin = iota
+	// TabLineStart measures tab stops from the content of each line,
+	// after its indentation of leading spaces and tabs. It keeps tabs
+	// aligned relative to the content of indented lines such as code.
+	// Tabs in the indentation are measured from the start edge.
+	TabLineStart
+)
+
+// FaceRange assigns a face to a range of runes.
+type FaceRange struct {
+	Runes Range
+	Face  FontFace
+	// Decoration is the decoration of the runes.
+	Decoration Decoration
+}
+
+// NoncharacterMode selects the display of runes that are not characters.
+type NoncharacterMode uint8
+
+const (
+	// NoncharacterReplace displays noncharacters as U+FFFD REPLACEMENT
+	// CHARACTER.
+	NoncharacterReplace NoncharacterMode = iota
+	// NoncharacterHide hides noncharacters, leaving clusters of no width.
+	NoncharacterHide
+)
+
+// Normalization selects the Unicode normalization form of text for shaping.
+type Normalization uint8
+
+const (
+	// NormalizeNone shapes text as it is.
+	NormalizeNone Normalization = iota
+	// NormalizeNFC shapes text in Normalization Form C, with characters
+	// composed where possible, such as 'e' followed by U+0301 COMBINING
+	// ACUTE ACCENT shaped as 'é'.
+	NormalizeNFC
+	// NormalizeNFD shapes text in Normalization Form D, with characters
+	// decomposed into base characters and combining marks.
+	NormalizeNFD
+)
+
+// TextSpan is a piece of text with its own style, for LayoutSpans.
+type TextSpan struct {
+	// Text is the text of the span.
+	Text string
+	// Font is the font of the text.
+	Font Font
+	// PxPerEm is the size of the text.
+	PxPerEm fixed.Int26_6
+	// Metadata is arbitrary data of the span, such as its color. The shaper
+	// does not interpret it.
+	Metadata interface{}
+	// Object, if non-zero, makes the span an inline object such as an icon,
+	// laid out as a single U+FFFC OBJECT REPLACEMENT CHARACTER in place of
+	// Text. The object is wrapped like an unbreakable cluster, and is
+	// displayed by a placeholder glyph without outline.
+	Object InlineObject
+}
+
+// InlineObject is the space reserved for an object placed in text.
+type InlineObject struct {
+	// Width is the advance of the object.
+	Width fixed.Int26_6
+	// Ascent and Descent are the extent of the object above and below the
+	// baseline. The line containing the object is tall enough for both.
+	Ascent, Descent fixed.Int26_6
+}
+
+// Decoration is a set of lines drawn along text.
+type Decoration uint8
+
+const (
+	// Underline draws a line below the baseline.
+	Underline Decoration = 1 << iota
+	// Strikethrough draws a line through the text.
+	Strikethrough
+)
+
+// DecorationRect is the rectangle of a decoration line spanning one or more
+// adjacent runs of a line.
+type DecorationRect struct {
+	// Decoration is the single decoration the rectangle draws.
+	Decoration Decoration
+	// Start and End are the horizontal extent of the rectangle.
+	Start, End fixed.Int26_6
+	// Y is the vertical position of the top of the rectangle.
+	Y fixed.Int26_6
+	// Thickness is the height of the rectangle.
+	Thickness fixed.Int26_6
 }
 
 // A FontFace is a Font and a matching Face.
@@ -67,6 +435,10 @@ type Glyph struct {
 	// Descent is the distance from the dot to the logical bottom of glyphs
 	// in this glyph's face. The specific glyph may descend less than this.
 	Descent fixed.Int26_6
+	// LineGap is the largest line gap among the runs of the glyph's line.
+	// Descent already includes the gap; LineGap separates the spacing
+	// between lines from the extent of the glyphs.
+	LineGap fixed.Int26_6
 	// Offset encodes the origin of the drawing coordinate space for this glyph
 	// relative to the dot. This value is used when converting glyphs to paths.
 	Offset fixed.Point26_6
@@ -77,8 +449,25 @@ type Glyph struct {
 	// always be zero. The final glyph in the cluster contains the runes count
 	// for the entire cluster.
 	Runes byte
+	// RuneOffset is the offset of the first rune of the cluster of this glyph
+	// in the text.
+	RuneOffset int
 	// Flags encode special properties of this glyph.
 	Flags Flags
+	// Oblique is the angle, in degrees, by which Shape slants the outline of
+	// the glyph if Flags contains FlagSyntheticOblique. It is
+	// Parameters.ObliqueAngle, or the default of 12 degrees if that is zero.
+	Oblique float32
+	// Color is the source of the colors of the glyph, for glyphs of color
+	// fonts such as emoji.
+	Color ColorSource
+	// Span is the index of the TextSpan the glyph represents text of, for
+	// text laid out by LayoutSpans. It is zero otherwise.
+	Span int
+	// Fade is the opacity removed from the glyph by Parameters.Fade, from
+	// zero for an opaque glyph to 255 for a transparent one. Renderers scale
+	// the alpha of the glyph color by 255-Fade.
+	Fade uint8
 }
 
 type Flags uint16
@@ -105,6 +494,14 @@ const (
 	FlagParagraphBreak
 	// FlagParagraphStart indicates that the glyph starts a new paragraph.
 	FlagParagraphStart
+	// FlagSyntheticBold is set for glyphs emboldened by Parameters.Synthesize
+	// because their face lacks the requested weight. Shape widens their
+	// outlines.
+	FlagSyntheticBold
+	// FlagSyntheticOblique is set for glyphs slanted by Parameters.Synthesize
+	// because their face lacks the requested italic style. Shape slants their
+	// outlines by Glyph.Oblique.
+	FlagSyntheticOblique
 )
 
 func (f Flags) String() string {
@@ -139,6 +536,12 @@ func (f Flags) String() string {
 	} else {
 		b.WriteString("_")
 	}
+	if f&FlagSyntheticBold != 0 {
+		b.WriteString("B")
+	}
+	if f&FlagSyntheticOblique != 0 {
+		b.WriteString("O")
+	}
 	return b.String()
 }
 
@@ -160,6 +563,8 @@ type Shaper struct {
 	line             int
 	run              int
 	glyph            int
+	// lineStart is the rune offset of the current line.
+	lineStart int
 	// advance is the width of glyphs from the current run that have already been displayed.
 	advance fixed.Int26_6
 	// done tracks whether iteration is over.
@@ -171,25 +576,373 @@ type Shaper struct {
 // available.
 func NewShaper(collection []FontFace) *Shaper {
 	l := &Shaper{}
+	l.shaper.runs.size = maxSize
 	for _, f := range collection {
 		l.shaper.Load(f)
 	}
 	return l
 }
 
+// LoadLazy registers a face for fnt without loading it, so that fonts that
+// are rarely used don't slow down startup. The font is matched against the
+// fonts of text like the fonts of loaded faces, and load is called the first
+// time its face is chosen for shaping text. The loaded face is reused by
+// later layouts. If load fails, the face is skipped.
+func (l *Shaper) LoadLazy(fnt Font, load func() (Face, error)) {
+	l.shaper.LoadLazy(fnt, load)
+	// Cached layouts may resolve their fonts to the registered face.
+	l.layoutCache = layoutCache{}
+}
+
+// LoadDir loads the faces of the font files in the directory tree at path,
+// such as a font directory of the operating system, so that they can be
+// selected by the family names of their fonts. Files with the .ttf, .otf,
+// .ttc and .otc extensions are parsed, and files that can't be read or
+// parsed are skipped. Faces with the family, style and weight of a loaded
+// face are skipped as well. LoadDir returns the number of faces loaded and
+// the error reading path, if any.
+func (l *Shaper) LoadDir(path string) (int, error) {
+	n := 0
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == path {
+				return err
+			}
+			// Skip unreadable subdirectories.
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".ttf", ".otf", ".ttc", ".otc":
+		default:
+			return nil
+		}
+		src, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		faces, err := opentype.ParseCollection(src)
+		if err != nil {
+			return nil
+		}
+		for _, face := range faces {
+			fnt := fontFor(face.Metadata())
+			if _, exists := l.shaper.orderer.faces[fnt]; exists {
+				continue
+			}
+			l.shaper.Load(FontFace{Font: fnt, Face: face})
+			n++
+		}
+		return nil
+	})
+	if n > 0 {
+		// Cached layouts may resolve their fonts to the loaded faces.
+		l.layoutCache = layoutCache{}
+	}
+	return n, err
+}
+
+// fontFor returns the Font described by the metadata of a face.
+func fontFor(m opentype.Metadata) Font {
+	fnt := Font{Typeface: Typeface(m.Family)}
+	if m.Italic {
+		fnt.Style = Italic
+	}
+	if m.Weight > 0 {
+		fnt.Weight = Weight(m.Weight) - 400
+	}
+	return fnt
+}
+
+// SetShapingWorkers sets the number of goroutines shaping the runs of long
+// paragraphs concurrently, such as the runs of mixed-direction text. Short
+// paragraphs are always shaped serially. A count of zero or less selects
+// runtime.GOMAXPROCS(0) workers. By default, text is shaped serially.
+func (l *Shaper) SetShapingWorkers(workers int) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	l.shaper.workers = workers
+}
+
+// SetRunCacheSize sets the maximum number of shaped runs memoized across
+// layouts. Runs are looked up by their face, text, size and features, so that
+// laying out unchanged text again, such as at another width, skips shaping.
+// The cache is cleared when faces are loaded. A size of zero disables the
+// cache. The default size is 1000.
+func (l *Shaper) SetRunCacheSize(size int) {
+	l.shaper.runs.size = size
+	if size == 0 {
+		l.shaper.runs.Clear()
+	}
+}
+
+// SetFallback registers a function that provides faces for runes missing from
+// every face known to the shaper, such as a resolver of system fonts. It is
+// consulted before the runes are displayed with the .notdef glyph of the
+// primary face. The faces it returns are loaded and used for subsequent
+// layouts. A nil function disables the fallback, which is the default.
+func (l *Shaper) SetFallback(resolve func(font Font, r rune) (FontFace, bool)) {
+	l.shaper.orderer.fallback = resolve
+	// Cached layouts may display runes the fallback provides faces for.
+	l.layoutCache = layoutCache{}
+}
+
+// SetFallbacks sets the fonts whose faces are preferred, in order, for runes
+// missing from the face chosen for the text, such as an emoji font before a
+// CJK font. Each rune is displayed by the first face in the order that
+// covers it, with the faces of fonts not in the list last, in the order they
+// were loaded. The fonts are matched against the loaded fonts like the
+// font of the text. Faces of the fonts that were registered with LoadLazy
+// are loaded when text is first shaped.
+func (l *Shaper) SetFallbacks(fonts []Font) {
+	l.shaper.orderer.fallbacks = append([]Font(nil), fonts...)
+	// Cached layouts may display missing runes with other faces.
+	l.layoutCache = layoutCache{}
+}
+
+// SetTofu registers a function that provides the runes displayed in place of
+// runes missing from every face, instead of the .notdef glyph of the primary
+// face. The replacement, such as the code point of the rune in hexadecimal,
+// is shaped with the face selected by font, and represents the missing rune
+// like a single glyph cluster. A nil function displays missing runes with
+// .notdef glyphs, which is the default.
+func (l *Shaper) SetTofu(font Font, replace func(r rune) []rune) {
+	l.shaper.tofu, l.shaper.tofuFont = replace, font
+	// Cached layouts may display missing runes differently.
+	l.layoutCache = layoutCache{}
+}
+
+// RunStats describes the resolution of the face of a shaped run.
+type RunStats struct {
+	// Runes is the range of runes of the run, relative to the start of its
+	// paragraph.
+	Runes Range
+	// FacesTried is the number of faces consulted, in fallback order,
+	// before one covering the first rune of the run was found, counting
+	// each consultation of the function registered with SetFallback as a
+	// face. It is 1 for runs shaped with the primary face. Large counts
+	// indicate runes missing from the primary faces.
+	FacesTried int
+}
+
+// SetObserver registers a function that is notified of the face resolution of
+// each run shaped by subsequent layouts, for diagnosing slow layouts caused
+// by deep fallback chains. Layouts served from the cache of the shaper are
+// not reported. A nil function disables notifications, which is the default.
+func (l *Shaper) SetObserver(observe func(RunStats)) {
+	l.shaper.observer = observe
+}
+
+// SetOnMissingGlyph registers a function that is notified of the runes
+// that can't be displayed by any face, and are displayed by a .notdef glyph
+// or the replacement of SetTofu instead. It is called while text is shaped,
+// once per missing rune for each call that lays out or measures text. Layouts
+// served from the cache of the shaper are not reported. A nil function
+// disables notifications, which is the default.
+func (l *Shaper) SetOnMissingGlyph(fn func(r rune)) {
+	l.shaper.missingGlyph = fn
+}
+
+// HasFeature reports whether the face that would be used to shape text
+// in font supports the OpenType feature tag. It can be used to disable
+// typographic options that would have no effect.
+func (l *Shaper) HasFeature(font Font, tag Tag) bool {
+	return l.shaper.HasFeature(font, tag)
+}
+
+// Metrics returns the x-height, cap-height and decoration metrics of the
+// face that would be used to shape text in font at size pxPerEm.
+func (l *Shaper) Metrics(font Font, pxPerEm fixed.Int26_6) Metrics {
+	return l.shaper.Metrics(font, pxPerEm)
+}
+
+// Unbounded is a maximum width that never wraps lines, laying out each
+// paragraph on a single line. It is distinct from a maximum width of zero,
+// which breaks lines at every opportunity.
+const Unbounded = math.MaxInt
+
 // Layout text from an io.Reader according to a set of options. Results can be retrieved by
-// iteratively calling NextGlyph.
+// iteratively calling NextGlyph. Lines are wrapped to maxWidth, which may be
+// Unbounded; a maxWidth of zero puts every word on its own line.
 func (l *Shaper) Layout(params Parameters, minWidth, maxWidth int, lc system.Locale, txt io.Reader) {
-	l.layoutText(params, minWidth, maxWidth, lc, bufio.NewReader(txt), "")
+	l.layoutText(params, minWidth, maxWidth, lc, bufio.NewReader(txt), "", nil, nil)
 }
 
 // LayoutString is Layout for strings.
 func (l *Shaper) LayoutString(params Parameters, minWidth, maxWidth int, lc system.Locale, str string) {
-	l.layoutText(params, minWidth, maxWidth, lc, nil, str)
+	l.layoutText(params, minWidth, maxWidth, lc, nil, str, nil, nil)
+}
+
+// MinBreakWidth returns the narrowest width str can be wrapped to without
+// overflowing, that is the width of its widest part that can't be broken
+// across lines according to params.WrapPolicy.
+func (l *Shaper) MinBreakWidth(params Parameters, lc system.Locale, str string) fixed.Int26_6 {
+	l.shaper.resetMissing()
+	return l.shaper.MinBreakWidth(params, lc, []rune(str))
+}
+
+// Measure returns the size of runes laid out by Layout with a minimum width
+// of zero, without computing the glyphs of the layout. It is cheaper than
+// Layout for sizing text before laying it out, and does not affect the
+// result of the most recent layout.
+func (l *Shaper) Measure(params Parameters, maxWidth int, lc system.Locale, runes []rune) image.Point {
+	l.shaper.resetMissing()
+	return l.shaper.Measure(params, maxWidth, lc, runes)
+}
+
+// LayoutFaces is LayoutString, except that the runes in each of faces are
+// shaped with its face, without checking that the face supports them. Runes
+// missing from their face are displayed with its .notdef glyph, and runes
+// outside of faces use the face selected by params.Font. It avoids the cost of
+// resolving faces when the faces of the text are known in advance. Faces not
+// loaded by the Shaper are not used for other text. The layout is not cached.
+func (l *Shaper) LayoutFaces(params Parameters, minWidth, maxWidth int, lc system.Locale, str string, faces []FaceRange) {
+	if faces == nil {
+		faces = []FaceRange{}
+	}
+	l.layoutText(params, minWidth, maxWidth, lc, nil, str, faces, nil)
+}
+
+// LayoutSpans lays out the concatenated text of spans, shaping the text of
+// each span with its font and size. Lines mixing sizes are tall enough for
+// their tallest run, and their runs share a baseline. The Span field of the
+// glyphs of the layout is the index of their span.
+func (l *Shaper) LayoutSpans(spans []TextSpan, minWidth, maxWidth int, lc system.Locale) {
+	var params Parameters
+	var b strings.Builder
+	for _, sp := range spans {
+		if sp.Object != (InlineObject{}) {
+			b.WriteRune(objectReplacement)
+			continue
+		}
+		b.WriteString(sp.Text)
+	}
+	if len(spans) > 0 {
+		params.Font = spans[0].Font
+		params.PxPerEm = spans[0].PxPerEm
+	}
+	l.layoutText(params, minWidth, maxWidth, lc, nil, b.String(), nil, spans)
+}
+
+// Relayout updates the most recent layout for replacing the runes in
+// [editStart, editEnd) of its text with replacement. Only the paragraphs
+// touched by the edit are laid out again, including the paragraphs merged or
+// split by edits of paragraph separators; the lines of the other paragraphs
+// are reused and moved vertically. The parameters, widths and locale must
+// match those of the most recent layout, which must have been made with
+// params.RetainSource set. Layouts limited by MaxLines or MaxHeight are laid
+// out in full.
+func (l *Shaper) Relayout(params Parameters, minWidth, maxWidth int, lc system.Locale, editStart, editEnd int, replacement []rune) {
+	old := l.txt
+	l.shaper.resetMissing()
+	if !params.RetainSource {
+		panic("text: Relayout requires Parameters.RetainSource")
+	}
+	if editStart < 0 || editStart > editEnd || editEnd > len(old.source) {
+		panic("text: edit out of range")
+	}
+	src := make([]rune, 0, len(old.source)-(editEnd-editStart)+len(replacement))
+	src = append(src, old.source[:editStart]...)
+	src = append(src, replacement...)
+	src = append(src, old.source[editEnd:]...)
+	if params.MaxLines > 0 || params.MaxHeight > 0 || old.Truncated > 0 || len(src) == 0 {
+		l.LayoutString(params, minWidth, maxWidth, lc, string(src))
+		return
+	}
+	// Find the lines and runes of the paragraphs containing the edit. The
+	// paragraph after a deleted separator is merged into the edited one.
+	var firstPara, lastPara, firstLine, lastLine, runeStart, runeEnd int
+	para, paraLine, paraRune, runes := 0, 0, 0, 0
+	for i, ln := range old.lines {
+		runes += ln.runeCount
+		if ln.Ending.wraps() && i < len(old.lines)-1 {
+			continue
+		}
+		if editStart >= paraRune {
+			firstPara, firstLine, runeStart = para, paraLine, paraRune
+		}
+		lastPara, lastLine, runeEnd = para, i+1, runes
+		if editEnd < runes {
+			break
+		}
+		para, paraLine, paraRune = para+1, i+1, runes
+	}
+	// Lay out the text of the touched paragraphs after the edit.
+	edited := src[runeStart : runeEnd-(editEnd-editStart)+len(replacement)]
+	var doc document
+	doc.alignment = params.Alignment
+	doc.append(old.slice(0, firstLine, 0, firstPara, 0))
+	splitParagraphs := !params.Whitespace.collapses()
+	for len(edited) > 0 {
+		end := len(edited)
+		if splitParagraphs {
+			if i := slices.IndexFunc(edited, isParagraphSeparator); i >= 0 {
+				end = i + 1
+			}
+		}
+		doc.append(l.layoutParagraph(params, minWidth, maxWidth, lc, string(edited[:end]), nil))
+		edited = edited[end:]
+	}
+	doc.append(old.slice(lastLine, len(old.lines), lastPara+1, len(old.paragraphs), runeEnd))
+	doc.alignWidth = alignWidth(minWidth, doc.lines)
+	doc.minWidth = minWidth
+	l.line, l.run, l.glyph, l.advance, l.lineStart = 0, 0, 0, 0, 0
+	l.done = false
+	l.txt = doc
+}
+
+// Overflowed reports whether a line of the most recent layout is wider than
+// the maximum width, such as when it contains a word that could not be
+// broken.
+func (l *Shaper) Overflowed() bool {
+	return l.txt.Overflowed
+}
+
+// UsedFaces returns the distinct faces and sizes of the glyphs of the most
+// recent layout, in order of first use.
+func (l *Shaper) UsedFaces() []UsedFace {
+	return l.txt.UsedFaces()
+}
+
+// Decorations returns the rectangles of the decorations of the most recent
+// layout, in the coordinates of its glyphs. The rectangles of each line are
+// in visual order, and adjacent runs with the same decoration share a
+// rectangle.
+func (l *Shaper) Decorations() []DecorationRect {
+	var rects []DecorationRect
+	for _, line := range l.txt.lines {
+		align := l.txt.alignment.Align(line.direction, line.width, l.txt.alignWidth)
+		for _, d := range line.decorations {
+			d.Start += align
+			d.End += align
+			d.Y += fixed.I(line.yOffset)
+			rects = append(rects, d)
+		}
+	}
+	return rects
+}
+
+// IgnorableMarkers returns the markers of the default-ignorable characters
+// of the most recent layout, in the coordinates of its glyphs, if it was
+// laid out with Parameters.ShowIgnorables.
+func (l *Shaper) IgnorableMarkers() []IgnorableMarker {
+	var markers []IgnorableMarker
+	for _, line := range l.txt.lines {
+		align := l.txt.alignment.Align(line.direction, line.width, l.txt.alignWidth)
+		for _, m := range line.ignorables {
+			m.X += align
+			m.Y += fixed.I(line.yOffset)
+			markers = append(markers, m)
+		}
+	}
+	return markers
 }
 
 func (l *Shaper) reset(align Alignment) {
-	l.line, l.run, l.glyph, l.advance = 0, 0, 0, 0
+	l.line, l.run, l.glyph, l.advance, l.lineStart = 0, 0, 0, 0, 0
 	l.done = false
 	l.txt.reset()
 	l.txt.alignment = align
@@ -197,18 +950,25 @@ func (l *Shaper) reset(align Alignment) {
 
 // layoutText lays out a large text document by breaking it into paragraphs and laying
 // out each of them separately. This allows the shaping results to be cached independently
-// by paragraph. Only one of txt and str should be provided.
-func (l *Shaper) layoutText(params Parameters, minWidth, maxWidth int, lc system.Locale, txt io.RuneReader, str string) {
+// by paragraph. Only one of txt and str should be provided. If faces is
+// non-nil, the faces of the text are assigned by it instead. If spans is
+// non-nil, the text is styled by it.
+func (l *Shaper) layoutText(params Parameters, minWidth, maxWidth int, lc system.Locale, txt io.RuneReader, str string, faces []FaceRange, spans []TextSpan) {
 	l.reset(params.Alignment)
+	l.shaper.resetMissing()
 	if txt == nil && len(str) == 0 {
 		l.txt.append(l.layoutParagraph(params, minWidth, maxWidth, lc, "", nil))
 		return
 	}
 	truncating := params.MaxLines > 0
 	maxLines := params.MaxLines
+	// Collapsed whitespace includes newlines, so the text is a single paragraph.
+	splitParagraphs := !params.Whitespace.collapses()
 	var done bool
 	var startByte int
 	var endByte int
+	// startRune is the rune offset of the current paragraph.
+	var startRune int
 	for !done {
 		var runes int
 		l.paragraph = l.paragraph[:0]
@@ -220,7 +980,7 @@ func (l *Shaper) layoutText(params Parameters, minWidth, maxWidth int, lc system
 				}
 				l.paragraph = append(l.paragraph, r)
 				runes++
-				if r == '\n' {
+				if isParagraphSeparator(r) && splitParagraphs {
 					break
 				}
 			}
@@ -229,26 +989,59 @@ func (l *Shaper) layoutText(params Parameters, minWidth, maxWidth int, lc system
 				r, width := utf8.DecodeRuneInString(str[endByte:])
 				endByte += width
 				runes++
-				if r == '\n' {
+				if isParagraphSeparator(r) && splitParagraphs {
 					break
 				}
 			}
 			done = endByte == len(str)
 		}
 		if startByte != endByte || (len(l.paragraph) > 0 || len(l.txt.lines) == 0) {
-			l.txt.append(l.layoutParagraph(params, minWidth, maxWidth, lc, str[startByte:endByte], l.paragraph))
+			if faces != nil || spans != nil {
+				paragraph := l.paragraph
+				if txt == nil {
+					paragraph = []rune(str[startByte:endByte])
+				}
+				if spans != nil {
+					l.txt.append(l.shaper.LayoutSpans(params, minWidth, maxWidth, lc, paragraph, spans, startRune))
+				} else {
+					l.txt.append(l.shaper.LayoutAssigned(params, minWidth, maxWidth, lc, paragraph, faces, startRune))
+				}
+			} else {
+				l.txt.append(l.layoutParagraph(params, minWidth, maxWidth, lc, str[startByte:endByte], l.paragraph))
+			}
 			if truncating {
 				params.MaxLines = maxLines - len(l.txt.lines)
 				if params.MaxLines == 0 {
+					if !done {
+						// Account for the paragraphs that are not laid out.
+						l.txt.Truncated += countRunes(txt, str[endByte:])
+					}
 					done = true
 				}
 			}
 		}
 		if done {
+			if params.MaxHeight > 0 {
+				l.txt.truncateHeight(params.MaxHeight, params.Orphans, params.Widows)
+			}
 			return
 		}
 		startByte = endByte
+		startRune += runes
+	}
+}
+
+// countRunes returns the number of runes remaining in txt, or in str if txt
+// is nil.
+func countRunes(txt io.RuneReader, str string) int {
+	if txt == nil {
+		return utf8.RuneCountInString(str)
+	}
+	n := 0
+	for _, _, err := txt.ReadRune(); err == nil; _, _, err = txt.ReadRune() {
+		n++
 	}
+	return n
 }
 
 func (l *Shaper) layoutParagraph(params Parameters, minWidth, maxWidth int, lc system.Locale, asStr string, asRunes []rune) document {
@@ -258,27 +1051,126 @@ func (l *Shaper) layoutParagraph(params Parameters, minWidth, maxWidth int, lc s
 	if len(asStr) == 0 && len(asRunes) > 0 {
 		asStr = string(asRunes)
 	}
-	// Alignment is not part of the cache key because changing it does not impact shaping.
+	// Alignment is not part of the cache key because changing it does not impact shaping,
+	// except for justification.
 	lk := layoutKey{
-		ppem:     params.PxPerEm,
-		maxWidth: maxWidth,
-		minWidth: minWidth,
-		maxLines: params.MaxLines,
-		str:      asStr,
-		locale:   lc,
-		font:     params.Font,
+		justify:        params.Alignment == Justify,
+		justifyLast:    params.JustifyLastLine,
+		kashida:        params.Kashida,
+		ppem:           params.PxPerEm,
+		maxWidth:       maxWidth,
+		minWidth:       minWidth,
+		maxLines:       params.MaxLines,
+		truncator:      params.Truncator,
+		fade:           params.Fade,
+		str:            asStr,
+		locale:         lc,
+		font:           params.Font,
+		retainSource:   params.RetainSource,
+		oblique:        params.ObliqueAngle,
+		synthesize:     params.Synthesize,
+		stemDarkening:  params.StemDarkening,
+		noncharacters:  params.Noncharacters,
+		normalize:      params.Normalize,
+		showInvisibles: params.ShowInvisibles,
+		showIgnorables: params.ShowIgnorables,
+		dottedCircle:   params.DottedCircle,
+		circleFont:     params.DottedCircleFont,
+		punctuation:    params.SubstitutePunctuation,
+		smartQuotes:    params.SmartQuotes,
+		whitespace:     params.Whitespace,
+		separators:     params.TabularSeparators,
+		gridCell:       params.GridCell,
+		ambiguous:      params.AmbiguousWidth,
+		tabWidth:       params.TabWidth,
+		tabSpaces:      params.TabSpaces,
+		tabOrigin:      params.TabOrigin,
+		wrapPolicy:     params.WrapPolicy,
+		roundMode:      params.RoundMode,
+		objectSize:     params.ObjectSize,
+		minHeight:      params.MinLineHeight,
+		debugKerning:   params.DebugKerning,
+		detectDir:      params.DetectDirection,
+		sizeAdjust:     params.SizeAdjust,
+		spacing:        params.LetterSpacing,
+		wordSpacing:    params.WordSpacing,
+		noMark:         params.DisableMark,
+		noMarkToMark:   params.DisableMarkToMark,
+		features:       featuresKey(params.Features),
+		tabularNums:    params.TabularNumbers,
+		smallCaps:      params.SmallCaps,
 	}
-	if l, ok := l.layoutCache.Get(lk); ok {
-		return l
+	// Hyphenators need not be comparable, so layouts using them are not
+	// cached.
+	cached := params.Hyphenation == nil
+	if cached {
+		if l, ok := l.layoutCache.Get(lk); ok {
+			return l
+		}
 	}
 	if len(asRunes) == 0 && len(asStr) > 0 {
 		asRunes = []rune(asStr)
 	}
 	lines := l.shaper.LayoutRunes(params, minWidth, maxWidth, lc, asRunes)
-	l.layoutCache.Put(lk, lines)
+	if cached {
+		l.layoutCache.Put(lk, lines)
+	}
 	return lines
 }
 
+// Locate returns the rune offset of the caret position closest to pt, in
+// the coordinates of the glyphs of the most recent layout. It handles
+// right-to-left and bidirectional text, where the visual order of runs
+// differs from their logical order.
+func (l *Shaper) Locate(pt fixed.Point26_6) int {
+	return l.txt.Locate(pt)
+}
+
+// CaretPos returns the x coordinate of the caret before the rune at
+// runeIndex, and the top and bottom of its line, in the coordinates of the
+// glyphs of the most recent layout. At the boundary of runs of different
+// directions, the caret follows the logically preceding rune.
+func (l *Shaper) CaretPos(runeIndex int) (x, top, bottom fixed.Int26_6) {
+	return l.txt.CaretPos(runeIndex)
+}
+
+// SelectionRegions returns the regions covering the runes in [start, end)
+// of the most recent layout, in the coordinates of its glyphs. A range
+// crossing a bidi boundary may produce several regions per line.
+func (l *Shaper) SelectionRegions(start, end int) []Region {
+	return l.txt.SelectionRegions(start, end)
+}
+
+// SelectionOutline returns the closed polygon enclosing the selection of
+// the runes in [start, end) of the most recent layout, in the coordinates of
+// its glyphs. Unlike SelectionRegions, the lines of the selection form a
+// single outline suitable for drawing one continuous highlight.
+func (l *Shaper) SelectionOutline(start, end int) []f32.Point {
+	return l.txt.SelectionOutline(start, end)
+}
+
+// SnapClusters moves the glyph clusters of the most recent layout to the
+// nearest positions of grid, relative to the start of each line, such as
+// the beats of a rhythm for aligning lyrics. It returns the resulting
+// advances of the clusters. SnapClusters must be called before iterating
+// the glyphs of the layout.
+func (l *Shaper) SnapClusters(grid []fixed.Int26_6) []fixed.Int26_6 {
+	return l.txt.SnapClusters(grid)
+}
+
+// ColorLayers returns the layers of a glyph with the ColorLayered color
+// source, from bottom to top. Each layer is a glyph to be shaped by Shape
+// and filled with the color of the layer.
+func (l *Shaper) ColorLayers(g Glyph) []ColorLayer {
+	return l.shaper.ColorLayers(g)
+}
+
+// Bitmap returns the embedded image of a glyph with the ColorBitmap color
+// source.
+func (l *Shaper) Bitmap(g Glyph) (GlyphBitmap, bool) {
+	return l.shaper.Bitmap(g)
+}
+
 // NextGlyph returns the next glyph from the most recent shaping operation, if
 // any. If there are no more glyphs, ok will be false.
 func (l *Shaper) NextGlyph() (_ Glyph, ok bool) {
@@ -300,6 +1192,7 @@ func (l *Shaper) NextGlyph() (_ Glyph, ok bool) {
 		if l.run == len(line.runs) {
 			l.line++
 			l.run = 0
+			l.lineStart += line.runeCount
 			continue
 		}
 		run := line.runs[l.run]
@@ -316,6 +1209,7 @@ func (l *Shaper) NextGlyph() (_ Glyph, ok bool) {
 				Flags:   FlagLineBreak | FlagClusterBreak | FlagRunBreak,
 				Ascent:  line.ascent,
 				Descent: line.descent,
+				LineGap: line.lineGap,
 			}, true
 		}
 		if l.glyph == len(run.Glyphs) {
@@ -342,18 +1236,23 @@ func (l *Shaper) NextGlyph() (_ Glyph, ok bool) {
 			runOffset = run.Advance - l.advance
 		}
 		glyph := Glyph{
-			ID:      g.id,
-			X:       align + run.X + runOffset,
-			Y:       int32(line.yOffset),
-			Ascent:  line.ascent,
-			Descent: line.descent,
-			Advance: g.xAdvance,
-			Runes:   byte(g.runeCount),
+			ID:         g.id,
+			X:          align + run.X + runOffset,
+			Y:          int32(line.yOffset),
+			Ascent:     line.ascent,
+			Descent:    line.descent,
+			LineGap:    line.lineGap,
+			Advance:    g.xAdvance,
+			Runes:      byte(g.runeCount),
+			RuneOffset: l.lineStart + g.runeOffset,
 			Offset: fixed.Point26_6{
 				X: g.xOffset,
 				Y: g.yOffset,
 			},
 			Bounds: g.bounds,
+			Color:  g.color,
+			Span:   run.Span,
+			Fade:   g.fade,
 		}
 		l.glyph++
 		if !rtl {
@@ -382,6 +1281,15 @@ func (l *Shaper) NextGlyph() (_ Glyph, ok bool) {
 		if run.Direction.Progression() == system.TowardOrigin {
 			glyph.Flags |= FlagTowardOrigin
 		}
+		if run.synthesize {
+			if run.Embolden {
+				glyph.Flags |= FlagSyntheticBold
+			}
+			if run.Oblique != 0 {
+				glyph.Flags |= FlagSyntheticOblique
+				glyph.Oblique = run.Oblique
+			}
+		}
 		if l.brokeParagraph {
 			glyph.Flags |= FlagParagraphStart
 			l.brokeParagraph = false
@@ -391,9 +1299,11 @@ func (l *Shaper) NextGlyph() (_ Glyph, ok bool) {
 			l.brokeParagraph = true
 			if endOfText {
 				l.pararagraphStart = Glyph{
-					Ascent:  glyph.Ascent,
-					Descent: glyph.Descent,
-					Flags:   FlagParagraphStart | FlagLineBreak | FlagRunBreak | FlagClusterBreak,
+					Ascent:     glyph.Ascent,
+					Descent:    glyph.Descent,
+					LineGap:    glyph.LineGap,
+					RuneOffset: l.lineStart + line.runeCount,
+					Flags:      FlagParagraphStart | FlagLineBreak | FlagRunBreak | FlagClusterBreak,
 				}
 				// If a glyph is both a paragraph break and the final glyph, it's a newline
 				// at the end of the text. We must inform widgets like the text editor
@@ -412,6 +1322,8 @@ const (
 	facebits = 16
 	sizebits = 16
 	gidbits  = 64 - facebits - sizebits
+	// maxFaceIndex is the largest face index of a GlyphID.
+	maxFaceIndex = 1<<facebits - 1
 )
 
 // newGlyphID encodes a face and a glyph id into a GlyphID.
@@ -434,7 +1346,7 @@ func newGlyphID(ppem fixed.Int26_6, faceIdx int, gid font.GID) GlyphID {
 
 // splitGlyphID is the opposite of newGlyphID.
 func splitGlyphID(g GlyphID) (fixed.Int26_6, int, font.GID) {
-	faceIdx := int(g) >> (gidbits + sizebits)
+	faceIdx := int(g >> (gidbits + sizebits))
 	ppem := fixed.Int26_6((g & ((1<<sizebits - 1) << gidbits)) >> gidbits)
 	gid := font.GID(g) & (1<<gidbits - 1)
 	return ppem, faceIdx, gid
@@ -2,13 +2,20 @@ package text
 
 import (
 	"fmt"
+	"image"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"unicode"
 
 	nsareg "eliasnaur.com/font/noto/sans/arabic/regular"
+	"eliasnaur.com/font/roboto/robotoregular"
 	"gioui.org/font/opentype"
 	"gioui.org/io/system"
+	"github.com/benoitkugler/textlayout/fonts/truetype"
 	"golang.org/x/exp/slices"
+	"golang.org/x/image/font/gofont/gomono"
 	"golang.org/x/image/font/gofont/goregular"
 	"golang.org/x/image/math/fixed"
 )
@@ -51,6 +58,68 @@ func TestWrappingTruncation(t *testing.T) {
 	}
 }
 
+// TestTruncatedRunes checks that the runes omitted because of MaxLines are
+// counted, and that the kept lines account for all other runes.
+func TestTruncatedRunes(t *testing.T) {
+	const txt = "Lorem ipsum dolor sit amet, consectetur adipiscing elit,\nsed do eiusmod tempor incididunt ut labore et\ndolore magna aliqua.\n"
+	total := len([]rune(txt))
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	cache.LayoutString(params, 0, 200, english, txt)
+	untruncated := len(cache.txt.lines)
+	if cache.txt.Truncated != 0 {
+		t.Errorf("expected no truncation without limit, got %d runes", cache.txt.Truncated)
+	}
+	for limit := 1; limit <= untruncated+2; limit++ {
+		params.MaxLines = limit
+		for _, reader := range []bool{false, true} {
+			if reader {
+				cache.Layout(params, 0, 200, english, strings.NewReader(txt))
+			} else {
+				cache.LayoutString(params, 0, 200, english, txt)
+			}
+			kept := 0
+			for _, l := range cache.txt.lines {
+				kept += l.runeCount
+			}
+			truncated := cache.txt.Truncated
+			if kept+truncated != total {
+				t.Errorf("limit %d: %d kept and %d truncated runes, expected %d in total", limit, kept, truncated, total)
+			}
+			// Wrapping to exactly the limit truncates nothing.
+			if fits := limit >= untruncated; fits != (truncated == 0) {
+				t.Errorf("limit %d of %d lines: truncated %d runes", limit, untruncated, truncated)
+			}
+		}
+	}
+}
+
+// TestShaperRuneOffset checks that glyphs report the offsets of their clusters
+// in text of several lines and paragraphs.
+func TestShaperRuneOffset(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}, {Face: rtlFace}})
+	const txt = "The quick brown fox\nسماء jumps over\nthe lazy dog\n"
+	cache.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 60, english, txt)
+	if len(cache.txt.lines) < 4 {
+		t.Fatalf("expected the paragraphs to wrap, got %d lines", len(cache.txt.lines))
+	}
+	offset := 0
+	for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+		if g.RuneOffset != offset {
+			t.Errorf("glyph %+v: expected rune offset %d, got %d", g, offset, g.RuneOffset)
+		}
+		if g.Flags&FlagClusterBreak != 0 {
+			offset += int(g.Runes)
+		}
+	}
+	if total := len([]rune(txt)); offset != total {
+		t.Errorf("expected glyphs of %d runes, got %d", total, offset)
+	}
+}
+
 // TestShapingNewlineHandling checks that the shaper's newline splitting behaves
 // consistently and does not create spurious lines of text.
 func TestShapingNewlineHandling(t *testing.T) {
@@ -278,6 +347,24 @@ func TestCacheGlyphConverstion(t *testing.T) {
 	}
 }
 
+// TestHasFeature checks that feature queries consult the face resolved
+// for the requested font.
+func TestHasFeature(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	robotoFace, _ := opentype.Parse(robotoregular.TTF)
+	cache := NewShaper([]FontFace{
+		{Font: Font{Typeface: "Go"}, Face: ltrFace},
+		{Font: Font{Typeface: "Roboto"}, Face: robotoFace},
+	})
+	smcp := truetype.MustNewTag("smcp")
+	if !cache.HasFeature(Font{Typeface: "Roboto"}, smcp) {
+		t.Errorf("expected Roboto to support smcp")
+	}
+	if cache.HasFeature(Font{Typeface: "Go"}, smcp) {
+		t.Errorf("expected Go to lack smcp")
+	}
+}
+
 func checkFlag(t *testing.T, shouldHave bool, flag Flags, actual Glyph, glyphCursor int) {
 	t.Helper()
 	if shouldHave && actual.Flags&flag == 0 {
@@ -316,3 +403,1502 @@ func printLinePositioning(t *testing.T, lines []line, glyphs []Glyph) {
 		}
 	}
 }
+
+// TestWhitespaceCollapse checks that collapsed whitespace is shaped as a
+// single space while rune counts still describe the original text.
+func TestWhitespaceCollapse(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	const txt = "a   b\n c"
+	cache.LayoutString(Parameters{
+		PxPerEm:    fixed.I(10),
+		Whitespace: WhitespaceNormal,
+	}, 0, 200, english, txt)
+	if n := len(cache.txt.lines); n != 1 {
+		t.Fatalf("expected a single line, got %d", n)
+	}
+	var glyphs, runes int
+	for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+		glyphs++
+		runes += int(g.Runes)
+	}
+	if glyphs != len("a b c") {
+		t.Errorf("expected %d glyphs, got %d", len("a b c"), glyphs)
+	}
+	if runes != len(txt) {
+		t.Errorf("expected glyphs to cover %d runes, got %d", len(txt), runes)
+	}
+	for _, tc := range []struct {
+		rune     int
+		expected Range
+	}{
+		{rune: 0, expected: Range{Offset: 0, Count: 1}},
+		{rune: 2, expected: Range{Offset: 1, Count: 3}},
+		{rune: 4, expected: Range{Offset: 4, Count: 1}},
+		{rune: 6, expected: Range{Offset: 5, Count: 2}},
+		{rune: 7, expected: Range{Offset: 7, Count: 1}},
+	} {
+		if got, _, _ := cache.txt.ClusterAt(tc.rune); got != tc.expected {
+			t.Errorf("rune %d: expected cluster %+v, got %+v", tc.rune, tc.expected, got)
+		}
+	}
+}
+
+// TestSnapshot checks that a document snapshot is unaffected by later layouts
+// reusing the shaper's memory.
+func TestSnapshot(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10), RetainSource: true}
+	cache.LayoutString(params, 0, 200, english, "first\nparagraph")
+	snap := cache.txt.Snapshot()
+	expected := fmt.Sprintf("%+v", snap)
+	if n := len(snap.lines); n != 2 {
+		t.Fatalf("expected 2 lines, got %d", n)
+	}
+	cache.LayoutString(params, 0, 50, english, "a rather different text that wraps")
+	cache.txt.lines[0].runs[0].X = 100
+	if got := fmt.Sprintf("%+v", snap); got != expected {
+		t.Errorf("snapshot changed after layout:\n%s\nexpected:\n%s", got, expected)
+	}
+	if got := string(snap.Source()); got != "first\nparagraph" {
+		t.Errorf("expected snapshot source %q, got %q", "first\nparagraph", got)
+	}
+}
+
+// TestLayoutFaces checks that runes are shaped with the faces assigned to
+// them, regardless of coverage.
+func TestLayoutFaces(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	ltr := FontFace{Font: Font{Typeface: "LTR"}, Face: ltrFace}
+	rtl := FontFace{Font: Font{Typeface: "RTL"}, Face: rtlFace}
+	cache := NewShaper([]FontFace{ltr, rtl})
+	const txt = "abc\ndef"
+	cache.LayoutFaces(Parameters{PxPerEm: fixed.I(10)}, 0, 200, english, txt, []FaceRange{
+		{Runes: Range{Offset: 1, Count: 1}, Face: rtl},
+		{Runes: Range{Offset: 5, Count: 2}, Face: rtl},
+	})
+	expected := [][]Font{
+		{ltr.Font, rtl.Font, ltr.Font},
+		{ltr.Font, rtl.Font},
+	}
+	if len(cache.txt.lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d", len(expected), len(cache.txt.lines))
+	}
+	for i, line := range cache.txt.lines {
+		var fonts []Font
+		for _, run := range line.runs {
+			fonts = append(fonts, cache.shaper.orderer.fontFor(run.face))
+		}
+		if !slices.Equal(fonts, expected[i]) {
+			t.Errorf("line %d: expected run fonts %v, got %v", i, expected[i], fonts)
+		}
+	}
+	// The assigned face lacks Latin glyphs, so it must display .notdef.
+	if _, _, gid := splitGlyphID(cache.txt.lines[0].runs[1].Glyphs[0].id); gid != 0 {
+		t.Errorf("expected .notdef glyph for unsupported rune, got glyph id %d", gid)
+	}
+}
+
+// TestLayoutFacesUnloaded checks that faces assigned to text are not loaded
+// for resolving the faces of other text.
+func TestLayoutFacesUnloaded(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	ltr := FontFace{Font: Font{Typeface: "LTR"}, Face: ltrFace}
+	rtl := FontFace{Font: Font{Typeface: "RTL"}, Face: rtlFace}
+	cache := NewShaper([]FontFace{ltr})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	const arabic = "سماء"
+	cache.LayoutFaces(params, 0, 200, english, arabic, []FaceRange{
+		{Runes: Range{Count: 4}, Face: rtl},
+	})
+	run := cache.txt.lines[0].runs[0]
+	if run.face != rtlFace.Face() || run.Font != rtl.Font {
+		t.Errorf("expected the assigned face of font %v, got %v", rtl.Font, run.Font)
+	}
+	var glyphs []Glyph
+	for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+		glyphs = append(glyphs, g)
+	}
+	// Shaping the glyphs must find their face.
+	cache.Shape(glyphs)
+	if len(cache.shaper.orderer.fonts) != 1 {
+		t.Errorf("expected 1 registered font, got %v", cache.shaper.orderer.fonts)
+	}
+	// Text without assigned faces must not be shaped with the unloaded face.
+	cache.LayoutString(params, 0, 200, english, arabic)
+	for _, run := range cache.txt.lines[0].runs {
+		if run.face != ltrFace.Face() {
+			t.Errorf("expected only the loaded face, got a run of %v", run.Font)
+		}
+	}
+}
+
+// TestShaperDecorations checks that the decorations assigned to runes are
+// reported in the coordinates of the glyphs of each paragraph.
+func TestShaperDecorations(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	ltr := FontFace{Font: Font{Typeface: "LTR"}, Face: ltrFace}
+	cache := NewShaper([]FontFace{ltr})
+	params := Parameters{PxPerEm: fixed.I(10), Alignment: End}
+	cache.LayoutFaces(params, 100, 100, english, "abc\ndef", []FaceRange{
+		{Runes: Range{Offset: 0, Count: 2}, Face: ltr},
+		{Runes: Range{Offset: 2, Count: 3}, Face: ltr, Decoration: Underline},
+		{Runes: Range{Offset: 5, Count: 2}, Face: ltr},
+	})
+	rects := cache.Decorations()
+	if len(rects) != 2 {
+		t.Fatalf("expected 2 decorations, got %v", rects)
+	}
+	var dots []fixed.Point26_6
+	for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+		dots = append(dots, fixed.Point26_6{X: g.X, Y: fixed.I(int(g.Y))})
+	}
+	// The underline spans "c" on the first line and "d" on the second.
+	for i, glyph := range []int{2, 4} {
+		d := rects[i]
+		if d.Start != dots[glyph].X || d.End <= d.Start {
+			t.Errorf("decoration %d: expected to start at %v, got %v", i, dots[glyph].X, d)
+		}
+		if d.Y <= dots[glyph].Y {
+			t.Errorf("decoration %d: expected below the baseline at %v, got %v", i, dots[glyph].Y, d.Y)
+		}
+	}
+}
+
+func BenchmarkLayoutFaces(b *testing.B) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	ltr := FontFace{Font: Font{Typeface: "LTR"}, Face: ltrFace}
+	rtl := FontFace{Font: Font{Typeface: "RTL"}, Face: rtlFace}
+	txt := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20)
+	faces := []FaceRange{{Runes: Range{Count: len([]rune(txt))}, Face: ltr}}
+	params := Parameters{PxPerEm: fixed.I(10)}
+	b.Run("resolved", func(b *testing.B) {
+		cache := NewShaper([]FontFace{rtl, ltr})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cache.shaper.LayoutRunes(params, 0, 200, english, []rune(txt))
+		}
+	})
+	b.Run("assigned", func(b *testing.B) {
+		cache := NewShaper([]FontFace{rtl, ltr})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cache.shaper.LayoutAssigned(params, 0, 200, english, []rune(txt), faces, 0)
+		}
+	})
+}
+
+// TestMeasure checks that measuring text matches the size of its layout.
+func TestMeasure(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	const txt = "The quick brown fox\njumps over the lazy dog.\n\nThe end\n"
+	for _, params := range []Parameters{
+		{PxPerEm: fixed.I(10)},
+		{PxPerEm: fixed.I(14), Whitespace: WhitespaceNormal},
+		{PxPerEm: fixed.I(10), Alignment: Justify},
+		{PxPerEm: fixed.I(10), MaxLines: 3, Truncator: "…"},
+	} {
+		for _, maxWidth := range []int{40, 100, 1000} {
+			for _, str := range []string{"", txt} {
+				got := cache.Measure(params, maxWidth, english, []rune(str))
+				cache.LayoutString(params, 0, maxWidth, english, str)
+				lines := cache.txt.lines
+				last := lines[len(lines)-1]
+				want := image.Pt(alignWidth(0, lines), last.yOffset+last.descent.Ceil())
+				if got != want {
+					t.Errorf("%+v, width %d, %q: expected size %v, got %v", params, maxWidth, str, want, got)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkMeasure(b *testing.B) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	txt := []rune(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20))
+	params := Parameters{PxPerEm: fixed.I(10)}
+	b.Run("measure", func(b *testing.B) {
+		cache := NewShaper([]FontFace{{Face: ltrFace}})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cache.Measure(params, 200, english, txt)
+		}
+	})
+	b.Run("layout", func(b *testing.B) {
+		cache := NewShaper([]FontFace{{Face: ltrFace}})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cache.shaper.LayoutRunes(params, 0, 200, english, append([]rune(nil), txt...))
+		}
+	})
+}
+
+// TestRunCache checks that layouts using cached runs are identical to
+// layouts shaping every run, including runs cached from other text, that
+// only the context of runs is cached, and that loading faces empties the
+// cache.
+func TestRunCache(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	collection := []FontFace{{Face: ltrFace}, {Face: rtlFace}}
+	cached := NewShaper(collection)
+	uncached := NewShaper(collection)
+	uncached.SetRunCacheSize(0)
+	glyphs := func(s *Shaper) []Glyph {
+		var gs []Glyph
+		for g, ok := s.NextGlyph(); ok; g, ok = s.NextGlyph() {
+			gs = append(gs, g)
+		}
+		return gs
+	}
+	texts := []string{
+		"hello سلام world\nthe quick brown fox",
+		// Shares runs with the first text at other offsets.
+		"once more, hello سلام world and the quick brown fox",
+	}
+	params := Parameters{PxPerEm: fixed.I(10), Features: []FontFeature{{Tag: tagProportional, Value: 0}}}
+	for _, txt := range texts {
+		for _, maxWidth := range []int{40, 100, 1000, 40} {
+			for _, p := range []Parameters{{PxPerEm: fixed.I(10)}, params} {
+				cached.LayoutString(p, 0, maxWidth, english, txt)
+				uncached.LayoutString(p, 0, maxWidth, english, txt)
+				if want, got := glyphs(uncached), glyphs(cached); !slices.Equal(got, want) {
+					t.Errorf("%q width %d: cached layout differs:\n%v\n%v", txt, maxWidth, got, want)
+				}
+			}
+		}
+	}
+	if len(cached.shaper.runs.m) == 0 {
+		t.Errorf("expected cached runs")
+	}
+	for k, e := range cached.shaper.runs.m {
+		if n := k.end - k.start + 2*runContext; len(e.text) > n {
+			t.Errorf("cached %d runes for a run of %d", len(e.text), k.end-k.start)
+		}
+	}
+	if len(uncached.shaper.runs.m) != 0 {
+		t.Errorf("expected no cached runs with a disabled cache")
+	}
+	cached.shaper.Load(FontFace{Face: ltrFace})
+	if len(cached.shaper.runs.m) != 0 {
+		t.Errorf("expected loading faces to clear the cache")
+	}
+}
+
+func BenchmarkRunCache(b *testing.B) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	txt := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20)
+	params := Parameters{PxPerEm: fixed.I(10)}
+	for _, size := range []int{0, maxSize} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			cache := NewShaper([]FontFace{{Face: ltrFace}})
+			cache.SetRunCacheSize(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// Vary the width to miss the layout cache.
+				cache.LayoutString(params, 0, 200+i, english, txt)
+			}
+		})
+	}
+}
+
+// TestConcurrentShaping checks that shaping the runs of long text
+// concurrently produces the same layout as shaping them serially.
+func TestConcurrentShaping(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	collection := []FontFace{{Face: ltrFace}, {Face: rtlFace}}
+	serial := NewShaper(collection)
+	serial.SetRunCacheSize(0)
+	concurrent := NewShaper(collection)
+	concurrent.SetRunCacheSize(0)
+	concurrent.SetShapingWorkers(4)
+	glyphs := func(s *Shaper) []Glyph {
+		var gs []Glyph
+		for g, ok := s.NextGlyph(); ok; g, ok = s.NextGlyph() {
+			gs = append(gs, g)
+		}
+		return gs
+	}
+	txt := strings.Repeat("hello سلام world 123 ", 200)
+	if n := len([]rune(txt)); n < minConcurrentRunes {
+		t.Fatalf("expected text of at least %d runes, got %d", minConcurrentRunes, n)
+	}
+	for _, params := range []Parameters{
+		{PxPerEm: fixed.I(10)},
+		{PxPerEm: fixed.I(10), TabularNumbers: true},
+	} {
+		serial.LayoutString(params, 0, 300, english, txt)
+		concurrent.LayoutString(params, 0, 300, english, txt)
+		if want, got := glyphs(serial), glyphs(concurrent); !slices.Equal(got, want) {
+			t.Errorf("%+v: concurrent layout differs from serial layout", params)
+		}
+	}
+}
+
+func BenchmarkConcurrentShaping(b *testing.B) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	collection := []FontFace{{Face: ltrFace}, {Face: rtlFace}}
+	txt := []rune(strings.Repeat("The quick brown fox سلام عليكم jumps over the lazy dog. ", 100))
+	params := Parameters{PxPerEm: fixed.I(10)}
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			cache := NewShaper(collection)
+			cache.SetRunCacheSize(0)
+			cache.SetShapingWorkers(workers)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cache.shaper.LayoutRunes(params, 0, 500, english, append([]rune(nil), txt...))
+			}
+		})
+	}
+}
+
+// TestRelayout checks that relaying out an edit reuses the lines of the
+// paragraphs it doesn't touch, and matches a full layout of the edited text.
+func TestRelayout(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	full := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10), RetainSource: true}
+	const maxWidth = 100
+	glyphs := func(s *Shaper) []Glyph {
+		var gs []Glyph
+		for g, ok := s.NextGlyph(); ok; g, ok = s.NextGlyph() {
+			gs = append(gs, g)
+		}
+		return gs
+	}
+	paragraphs := []string{"first paragraph\n", "second\n", "third paragraph of text\n", "fourth\n", "fifth"}
+	txt := strings.Join(paragraphs, "")
+	second := len([]rune(paragraphs[0]))
+	for _, tc := range []struct {
+		name       string
+		start, end int
+		repl       string
+	}{
+		{"insert", second + 3, second + 3, " paragraph grows to wrap"},
+		{"delete", second, second + 3, ""},
+		{"split", second + 3, second + 3, "\n"},
+		{"merge", second + 6, second + 7, " "},
+		{"start", 0, 0, "new\n"},
+		{"end", len([]rune(txt)), len([]rune(txt)), "\nsixth"},
+	} {
+		cache.LayoutString(params, 0, maxWidth, english, txt)
+		before := append([]line(nil), cache.txt.lines...)
+		cache.Relayout(params, 0, maxWidth, english, tc.start, tc.end, []rune(tc.repl))
+		edited := []rune(txt)
+		edited = append(edited[:tc.start], append([]rune(tc.repl), edited[tc.end:]...)...)
+		full.LayoutString(params, 0, maxWidth, english, string(edited))
+		if got, want := string(cache.txt.source), string(edited); got != want {
+			t.Errorf("%s: expected source %q, got %q", tc.name, want, got)
+		}
+		if got, want := glyphs(cache), glyphs(full); !slices.Equal(got, want) {
+			t.Errorf("%s: relayout differs from full layout", tc.name)
+		}
+		if got, want := cache.txt.ParagraphDirections(), full.txt.ParagraphDirections(); !slices.Equal(got, want) {
+			t.Errorf("%s: expected %d paragraphs, got %d", tc.name, len(want), len(got))
+		}
+		if tc.name != "insert" {
+			continue
+		}
+		// The first paragraph is untouched, and the last three are moved by
+		// the height of the added line.
+		after := cache.txt.lines
+		if len(after) != len(before)+1 {
+			t.Fatalf("%s: expected %d lines, got %d", tc.name, len(before)+1, len(after))
+		}
+		delta := after[2].yOffset - after[1].yOffset
+		for i, ln := range before {
+			k, dy := i, 0
+			if i > 0 {
+				k, dy = i+1, delta
+			}
+			if i == 1 {
+				continue
+			}
+			if &after[k].runs[0] != &ln.runs[0] {
+				t.Errorf("%s: line %d: expected reused runs", tc.name, i)
+			}
+			if after[k].yOffset != ln.yOffset+dy {
+				t.Errorf("%s: line %d: expected y offset %d, got %d", tc.name, i, ln.yOffset+dy, after[k].yOffset)
+			}
+		}
+	}
+}
+
+// TestMinBreakWidth checks the minimum break width under each wrap policy.
+func TestMinBreakWidth(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	width := func(txt string) fixed.Int26_6 {
+		cache.LayoutString(params, 0, 1000, english, txt)
+		return cache.txt.lines[0].width
+	}
+	const txt = "a bb wwww"
+	if got, want := cache.MinBreakWidth(params, english, txt), width("wwww"); got != want {
+		t.Errorf("normal: expected minimum break width %v, got %v", want, got)
+	}
+	params.WrapPolicy = WrapWordsOrGraphemes
+	if got, want := cache.MinBreakWidth(params, english, txt), width("w"); got != want {
+		t.Errorf("anywhere: expected minimum break width %v, got %v", want, got)
+	}
+	params.WrapPolicy = WrapKeepAll
+	if got, want := cache.MinBreakWidth(params, english, "go 你好世界"), width("你好世界"); got != want {
+		t.Errorf("keep-all: expected minimum break width %v, got %v", want, got)
+	}
+}
+
+// TestMinBreakWidthTrailingSpace checks that trailing whitespace, which may
+// overflow lines, is excluded from the minimum break width.
+func TestMinBreakWidthTrailingSpace(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	cache.LayoutString(params, 0, 1000, english, "wwww")
+	wwww := cache.txt.lines[0].width
+	const txt = "wwww     wwww     "
+	minWidth := cache.MinBreakWidth(params, english, txt)
+	if minWidth != wwww {
+		t.Errorf("expected minimum break width %v, got %v", wwww, minWidth)
+	}
+	// Lines of the minimum break width fit the words and their trailing
+	// spaces, regardless of the wrap policy.
+	for _, policy := range []WrapPolicy{WrapWords, WrapWordsOrGraphemes, WrapGraphemes} {
+		params.WrapPolicy = policy
+		cache.LayoutString(params, 0, minWidth.Ceil(), english, txt)
+		if n := len(cache.txt.lines); n != 2 {
+			t.Errorf("policy %v: expected 2 lines, got %d", policy, n)
+		}
+	}
+}
+
+// TestWrapWordsOrGraphemes checks that words too wide for a line are broken
+// between graphemes.
+func TestWrapWordsOrGraphemes(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	const txt = "go wwwwwwwwwwwwwwwwwwww éééééé"
+	const maxWidth = 40
+	cache.LayoutString(params, 0, maxWidth, english, txt)
+	if n := len(cache.txt.lines); n != 3 {
+		t.Fatalf("normal: expected 3 lines, got %d", n)
+	}
+	params.WrapPolicy = WrapWordsOrGraphemes
+	cache.LayoutString(params, 0, maxWidth, english, txt)
+	if n := len(cache.txt.lines); n <= 3 {
+		t.Fatalf("anywhere: expected more than 3 lines, got %d", n)
+	}
+	runes := 0
+	for i, line := range cache.txt.lines {
+		if line.width.Ceil() > maxWidth {
+			t.Errorf("line %d: width %v exceeds %d", i, line.width, maxWidth)
+		}
+		// Combining sequences must not be split.
+		if r := []rune(txt)[runes]; unicode.Is(unicode.Mn, r) {
+			t.Errorf("line %d: starts with combining mark %U", i, r)
+		}
+		runes += line.runeCount
+	}
+	if runes != len([]rune(txt)) {
+		t.Errorf("expected %d runes, got %d", len([]rune(txt)), runes)
+	}
+}
+
+// TestWrapPolicy checks that a word wider than a line is broken between
+// graphemes under WrapGraphemes, and overflows its line under WrapWords.
+func TestWrapPolicy(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(20)}
+	word := strings.Repeat("we\u0301", 20)
+	const maxWidth = 200
+	cache.LayoutString(params, 0, 1000, english, word)
+	if w := cache.txt.lines[0].width; w.Ceil() < 500 {
+		t.Fatalf("expected a word at least 500px wide, got %v", w)
+	}
+	cache.LayoutString(params, 0, maxWidth, english, word)
+	if n := len(cache.txt.lines); n != 1 {
+		t.Errorf("words: expected 1 line, got %d", n)
+	}
+	if !cache.txt.lines[0].Overflowing {
+		t.Errorf("words: expected overflowing line")
+	}
+	for _, policy := range []WrapPolicy{WrapGraphemes, WrapWordsOrGraphemes} {
+		params.WrapPolicy = policy
+		cache.LayoutString(params, 0, maxWidth, english, word)
+		if n := len(cache.txt.lines); n < 3 {
+			t.Errorf("policy %d: expected at least 3 lines, got %d", policy, n)
+		}
+		runes := 0
+		for i, line := range cache.txt.lines {
+			if line.width.Ceil() > maxWidth {
+				t.Errorf("policy %d, line %d: width %v exceeds %d", policy, i, line.width, maxWidth)
+			}
+			if r := []rune(word)[runes]; unicode.Is(unicode.Mn, r) {
+				t.Errorf("policy %d, line %d: starts with combining mark %U", policy, i, r)
+			}
+			runes += line.runeCount
+		}
+	}
+	// Under WrapGraphemes, words are broken to fill lines, rather than moved
+	// to the next line.
+	params.WrapPolicy = WrapGraphemes
+	cache.LayoutString(params, 0, maxWidth, english, "go "+word)
+	if n := cache.txt.lines[0].runeCount; n <= 3 {
+		t.Errorf("break-all: expected the word to start on the first line, got %d runes", n)
+	}
+	params.WrapPolicy = WrapWordsOrGraphemes
+	cache.LayoutString(params, 0, maxWidth, english, "go "+word)
+	if n := cache.txt.lines[0].runeCount; n != 3 {
+		t.Errorf("words or graphemes: expected the word to start a line, got %d runes", n)
+	}
+}
+
+// TestWrapKeepAll checks that lines are not broken between ideographs under
+// WrapKeepAll.
+func TestWrapKeepAll(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	const txt = "你好世界 你好世界"
+	cache.LayoutString(params, 0, 1000, english, "你好世界")
+	maxWidth := cache.txt.lines[0].width.Ceil() - 1
+	cache.LayoutString(params, 0, maxWidth, english, txt)
+	if n := len(cache.txt.lines); n <= 2 {
+		t.Errorf("words: expected ideographs to be broken, got %d lines", n)
+	}
+	params.WrapPolicy = WrapKeepAll
+	cache.LayoutString(params, 0, maxWidth, english, txt)
+	if n := len(cache.txt.lines); n != 2 {
+		t.Fatalf("keep-all: expected 2 lines, got %d", n)
+	}
+	if n := cache.txt.lines[0].runeCount; n != 5 {
+		t.Errorf("keep-all: expected a line break after the space, got %d runes", n)
+	}
+}
+
+// TestLineEnding checks that lines are marked as ended by wrapping, by a
+// newline or by the end of the text.
+func TestLineEnding(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	for _, tc := range []struct {
+		txt  string
+		want []LineEnding
+	}{
+		{"", []LineEnding{EndOfText}},
+		{"go", []LineEnding{EndOfText}},
+		{"go\n", []LineEnding{HardBreak}},
+		{"go\ngo", []LineEnding{HardBreak, EndOfText}},
+		{"go go go go go go\n", []LineEnding{SoftWrap, SoftWrap, HardBreak}},
+		{"go go go go go go", []LineEnding{SoftWrap, SoftWrap, EndOfText}},
+	} {
+		cache.LayoutString(params, 0, 40, english, tc.txt)
+		var got []LineEnding
+		for _, l := range cache.txt.lines {
+			got = append(got, l.Ending)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%q: expected line endings %v, got %v", tc.txt, tc.want, got)
+		}
+	}
+	// Lines truncated by MaxLines continue beyond the layout.
+	params.MaxLines = 1
+	cache.LayoutString(params, 0, 40, english, "go go go go go go\n")
+	if got := cache.txt.lines[0].Ending; got != SoftWrap {
+		t.Errorf("truncated: expected SoftWrap, got %v", got)
+	}
+}
+
+// TestSetFallbacks checks that runes missing from the primary face are
+// displayed by the first face of the fallback list covering them.
+func TestSetFallbacks(t *testing.T) {
+	arabicFace, _ := opentype.Parse(nsareg.TTF)
+	goFace, _ := opentype.Parse(goregular.TTF)
+	monoFace, _ := opentype.Parse(gomono.TTF)
+	cache := NewShaper([]FontFace{
+		{Font: Font{Typeface: "Arabic"}, Face: arabicFace},
+		{Font: Font{Typeface: "Go"}, Face: goFace},
+		{Font: Font{Typeface: "Mono"}, Face: monoFace},
+	})
+	params := Parameters{PxPerEm: fixed.I(10), Font: Font{Typeface: "Arabic"}}
+	for _, tc := range []struct {
+		fallbacks []Font
+		want      opentype.Face
+	}{
+		{nil, goFace},
+		{[]Font{{Typeface: "Mono"}, {Typeface: "Go"}}, monoFace},
+		{[]Font{{Typeface: "Go"}, {Typeface: "Mono"}}, goFace},
+		{[]Font{{Typeface: "Mono", Weight: Bold}}, monoFace},
+	} {
+		cache.SetFallbacks(tc.fallbacks)
+		cache.LayoutString(params, 0, 1000, english, "\u0633\u0644\u0627\u0645 abc")
+		runs := cache.txt.lines[0].runs
+		last := runs[len(runs)-1]
+		if last.face != tc.want.Face() {
+			t.Errorf("fallbacks %v: latin runes resolved from the wrong face", tc.fallbacks)
+		}
+	}
+}
+
+// TestNormalize checks that normalized text is shaped in its normalized form,
+// while the rune offsets of the layout refer to the original text.
+func TestNormalize(t *testing.T) {
+	face, _ := opentype.Parse(robotoregular.TTF)
+	cache := NewShaper([]FontFace{{Face: face}})
+	// The decomposed é is composed by the shaper regardless of
+	// normalization, whereas U+212B ANGSTROM SIGN is displayed by its own
+	// glyph unless normalized to U+00C5.
+	const txt = "e\u0301x\u212By"
+	layout := func(n Normalization) (glyphs []Glyph, runes int) {
+		cache.LayoutString(Parameters{PxPerEm: fixed.I(10), Normalize: n}, 0, 1000, english, txt)
+		for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+			glyphs = append(glyphs, g)
+			runes += int(g.Runes)
+		}
+		return glyphs, runes
+	}
+	plain, _ := layout(NormalizeNone)
+	nfc, runes := layout(NormalizeNFC)
+	if runes != 5 {
+		t.Errorf("expected glyphs of 5 runes, got %d", runes)
+	}
+	if len(plain) != len(nfc) || plain[2].ID == nfc[2].ID {
+		t.Errorf("expected the angstrom sign to be displayed as U+00C5")
+	}
+	if plain[0].ID != nfc[0].ID || nfc[0].Runes != 2 {
+		t.Errorf("expected the composed é to represent 2 runes, got %d", nfc[0].Runes)
+	}
+	// Rune offsets refer to the text before normalization.
+	x2, _, _ := cache.CaretPos(2)
+	if want := nfc[0].X + nfc[0].Advance; x2 != want {
+		t.Errorf("expected caret of rune 2 at %v, got %v", want, x2)
+	}
+	x4, _, _ := cache.CaretPos(4)
+	if want := nfc[2].X + nfc[2].Advance; x4 != want {
+		t.Errorf("expected caret of rune 4 at %v, got %v", want, x4)
+	}
+	if got := cache.Locate(fixed.Point26_6{X: x4 + 1}); got != 4 {
+		t.Errorf("expected rune 4 at the caret after the angstrom sign, got %d", got)
+	}
+}
+
+// TestOnMissingGlyph checks that runes missing from every face are reported
+// once per layout.
+func TestOnMissingGlyph(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	var missing []rune
+	cache.SetOnMissingGlyph(func(r rune) {
+		missing = append(missing, r)
+	})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	cache.LayoutString(params, 0, 1000, english, "a\U0001F600b\U0001F600\nc\U0001F600")
+	if want := []rune{'\U0001F600'}; !slices.Equal(missing, want) {
+		t.Errorf("expected missing runes %q, got %q", want, missing)
+	}
+	missing = nil
+	cache.LayoutString(params, 0, 1000, english, "hello")
+	if len(missing) != 0 {
+		t.Errorf("expected no missing runes, got %q", missing)
+	}
+	// Runes are reported again by later layouts.
+	cache.LayoutString(params, 0, 1000, english, "\U0001F600")
+	if want := []rune{'\U0001F600'}; !slices.Equal(missing, want) {
+		t.Errorf("expected missing runes %q, got %q", want, missing)
+	}
+}
+
+// TestLoadLazy checks that the faces registered by LoadLazy are loaded once,
+// when text first uses them.
+func TestLoadLazy(t *testing.T) {
+	monoFace, _ := opentype.Parse(gomono.TTF)
+	cache := NewShaper([]FontFace{{Font: Font{Typeface: "Mono"}, Face: monoFace}})
+	var lazyFace opentype.Face
+	calls := 0
+	cache.LoadLazy(Font{Typeface: "Go"}, func() (Face, error) {
+		calls++
+		var err error
+		lazyFace, err = opentype.Parse(goregular.TTF)
+		return lazyFace, err
+	})
+	params := Parameters{PxPerEm: fixed.I(10), Font: Font{Typeface: "Mono"}}
+	cache.LayoutString(params, 0, 1000, english, "hello")
+	if calls != 0 {
+		t.Fatalf("expected no loads before the face is used, got %d", calls)
+	}
+	params.Font.Typeface = "Go"
+	for i := 0; i < 2; i++ {
+		cache.LayoutString(params, 0, 1000, english, "hello")
+		if calls != 1 {
+			t.Fatalf("layout %d: expected 1 load, got %d", i, calls)
+		}
+		if got := cache.txt.lines[0].runs[0].face; got != lazyFace.Face() {
+			t.Errorf("layout %d: expected the lazily loaded face", i)
+		}
+	}
+}
+
+// TestLoadDir checks that LoadDir loads the distinct faces of a directory
+// tree, skipping duplicates and files that are not fonts.
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"Go-Regular.ttf":             goregular.TTF,
+		"copy/Go-Regular.ttf":        goregular.TTF,
+		"NotoSansArabic-Regular.TTF": nsareg.TTF,
+		"broken.otf":                 []byte("not a font"),
+		"README.txt":                 []byte("fonts"),
+	}
+	for name, src := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, src, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache := NewShaper(nil)
+	n, err := cache.LoadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 faces loaded, got %d", n)
+	}
+	for _, family := range []Typeface{"Go", "Noto Sans Arabic"} {
+		if _, ok := cache.shaper.orderer.faces[Font{Typeface: family}]; !ok {
+			t.Errorf("expected a face for %q", family)
+		}
+	}
+	// Loading again finds only duplicates.
+	if n, err := cache.LoadDir(dir); err != nil || n != 0 {
+		t.Errorf("reloading: expected 0 faces, got %d, %v", n, err)
+	}
+	if _, err := cache.LoadDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+// TestVerticalTabFormFeed checks that vertical tabs and form feeds break
+// lines like newlines, and are displayed by ShowInvisibles.
+func TestVerticalTabFormFeed(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	const txt = "ab\vab\fab"
+	for _, show := range []bool{false, true} {
+		params.ShowInvisibles = show
+		cache.LayoutString(params, 0, 1000, english, txt)
+		lines := cache.txt.lines
+		if len(lines) != 3 {
+			t.Fatalf("show=%v: expected 3 lines, got %d", show, len(lines))
+		}
+		wantEndings := []LineEnding{HardBreak, HardBreak, EndOfText}
+		wantRunes := []int{3, 3, 2}
+		for i, l := range lines {
+			if l.Ending != wantEndings[i] {
+				t.Errorf("show=%v: line %d: expected ending %v, got %v", show, i, wantEndings[i], l.Ending)
+			}
+			if l.runeCount != wantRunes[i] {
+				t.Errorf("show=%v: line %d: expected %d runes, got %d", show, i, wantRunes[i], l.runeCount)
+			}
+		}
+		// The displayed separator widens the first line.
+		if visible := lines[0].width > lines[2].width; visible != show {
+			t.Errorf("show=%v: got line widths %v and %v", show, lines[0].width, lines[2].width)
+		}
+	}
+}
+
+// TestEmergencyWrap checks that lines wrapped within a word too wide for a
+// line are told apart from lines wrapped between words.
+func TestEmergencyWrap(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	for _, tc := range []struct {
+		name string
+		wrap WrapPolicy
+		want []LineEnding
+	}{
+		{"words", WrapWords, []LineEnding{SoftWrap, EndOfText}},
+		{"graphemes", WrapWordsOrGraphemes, []LineEnding{EmergencyWrap, SoftWrap, EndOfText}},
+	} {
+		params := Parameters{PxPerEm: fixed.I(10), WrapPolicy: tc.wrap}
+		cache.LayoutString(params, 0, 40, english, "wwwwwwwwww go")
+		var got []LineEnding
+		for _, l := range cache.txt.lines {
+			got = append(got, l.Ending)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: expected line endings %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+// TestWidowsOrphans checks that text truncated by MaxHeight keeps at least
+// Orphans lines of a split paragraph before the break and Widows after it.
+func TestWidowsOrphans(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	const (
+		first  = "go go go go go go\n"
+		second = "go go go go go go go go go go"
+		txt    = first + second
+	)
+	params := Parameters{PxPerEm: fixed.I(10)}
+	cache.LayoutString(params, 0, 40, english, txt)
+	lines := append([]line(nil), cache.txt.lines...)
+	if len(lines) != 8 || lines[2].Ending != HardBreak {
+		t.Fatalf("expected paragraphs of 3 and 5 lines, got %d lines", len(lines))
+	}
+	// heightOf returns the height of the first n lines.
+	heightOf := func(n int) int {
+		return lines[n-1].yOffset + lines[n-1].descent.Ceil()
+	}
+	runesOf := func(lines []line) int {
+		n := 0
+		for _, l := range lines {
+			n += l.runeCount
+		}
+		return n
+	}
+	for _, tc := range []struct {
+		name            string
+		height          int
+		orphans, widows int
+		want            int
+	}{
+		{"unconstrained", heightOf(8), 2, 2, 8},
+		{"plain", heightOf(4), 0, 0, 4},
+		{"orphans", heightOf(4), 2, 0, 3},
+		{"plain widow", heightOf(7), 0, 0, 7},
+		{"widows", heightOf(7), 0, 2, 6},
+		{"widows and orphans", heightOf(5), 2, 4, 3},
+	} {
+		params := params
+		params.MaxHeight, params.Orphans, params.Widows = tc.height, tc.orphans, tc.widows
+		cache.LayoutString(params, 0, 40, english, txt)
+		doc := cache.txt
+		if n := len(doc.lines); n != tc.want {
+			t.Errorf("%s: expected %d lines, got %d", tc.name, tc.want, n)
+			continue
+		}
+		if got, want := doc.Truncated, runesOf(lines[tc.want:]); got != want {
+			t.Errorf("%s: expected %d truncated runes, got %d", tc.name, want, got)
+		}
+		paragraphs := 2
+		if tc.want <= 3 {
+			paragraphs = 1
+		}
+		if n := len(doc.paragraphs); n != paragraphs {
+			t.Errorf("%s: expected %d paragraphs, got %d", tc.name, paragraphs, n)
+		}
+	}
+}
+
+// TestJustifyParagraphs checks that justification stretches wrapped lines
+// to the maximum width, and leaves the lines ending paragraphs unchanged.
+func TestJustifyParagraphs(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	const maxWidth = 100
+	const txt = "go go go go go go go go go go go go\ngo go go go go go go go go go go go"
+	params := Parameters{PxPerEm: fixed.I(10)}
+	cache.LayoutString(params, 0, maxWidth, english, txt)
+	plain := append([]line(nil), cache.txt.lines...)
+	params.Alignment = Justify
+	cache.LayoutString(params, 0, maxWidth, english, txt)
+	lines := cache.txt.lines
+	if len(lines) != len(plain) {
+		t.Fatalf("expected %d lines, got %d", len(plain), len(lines))
+	}
+	hardBreaks := 0
+	for i, l := range lines {
+		var advance fixed.Int26_6
+		for _, run := range l.runs {
+			for _, g := range run.Glyphs {
+				advance += g.xAdvance
+			}
+		}
+		want := fixed.I(maxWidth)
+		if l.Ending != SoftWrap {
+			want = plain[i].width
+		}
+		if advance != want {
+			t.Errorf("line %d (%v): expected total advance %v, got %v", i, l.Ending, want, advance)
+		}
+		if l.Ending == HardBreak {
+			hardBreaks++
+		}
+	}
+	if hardBreaks != 1 {
+		t.Errorf("expected 1 line ending in a newline, got %d", hardBreaks)
+	}
+}
+
+// TestOverflowingLines checks that lines overflowing the maximum width, such
+// as lines of unbreakable words, are marked with the amount of overflow.
+func TestOverflowingLines(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	const maxWidth = 40
+	cache.LayoutString(params, 0, maxWidth, english, "go wwwwwwwwwwwwwwwwwwww go")
+	lines := cache.txt.lines
+	if n := len(lines); n != 3 {
+		t.Fatalf("expected 3 lines, got %d", n)
+	}
+	for i, line := range lines {
+		overflowing := i == 1
+		if line.Overflowing != overflowing {
+			t.Errorf("line %d: expected overflowing %v, got %v", i, overflowing, line.Overflowing)
+		}
+		var overflow fixed.Int26_6
+		if overflowing {
+			overflow = line.width - fixed.I(maxWidth)
+		}
+		if line.overflow != overflow {
+			t.Errorf("line %d: expected overflow %v, got %v", i, overflow, line.overflow)
+		}
+	}
+	if lines[1].overflow <= 0 {
+		t.Errorf("expected positive overflow, got %v", lines[1].overflow)
+	}
+}
+
+// TestFade checks that the end of a truncated line fades out, with
+// decreasing opacity towards the end of the line.
+func TestFade(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10), MaxLines: 1, Fade: fixed.I(20)}
+	lineGlyphs := func(txt string) []Glyph {
+		cache.LayoutString(params, 0, 100, english, txt)
+		var glyphs []Glyph
+		for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+			glyphs = append(glyphs, g)
+			if g.Flags&FlagLineBreak != 0 {
+				break
+			}
+		}
+		return glyphs
+	}
+	glyphs := lineGlyphs("hello world, this text is truncated")
+	if glyphs[0].Fade != 0 {
+		t.Errorf("expected opaque first glyph, got fade %d", glyphs[0].Fade)
+	}
+	end := glyphs[len(glyphs)-1]
+	end.X += end.Advance
+	faded := 0
+	for i, g := range glyphs {
+		if g.X+g.Advance/2 < end.X-params.Fade {
+			if g.Fade != 0 {
+				t.Errorf("glyph %d: expected opaque glyph before the fade, got %d", i, g.Fade)
+			}
+			continue
+		}
+		faded++
+		if g.Fade == 0 {
+			t.Errorf("glyph %d: expected faded glyph", i)
+		}
+		if prev := glyphs[i-1]; g.Fade <= prev.Fade {
+			t.Errorf("glyph %d: expected fade above %d, got %d", i, prev.Fade, g.Fade)
+		}
+	}
+	if faded < 2 {
+		t.Errorf("expected several faded glyphs, got %d", faded)
+	}
+	for i, g := range lineGlyphs("hello") {
+		if g.Fade != 0 {
+			t.Errorf("glyph %d: expected no fade without truncation, got %d", i, g.Fade)
+		}
+	}
+}
+
+// TestOverflowed checks that the document reports whether any of its lines
+// overflows.
+func TestOverflowed(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	const maxWidth = 40
+	cache.LayoutString(params, 0, maxWidth, english, "go go go\ngo wwwwwwwwwwwwwwwwwwww")
+	if !cache.Overflowed() {
+		t.Errorf("expected an unbreakable word to overflow")
+	}
+	cache.LayoutString(params, 0, maxWidth, english, "go go go\ngo go go")
+	if cache.Overflowed() {
+		t.Errorf("expected wrapped text not to overflow")
+	}
+}
+
+// TestMinLineHeight checks that lines are at least as tall as the minimum
+// line height, and that taller lines are unaffected.
+func TestMinLineHeight(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	const txt = "abc\n\nxyz"
+	params := Parameters{PxPerEm: fixed.I(10)}
+	cache.LayoutString(params, 0, 200, english, txt)
+	natural := slices.Clone(cache.txt.lines)
+	if len(natural) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(natural))
+	}
+	height := func(l line) fixed.Int26_6 { return l.ascent + l.descent }
+	params.MinLineHeight = height(natural[0]) + fixed.I(10)
+	cache.LayoutString(params, 0, 200, english, txt)
+	for i, l := range cache.txt.lines {
+		if got := height(l); got < params.MinLineHeight {
+			t.Errorf("line %d: height %v is less than the minimum %v", i, got, params.MinLineHeight)
+		}
+		if got := l.bounds.Max.Y - l.bounds.Min.Y; got != height(l) {
+			t.Errorf("line %d: bounds height %v doesn't match line height %v", i, got, height(l))
+		}
+	}
+	params.MinLineHeight = fixed.I(1)
+	cache.LayoutString(params, 0, 200, english, txt)
+	for i, l := range cache.txt.lines {
+		if got, want := height(l), height(natural[i]); got != want {
+			t.Errorf("line %d: height %v changed from %v by a smaller minimum", i, got, want)
+		}
+	}
+}
+
+// dictHyphenator breaks the words of its dictionary. Its dynamic type is not
+// comparable.
+type dictHyphenator map[string][]int
+
+func (d dictHyphenator) BreakPoints(word []rune, lang string) []int {
+	return d[string(word)]
+}
+
+// TestHyphenatorNotComparable checks that hyphenators need not be comparable.
+func TestHyphenatorNotComparable(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{
+		PxPerEm:     fixed.I(20),
+		Hyphenation: dictHyphenator{"hyphenation": {2}},
+	}
+	for i := 0; i < 2; i++ {
+		cache.LayoutString(params, 0, 60, english, "a hyphenation")
+		if len(cache.txt.lines) < 2 {
+			t.Fatalf("layout %d: expected the word to be hyphenated", i)
+		}
+	}
+}
+
+// TestGlyphOblique checks that synthesized oblique glyphs report the angle
+// they are slanted by.
+func TestGlyphOblique(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{
+		PxPerEm:      fixed.I(10),
+		Font:         Font{Style: Italic},
+		Synthesize:   true,
+		ObliqueAngle: 20,
+	}
+	cache.LayoutString(params, 0, 200, english, "hello")
+	for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+		if g.Flags&FlagSyntheticOblique == 0 || g.Oblique != 20 {
+			t.Errorf("expected a glyph slanted by 20 degrees, got flags %v and angle %v", g.Flags, g.Oblique)
+		}
+	}
+}
+
+// TestFallback checks that the fallback is consulted only for runes missing
+// from the loaded faces, and that the faces it provides are used.
+func TestFallback(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	rtl := FontFace{Font: Font{Typeface: "System"}, Face: rtlFace}
+	cache := NewShaper([]FontFace{{Font: Font{Typeface: "Go"}, Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	// Layouts without a fallback must not be reused by layouts with one.
+	cache.LayoutString(params, 0, 1000, english, "hello سلام")
+	var requested []rune
+	cache.SetFallback(func(font Font, r rune) (FontFace, bool) {
+		requested = append(requested, r)
+		return rtl, true
+	})
+	cache.LayoutString(params, 0, 1000, english, "hello سلام")
+	if got, want := string(requested), "س"; got != want {
+		t.Errorf("expected fallback to be consulted for %q, got %q", want, got)
+	}
+	var fonts []Font
+	for _, run := range cache.txt.lines[0].runs {
+		fonts = append(fonts, cache.shaper.orderer.fontFor(run.face))
+	}
+	if !slices.Contains(fonts, rtl.Font) {
+		t.Errorf("expected a run in the fallback face, got runs in %v", fonts)
+	}
+	requested = requested[:0]
+	cache.LayoutString(params, 0, 1000, english, "world عالم")
+	if len(requested) > 0 {
+		t.Errorf("expected no fallback for covered runes, got %q", string(requested))
+	}
+}
+
+// TestParagraphDirections checks that the direction of each paragraph is
+// reported, whether detected from the text or taken from the locale.
+func TestParagraphDirections(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}, {Face: rtlFace}})
+	const txt = "1. first\n2. سماء\n3. 42\n4. third"
+	params := Parameters{PxPerEm: fixed.I(10)}
+	for _, tc := range []struct {
+		detect   bool
+		locale   system.Locale
+		expected []system.TextDirection
+	}{
+		{false, english, []system.TextDirection{system.LTR, system.LTR, system.LTR, system.LTR}},
+		{true, english, []system.TextDirection{system.LTR, system.RTL, system.LTR, system.LTR}},
+		// Paragraphs without strong characters keep the direction of the locale.
+		{true, arabic, []system.TextDirection{system.LTR, system.RTL, system.RTL, system.LTR}},
+	} {
+		params.DetectDirection = tc.detect
+		cache.LayoutString(params, 0, 200, tc.locale, txt)
+		got := cache.txt.ParagraphDirections()
+		if !slices.Equal(got, tc.expected) {
+			t.Errorf("detect %v, locale %v: expected directions %v, got %v", tc.detect, tc.locale.Direction, tc.expected, got)
+		}
+		if len(cache.txt.lines) != len(got) {
+			t.Fatalf("expected a line per paragraph, got %d lines", len(cache.txt.lines))
+		}
+		for i, ln := range cache.txt.lines {
+			if ln.direction != got[i] {
+				t.Errorf("detect %v, locale %v: line %d has direction %v, paragraph %v", tc.detect, tc.locale.Direction, i, ln.direction, got[i])
+			}
+		}
+	}
+}
+
+// TestUnboundedWidth checks that Unbounded never wraps lines, unlike a zero
+// maximum width that breaks lines at every opportunity.
+func TestUnboundedWidth(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	params := Parameters{PxPerEm: fixed.I(10)}
+	const txt = "the quick brown fox jumps\nover the lazy dog"
+	for _, tc := range []struct {
+		maxWidth int
+		lines    int
+	}{
+		{Unbounded, 2},
+		{60, 5},
+		{0, 9},
+	} {
+		cache.LayoutString(params, 0, tc.maxWidth, english, txt)
+		if n := len(cache.txt.lines); n != tc.lines {
+			t.Errorf("max width %d: expected %d lines, got %d", tc.maxWidth, tc.lines, n)
+		}
+	}
+}
+
+// TestVisibleLines checks that VisibleLines returns exactly the lines
+// intersecting a vertical window.
+func TestVisibleLines(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}, {Face: rtlFace}})
+	const txt = "the quick brown fox\nجميل\n\njumps over the lazy dog\nlast"
+	cache.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 60, english, txt)
+	doc := &cache.txt
+	if len(doc.lines) < 6 {
+		t.Fatalf("expected at least 6 lines, got %d", len(doc.lines))
+	}
+	for i := 1; i < len(doc.lines); i++ {
+		if doc.lines[i].yOffset <= doc.lines[i-1].yOffset {
+			t.Fatalf("line %d: yOffset %d not after %d", i, doc.lines[i].yOffset, doc.lines[i-1].yOffset)
+		}
+	}
+	last := doc.lines[len(doc.lines)-1]
+	height := fixed.I(last.yOffset) + last.descent
+	for top := -fixed.I(5); top < height+fixed.I(5); top += 37 {
+		for _, size := range []fixed.Int26_6{0, 1, fixed.I(3), fixed.I(12), fixed.I(40)} {
+			bottom := top + size
+			wantStart, wantEnd := -1, -1
+			for i, ln := range doc.lines {
+				if fixed.I(ln.yOffset)-ln.ascent < bottom && fixed.I(ln.yOffset)+ln.descent > top {
+					if wantStart == -1 {
+						wantStart = i
+					}
+					wantEnd = i + 1
+				}
+			}
+			start, end := doc.VisibleLines(top, bottom)
+			if wantStart == -1 {
+				if start != end {
+					t.Errorf("window [%v, %v): expected no lines, got [%d, %d)", top, bottom, start, end)
+				}
+				continue
+			}
+			if start != wantStart || end != wantEnd {
+				t.Errorf("window [%v, %v): expected lines [%d, %d), got [%d, %d)", top, bottom, wantStart, wantEnd, start, end)
+			}
+		}
+	}
+}
+
+// TestMixedLineMetrics checks that lines report the largest metrics of their runs,
+// and that the metrics are provided with the glyphs of the lines.
+func TestMixedLineMetrics(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	cache := NewShaper([]FontFace{
+		{Font: Font{Typeface: "Go"}, Face: ltrFace},
+		{Font: Font{Typeface: "Noto"}, Face: rtlFace},
+	})
+	params := Parameters{PxPerEm: fixed.I(10), Font: Font{Typeface: "Go"}}
+	metrics := func(txt string) line {
+		cache.LayoutString(params, 0, 1000, english, txt)
+		if n := len(cache.txt.lines); n != 1 {
+			t.Fatalf("%q: expected a single line, got %d", txt, n)
+		}
+		return cache.txt.lines[0]
+	}
+	ltr, rtl := metrics("abc"), metrics("سماء")
+	if rtl.fontAscent <= ltr.fontAscent {
+		t.Fatalf("expected the RTL face to be taller, got ascents %v and %v", rtl.fontAscent, ltr.fontAscent)
+	}
+	mixed := metrics("abc سماء")
+	if mixed.fontAscent != rtl.fontAscent {
+		t.Errorf("expected ascent %v, got %v", rtl.fontAscent, mixed.fontAscent)
+	}
+	larger := func(a, b fixed.Int26_6) fixed.Int26_6 {
+		if a > b {
+			return a
+		}
+		return b
+	}
+	if want := larger(ltr.fontDescent, rtl.fontDescent); mixed.fontDescent != want {
+		t.Errorf("expected descent %v, got %v", want, mixed.fontDescent)
+	}
+	if want := larger(ltr.lineGap, rtl.lineGap); mixed.lineGap != want {
+		t.Errorf("expected line gap %v, got %v", want, mixed.lineGap)
+	}
+	for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+		if g.LineGap != mixed.lineGap {
+			t.Errorf("glyph %v: expected line gap %v, got %v", g.ID, mixed.lineGap, g.LineGap)
+		}
+	}
+}
+
+// TestShaperLocate checks that points beyond the ends of the laid out text
+// map to its ends.
+func TestShaperLocate(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := NewShaper([]FontFace{{Face: ltrFace}})
+	const txt = "hello"
+	shaper.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 1000, english, txt)
+	if got := shaper.Locate(fixed.Point26_6{X: -fixed.I(10)}); got != 0 {
+		t.Errorf("expected offset 0 before the text, got %d", got)
+	}
+	if got := shaper.Locate(fixed.Point26_6{X: fixed.I(1000), Y: fixed.I(1000)}); got != len(txt) {
+		t.Errorf("expected offset %d after the text, got %d", len(txt), got)
+	}
+}
+
+// TestShaperCaretPos checks the caret positions at the ends of the laid out
+// text.
+func TestShaperCaretPos(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := NewShaper([]FontFace{{Face: ltrFace}})
+	const txt = "hello"
+	shaper.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 1000, english, txt)
+	start, top, bottom := shaper.CaretPos(0)
+	if start != 0 || top >= bottom {
+		t.Errorf("expected caret at 0 with positive height, got %v from %v to %v", start, top, bottom)
+	}
+	if end, _, _ := shaper.CaretPos(len(txt)); end <= start {
+		t.Errorf("expected caret after the text to the right of %v, got %v", start, end)
+	}
+}
+
+// TestObserverFacesTried checks that the observer reports the number of faces
+// consulted for each run.
+func TestObserverFacesTried(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	monoFace, _ := opentype.Parse(gomono.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := NewShaper([]FontFace{
+		{Font: Font{Typeface: "Go"}, Face: ltrFace},
+		{Font: Font{Typeface: "Mono"}, Face: monoFace},
+		{Font: Font{Typeface: "Noto"}, Face: rtlFace},
+	})
+	var stats []RunStats
+	shaper.SetObserver(func(s RunStats) {
+		stats = append(stats, s)
+	})
+	// Only the last face covers Arabic.
+	shaper.LayoutString(Parameters{Font: Font{Typeface: "Go"}, PxPerEm: fixed.I(10)}, 0, 1000, english, "abc سماء")
+	want := []RunStats{
+		{Runes: Range{Offset: 0, Count: 4}, FacesTried: 1},
+		{Runes: Range{Offset: 4, Count: 4}, FacesTried: 3},
+	}
+	if !slices.Equal(stats, want) {
+		t.Errorf("expected stats %v, got %v", want, stats)
+	}
+	shaper.SetObserver(nil)
+	stats = nil
+	shaper.LayoutString(Parameters{Font: Font{Typeface: "Go"}, PxPerEm: fixed.I(10)}, 0, 1000, english, "other")
+	if len(stats) != 0 {
+		t.Errorf("expected no stats without an observer, got %v", stats)
+	}
+}
+
+// TestObserverFallbackTried checks that the faces provided by the fallback
+// count as tried.
+func TestObserverFallbackTried(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	rtlFace, _ := opentype.Parse(nsareg.TTF)
+	shaper := NewShaper([]FontFace{{Font: Font{Typeface: "Go"}, Face: ltrFace}})
+	shaper.SetFallback(func(_ Font, r rune) (FontFace, bool) {
+		return FontFace{Font: Font{Typeface: "Noto"}, Face: rtlFace}, true
+	})
+	var stats []RunStats
+	shaper.SetObserver(func(s RunStats) {
+		stats = append(stats, s)
+	})
+	params := Parameters{Font: Font{Typeface: "Go"}, PxPerEm: fixed.I(10)}
+	shaper.LayoutString(params, 0, 1000, english, "abc سماء")
+	// The Arabic run tried the fallback, the primary face and the face
+	// provided by the fallback.
+	want := []RunStats{
+		{Runes: Range{Offset: 0, Count: 4}, FacesTried: 1},
+		{Runes: Range{Offset: 4, Count: 4}, FacesTried: 3},
+	}
+	if !slices.Equal(stats, want) {
+		t.Errorf("expected stats %v, got %v", want, stats)
+	}
+	// The face provided by the fallback is known to later layouts.
+	stats = nil
+	shaper.LayoutString(params, 0, 1000, english, "xyz سماء")
+	want[1].FacesTried = 2
+	if !slices.Equal(stats, want) {
+		t.Errorf("expected stats %v, got %v", want, stats)
+	}
+}
+
+// TestLayoutSpans checks that spans of different sizes on a line share its
+// baseline, and that glyphs are attributed to their spans.
+func TestLayoutSpans(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	spans := []TextSpan{
+		{Text: "small ", PxPerEm: fixed.I(12), Metadata: "gray"},
+		{Text: "LARGE", PxPerEm: fixed.I(24), Metadata: "red"},
+		{Text: " small", PxPerEm: fixed.I(12)},
+	}
+	cache.LayoutSpans(spans, 0, 1000, english)
+	if len(cache.txt.lines) != 1 {
+		t.Fatalf("expected 1 line, got %d", len(cache.txt.lines))
+	}
+	// The line is as tall as the runs of the large span.
+	cache.LayoutString(Parameters{PxPerEm: fixed.I(24)}, 0, 1000, english, "LARGE")
+	large := cache.txt.lines[0]
+	cache.LayoutString(Parameters{PxPerEm: fixed.I(12)}, 0, 1000, english, "small")
+	small := cache.txt.lines[0]
+	cache.LayoutSpans(spans, 0, 1000, english)
+	ln := cache.txt.lines[0]
+	if ln.ascent != large.ascent || ln.descent != large.descent {
+		t.Errorf("expected the ascent and descent %v, %v of the large span, got %v, %v", large.ascent, large.descent, ln.ascent, ln.descent)
+	}
+	var spanIdx []int
+	var y []int32
+	var widths [3]fixed.Int26_6
+	for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+		spanIdx = append(spanIdx, g.Span)
+		y = append(y, g.Y)
+		widths[g.Span] += g.Advance
+	}
+	want := []int{0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2}
+	if !slices.Equal(spanIdx, want) {
+		t.Errorf("expected glyph spans %v, got %v", want, spanIdx)
+	}
+	for i := range y {
+		if y[i] != y[0] {
+			t.Errorf("glyph %d: expected baseline %d, got %d", i, y[0], y[i])
+		}
+	}
+	if int(y[0]) != large.ascent.Ceil() {
+		t.Errorf("expected baseline %d below the top, got %d", large.ascent.Ceil(), y[0])
+	}
+	if widths[1] != large.width {
+		t.Errorf("expected the large span to be %v wide, got %v", large.width, widths[1])
+	}
+	if small.ascent >= large.ascent {
+		t.Errorf("expected the small span to be shorter than the large span")
+	}
+}
+
+// TestLayoutSpansObject checks that an inline object span wraps like a
+// cluster of its width and raises the ascent and descent of its line.
+func TestLayoutSpansObject(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	cache := NewShaper([]FontFace{{Face: ltrFace}})
+	box := InlineObject{Width: fixed.I(20), Ascent: fixed.I(20), Descent: fixed.I(10)}
+	spans := []TextSpan{
+		{Text: "hello ", PxPerEm: fixed.I(10)},
+		{PxPerEm: fixed.I(10), Object: box},
+		{Text: " world", PxPerEm: fixed.I(10)},
+	}
+	cache.LayoutString(Parameters{PxPerEm: fixed.I(10)}, 0, 1000, english, "hello ")
+	text := cache.txt.lines[0]
+	cache.LayoutSpans(spans, 0, 1000, english)
+	if len(cache.txt.lines) != 1 {
+		t.Fatalf("expected 1 line, got %d", len(cache.txt.lines))
+	}
+	ln := cache.txt.lines[0]
+	if ln.ascent != box.Ascent || text.ascent >= box.Ascent {
+		t.Errorf("expected the line ascent %v of the object, got %v", box.Ascent, ln.ascent)
+	}
+	if ln.descent != box.Descent || text.descent >= box.Descent {
+		t.Errorf("expected the line descent %v of the object, got %v", box.Descent, ln.descent)
+	}
+	if ln.runeCount != 13 {
+		t.Errorf("expected the object to be a single rune, got %d runes", ln.runeCount)
+	}
+	var object *Glyph
+	for g, ok := cache.NextGlyph(); ok; g, ok = cache.NextGlyph() {
+		if g.Span == 1 {
+			if object != nil {
+				t.Fatalf("expected a single glyph for the object")
+			}
+			g := g
+			object = &g
+		}
+	}
+	if object == nil || object.Advance != box.Width || object.Flags&FlagClusterBreak == 0 {
+		t.Fatalf("expected a placeholder cluster of width %v, got %+v", box.Width, object)
+	}
+	if object.X != text.width {
+		t.Errorf("expected the object after the text at %v, got %v", text.width, object.X)
+	}
+	// The object doesn't fit after the text, so it starts the second line.
+	cache.LayoutSpans(spans, 0, (text.width + box.Width/2).Ceil(), english)
+	if len(cache.txt.lines) < 2 {
+		t.Fatalf("expected the object to wrap, got %d lines", len(cache.txt.lines))
+	}
+	first, second := cache.txt.lines[0], cache.txt.lines[1]
+	if first.ascent != text.ascent {
+		t.Errorf("expected the first line ascent %v of the text, got %v", text.ascent, first.ascent)
+	}
+	if second.ascent != box.Ascent || second.runs[0].Span != 1 {
+		t.Errorf("expected the second line to start with the object and fit it, got ascent %v", second.ascent)
+	}
+}
@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"math"
+
+	"github.com/benoitkugler/textlayout/fonts"
+	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/image/math/fixed"
+)
+
+// syntheticFlags are the glyph flags that affect the outlines of glyphs.
+const syntheticFlags = FlagSyntheticBold | FlagSyntheticOblique
+
+// emboldenDivisor relates the stroke width of synthetic bold glyphs to
+// their size, matching FreeType.
+const emboldenDivisor = 24
+
+// emboldenAdvances widens the glyphs of the outputs shaped with faces lacking
+// a bold weight by the stroke width added by synthetic bold, so that lines
+// are wrapped with the synthesized advances. Glyphs without advance, such as
+// combining marks, are not widened.
+func (s *shaperImpl) emboldenAdvances(outs []shaping.Output) {
+	for i := range outs {
+		out := &outs[i]
+		if s.orderer.fontFor(out.Face).Weight >= SemiBold {
+			continue
+		}
+		strength := out.Size / emboldenDivisor
+		for k := range out.Glyphs {
+			g := &out.Glyphs[k]
+			if g.XAdvance == 0 {
+				continue
+			}
+			g.XAdvance += strength
+			g.Width += strength
+		}
+		out.RecomputeAdvance()
+	}
+}
+
+// Stem darkening applies fully up to stemDarkeningFullSize, and not at all
+// from stemDarkeningMaxSize.
+const (
+	stemDarkeningFullSize = 8 << 6
+	stemDarkeningMaxSize  = 24 << 6
+)
+
+// stemDarkening returns the width added to glyphs of size ppem by a
+// renderer darkening stems by amount at small sizes.
+func stemDarkening(amount, ppem fixed.Int26_6) fixed.Int26_6 {
+	switch {
+	case ppem <= stemDarkeningFullSize:
+		return amount
+	case ppem >= stemDarkeningMaxSize:
+		return 0
+	}
+	return amount * (stemDarkeningMaxSize - ppem) / (stemDarkeningMaxSize - stemDarkeningFullSize)
+}
+
+// darkenAdvances widens the glyphs of outs by the width added by stem
+// darkening of amount at their size. Glyphs without advance, such as
+// combining marks, are not widened.
+func darkenAdvances(outs []shaping.Output, amount fixed.Int26_6) {
+	for i := range outs {
+		out := &outs[i]
+		extra := stemDarkening(amount, out.Size)
+		if extra == 0 {
+			continue
+		}
+		for k := range out.Glyphs {
+			g := &out.Glyphs[k]
+			if g.XAdvance == 0 {
+				continue
+			}
+			g.XAdvance += extra
+			g.Width += extra
+		}
+		out.RecomputeAdvance()
+	}
+}
+
+// synthesizeOutline emboldens and slants the outline segments of a glyph of
+// a face with upem units per em, as requested by flags. Oblique outlines are
+// slanted by angle degrees. Segments are in font units and modified in
+// place.
+func synthesizeOutline(segments []fonts.Segment, flags Flags, angle, upem float32) []fonts.Segment {
+	if flags&FlagSyntheticBold != 0 {
+		emboldenOutline(segments, upem/emboldenDivisor)
+	}
+	if flags&FlagSyntheticOblique != 0 {
+		slant := float32(math.Tan(float64(angle) * math.Pi / 180))
+		for i := range segments {
+			for k := range segments[i].ArgsSlice() {
+				pt := &segments[i].Args[k]
+				pt.X += pt.Y * slant
+			}
+		}
+	}
+	return segments
+}
+
+// emboldenOutline widens the contours of segments by strength, like
+// FreeType's FT_Outline_EmboldenXY. Each point is moved outwards along the
+// bisector of its adjacent edges, and the outline is shifted right by half
+// of strength to keep its left side bearing.
+func emboldenOutline(segments []fonts.Segment, strength float32) {
+	var points []*fonts.SegmentPoint
+	flush := func() {
+		emboldenContour(points, strength/2)
+		points = points[:0]
+	}
+	for i := range segments {
+		seg := &segments[i]
+		if seg.Op == fonts.SegmentOpMoveTo {
+			flush()
+		}
+		for k := range seg.ArgsSlice() {
+			points = append(points, &seg.Args[k])
+		}
+	}
+	flush()
+	for i := range segments {
+		for k := range segments[i].ArgsSlice() {
+			segments[i].Args[k].X += strength / 2
+		}
+	}
+}
+
+// emboldenContour moves the points of a closed contour outwards by offset.
+func emboldenContour(points []*fonts.SegmentPoint, offset float32) {
+	// Ignore the point closing the contour at its start.
+	n := len(points)
+	closed := n > 1 && *points[0] == *points[n-1]
+	if closed {
+		n--
+	}
+	if n < 3 {
+		return
+	}
+	// The signed area determines the orientation of the contour. Outer
+	// contours of TrueType fonts are clockwise.
+	var area float32
+	for i := 0; i < n; i++ {
+		p, q := points[i], points[(i+1)%n]
+		area += p.X*q.Y - q.X*p.Y
+	}
+	if area == 0 {
+		return
+	}
+	sign := float32(1)
+	if area > 0 {
+		sign = -1
+	}
+	shifts := make([]fonts.SegmentPoint, n)
+	for i := 0; i < n; i++ {
+		prev, cur, next := points[(i+n-1)%n], points[i], points[(i+1)%n]
+		inX, inY, inLen := normalize(cur.X-prev.X, cur.Y-prev.Y)
+		outX, outY, outLen := normalize(next.X-cur.X, next.Y-cur.Y)
+		if inLen == 0 || outLen == 0 {
+			continue
+		}
+		// Skip sharp reversals, where the bisector is unstable.
+		d := inX*outX + inY*outY
+		if d <= -0.9375 {
+			continue
+		}
+		d++
+		// The bisector of the edge normals, pointing outwards.
+		shiftX, shiftY := -sign*(inY+outY), sign*(inX+outX)
+		// Limit the shift of points on short edges, whose neighbours would
+		// be crossed otherwise.
+		q := sign * (outX*inY - outY*inX)
+		l := float32(math.Min(float64(inLen), float64(outLen)))
+		if offset*q <= l*d {
+			shiftX, shiftY = shiftX*offset/d, shiftY*offset/d
+		} else {
+			shiftX, shiftY = shiftX*l/q, shiftY*l/q
+		}
+		shifts[i] = fonts.SegmentPoint{X: shiftX, Y: shiftY}
+	}
+	for i := 0; i < n; i++ {
+		points[i].Move(shifts[i].X, shifts[i].Y)
+	}
+	if closed {
+		*points[len(points)-1] = *points[0]
+	}
+}
+
+// normalize returns the unit vector in the direction of (x, y) and its
+// length.
+func normalize(x, y float32) (float32, float32, float32) {
+	l := float32(math.Hypot(float64(x), float64(y)))
+	if l == 0 {
+		return 0, 0, 0
+	}
+	return x / l, y / l, l
+}
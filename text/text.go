@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"gioui.org/io/system"
+	"github.com/benoitkugler/textlayout/fonts/truetype"
 	"github.com/go-text/typesetting/font"
 	"golang.org/x/image/math/fixed"
 )
@@ -32,6 +33,18 @@ type Face interface {
 	Face() font.Face
 }
 
+// Tag is a four byte OpenType identifier, such as the feature tags "liga"
+// or "smcp".
+type Tag = truetype.Tag
+
+// FontFeature sets the value of an OpenType feature for the whole text.
+// Boolean features such as "liga" are disabled by the value 0 and enabled by
+// 1. Features such as "salt" select an alternate by value.
+type FontFeature struct {
+	Tag   Tag
+	Value uint32
+}
+
 // Typeface identifies a particular typeface design. The empty
 // string denotes the default typeface.
 type Typeface string
@@ -45,6 +58,9 @@ const (
 	Start Alignment = iota
 	End
 	Middle
+	// Justify stretches the spaces of wrapped lines such that they fill the
+	// maximum width. The last line of each paragraph is aligned like Start.
+	Justify
 )
 
 const (
@@ -79,6 +95,8 @@ func (a Alignment) String() string {
 		return "End"
 	case Middle:
 		return "Middle"
+	case Justify:
+		return "Justify"
 	default:
 		panic("invalid Alignment")
 	}
@@ -91,7 +109,7 @@ func (a Alignment) Align(dir system.TextDirection, width fixed.Int26_6, maxWidth
 	mw := fixed.I(maxWidth)
 	if dir.Progression() == system.TowardOrigin {
 		switch a {
-		case Start:
+		case Start, Justify:
 			a = End
 		case End:
 			a = Start
@@ -102,7 +120,7 @@ func (a Alignment) Align(dir system.TextDirection, width fixed.Int26_6, maxWidth
 		return fixed.I(((mw - width) / 2).Floor())
 	case End:
 		return fixed.I((mw - width).Floor())
-	case Start:
+	case Start, Justify:
 		return 0
 	default:
 		panic(fmt.Errorf("unknown alignment %v", a))
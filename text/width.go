@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/width"
+
+	"gioui.org/io/system"
+)
+
+// AmbiguousWidth selects the display width of characters whose East Asian
+// Width is Ambiguous, such as Greek and Cyrillic letters and many symbols.
+// They are traditionally displayed wide in East Asian contexts and narrow
+// otherwise.
+type AmbiguousWidth uint8
+
+const (
+	// AmbiguousAuto resolves ambiguous characters as wide for Chinese,
+	// Japanese and Korean locales, and narrow otherwise.
+	AmbiguousAuto AmbiguousWidth = iota
+	// AmbiguousNarrow resolves ambiguous characters as narrow.
+	AmbiguousNarrow
+	// AmbiguousWide resolves ambiguous characters as wide.
+	AmbiguousWide
+)
+
+// wide reports whether a resolves ambiguous characters as wide in the
+// locale lc.
+func (a AmbiguousWidth) wide(lc system.Locale) bool {
+	switch a {
+	case AmbiguousNarrow:
+		return false
+	case AmbiguousWide:
+		return true
+	}
+	lang := strings.ToLower(lc.Language)
+	for _, cjk := range []string{"zh", "ja", "ko"} {
+		if lang == cjk || strings.HasPrefix(lang, cjk+"-") || strings.HasPrefix(lang, cjk+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// DisplayWidth returns the number of cells of a monospace grid occupied by
+// str in the locale lc. Wide and fullwidth characters occupy two cells,
+// ambiguous characters are resolved by ambiguous, and control characters,
+// format characters and combining marks occupy none.
+func DisplayWidth(lc system.Locale, ambiguous AmbiguousWidth, str string) int {
+	wide := ambiguous.wide(lc)
+	n := 0
+	for _, r := range str {
+		n += runeCells(r, wide)
+	}
+	return n
+}
+
+// runeCells returns the number of grid cells occupied by r. Ambiguous runes
+// occupy two cells if wide is set.
+func runeCells(r rune, wide bool) int {
+	if unicode.IsControl(r) || unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	case width.EastAsianAmbiguous:
+		if wide {
+			return 2
+		}
+	}
+	return 1
+}
+
+// snapToGrid gives every cluster of outs the advance of the grid cells
+// occupied by its runes of txt. The glyphs of a cluster are centered in its
+// new advance. Clusters occupying no cells are left as is.
+func snapToGrid(outs []shaping.Output, txt []rune, cell fixed.Int26_6, wide bool) {
+	for i := range outs {
+		out := &outs[i]
+		for start := 0; start < len(out.Glyphs); {
+			first := out.Glyphs[start]
+			end := start
+			var advance fixed.Int26_6
+			for ; end < len(out.Glyphs) && out.Glyphs[end].ClusterIndex == first.ClusterIndex; end++ {
+				advance += out.Glyphs[end].XAdvance
+			}
+			cells := 0
+			for _, r := range txt[first.ClusterIndex : first.ClusterIndex+first.RuneCount] {
+				cells += runeCells(r, wide)
+			}
+			if cells > 0 {
+				delta := fixed.Int26_6(cells)*cell - advance
+				for k := start; k < end; k++ {
+					out.Glyphs[k].XOffset += delta / 2
+				}
+				out.Glyphs[end-1].XAdvance += delta
+				out.Advance += delta
+			}
+			start = end
+		}
+	}
+}
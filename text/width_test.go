@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"testing"
+
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+
+	"gioui.org/font/opentype"
+	"gioui.org/io/system"
+)
+
+var japanese = system.Locale{
+	Language:  "ja",
+	Direction: system.LTR,
+}
+
+func TestDisplayWidth(t *testing.T) {
+	for _, tc := range []struct {
+		str       string
+		lc        system.Locale
+		ambiguous AmbiguousWidth
+		want      int
+	}{
+		{"abc", english, AmbiguousAuto, 3},
+		{"漢字", english, AmbiguousAuto, 4},
+		{"é", english, AmbiguousAuto, 1},
+		{"α", english, AmbiguousAuto, 1},
+		{"α", japanese, AmbiguousAuto, 2},
+		{"α", english, AmbiguousWide, 2},
+		{"α", japanese, AmbiguousNarrow, 1},
+	} {
+		if got := DisplayWidth(tc.lc, tc.ambiguous, tc.str); got != tc.want {
+			t.Errorf("%q in %s with %d: expected %d cells, got %d", tc.str, tc.lc.Language, tc.ambiguous, tc.want, got)
+		}
+	}
+}
+
+// TestGridCell checks that text is snapped to the cells of a monospace grid,
+// with ambiguous characters resolved by the locale.
+func TestGridCell(t *testing.T) {
+	ltrFace, _ := opentype.Parse(goregular.TTF)
+	shaper := testShaper(ltrFace)
+	params := Parameters{PxPerEm: fixed.I(10), GridCell: fixed.I(8)}
+	for _, tc := range []struct {
+		lc   system.Locale
+		want fixed.Int26_6
+	}{
+		{english, fixed.I(8 * 3)},
+		{japanese, fixed.I(8 * 4)},
+	} {
+		line := shaper.LayoutString(params, 0, 1000, tc.lc, "ab±").lines[0]
+		if line.width != tc.want {
+			t.Errorf("%s: expected width %v, got %v", tc.lc.Language, tc.want, line.width)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package text
+
+import (
+	"unicode"
+
+	"github.com/go-text/typesetting/di"
+	"github.com/go-text/typesetting/segmenter"
+	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/image/math/fixed"
+
+	"gioui.org/io/system"
+)
+
+// breaker computes the break opportunities of shaped paragraphs.
+type breaker struct {
+	seg       segmenter.Segmenter
+	paragraph []rune
+	// advances holds the advance of the cluster starting at each rune,
+	// and zero for runes inside clusters.
+	advances []fixed.Int26_6
+	// clusters reports whether a cluster starts at each rune.
+	clusters []bool
+	// words and graphemes hold the end of every word and grapheme at which
+	// a line may be broken.
+	words, graphemes []int
+	// anywhere holds the breaks of breakAll, and kept the breaks of keepAll.
+	anywhere, kept []int
+}
+
+// init computes the cluster advances and break opportunities of paragraph
+// as shaped into outs.
+func (b *breaker) init(paragraph []rune, outs []shaping.Output) {
+	n := len(paragraph)
+	b.paragraph = paragraph
+	b.advances = append(b.advances[:0], make([]fixed.Int26_6, n)...)
+	b.clusters = append(b.clusters[:0], make([]bool, n)...)
+	for _, out := range outs {
+		for _, g := range out.Glyphs {
+			b.advances[g.ClusterIndex] += g.XAdvance
+			b.clusters[g.ClusterIndex] = true
+		}
+	}
+	b.seg.Init(paragraph)
+	b.words = b.words[:0]
+	for it := b.seg.LineIterator(); it.Next(); {
+		l := it.Line()
+		if end := l.Offset + len(l.Text); b.breakable(end) {
+			b.words = append(b.words, end)
+		}
+	}
+	b.graphemes = b.graphemes[:0]
+	for it := b.seg.GraphemeIterator(); it.Next(); {
+		g := it.Grapheme()
+		if end := g.Offset + len(g.Text); b.breakable(end) {
+			b.graphemes = append(b.graphemes, end)
+		}
+	}
+}
+
+// breakAll returns the grapheme breaks of paragraph that are not followed by
+// whitespace, so that whitespace stays at the end of lines.
+func (b *breaker) breakAll(paragraph []rune) []int {
+	b.anywhere = b.anywhere[:0]
+	for _, end := range b.graphemes {
+		if end < len(paragraph) && unicode.IsSpace(paragraph[end]) {
+			continue
+		}
+		b.anywhere = append(b.anywhere, end)
+	}
+	return b.anywhere
+}
+
+// keepAll returns the word breaks of paragraph that are not between letters
+// or numbers, such that words of scripts without spaces are kept whole.
+func (b *breaker) keepAll(paragraph []rune) []int {
+	b.kept = b.kept[:0]
+	for _, end := range b.words {
+		if end < len(paragraph) && isWordRune(paragraph[end-1]) && isWordRune(paragraph[end]) {
+			continue
+		}
+		b.kept = append(b.kept, end)
+	}
+	return b.kept
+}
+
+// isWordRune reports whether r is a letter, number or mark, between which
+// WrapKeepAll doesn't break lines.
+func isWordRune(r rune) bool {
+	return unicode.In(r, unicode.L, unicode.N, unicode.M)
+}
+
+// breakable reports whether a line may end before the rune at idx without
+// splitting a cluster.
+func (b *breaker) breakable(idx int) bool {
+	return idx == len(b.clusters) || b.clusters[idx]
+}
+
+// width returns the advance of the runes in [start, end).
+func (b *breaker) width(start, end int) fixed.Int26_6 {
+	var w fixed.Int26_6
+	for _, adv := range b.advances[start:end] {
+		w += adv
+	}
+	return w
+}
+
+// fitWidth returns the advance of the runes in [start, end) that must fit in
+// a line, which excludes trailing whitespace.
+func (b *breaker) fitWidth(start, end int) fixed.Int26_6 {
+	for end > start && unicode.IsSpace(b.paragraph[end-1]) {
+		end--
+	}
+	return b.width(start, end)
+}
+
+// widest returns the fitted width of the widest segment between consecutive
+// breaks.
+func (b *breaker) widest(breaks []int) fixed.Int26_6 {
+	var widest fixed.Int26_6
+	start := 0
+	for _, end := range breaks {
+		if w := b.fitWidth(start, end); w > widest {
+			widest = w
+		}
+		start = end
+	}
+	return widest
+}
+
+// wrapLines wraps the shaped runs of paragraph into lines no wider than
+// maxWidth, breaking lines between words. Words that would overflow their
+// line are broken at the points found by opts.hyphenator, if set, which are
+// recorded in opts.hyphenBreaks. Under WrapWordsOrGraphemes, words too wide for
+// a line of their own are broken between graphemes, recorded in
+// opts.emergencyBreaks, and under WrapGraphemes
+// lines are broken between any graphemes. Breaks at soft hyphens and
+// hyphenation points leave room for the hyphen displayed at the end of the
+// line. Trailing whitespace may overflow lines. At most maxLines lines are
+// returned if maxLines is positive.
+func (s *shaperImpl) wrapLines(opts *shapeOptions, maxWidth, maxLines int, paragraph []rune, policy WrapPolicy, outs []shaping.Output) []shaping.Line {
+	if len(paragraph) == 0 {
+		return []shaping.Line{outs}
+	}
+	b := &s.breaker
+	b.init(paragraph, outs)
+	var lines []shaping.Line
+	var lineStart, prev, g int
+	var width fixed.Int26_6
+	emit := func(end int) {
+		lines = append(lines, cutLine(outs, lineStart, end))
+		lineStart = end
+		width = 0
+	}
+	breaks := b.words
+	switch policy {
+	case WrapGraphemes:
+		breaks = b.breakAll(paragraph)
+	case WrapKeepAll:
+		breaks = b.keepAll(paragraph)
+	}
+	graphemes := policy == WrapWordsOrGraphemes
+	for _, end := range breaks {
+		w := b.width(prev, end)
+		for wordStart := prev; opts.hyphenator != nil && (width+b.fitWidth(prev, end)+opts.softHyphenWidth(paragraph, end)).Ceil() > maxWidth; {
+			brk, ok := s.hyphenate(opts, paragraph, outs, wordStart, prev, end, width, maxWidth)
+			if !ok {
+				if prev > lineStart {
+					// Try again at the start of a line.
+					emit(prev)
+					continue
+				}
+				break
+			}
+			width += b.width(prev, brk)
+			emit(brk)
+			opts.hyphenBreaks = append(opts.hyphenBreaks, brk)
+			prev = brk
+			w = b.width(prev, end)
+		}
+		// A break at a soft hyphen displays a hyphen, which must fit too.
+		if (width + b.fitWidth(prev, end) + opts.softHyphenWidth(paragraph, end)).Ceil() > maxWidth {
+			if prev > lineStart {
+				emit(prev)
+			}
+			if graphemes && b.fitWidth(prev, end).Ceil() > maxWidth {
+				// Break the word between graphemes.
+				for ; g < len(b.graphemes) && b.graphemes[g] <= prev; g++ {
+				}
+				gstart := prev
+				for ; g < len(b.graphemes) && b.graphemes[g] <= end; g++ {
+					gend := b.graphemes[g]
+					gw := b.width(gstart, gend)
+					if (width+b.fitWidth(gstart, gend)).Ceil() > maxWidth && gstart > lineStart {
+						emit(gstart)
+						opts.emergencyBreaks = append(opts.emergencyBreaks, gstart)
+					}
+					width += gw
+					gstart = gend
+				}
+				prev = end
+				continue
+			}
+		}
+		width += w
+		prev = end
+	}
+	if lineStart < len(paragraph) {
+		emit(len(paragraph))
+	}
+	if maxLines > 0 && len(lines) > maxLines {
+		lines = lines[:maxLines]
+	}
+	return lines
+}
+
+// hyphenate returns the last break point of the word of paragraph in
+// [wordStart, end) for which the part of the word in [start, break) and a
+// hyphen fit in a line of maxWidth already width wide.
+func (s *shaperImpl) hyphenate(opts *shapeOptions, paragraph []rune, outs []shaping.Output, wordStart, start, end int, width fixed.Int26_6, maxWidth int) (int, bool) {
+	wordEnd := end
+	for wordEnd > start && unicode.IsSpace(paragraph[wordEnd-1]) {
+		wordEnd--
+	}
+	b := &s.breaker
+	best := -1
+	for _, p := range opts.hyphenator.BreakPoints(paragraph[wordStart:wordEnd], opts.hyphenLocale.Language) {
+		brk := wordStart + p
+		if brk <= start || brk >= wordEnd || brk <= best || !b.breakable(brk) {
+			continue
+		}
+		var hyphen fixed.Int26_6
+		for _, out := range outs {
+			if out.Runes.Offset < brk && brk <= out.Runes.Offset+out.Runes.Count {
+				if g, ok := s.shapeHyphen(out, opts.hyphenLocale); ok {
+					hyphen = g.XAdvance
+				}
+				break
+			}
+		}
+		if (width + b.width(start, brk) + hyphen).Ceil() <= maxWidth {
+			best = brk
+		}
+	}
+	return best, best != -1
+}
+
+// cutLine returns the line made of the parts of outs that represent the runes
+// in [start, end). The range must not split clusters.
+func cutLine(outs []shaping.Output, start, end int) shaping.Line {
+	var line shaping.Line
+	for _, out := range outs {
+		runeStart, runeEnd := out.Runes.Offset, out.Runes.Offset+out.Runes.Count
+		if runeEnd <= start || runeStart >= end {
+			continue
+		}
+		if runeStart < start {
+			runeStart = start
+		}
+		if runeEnd > end {
+			runeEnd = end
+		}
+		first, last := len(out.Glyphs), 0
+		for i, g := range out.Glyphs {
+			if start <= g.ClusterIndex && g.ClusterIndex < end {
+				if i < first {
+					first = i
+				}
+				last = i + 1
+			}
+		}
+		if first > last {
+			first, last = 0, 0
+		}
+		out.Glyphs = out.Glyphs[first:last]
+		out.Runes = shaping.Range{Offset: runeStart, Count: runeEnd - runeStart}
+		out.RecomputeAdvance()
+		line = append(line, out)
+	}
+	return line
+}
+
+// MinBreakWidth returns the width of the widest part of txt that can't be
+// broken across lines, that is the narrowest width txt can be wrapped to
+// without overflowing. Trailing whitespace is excluded, because it may
+// overflow lines.
+func (s *shaperImpl) MinBreakWidth(params Parameters, lc system.Locale, txt []rune) fixed.Int26_6 {
+	paragraph := append([]rune(nil), txt...)
+	if s.normalizes(params) {
+		paragraph, _ = normalizeRunes(params.Normalize, paragraph, nil, nil)
+	}
+	paragraph = replaceNoncharacters(replaceControlCharacters(paragraph), params.Noncharacters)
+	outs := s.shapeText(newShapeOptions(params), s.orderer.sortedFacesForStyle(params.Font), params.PxPerEm, lc, paragraph)
+	b := &s.breaker
+	b.init(paragraph, outs)
+	switch params.WrapPolicy {
+	case WrapGraphemes:
+		return b.widest(b.breakAll(paragraph))
+	case WrapWordsOrGraphemes:
+		return b.widest(b.graphemes)
+	case WrapKeepAll:
+		return b.widest(b.keepAll(paragraph))
+	}
+	return b.widest(b.words)
+}
+
+// splitLongRuns splits the runs of l with more than max glyphs into runs of
+// at most max glyphs, at cluster boundaries. The split runs represent
+// contiguous runes in logical order. Clusters of more than max glyphs are
+// not split.
+func splitLongRuns(l shaping.Line, max int) shaping.Line {
+	long := false
+	for _, out := range l {
+		if len(out.Glyphs) > max {
+			long = true
+			break
+		}
+	}
+	if !long {
+		return l
+	}
+	split := make(shaping.Line, 0, len(l)+1)
+	for _, out := range l {
+		if len(out.Glyphs) <= max {
+			split = append(split, out)
+			continue
+		}
+		// Visit the glyphs in logical order, which is reversed for
+		// right-to-left runs.
+		n := len(out.Glyphs)
+		logical := func(i int) shaping.Glyph {
+			if out.Direction.Progression() == di.TowardTopLeft {
+				return out.Glyphs[n-1-i]
+			}
+			return out.Glyphs[i]
+		}
+		start, count := out.Runes.Offset, 0
+		for i := 0; i < n; {
+			cluster := logical(i).ClusterIndex
+			end := i
+			for ; end < n && logical(end).ClusterIndex == cluster; end++ {
+			}
+			if size := end - i; count > 0 && count+size > max {
+				split = append(split, cutLine([]shaping.Output{out}, start, cluster)...)
+				start, count = cluster, 0
+			}
+			count += end - i
+			i = end
+		}
+		split = append(split, cutLine([]shaping.Output{out}, start, out.Runes.Offset+out.Runes.Count)...)
+	}
+	return split
+}